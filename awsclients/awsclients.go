@@ -4,22 +4,28 @@ package awsclients
 // hammer metadata services or anything.
 
 import (
+	"context"
 	"sync"
 
+	"github.com/AdRoll/batchiepatchie/metrics"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/batch/batchiface"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 )
 
 var Session *session.Session
 var s3B map[string]*s3.S3
 var s3R map[string]*s3.S3
-var Batch *batch.Batch
+var Batch batchiface.BatchAPI
 var ECS *ecs.ECS
 var EC2 *ec2.EC2
 var CloudWatchLogs *cloudwatchlogs.CloudWatchLogs
@@ -58,12 +64,69 @@ func GetS3ClientForBucket(bucket string) (*s3.S3, error) {
 	return region, nil
 }
 
+// countCall counts every attempt of an AWS call, and the attempts that were
+// throttled.
+func countCall(r *request.Request) {
+	operation := ""
+	if r.Operation != nil {
+		operation = r.Operation.Name
+	}
+	metrics.AWSCalls.WithLabelValues(r.ClientInfo.ServiceName, operation).Inc()
+	if r.Error != nil && request.IsErrorThrottle(r.Error) {
+		metrics.AWSThrottles.WithLabelValues(r.ClientInfo.ServiceName, operation).Inc()
+	}
+}
+
+type callSpanKey struct{}
+
+// callSpan is the span of an AWS call attempt and the context the call had
+// before it.
+type callSpan struct {
+	span   opentracing.Span
+	parent aws.Context
+}
+
+// startCallSpan starts a span for an attempt of an AWS call, as a child of
+// the span in the context of the call.
+func startCallSpan(r *request.Request) {
+	operation := ""
+	if r.Operation != nil {
+		operation = r.Operation.Name
+	}
+	parent := r.Context()
+	span, ctx := opentracing.StartSpanFromContext(parent, "AWS."+r.ClientInfo.ServiceName+"."+operation)
+	span.SetTag("aws.service", r.ClientInfo.ServiceName)
+	span.SetTag("aws.operation", operation)
+	r.SetContext(context.WithValue(ctx, callSpanKey{}, &callSpan{span: span, parent: parent}))
+}
+
+// finishCallSpan finishes the span startCallSpan started, so that a retry
+// gets a span of its own.
+func finishCallSpan(r *request.Request) {
+	call_span, ok := r.Context().Value(callSpanKey{}).(*callSpan)
+	if !ok {
+		return
+	}
+	if r.RequestID != "" {
+		call_span.span.SetTag("aws.request_id", r.RequestID)
+	}
+	if r.Error != nil {
+		ext.Error.Set(call_span.span, true)
+		call_span.span.LogKV("error", r.Error.Error())
+	}
+	call_span.span.Finish()
+	r.SetContext(call_span.parent)
+}
+
 func OpenSessions(region string) error {
 	conf := &aws.Config{
 		Region:     aws.String(region),
 		MaxRetries: aws.Int(10),
 	}
 	Session = session.Must(session.NewSession(conf))
+	Session.Handlers.Send.PushFront(startCallSpan)
+	Session.Handlers.CompleteAttempt.PushBack(finishCallSpan)
+	Session.Handlers.CompleteAttempt.PushBack(countCall)
 	Batch = batch.New(Session)
 	S3General = s3.New(Session)
 	ECS = ecs.New(Session)
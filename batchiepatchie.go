@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/AdRoll/batchiepatchie/config"
 	"github.com/AdRoll/batchiepatchie/fetcher"
 	"github.com/AdRoll/batchiepatchie/handlers"
 	"github.com/AdRoll/batchiepatchie/jobs"
+	"github.com/AdRoll/batchiepatchie/metrics"
+	"github.com/AdRoll/batchiepatchie/migrations"
 	"github.com/AdRoll/batchiepatchie/syncer"
+	"github.com/AdRoll/batchiepatchie/tracing"
 	"github.com/bakatz/echo-logrusmiddleware"
 	"github.com/labstack/echo"
 	"github.com/opentracing/opentracing-go"
@@ -36,6 +44,15 @@ func pingHandler(c echo.Context) error {
 }
 
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "restore" {
+		runRestore(os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+
 	configurationFile := ""
 	if len(os.Args) > 2 {
 		log.Fatal("batchiepatchie expects exactly one argument: filename to .toml configuration.")
@@ -68,7 +85,10 @@ func main() {
 	}
 
 	var trace opentracing.Tracer
-	if config.Conf.UseDatadogTracing {
+	// flushTraces exports the spans that are still buffered at shutdown.
+	flushTraces := func(ctx context.Context) error { return nil }
+	switch config.Conf.Tracer {
+	case "datadog":
 		ip := os.Getenv("BATCHIEPATCHIE_IP")
 		if ip != "" {
 			// If we have been passed an IP explictly; attempt to
@@ -82,16 +102,67 @@ func main() {
 		} else {
 			trace = opentracer.New(tracer.WithServiceName("batchiepatchie"))
 		}
-	} else {
+		flushTraces = func(ctx context.Context) error {
+			tracer.Stop()
+			return nil
+		}
+	case "otlp", "stdout":
+		exporter, err := tracing.NewExporter(context.Background(), config.Conf.Tracer, os.Stdout)
+		if err != nil {
+			log.Fatal("Cannot make OpenTelemetry exporter, ", err)
+		}
+		trace, flushTraces, err = tracing.NewTracer(context.Background(), exporter)
+		if err != nil {
+			log.Fatal("Cannot set up OpenTelemetry tracing, ", err)
+		}
+	default:
 		trace = opentracing.NoopTracer{}
 	}
 	opentracing.SetGlobalTracer(trace)
 
-	storage, err := jobs.NewPostgreSQLStore(config.Conf.DatabaseHost, config.Conf.DatabasePort, config.Conf.DatabaseUsername, config.Conf.DatabaseName, config.Conf.DatabasePassword, config.Conf.DatabaseRootCertificate)
+	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatal("Creating postgresql store failed, ", err)
+		log.Fatal("Cannot get hostname, ", err)
+	}
+	identity := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+
+	var storage jobs.FinderStorer
+	var cleaner jobs.Cleaner
+	var leadership jobs.LeaderElection
+	if config.Conf.Store == "memory" {
+		memoryStore := jobs.NewMemoryStore()
+		storage = memoryStore
+		cleaner = memoryStore
+		leadership = memoryStore.NewLeaderElection(identity)
+		log.Warning("Using in-memory store. Nothing will be persisted when batchiepatchie exits.")
+	} else {
+		if config.Conf.CheckSchemaVersion {
+			db, err := jobs.OpenPostgreSQL(config.Conf.DatabaseHost, config.Conf.DatabasePort, config.Conf.DatabaseUsername, config.Conf.DatabaseName, config.Conf.DatabasePassword, config.Conf.DatabaseRootCertificate)
+			if err != nil {
+				log.Fatal("Connecting to postgresql failed, ", err)
+			}
+			err = migrations.CheckVersion(db)
+			db.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		postgresStore, err := jobs.NewPostgreSQLStore(config.Conf.DatabaseHost, config.Conf.DatabasePort, config.Conf.DatabaseUsername, config.Conf.DatabaseName, config.Conf.DatabasePassword, config.Conf.DatabaseRootCertificate)
+		if err != nil {
+			log.Fatal("Creating postgresql store failed, ", err)
+		}
+		if config.Conf.ReadReplica.Host != "" {
+			err = postgresStore.UseReadReplica(config.Conf.ReadReplica.Host, config.Conf.ReadReplica.Port, config.Conf.DatabaseUsername, config.Conf.DatabaseName, config.Conf.DatabasePassword, config.Conf.DatabaseRootCertificate, time.Duration(config.Conf.ReadReplica.MaxLag)*time.Second, time.Duration(config.Conf.ReadReplica.LagCheckPeriod)*time.Second)
+			if err != nil {
+				log.Fatal("Connecting to read replica failed, ", err)
+			}
+			log.Info("Successfully connected to PostgreSQL read replica.")
+		}
+		storage = postgresStore
+		cleaner = postgresStore
+		leadership = postgresStore.NewLeaderElection(identity)
+		log.Info("Successfully connected to PostgreSQL database.")
 	}
-	log.Info("Successfully connected to PostgreSQL database.")
 
 	killer, err := jobs.NewKillerHandler()
 	if err != nil {
@@ -110,27 +181,45 @@ func main() {
 		}
 	}
 
+	// The periodic loops below only do work while this process is the
+	// leader; other processes just serve the API.
+	if leadership.IsLeader() {
+		log.Info("This process (", identity, ") is the leader.")
+	} else {
+		log.Info("This process (", identity, ") is a follower, periodic synchronizer, scaler and cleaner are on standby.")
+	}
+
 	// Launch the periodic synchronizer
-	syncer.RunPeriodicSynchronizer(storage, killer)
+	syncer.RunPeriodicSynchronizer(storage, killer, leadership)
 	// Launch the periodic scaler
 	if config.Conf.UseAutoScaler {
 		log.Info("Auto-scaler enabled.")
-		syncer.RunPeriodicScaler(storage)
+		syncer.RunPeriodicScaler(storage, leadership)
 	} else {
 		log.Info("Auto-scaler disabled.")
 	}
+	// Launch the periodic partition creator
+	syncer.RunPeriodicPartitionCreator(cleaner, leadership)
 	// Launch the periodic cleaner
 	if config.Conf.UseCleaner {
-		syncer.RunPeriodicCleaner(storage)
+		syncer.RunPeriodicCleaner(cleaner, leadership)
 	} else {
 		log.Info("Cleaner disabled.")
 	}
 
 	// handle.Server is a structure to save context shared between requests
+	query_timeouts := make(map[string]time.Duration)
+	for endpoint, timeout := range config.Conf.QueryTimeouts.Endpoints {
+		query_timeouts[endpoint] = time.Duration(timeout) * time.Second
+	}
 	s := &handlers.Server{
-		Storage: storage,
-		Killer:  killer,
-		Index:   index,
+		Storage:             storage,
+		Killer:              killer,
+		Leadership:          leadership,
+		Index:               index,
+		DefaultQueryTimeout: time.Duration(config.Conf.QueryTimeouts.Default) * time.Second,
+		QueryTimeouts:       query_timeouts,
+		SyncStaleAfter:      time.Duration(config.Conf.SyncStaleAfter) * time.Second,
 	}
 
 	e := echo.New()
@@ -138,9 +227,11 @@ func main() {
 	// Logging middleware for API requests
 	e.Logger = logrusmiddleware.Logger{Logger: log.StandardLogger()}
 	e.Use(logrusmiddleware.Hook())
+	e.Use(handlers.Tracing)
+	e.Use(handlers.RequestMetrics)
 
 	// Jobs API
-	api := e.Group("/api/v1")
+	api := e.Group("/api/v1", s.QueryTimeout)
 	{
 		api.GET("/jobs/:id", s.FindOne)
 		api.GET("/jobs", s.Find)
@@ -150,13 +241,25 @@ func main() {
 		api.GET("/job_queues/all", s.ListAllJobQueues)
 		api.POST("/job_queues/:name/activate", s.ActivateJobQueue)
 		api.POST("/job_queues/:name/deactivate", s.DeactivateJobQueue)
+		api.GET("/job_definitions", s.ListJobDefinitions)
+		api.GET("/job_definitions/diff", s.DiffJobDefinitions)
+		api.GET("/job_definitions/:name/:revision", s.GetJobDefinition)
 		api.GET("/jobs/:id/status", s.GetStatus)
+		api.GET("/jobs/:id/history", s.GetStatusHistory)
+		api.GET("/jobs/:id/attempts", s.GetAttempts)
+		api.GET("/jobs/:id/graph", s.GetJobGraph)
+		api.GET("/jobs/:id/children", s.GetArrayChildren)
 		api.POST("/jobs/notify", s.JobStatusNotification)
 		api.GET("/jobs/:id/status_websocket", s.SubscribeToJobEvent)
 		api.GET("/jobs/stats", s.JobStats)
+		api.GET("/leader", s.GetLeader)
+		api.GET("/health", s.GetHealth)
 	}
 
 	e.GET("/ping", pingHandler)
+	e.GET("/healthz", s.Healthz)
+	e.GET("/readyz", s.Readyz)
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
 	e.GET("/", s.IndexHandler)
 	e.GET("/stats", s.IndexHandler)
 	e.GET("/index.html", s.IndexHandler)
@@ -170,5 +273,53 @@ func main() {
 	}
 
 	// Launch web server
-	e.Logger.Fatal(e.Start(config.Conf.Host + ":" + strconv.Itoa(config.Conf.Port)))
+	go func() {
+		err := e.Start(config.Conf.Host + ":" + strconv.Itoa(config.Conf.Port))
+		if err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	received := <-signals
+	log.Info("Received ", received, ", shutting down.")
+	shutdown(e, s, storage, leadership, flushTraces)
+}
+
+// shutdown stops taking requests, lets in-flight requests and background
+// rounds finish within shutdown_timeout, closes WebSocket subscriptions and
+// finally closes the store and exports the last spans. Whatever has not
+// finished by then is cancelled.
+func shutdown(e *echo.Echo, s *handlers.Server, storage jobs.FinderStorer, leadership jobs.LeaderElection, flushTraces func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Conf.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	syncer.StopLoops()
+	err := e.Shutdown(ctx)
+	if err != nil {
+		log.Warning("HTTP requests did not finish in time: ", err)
+	}
+	err = s.CloseWebSockets(ctx)
+	if err != nil {
+		log.Warning("WebSocket subscriptions did not close in time: ", err)
+	}
+	err = syncer.WaitForLoops(ctx)
+	if err != nil {
+		log.Warning("Background rounds did not finish in time: ", err)
+	}
+	leadership.Resign()
+	err = storage.Close()
+	if err != nil {
+		log.Warning("Cannot close store: ", err)
+	}
+	// The shutdown timeout may have run out already; the last spans get
+	// a few seconds of their own.
+	flush_ctx, flush_cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flush_cancel()
+	err = flushTraces(flush_ctx)
+	if err != nil {
+		log.Warning("Cannot export the last spans: ", err)
+	}
+	log.Info("Shut down.")
 }
@@ -22,12 +22,16 @@ import (
 type Config struct {
 	Port                    int    `toml:"port"`
 	Host                    string `toml:"host"`
+	Store                   string `toml:"store"`
 	DatabaseHost            string `toml:"database_host"`
 	DatabasePort            int    `toml:"database_port"`
 	DatabaseUsername        string `toml:"database_username"`
 	DatabaseName            string `toml:"database_name"`
 	DatabasePassword        string `toml:"database_password"`
 	DatabaseRootCertificate string `toml:"database_root_certificate"`
+	// CheckSchemaVersion makes batchiepatchie refuse to start if the database
+	// schema is older than the embedded migrations.
+	CheckSchemaVersion bool `toml:"check_schema_version"`
 
 	LogEntriesHost string `toml:"logentries_host"`
 	LogEntriesKey  string `toml:"logentries_token"`
@@ -45,13 +49,66 @@ type Config struct {
 	SyncPeriod  int64 `toml:"sync_period"`
 	ScalePeriod int64 `toml:"scale_period"`
 	CleanPeriod int64 `toml:"clean_period"`
+	// SyncStaleAfter is how many seconds the synchronizer may go without a
+	// successful round before /readyz fails. 0 means 10 sync periods.
+	SyncStaleAfter int64 `toml:"sync_stale_after"`
+	// ShutdownTimeout is how many seconds in-flight requests and rounds
+	// get to finish on SIGTERM or SIGINT.
+	ShutdownTimeout int64 `toml:"shutdown_timeout"`
+
+	IncrementalSync bool `toml:"incremental_sync"`
+	// SyncConcurrency is how many job queues are synchronized at a time.
+	SyncConcurrency int `toml:"sync_concurrency"`
+	// BatchCallsPerSecond is the budget of AWS Batch calls the synchronizer
+	// may make each second, shared by all of its workers.
+	BatchCallsPerSecond float64 `toml:"batch_calls_per_second"`
 
 	KillStuckJobs bool `toml:"kill_stuck_jobs"`
 
-	UseDatadogTracing bool `toml:"use_datadog_tracing"`
+	// Tracer is where spans go: "none", "datadog", "otlp" or "stdout".
+	// use_datadog_tracing = true is the same as tracer = "datadog".
+	Tracer            string `toml:"tracer"`
+	UseDatadogTracing bool   `toml:"use_datadog_tracing"`
 
 	UseAutoScaler bool `toml:"use_auto_scaler"`
 	UseCleaner    bool `toml:"use_cleaner"`
+
+	Retention RetentionConfig `toml:"retention"`
+
+	ReadReplica ReadReplicaConfig `toml:"read_replica"`
+
+	QueryTimeouts QueryTimeoutsConfig `toml:"query_timeouts"`
+}
+
+// RetentionConfig is the [retention] section. Everything is in days and 0
+// means keep forever.
+type RetentionConfig struct {
+	Days                           int            `toml:"days"`
+	JobQueues                      map[string]int `toml:"job_queues"`
+	InstanceEventLogDays           int            `toml:"instance_event_log_days"`
+	JobSummaryEventLogDays         int            `toml:"job_summary_event_log_days"`
+	ComputeEnvironmentEventLogDays int            `toml:"compute_environment_event_log_days"`
+	InstancesDays                  int            `toml:"instances_days"`
+	RestoredDays                   int            `toml:"restored_days"`
+	BatchSize                      int            `toml:"batch_size"`
+	Archive                        string         `toml:"archive"`
+}
+
+// ReadReplicaConfig is the [read_replica] section. The replica uses the same
+// username, database name, password and root certificate as the primary.
+type ReadReplicaConfig struct {
+	Host           string `toml:"host"`
+	Port           int    `toml:"port"`
+	MaxLag         int64  `toml:"max_lag"`
+	LagCheckPeriod int64  `toml:"lag_check_period"`
+}
+
+// QueryTimeoutsConfig is the [query_timeouts] section: how many seconds an API
+// request may spend querying the store. Endpoints overrides Default per route
+// path, for example "/api/v1/jobs/stats". 0 means no timeout.
+type QueryTimeoutsConfig struct {
+	Default   int            `toml:"default"`
+	Endpoints map[string]int `toml:"endpoints"`
 }
 
 // Store config in a global variable
@@ -78,12 +135,33 @@ func ReadConfiguration(filename string) error {
 
 	Conf = Config{
 		// Default values here
-		SyncPeriod:    30,
-		ScalePeriod:   30,
-		CleanPeriod:   30 * 60, // 30 minutes in seconds
-		KillStuckJobs: false,
-		UseAutoScaler: true,
-		UseCleaner:    false,
+		Store:               "postgresql",
+		SyncPeriod:          30,
+		ScalePeriod:         30,
+		CleanPeriod:         30 * 60, // 30 minutes in seconds
+		SyncConcurrency:     4,
+		ShutdownTimeout:     30,
+		BatchCallsPerSecond: 10,
+		KillStuckJobs:       false,
+		UseAutoScaler:       true,
+		UseCleaner:          false,
+		Retention: RetentionConfig{
+			Days:                           30,
+			InstanceEventLogDays:           30,
+			JobSummaryEventLogDays:         30,
+			ComputeEnvironmentEventLogDays: 30,
+			InstancesDays:                  30,
+			RestoredDays:                   30,
+			BatchSize:                      1000,
+		},
+		ReadReplica: ReadReplicaConfig{
+			Port:           5432,
+			MaxLag:         30,
+			LagCheckPeriod: 10,
+		},
+		QueryTimeouts: QueryTimeoutsConfig{
+			Default: 30,
+		},
 	}
 	if _, err := toml.Decode(string(tomlData), &Conf); err != nil {
 		return err
@@ -113,13 +191,91 @@ func ReadConfiguration(filename string) error {
 		log.Fatal("Port is invalid; expecting port between 1 and 65535")
 	}
 
-	// Note: not checking password; it can be legitimately empty
-	if Conf.DatabaseHost == "" || Conf.DatabaseUsername == "" || Conf.DatabaseName == "" {
-		log.Fatal("Incomplete Database configuration. database_host, database_port, database_username and database_name must be supplied in .toml configuration or you must use S3 configuration.")
+	if Conf.Store != "postgresql" && Conf.Store != "memory" {
+		log.Fatal("store must be either 'postgresql' or 'memory'.")
+	}
+
+	if Conf.Store == "postgresql" {
+		// Note: not checking password; it can be legitimately empty
+		if Conf.DatabaseHost == "" || Conf.DatabaseUsername == "" || Conf.DatabaseName == "" {
+			log.Fatal("Incomplete Database configuration. database_host, database_port, database_username and database_name must be supplied in .toml configuration or you must use S3 configuration.")
+		}
+
+		if Conf.DatabasePort < 1 || Conf.DatabasePort > 65535 {
+			log.Fatal("Database port is invalid; expecting port between 1 and 65535.")
+		}
+	}
+
+	if Conf.ReadReplica.Host != "" {
+		Conf.ReadReplica.Host, err = envsubstituter.EnvironmentSubstitute(Conf.ReadReplica.Host)
+		if err != nil {
+			return err
+		}
+		if Conf.Store != "postgresql" {
+			log.Fatal("[read_replica] needs store = \"postgresql\".")
+		}
+		if Conf.ReadReplica.Port < 1 || Conf.ReadReplica.Port > 65535 {
+			log.Fatal("Read replica port is invalid; expecting port between 1 and 65535.")
+		}
+		if Conf.ReadReplica.MaxLag < 1 || Conf.ReadReplica.LagCheckPeriod < 1 {
+			log.Fatal("Read replica max_lag and lag_check_period must be at least 1 second.")
+		}
+	}
+
+	if Conf.UseDatadogTracing {
+		if Conf.Tracer != "" && Conf.Tracer != "datadog" {
+			log.Fatal("use_datadog_tracing = true conflicts with tracer = \"", Conf.Tracer, "\".")
+		}
+		Conf.Tracer = "datadog"
+	}
+	if Conf.Tracer == "" {
+		Conf.Tracer = "none"
+	}
+	if Conf.Tracer != "none" && Conf.Tracer != "datadog" && Conf.Tracer != "otlp" && Conf.Tracer != "stdout" {
+		log.Fatal("tracer must be either 'none', 'datadog', 'otlp' or 'stdout'.")
+	}
+
+	if Conf.ShutdownTimeout < 1 {
+		log.Fatal("shutdown_timeout must be at least 1 second.")
+	}
+
+	if Conf.SyncStaleAfter < 0 {
+		log.Fatal("sync_stale_after cannot be negative.")
+	}
+	if Conf.SyncStaleAfter == 0 {
+		Conf.SyncStaleAfter = 10 * Conf.SyncPeriod
+	}
+
+	if Conf.SyncConcurrency < 1 {
+		log.Fatal("sync_concurrency must be at least 1.")
+	}
+	if Conf.BatchCallsPerSecond <= 0 {
+		log.Fatal("batch_calls_per_second must be positive.")
 	}
 
-	if Conf.DatabasePort < 1 || Conf.DatabasePort > 65535 {
-		log.Fatal("Database port is invalid; expecting port between 1 and 65535.")
+	if Conf.Retention.Days < 0 || Conf.Retention.InstanceEventLogDays < 0 || Conf.Retention.JobSummaryEventLogDays < 0 || Conf.Retention.ComputeEnvironmentEventLogDays < 0 || Conf.Retention.InstancesDays < 0 || Conf.Retention.RestoredDays < 0 {
+		log.Fatal("Retention days cannot be negative.")
+	}
+	for job_queue, days := range Conf.Retention.JobQueues {
+		if days < 0 {
+			log.Fatal("Retention days for job queue ", job_queue, " cannot be negative.")
+		}
+	}
+	Conf.Retention.Archive, err = envsubstituter.EnvironmentSubstitute(Conf.Retention.Archive)
+	if err != nil {
+		return err
+	}
+	if Conf.Retention.BatchSize < 1 {
+		log.Fatal("Retention batch_size must be at least 1.")
+	}
+
+	if Conf.QueryTimeouts.Default < 0 {
+		log.Fatal("Query timeouts cannot be negative.")
+	}
+	for endpoint, timeout := range Conf.QueryTimeouts.Endpoints {
+		if timeout < 0 {
+			log.Fatal("Query timeout for ", endpoint, " cannot be negative.")
+		}
 	}
 
 	// Where are my frontend assets? Check that the configuration makes sense
@@ -4,8 +4,10 @@ package fetcher
 // locally.
 
 import (
+	"bytes"
 	"io"
 	"os"
+	"path/filepath"
 	"regexp"
 
 	"github.com/AdRoll/batchiepatchie/awsclients"
@@ -72,3 +74,30 @@ func ReadAll(location string) ([]byte, error) {
 func readAllLocalFile(location string) ([]byte, error) {
 	return os.ReadFile(location)
 }
+
+// WriteAll writes data to an S3 object or a local file, creating any missing
+// local directories.
+func WriteAll(location string, data []byte) error {
+	s3match := s3Regex.FindStringSubmatch(location)
+	if s3match == nil {
+		if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(location, data, 0644)
+	}
+
+	bucket := s3match[1]
+	key := s3match[2]
+
+	s3client, err := awsclients.GetS3ClientForBucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
@@ -5,11 +5,14 @@ Server structure for shared context between handlers.
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/AdRoll/batchiepatchie/awsclients"
 	"github.com/AdRoll/batchiepatchie/jobs"
@@ -23,13 +26,53 @@ import (
 
 const (
 	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
 	defaultPageNumber = 0
 )
 
 type Server struct {
-	Storage jobs.FinderStorer
-	Killer  jobs.Killer
-	Index   []byte
+	Storage    jobs.FinderStorer
+	Killer     jobs.Killer
+	Leadership jobs.LeaderElection
+	Index      []byte
+
+	// DefaultQueryTimeout limits how long a request may spend in the
+	// store; QueryTimeouts overrides it per route, keyed by route path
+	// such as "/api/v1/jobs". Zero means no limit.
+	DefaultQueryTimeout time.Duration
+	QueryTimeouts       map[string]time.Duration
+
+	// SyncStaleAfter is how long the synchronizer may go without a
+	// successful round before the process is not ready. Zero disables
+	// the check.
+	SyncStaleAfter time.Duration
+
+	// closing is closed by CloseWebSockets; webSockets counts the
+	// WebSocket subscriptions still open. webSocketsLock guards closing
+	// and adding to webSockets, so that no subscription is added once
+	// CloseWebSockets waits for them.
+	webSocketsLock sync.Mutex
+	closing        chan struct{}
+	webSockets     sync.WaitGroup
+}
+
+// QueryTimeout is a middleware that puts the query timeout of the route on
+// the request context. Store methods get the request context, so their
+// queries are cancelled when the timeout passes or the client goes away.
+func (s *Server) QueryTimeout(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		timeout, ok := s.QueryTimeouts[c.Path()]
+		if !ok {
+			timeout = s.DefaultQueryTimeout
+		}
+		if timeout <= 0 {
+			return next(c)
+		}
+		ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+		defer cancel()
+		c.SetRequest(c.Request().WithContext(ctx))
+		return next(c)
+	}
 }
 
 // KillTaskID is a struct to handle JSON request to kill a task
@@ -44,7 +87,7 @@ type KillTasks struct {
 
 // Find is a request handler, returns json with jobs matching the query param 'q'
 func (s *Server) Find(c echo.Context) error {
-	span := opentracing.StartSpan("API.Find")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.Find")
 	defer span.Finish()
 
 	c.QueryParams()
@@ -70,15 +113,46 @@ func (s *Server) Find(c echo.Context) error {
 		page = 0
 	}
 
-	foundJobs, err := s.Storage.Find(&jobs.Options{
-		Search:    search,
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultQueryLimit
+	}
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+
+	// Passing the cursor parameter, even empty for the first page, switches
+	// to keyset pagination. The cursor remembers the sort order it was made
+	// with.
+	_, use_cursor := c.QueryParams()["cursor"]
+	var cursor *jobs.Cursor
+	if encoded_cursor := c.QueryParam("cursor"); encoded_cursor != "" {
+		cursor, err = jobs.DecodeCursor(encoded_cursor)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		column = cursor.SortBy
+		sort = cursor.SortAsc
+	}
+
+	var search_query *jobs.SearchQuery
+	if strings.TrimSpace(search) != "" {
+		search_query, err = jobs.ParseSearch(search)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+
+	foundJobs, err := s.Storage.Find(ctx, &jobs.Options{
+		Search:    search_query,
 		DateRange: dateRange,
-		Limit:     defaultQueryLimit,
-		Offset:    page * defaultQueryLimit,
+		Limit:     limit,
+		Offset:    page * limit,
 		Queues:    queues,
 		SortBy:    column,
 		SortAsc:   sort,
 		Status:    status,
+		Cursor:    cursor,
 	})
 
 	if err != nil {
@@ -91,16 +165,28 @@ func (s *Server) Find(c echo.Context) error {
 		return err
 	}
 
+	if use_cursor {
+		var next_cursor *string
+		if len(foundJobs) == limit {
+			encoded := jobs.NewCursor(foundJobs[len(foundJobs)-1], column, sort).Encode()
+			next_cursor = &encoded
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"jobs":        foundJobs,
+			"next_cursor": next_cursor,
+		})
+	}
+
 	return c.JSON(http.StatusOK, foundJobs)
 }
 
 func (s *Server) GetStatus(c echo.Context) error {
-	span := opentracing.StartSpan("API.GetStatus")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.GetStatus")
 	defer span.Finish()
 
 	query := c.Param("id")
 
-	job, err := s.Storage.GetStatus(query)
+	job, err := s.Storage.GetStatus(ctx, query)
 	if err != nil {
 		log.Error(err)
 		newErr := c.JSON(http.StatusInternalServerError, err)
@@ -118,14 +204,142 @@ func (s *Server) GetStatus(c echo.Context) error {
 	}
 }
 
+// GetStatusHistory is a request handler, returns every status change of a job
+func (s *Server) GetStatusHistory(c echo.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.GetStatusHistory")
+	defer span.Finish()
+
+	query := c.Param("id")
+
+	history, err := s.Storage.GetStatusHistory(ctx, query)
+	if err != nil {
+		log.Error(err)
+		newErr := c.JSON(http.StatusInternalServerError, err)
+		if newErr != nil {
+			log.Error(newErr)
+			return newErr
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
+
+// GetAttempts is a request handler, returns every attempt AWS Batch made at
+// running a job
+func (s *Server) GetAttempts(c echo.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.GetAttempts")
+	defer span.Finish()
+
+	query := c.Param("id")
+
+	attempts, err := s.Storage.GetAttempts(ctx, query)
+	if err != nil {
+		log.Error(err)
+		newErr := c.JSON(http.StatusInternalServerError, err)
+		if newErr != nil {
+			log.Error(newErr)
+			return newErr
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, attempts)
+}
+
+// GetJobGraph is a request handler, returns the jobs a job depends on and
+// the jobs that depend on it
+func (s *Server) GetJobGraph(c echo.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.GetJobGraph")
+	defer span.Finish()
+
+	query := c.Param("id")
+
+	graph, err := s.Storage.GetJobGraph(ctx, query)
+	if err != nil {
+		log.Error(err)
+		newErr := c.JSON(http.StatusInternalServerError, err)
+		if newErr != nil {
+			log.Error(newErr)
+			return newErr
+		}
+		return err
+	}
+
+	if graph == nil {
+		return c.JSON(http.StatusNotFound, graph)
+	}
+	return c.JSON(http.StatusOK, graph)
+}
+
+// GetArrayChildren is a request handler, returns children of an array job.
+// Children can be filtered by 'status' and are paged by passing the
+// 'next_after' of a page as 'after' for the next one.
+func (s *Server) GetArrayChildren(c echo.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.GetArrayChildren")
+	defer span.Finish()
+
+	var status []string
+	if statusStr := c.QueryParam("status"); len(statusStr) > 0 {
+		status = strings.Split(strings.ToUpper(statusStr), ",")
+	}
+
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultQueryLimit
+	}
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+
+	var after_index *int64
+	if after := c.QueryParam("after"); after != "" {
+		index, err := strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "after must be an array index"})
+		}
+		after_index = &index
+	}
+
+	children, err := s.Storage.FindArrayChildren(ctx, &jobs.ArrayChildrenOptions{
+		ParentJobId: c.Param("id"),
+		Status:      status,
+		AfterIndex:  after_index,
+		Limit:       limit,
+	})
+	if err != nil {
+		log.Error(err)
+		newErr := c.JSON(http.StatusInternalServerError, err)
+		if newErr != nil {
+			log.Error(newErr)
+			return newErr
+		}
+		return err
+	}
+
+	if children == nil {
+		return c.JSON(http.StatusNotFound, children)
+	}
+
+	var next_after *int64
+	if len(children.Children) == limit {
+		next_after = children.Children[len(children.Children)-1].ArrayIndex
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"children":       children.Children,
+		"failed_indexes": children.FailedIndexes,
+		"next_after":     next_after,
+	})
+}
+
 // FindOne is a request handler, returns a job matching the query parameter 'q'
 func (s *Server) FindOne(c echo.Context) error {
-	span := opentracing.StartSpan("API.FindOne")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.FindOne")
 	defer span.Finish()
 
 	query := c.Param("id")
 
-	job, err := s.Storage.FindOne(query)
+	job, err := s.Storage.FindOne(ctx, query)
 	if err != nil {
 		log.Error(err)
 		newErr := c.JSON(http.StatusInternalServerError, err)
@@ -141,7 +355,7 @@ func (s *Server) FindOne(c echo.Context) error {
 
 // KillMany is a request handler, kills a job matching the post parameter 'id' (AWS task ID)
 func (s *Server) KillMany(c echo.Context) error {
-	span := opentracing.StartSpan("API.KillMany")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.KillMany")
 	defer span.Finish()
 
 	obj, err := BodyToKillTask(c)
@@ -161,7 +375,7 @@ func (s *Server) KillMany(c echo.Context) error {
 	results := make(map[string]string)
 
 	for _, value := range values {
-		err := s.Killer.KillOne(value, "terminated from UI", s.Storage)
+		err := s.Killer.KillOne(ctx, value, "terminated from UI", s.Storage)
 		if err != nil {
 			results[value] = err.Error()
 		}
@@ -172,7 +386,7 @@ func (s *Server) KillMany(c echo.Context) error {
 }
 
 func (s *Server) FetchLogs(c echo.Context) error {
-	span := opentracing.StartSpan("API.FetchLogs")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.FetchLogs")
 	defer span.Finish()
 
 	const LOG_GROUP_NAME = "/aws/batch/job"
@@ -185,7 +399,7 @@ func (s *Server) FetchLogs(c echo.Context) error {
 
 	id := c.Param("id")
 
-	job, err := s.Storage.FindOne(id)
+	job, err := s.Storage.FindOne(ctx, id)
 	if err != nil {
 		log.Error(err)
 		newErr := c.JSON(http.StatusInternalServerError, err)
@@ -196,6 +410,27 @@ func (s *Server) FetchLogs(c echo.Context) error {
 		return err
 	}
 
+	// Multi-node parallel jobs have no logs of their own; each node has.
+	// Without 'node' we show the logs of the main node.
+	node_param := c.QueryParam("node")
+	if job.NodeProperties != nil || node_param != "" {
+		if job.NodeProperties == nil {
+			return c.String(http.StatusNotFound, "Not a multi-node parallel job.")
+		}
+		node_index := job.NodeProperties.MainNode
+		if node_param != "" {
+			node_index, err = strconv.ParseInt(node_param, 10, 64)
+			if err != nil || node_index < 0 || node_index >= job.NodeProperties.NumNodes {
+				return c.String(http.StatusNotFound, "No such node.")
+			}
+		}
+		id = id + "#" + strconv.FormatInt(node_index, 10)
+		job, err = s.Storage.FindOne(ctx, id)
+		if err != nil {
+			return c.String(http.StatusNotFound, "No such node.")
+		}
+	}
+
 	svc := awsclients.CloudWatchLogs
 
 	oldStyleLogs := func() (*string, error) {
@@ -217,7 +452,24 @@ func (s *Server) FetchLogs(c echo.Context) error {
 		return log_stream_name, nil
 	}
 
-	logSources := [...]func() (*string, error){oldStyleLogs, newStyleLogs}
+	logSources := []func() (*string, error){oldStyleLogs, newStyleLogs}
+
+	// Logs of a specific attempt, if asked for. Attempts only have new
+	// style log streams.
+	if attempt_param := c.QueryParam("attempt"); attempt_param != "" {
+		attempt_index, err := strconv.Atoi(attempt_param)
+		if err != nil || attempt_index < 0 || attempt_index >= len(job.Attempts) {
+			return c.String(http.StatusNotFound, "No such attempt.")
+		}
+		attempt := job.Attempts[attempt_index]
+		attemptLogs := func() (*string, error) {
+			if attempt.LogStreamName == nil || len(*attempt.LogStreamName) == 0 {
+				return nil, nil
+			}
+			return attempt.LogStreamName, nil
+		}
+		logSources = []func() (*string, error){attemptLogs}
+	}
 	var logStreams *cloudwatchlogs.DescribeLogStreamsOutput
 
 	for _, log_source := range logSources {
@@ -309,7 +561,7 @@ func (s *Server) FetchLogs(c echo.Context) error {
 
 // KillOne is a request handler, kills a job matching the post parameter 'id' (AWS task ID)
 func (s *Server) KillOne(c echo.Context) error {
-	span := opentracing.StartSpan("API.KillOne")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.KillOne")
 	defer span.Finish()
 
 	task := new(KillTaskID)
@@ -318,7 +570,7 @@ func (s *Server) KillOne(c echo.Context) error {
 		return err
 	}
 
-	err := s.Killer.KillOne(task.ID, "terminated from UI", s.Storage)
+	err := s.Killer.KillOne(ctx, task.ID, "terminated from UI", s.Storage)
 
 	if err != nil {
 		log.Error(err)
@@ -333,11 +585,35 @@ func (s *Server) KillOne(c echo.Context) error {
 	return c.JSON(http.StatusOK, task.ID)
 }
 
+// GetLeader is a request handler, returns which process is currently running
+// the synchronizer, scaler and cleaner
+func (s *Server) GetLeader(c echo.Context) error {
+	span, _ := opentracing.StartSpanFromContext(c.Request().Context(), "API.GetLeader")
+	defer span.Finish()
+
+	leader, err := s.Leadership.CurrentLeader()
+	if err != nil {
+		log.Error(err)
+		newErr := c.JSON(http.StatusInternalServerError, err)
+		if newErr != nil {
+			log.Error(newErr)
+			return newErr
+		}
+		return err
+	}
+
+	result := map[string]interface{}{
+		"leader":    leader,
+		"is_leader": s.Leadership.IsLeader(),
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
 func (s *Server) ListActiveJobQueues(c echo.Context) error {
-	span := opentracing.StartSpan("API.ListActiveJobQueues")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.ListActiveJobQueues")
 	defer span.Finish()
 
-	active_job_queues, err := s.Storage.ListActiveJobQueues()
+	active_job_queues, err := s.Storage.ListActiveJobQueues(ctx)
 	if err != nil {
 		log.Error(err)
 		newErr := c.JSON(http.StatusInternalServerError, err)
@@ -352,7 +628,7 @@ func (s *Server) ListActiveJobQueues(c echo.Context) error {
 }
 
 func (s *Server) ListAllJobQueues(c echo.Context) error {
-	span := opentracing.StartSpan("API.ListAllJobQueues")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.ListAllJobQueues")
 	defer span.Finish()
 
 	// This function gets *all* job queues, even those not registered to
@@ -370,7 +646,7 @@ func (s *Server) ListAllJobQueues(c echo.Context) error {
 		} else {
 			input = &batch.DescribeJobQueuesInput{}
 		}
-		job_queues, err := svc.DescribeJobQueues(input)
+		job_queues, err := svc.DescribeJobQueuesWithContext(ctx, input)
 		if err != nil {
 			log.Error(err)
 			newErr := c.JSON(http.StatusInternalServerError, err)
@@ -396,11 +672,11 @@ func (s *Server) ListAllJobQueues(c echo.Context) error {
 }
 
 func (s *Server) ActivateJobQueue(c echo.Context) error {
-	span := opentracing.StartSpan("API.ActivateJobQueue")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.ActivateJobQueue")
 	defer span.Finish()
 
 	job_queue_name := c.Param("name")
-	err := s.Storage.ActivateJobQueue(job_queue_name)
+	err := s.Storage.ActivateJobQueue(ctx, job_queue_name)
 	if err != nil {
 		log.Error(err)
 		newErr := c.JSON(http.StatusInternalServerError, err)
@@ -415,11 +691,11 @@ func (s *Server) ActivateJobQueue(c echo.Context) error {
 }
 
 func (s *Server) DeactivateJobQueue(c echo.Context) error {
-	span := opentracing.StartSpan("API.DeactivateJobQueue")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.DeactivateJobQueue")
 	defer span.Finish()
 
 	job_queue_name := c.Param("name")
-	err := s.Storage.DeactivateJobQueue(job_queue_name)
+	err := s.Storage.DeactivateJobQueue(ctx, job_queue_name)
 	if err != nil {
 		log.Error(err)
 		newErr := c.JSON(http.StatusInternalServerError, err)
@@ -435,7 +711,7 @@ func (s *Server) DeactivateJobQueue(c echo.Context) error {
 
 // Stats
 func (s *Server) JobStats(c echo.Context) error {
-	span := opentracing.StartSpan("API.JobStats")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.JobStats")
 	defer span.Finish()
 
 	c.QueryParams()
@@ -490,7 +766,7 @@ func (s *Server) JobStats(c echo.Context) error {
 	if len(statusStr) > 0 {
 		status = strings.Split(statusStr, ",")
 	}
-	results, err := s.Storage.JobStats(&jobs.JobStatsOptions{
+	results, err := s.Storage.JobStats(ctx, &jobs.JobStatsOptions{
 		Queues:   queues,
 		Status:   status,
 		Interval: interval,
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/AdRoll/batchiepatchie/syncer"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/opentracing/opentracing-go"
+)
+
+// healthCheckTimeout limits how long a health check waits for the database.
+const healthCheckTimeout = 5 * time.Second
+
+// Health is what /api/v1/health returns.
+type Health struct {
+	// Database is "ok" or why the database cannot be reached
+	Database string `json:"database"`
+	IsLeader bool   `json:"is_leader"`
+	// SyncStaleness is how long the synchronizer has gone without a
+	// successful round; always 0 on followers
+	SyncStaleness float64             `json:"sync_staleness_seconds"`
+	SyncStale     bool                `json:"sync_stale"`
+	Loops         []syncer.LoopStatus `json:"loops"`
+	LastSync      syncer.SyncStats    `json:"last_sync"`
+}
+
+// Healthy tells if the database can be reached.
+func (h *Health) Healthy() bool {
+	return h.Database == "ok"
+}
+
+func (s *Server) checkHealth(ctx context.Context) *Health {
+	health := &Health{
+		Database: "ok",
+		IsLeader: s.Leadership.IsLeader(),
+		Loops:    syncer.LoopStatuses(),
+		LastSync: syncer.LastSyncStats(),
+	}
+
+	ctx_timeout, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	err := s.Storage.Ping(ctx_timeout)
+	if err != nil {
+		health.Database = err.Error()
+	}
+
+	staleness := syncer.SyncStaleness(time.Now())
+	health.SyncStaleness = staleness.Seconds()
+	health.SyncStale = s.SyncStaleAfter > 0 && staleness > s.SyncStaleAfter
+	return health
+}
+
+// GetHealth is a request handler, returns the health checks and the status
+// of every background loop
+func (s *Server) GetHealth(c echo.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.GetHealth")
+	defer span.Finish()
+
+	return c.JSON(http.StatusOK, s.checkHealth(ctx))
+}
+
+// Healthz is a request handler for liveness probes; it fails when the
+// database cannot be reached
+func (s *Server) Healthz(c echo.Context) error {
+	health := s.checkHealth(c.Request().Context())
+	if !health.Healthy() {
+		log.Warn("Health check failed, database: ", health.Database)
+		return c.String(http.StatusServiceUnavailable, "database: "+health.Database)
+	}
+	return c.String(http.StatusOK, "ok")
+}
+
+// Readyz is a request handler for readiness probes; on the leader it also
+// fails when synchronization has gone stale
+func (s *Server) Readyz(c echo.Context) error {
+	health := s.checkHealth(c.Request().Context())
+	if !health.Healthy() {
+		log.Warn("Readiness check failed, database: ", health.Database)
+		return c.String(http.StatusServiceUnavailable, "database: "+health.Database)
+	}
+	if health.SyncStale {
+		log.Warn("Readiness check failed, no successful synchronization in ", health.SyncStaleness, " seconds")
+		return c.String(http.StatusServiceUnavailable, "synchronization is stale")
+	}
+	return c.String(http.StatusOK, "ok")
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/AdRoll/batchiepatchie/jobs"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/opentracing/opentracing-go"
+)
+
+// ListJobDefinitions is a request handler, returns the latest revision of
+// every job definition, or every revision of the job definition in 'name'
+func (s *Server) ListJobDefinitions(c echo.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.ListJobDefinitions")
+	defer span.Finish()
+
+	job_definitions, err := s.Storage.ListJobDefinitions(ctx, c.QueryParam("name"))
+	if err != nil {
+		log.Error(err)
+		newErr := c.JSON(http.StatusInternalServerError, err)
+		if newErr != nil {
+			log.Error(newErr)
+			return newErr
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, job_definitions)
+}
+
+// GetJobDefinition is a request handler, returns a revision of a job
+// definition
+func (s *Server) GetJobDefinition(c echo.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.GetJobDefinition")
+	defer span.Finish()
+
+	revision, err := strconv.ParseInt(c.Param("revision"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "revision must be a number"})
+	}
+
+	job_definition, err := s.Storage.GetJobDefinition(ctx, c.Param("name"), revision)
+	if err != nil {
+		log.Error(err)
+		newErr := c.JSON(http.StatusInternalServerError, err)
+		if newErr != nil {
+			log.Error(newErr)
+			return newErr
+		}
+		return err
+	}
+
+	if job_definition == nil {
+		return c.JSON(http.StatusNotFound, job_definition)
+	}
+	return c.JSON(http.StatusOK, job_definition)
+}
+
+// findDiffedJobDefinition finds one side of a diff: either a job definition
+// given as name:revision in the 'param' query parameter, or the revision a
+// job ran with if the job ID is given in 'param_job'. If it cannot be found,
+// the HTTP status and the reason are returned instead.
+func (s *Server) findDiffedJobDefinition(ctx context.Context, c echo.Context, param string) (*jobs.JobDefinition, int, string, error) {
+	revision_param := c.QueryParam(param)
+	if job_id := c.QueryParam(param + "_job"); job_id != "" {
+		job, err := s.Storage.FindOne(ctx, job_id)
+		if err != nil {
+			return nil, http.StatusNotFound, "No such job: " + job_id, nil
+		}
+		revision_param = job.Description
+	}
+
+	name, revision, ok := jobs.ParseJobDefinitionARN(revision_param)
+	if !ok {
+		return nil, http.StatusBadRequest, param + " must be name:revision, or " + param + "_job a job ID", nil
+	}
+	job_definition, err := s.Storage.GetJobDefinition(ctx, name, revision)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "", err
+	}
+	if job_definition == nil {
+		return nil, http.StatusNotFound, "No such job definition: " + revision_param, nil
+	}
+	return job_definition, http.StatusOK, "", nil
+}
+
+// DiffJobDefinitions is a request handler, returns what changed between two
+// job definition revisions. Revisions are given as 'from' and 'to'
+// (name:revision), or through jobs that ran with them as 'from_job' and
+// 'to_job'.
+func (s *Server) DiffJobDefinitions(c echo.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.DiffJobDefinitions")
+	defer span.Finish()
+
+	var sides [2]*jobs.JobDefinition
+	for i, param := range []string{"from", "to"} {
+		job_definition, status, problem, err := s.findDiffedJobDefinition(ctx, c, param)
+		if err != nil {
+			log.Error(err)
+			newErr := c.JSON(http.StatusInternalServerError, err)
+			if newErr != nil {
+				log.Error(newErr)
+				return newErr
+			}
+			return err
+		}
+		if job_definition == nil {
+			return c.JSON(status, map[string]string{"error": problem})
+		}
+		sides[i] = job_definition
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"from":    sides[0].ARN,
+		"to":      sides[1].ARN,
+		"changes": jobs.DiffJobDefinitions(sides[0], sides[1]),
+	})
+}
@@ -21,14 +21,59 @@ type JobStatusNotification struct {
 }
 
 type JobStatusNotificationDetail struct {
-	JobName       string                         `json:"jobName"`
-	JobId         string                         `json:"jobId"`
-	JobQueue      string                         `json:"jobQueue"`
-	Status        string                         `json:"status"`
-	CreatedAt     int64                          `json:"createdAt"`
-	StartedAt     *int64                         `json:"startedAt"`
-	Container     JobStatusNotificationContainer `json:"container"`
-	JobDefinition string                         `json:"jobDefinition"`
+	JobName         string                                `json:"jobName"`
+	JobId           string                                `json:"jobId"`
+	JobQueue        string                                `json:"jobQueue"`
+	Status          string                                `json:"status"`
+	CreatedAt       int64                                 `json:"createdAt"`
+	StartedAt       *int64                                `json:"startedAt"`
+	Container       JobStatusNotificationContainer        `json:"container"`
+	JobDefinition   string                                `json:"jobDefinition"`
+	Attempts        []JobStatusNotificationAttempt        `json:"attempts"`
+	DependsOn       []JobStatusNotificationDependency     `json:"dependsOn"`
+	ArrayProperties *JobStatusNotificationArrayProperties `json:"arrayProperties"`
+	NodeProperties  *JobStatusNotificationNodeProperties  `json:"nodeProperties"`
+	NodeDetails     *JobStatusNotificationNodeDetails     `json:"nodeDetails"`
+}
+
+type JobStatusNotificationNodeProperties struct {
+	MainNode            int64                                      `json:"mainNode"`
+	NumNodes            int64                                      `json:"numNodes"`
+	NodeRangeProperties []JobStatusNotificationNodeRangeProperties `json:"nodeRangeProperties"`
+}
+
+type JobStatusNotificationNodeRangeProperties struct {
+	TargetNodes string                         `json:"targetNodes"`
+	Container   JobStatusNotificationContainer `json:"container"`
+}
+
+type JobStatusNotificationNodeDetails struct {
+	NodeIndex *int64 `json:"nodeIndex"`
+}
+
+type JobStatusNotificationArrayProperties struct {
+	// Index is only set on children of array jobs
+	Index *int64 `json:"index"`
+}
+
+type JobStatusNotificationDependency struct {
+	JobId string  `json:"jobId"`
+	Type  *string `json:"type"`
+}
+
+type JobStatusNotificationAttempt struct {
+	Container    JobStatusNotificationAttemptContainer `json:"container"`
+	StartedAt    *int64                                `json:"startedAt"`
+	StoppedAt    *int64                                `json:"stoppedAt"`
+	StatusReason *string                               `json:"statusReason"`
+}
+
+type JobStatusNotificationAttemptContainer struct {
+	ContainerInstanceArn *string `json:"containerInstanceArn"`
+	TaskArn              *string `json:"taskArn"`
+	ExitCode             *int64  `json:"exitCode"`
+	Reason               *string `json:"reason"`
+	LogStreamName        *string `json:"logStreamName"`
 }
 
 type env struct {
@@ -56,7 +101,7 @@ func stripArn(arnied_name string) string {
 }
 
 func (s *Server) JobStatusNotification(c echo.Context) error {
-	span := opentracing.StartSpan("API.JobStatusNotification")
+	span, ctx := opentracing.StartSpanFromContext(c.Request().Context(), "API.JobStatusNotification")
 	defer span.Finish()
 
 	// This function can be called from outside to update job status.
@@ -117,10 +162,83 @@ func (s *Server) JobStatusNotification(c echo.Context) error {
 	}
 	job.Timeout = timeout
 
-	jobs := make([]*jobs.Job, 1)
-	jobs[0] = &job
+	// Multi-node parallel jobs have no container of their own; we show the
+	// one of the main node.
+	if notification_node_properties := job_status_notification.Detail.NodeProperties; notification_node_properties != nil {
+		node_properties := &jobs.NodeProperties{
+			MainNode: notification_node_properties.MainNode,
+			NumNodes: notification_node_properties.NumNodes,
+		}
+		for _, range_properties := range notification_node_properties.NodeRangeProperties {
+			cmd, _ := json.Marshal(range_properties.Container.Command)
+			node_properties.NodeRanges = append(node_properties.NodeRanges, jobs.NodeRange{
+				TargetNodes: range_properties.TargetNodes,
+				Image:       range_properties.Container.Image,
+				VCpus:       range_properties.Container.Vcpus,
+				Memory:      range_properties.Container.Memory,
+				CommandLine: string(cmd),
+			})
+		}
+		if main_range := node_properties.NodeRangeFor(node_properties.MainNode); main_range != nil && job.Image == "" {
+			job.Image = main_range.Image
+			job.VCpus = main_range.VCpus
+			job.Memory = main_range.Memory
+			job.CommandLine = main_range.CommandLine
+		}
+		job.NodeProperties = node_properties
+	}
+
+	if node_details := job_status_notification.Detail.NodeDetails; node_details != nil && node_details.NodeIndex != nil {
+		if parent_job_id, index, ok := jobs.ParseNodeJobID(job.Id); ok && index == *node_details.NodeIndex {
+			job.ParentJobId = &parent_job_id
+			job.NodeIndex = &index
+			job.NodeProperties = nil
+		}
+	}
+
+	if array_properties := job_status_notification.Detail.ArrayProperties; array_properties != nil && array_properties.Index != nil {
+		if parent_job_id, index, ok := jobs.ParseArrayChildID(job.Id); ok && index == *array_properties.Index {
+			job.ParentJobId = &parent_job_id
+			job.ArrayIndex = &index
+		}
+	}
+
+	millisToTime := func(millis *int64) *time.Time {
+		if millis == nil {
+			return nil
+		}
+		t := time.Unix(*millis/1000, (*millis%1000)*1000000)
+		return &t
+	}
+	for i, notification_attempt := range job_status_notification.Detail.Attempts {
+		attempt := &jobs.JobAttempt{
+			JobId:                job.Id,
+			Attempt:              i,
+			StartedAt:            millisToTime(notification_attempt.StartedAt),
+			StoppedAt:            millisToTime(notification_attempt.StoppedAt),
+			Reason:               notification_attempt.StatusReason,
+			ExitCode:             notification_attempt.Container.ExitCode,
+			TaskARN:              notification_attempt.Container.TaskArn,
+			ContainerInstanceARN: notification_attempt.Container.ContainerInstanceArn,
+			LogStreamName:        notification_attempt.Container.LogStreamName,
+		}
+		if notification_attempt.Container.Reason != nil && len(*notification_attempt.Container.Reason) > 0 {
+			attempt.Reason = notification_attempt.Container.Reason
+		}
+		job.Attempts = append(job.Attempts, attempt)
+	}
+
+	for _, notification_dependency := range job_status_notification.Detail.DependsOn {
+		job.DependsOn = append(job.DependsOn, jobs.JobDependency{
+			JobId: notification_dependency.JobId,
+			Type:  notification_dependency.Type,
+		})
+	}
+
+	jobs_to_store := make([]*jobs.Job, 1)
+	jobs_to_store[0] = &job
 
-	err = s.Storage.Store(jobs)
+	err = s.Storage.Store(ctx, jobs_to_store, jobs.StatusChangeFromNotification)
 	if err != nil {
 		log.Warn("Failed to store job status notification: ", err)
 		return err
@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"net/http"
 	"time"
 
 	"github.com/AdRoll/batchiepatchie/jobs"
+	"github.com/AdRoll/batchiepatchie/metrics"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo"
 	log "github.com/sirupsen/logrus"
@@ -14,9 +17,64 @@ var (
 	upgrader = websocket.Upgrader{}
 )
 
+// closingChannel is closed when the server is shutting down. The caller must
+// hold webSocketsLock.
+func (s *Server) closingChannel() chan struct{} {
+	if s.closing == nil {
+		s.closing = make(chan struct{})
+	}
+	return s.closing
+}
+
+// addWebSocket counts a new WebSocket subscription, unless the server is
+// shutting down. The subscription must call webSockets.Done when it ends.
+func (s *Server) addWebSocket() (closing chan struct{}, ok bool) {
+	s.webSocketsLock.Lock()
+	defer s.webSocketsLock.Unlock()
+	closing = s.closingChannel()
+	select {
+	case <-closing:
+		return nil, false
+	default:
+	}
+	s.webSockets.Add(1)
+	return closing, true
+}
+
+// CloseWebSockets sends a close message to every WebSocket subscriber and
+// waits until they are all closed, or until ctx ends.
+func (s *Server) CloseWebSockets(ctx context.Context) error {
+	s.webSocketsLock.Lock()
+	closing := s.closingChannel()
+	select {
+	case <-closing:
+	default:
+		close(closing)
+	}
+	s.webSocketsLock.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		s.webSockets.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s *Server) SubscribeToJobEvent(c echo.Context) error {
 	job_id := c.Param("id")
 
+	closing, ok := s.addWebSocket()
+	if !ok {
+		return c.String(http.StatusServiceUnavailable, "shutting down")
+	}
+	defer s.webSockets.Done()
+
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		log.Warning("Invalid WebSocket attempt: ", err)
@@ -28,6 +86,8 @@ func (s *Server) SubscribeToJobEvent(c echo.Context) error {
 
 	events, unsubscribe := s.Storage.SubscribeToJobStatus(job_id)
 	defer unsubscribe()
+	metrics.WebSocketSubscriptions.Inc()
+	defer metrics.WebSocketSubscriptions.Dec()
 
 	// Launch a reader. We need it to detect if the connection closes
 	// suddenly.
@@ -39,7 +99,7 @@ func (s *Server) SubscribeToJobEvent(c echo.Context) error {
 
 	var previous_status *jobs.Job
 	// Immediately send status update on the job. If there is such as job.
-	job, err := s.Storage.FindOne(job_id)
+	job, err := s.Storage.FindOne(c.Request().Context(), job_id)
 	previous_status = job
 	if err == nil && job != nil {
 		marshalled, err := json.Marshal(*job)
@@ -67,6 +127,14 @@ func (s *Server) SubscribeToJobEvent(c echo.Context) error {
 			job_status = &stat
 		case <-time.After(time.Second * 5):
 			job_status = nil
+		case <-closing:
+			close_message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+			err = ws.WriteControl(websocket.CloseMessage, close_message, time.Now().Add(time.Second*5))
+			if err != nil {
+				log.Warning("Cannot send close message to WebSocket: ", err)
+				return err
+			}
+			return nil
 		}
 
 		if job_status != nil {
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AdRoll/batchiepatchie/metrics"
+	"github.com/labstack/echo"
+)
+
+// RequestMetrics is a middleware that records how long requests take per
+// route. Routes are recorded by path pattern, such as "/api/v1/jobs/:id", so
+// job IDs do not end up in label values.
+func RequestMetrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		started := time.Now()
+		err := next(c)
+		metrics.HTTPRequestDuration.WithLabelValues(c.Request().Method, routeOf(c), strconv.Itoa(responseStatus(c, err))).Observe(time.Since(started).Seconds())
+		return err
+	}
+}
+
+// routeOf is the path pattern of the route that matched the request.
+func routeOf(c echo.Context) string {
+	if c.Path() == "" {
+		return "unmatched"
+	}
+	return c.Path()
+}
+
+// responseStatus is the status code a request gets. Errors are turned into
+// responses only after the middlewares return, so unless the handler already
+// responded, the status is not in the response yet.
+func responseStatus(c echo.Context, err error) int {
+	if err == nil || c.Response().Committed {
+		return c.Response().Status
+	}
+	if http_err, ok := err.(*echo.HTTPError); ok {
+		return http_err.Code
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"github.com/labstack/echo"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// Tracing is a middleware that starts the root span of a request, so the
+// spans of handlers, the store and AWS calls end up in one trace. If the
+// request carries a trace context, the span continues that trace.
+func Tracing(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tracer := opentracing.GlobalTracer()
+		request := c.Request()
+		incoming, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(request.Header))
+		span := tracer.StartSpan("HTTP "+request.Method+" "+routeOf(c), ext.RPCServerOption(incoming))
+		defer span.Finish()
+		ext.HTTPMethod.Set(span, request.Method)
+		ext.HTTPUrl.Set(span, request.URL.Path)
+
+		c.SetRequest(request.WithContext(opentracing.ContextWithSpan(request.Context(), span)))
+		err := next(c)
+
+		status := responseStatus(c, err)
+		ext.HTTPStatusCode.Set(span, uint16(status))
+		if err != nil || status >= 500 {
+			ext.Error.Set(span, true)
+		}
+		if err != nil {
+			span.LogKV("error", err.Error())
+		}
+		return err
+	}
+}
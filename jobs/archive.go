@@ -0,0 +1,152 @@
+package jobs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/batchiepatchie/fetcher"
+	log "github.com/sirupsen/logrus"
+)
+
+// ArchivedJob is one line of a job archive: the job itself, everything else
+// the cleaner deletes along with it and the events of its instance while it
+// ran, which the cleaner deletes on their own schedule.
+type ArchivedJob struct {
+	Job            *Job                     `json:"job"`
+	Instance       *ArchivedInstance        `json:"instance,omitempty"`
+	InstanceEvents []*ArchivedInstanceEvent `json:"instance_events,omitempty"`
+	StatusHistory  []*JobStatusChange       `json:"status_history"`
+}
+
+// ArchivedInstance is a row of the instances table.
+type ArchivedInstance struct {
+	InstanceID            string     `json:"instance_id"`
+	AppearedAt            time.Time  `json:"appeared_at"`
+	DisappearedAt         *time.Time `json:"disappeared_at"`
+	LaunchedAt            *time.Time `json:"launched_at"`
+	AMI                   string     `json:"ami"`
+	InstanceType          string     `json:"instance_type"`
+	ComputeEnvironmentARN string     `json:"compute_environment_arn"`
+	ECSClusterARN         string     `json:"ecs_cluster_arn"`
+	AvailabilityZone      string     `json:"availability_zone"`
+	SpotInstanceRequestID *string    `json:"spot_instance_request_id"`
+	PrivateIP             *string    `json:"private_ip_address"`
+	PublicIP              *string    `json:"public_ip_address"`
+}
+
+// ArchivedInstanceEvent is a row of the instance_event_log table: the tasks
+// that were running on an instance at some time.
+type ArchivedInstanceEvent struct {
+	Timestamp  time.Time `json:"timestamp"`
+	InstanceID string    `json:"instance_id"`
+	ActiveJobs []string  `json:"active_jobs"`
+}
+
+// Archiver saves jobs somewhere before the cleaner deletes them. If Archive
+// returns an error, the jobs are not deleted.
+type Archiver interface {
+	Archive(jobs []*ArchivedJob) error
+}
+
+// Restorer puts archived jobs back into a store. Jobs that are already in the
+// store are left alone.
+type Restorer interface {
+	Restore(ctx context.Context, jobs []*ArchivedJob) error
+}
+
+/*
+fileArchiver writes gzip-compressed NDJSON files, one ArchivedJob per line,
+to S3 or to a local directory. Files are laid out as
+
+	<prefix>/dt=<day the job was created>/queue=<job queue>/<timestamp>-<job id>.ndjson.gz
+
+so that tools like Athena can use the day and the queue as partitions.
+*/
+type fileArchiver struct {
+	prefix string
+}
+
+// NewArchiver returns an Archiver that writes under prefix, which is either
+// s3://bucket/some/prefix or a local directory.
+func NewArchiver(prefix string) Archiver {
+	return &fileArchiver{prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+func (fa *fileArchiver) Archive(jobs []*ArchivedJob) error {
+	partitions := make(map[string][]*ArchivedJob)
+	for _, job := range jobs {
+		partition := fmt.Sprintf("dt=%s/queue=%s", job.Job.CreatedAt.UTC().Format("2006-01-02"), url.PathEscape(job.Job.JobQueue))
+		partitions[partition] = append(partitions[partition], job)
+	}
+
+	now := time.Now().UTC().Format("20060102T150405.000000000Z")
+	for partition, partition_jobs := range partitions {
+		data, err := EncodeArchive(partition_jobs)
+		if err != nil {
+			return err
+		}
+		location := fmt.Sprintf("%s/%s/%s-%s.ndjson.gz", fa.prefix, partition, now, partition_jobs[0].Job.Id)
+		err = fetcher.WriteAll(location, data)
+		if err != nil {
+			log.Warning("Cannot write job archive ", location, ": ", err)
+			return err
+		}
+		log.Info("Archived ", len(partition_jobs), " jobs to ", location)
+	}
+	return nil
+}
+
+// EncodeArchive turns jobs into gzip-compressed NDJSON.
+func EncodeArchive(jobs []*ArchivedJob) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(writer)
+	for _, job := range jobs {
+		if err := encoder.Encode(job); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeArchive reads what EncodeArchive wrote.
+func DecodeArchive(data []byte) ([]*ArchivedJob, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	jobs := make([]*ArchivedJob, 0)
+	lines := bufio.NewReader(reader)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var job ArchivedJob
+			if err := json.Unmarshal(line, &job); err != nil {
+				return nil, err
+			}
+			if job.Job == nil {
+				return nil, fmt.Errorf("Archive line without a job: %s", line)
+			}
+			jobs = append(jobs, &job)
+		}
+		if err == io.EOF {
+			return jobs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
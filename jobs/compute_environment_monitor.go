@@ -1,14 +1,17 @@
 package jobs
 
 import (
+	"context"
+
 	"github.com/AdRoll/batchiepatchie/awsclients"
+	"github.com/AdRoll/batchiepatchie/metrics"
 	"github.com/aws/aws-sdk-go/service/batch"
 	"github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
 )
 
-func GetComputeEnvironments(parentSpan opentracing.Span) ([]ComputeEnvironment, error) {
-	span := opentracing.StartSpan("GetComputeEnvironments", opentracing.ChildOf(parentSpan.Context()))
+func GetComputeEnvironments(ctx context.Context) ([]ComputeEnvironment, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "GetComputeEnvironments")
 	defer span.Finish()
 
 	var nextToken *string
@@ -18,7 +21,7 @@ func GetComputeEnvironments(parentSpan opentracing.Span) ([]ComputeEnvironment,
 
 	for {
 		hundred = 100
-		out, err := awsclients.Batch.DescribeComputeEnvironments(&batch.DescribeComputeEnvironmentsInput{
+		out, err := awsclients.Batch.DescribeComputeEnvironmentsWithContext(ctx, &batch.DescribeComputeEnvironmentsInput{
 			MaxResults: &hundred,
 			NextToken:  nextToken,
 		})
@@ -59,21 +62,49 @@ func GetComputeEnvironments(parentSpan opentracing.Span) ([]ComputeEnvironment,
 	return ce_lst, nil
 }
 
-func MonitorComputeEnvironments(fs Storer, queues []string) {
-	span := opentracing.StartSpan("MonitorComputeEnvironments")
+// computeEnvironmentsInMetrics are the compute environments that have series
+// in the compute environment metrics. Only the scaler loop touches it.
+var computeEnvironmentsInMetrics = make(map[string]bool)
+
+// updateComputeEnvironmentMetrics sets the vCPUs of the given compute
+// environments and then deletes the series of the others. The series are
+// never reset, so a scrape does not see a compute environment missing.
+func updateComputeEnvironmentMetrics(compute_environments []ComputeEnvironment) {
+	listed := make(map[string]bool)
+	for _, ce := range compute_environments {
+		metrics.ComputeEnvironmentDesiredVCpus.WithLabelValues(ce.Name).Set(float64(ce.WantedvCpus))
+		metrics.ComputeEnvironmentMinVCpus.WithLabelValues(ce.Name).Set(float64(ce.MinvCpus))
+		metrics.ComputeEnvironmentMaxVCpus.WithLabelValues(ce.Name).Set(float64(ce.MaxvCpus))
+		listed[ce.Name] = true
+		computeEnvironmentsInMetrics[ce.Name] = true
+	}
+	for name := range computeEnvironmentsInMetrics {
+		if !listed[name] {
+			metrics.ComputeEnvironmentDesiredVCpus.DeleteLabelValues(name)
+			metrics.ComputeEnvironmentMinVCpus.DeleteLabelValues(name)
+			metrics.ComputeEnvironmentMaxVCpus.DeleteLabelValues(name)
+			delete(computeEnvironmentsInMetrics, name)
+		}
+	}
+}
+
+func MonitorComputeEnvironments(ctx context.Context, fs Storer, queues []string) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MonitorComputeEnvironments")
 	defer span.Finish()
 
 	if len(queues) == 0 {
 		return
 	}
 
-	compute_environments, err := GetComputeEnvironments(span)
+	compute_environments, err := GetComputeEnvironments(ctx)
 	if err != nil {
 		log.Warning("Failed to get compute environments: ", err)
 		return
 	}
 
-	err = fs.UpdateComputeEnvironmentsLog(compute_environments)
+	updateComputeEnvironmentMetrics(compute_environments)
+
+	err = fs.UpdateComputeEnvironmentsLog(ctx, compute_environments)
 	if err != nil {
 		log.Warning("Failed to update compute environments log: ", err)
 		return
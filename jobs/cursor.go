@@ -0,0 +1,99 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// infinity is how a NULL stopped_at is represented in a cursor. PostgreSQL
+// sorts NULLs after every other value, just like 'infinity'::timestamptz.
+const infinity = "infinity"
+
+// Cursor marks a position in Find results for keyset pagination: the results
+// continue after the job with sort column value Value and ID JobId. Clients
+// only ever see it as an opaque string.
+type Cursor struct {
+	SortBy  string `json:"sort"`
+	SortAsc bool   `json:"asc"`
+	Value   string `json:"value"`
+	JobId   string `json:"id"`
+}
+
+// NewCursor returns a cursor that points right after job.
+func NewCursor(job *Job, sortBy string, sortAsc bool) *Cursor {
+	cursor := &Cursor{
+		SortBy:  sortBy,
+		SortAsc: sortAsc,
+		JobId:   job.Id,
+	}
+	switch parseSortColumn(sortBy) {
+	case sortByID:
+		cursor.Value = job.Id
+	case sortByName:
+		cursor.Value = job.Name
+	case sortByStatus:
+		cursor.Value = job.Status
+	case sortByStoppedAt:
+		if job.StoppedAt == nil {
+			cursor.Value = infinity
+		} else {
+			cursor.Value = job.StoppedAt.Format(time.RFC3339Nano)
+		}
+	default:
+		cursor.Value = job.LastUpdated.Format(time.RFC3339Nano)
+	}
+	return cursor
+}
+
+// Encode turns the cursor into the opaque string given to clients.
+func (c *Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses a string made by Cursor.Encode.
+func DecodeCursor(encoded string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	var cursor Cursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	if _, err := cursor.job(); err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// job returns a job that sorts exactly where the cursor points, for
+// comparing against other jobs with compareJobsByColumn.
+func (c *Cursor) job() (*Job, error) {
+	job := &Job{Id: c.JobId}
+	switch parseSortColumn(c.SortBy) {
+	case sortByID:
+		job.Id = c.Value
+	case sortByName:
+		job.Name = c.Value
+	case sortByStatus:
+		job.Status = c.Value
+	case sortByStoppedAt:
+		if c.Value != infinity {
+			stopped_at, err := time.Parse(time.RFC3339Nano, c.Value)
+			if err != nil {
+				return nil, err
+			}
+			job.StoppedAt = &stopped_at
+		}
+	default:
+		last_updated, err := time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return nil, err
+		}
+		job.LastUpdated = last_updated
+	}
+	return job, nil
+}
@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JobDefinition is a revision of an AWS Batch job definition. Revisions
+// never change once registered, except for being deregistered (Status
+// becomes INACTIVE).
+type JobDefinition struct {
+	ARN         string            `json:"arn"`
+	Name        string            `json:"name"`
+	Revision    int64             `json:"revision"`
+	Type        string            `json:"type"`
+	Status      string            `json:"status"`
+	Image       string            `json:"image"`
+	VCpus       int64             `json:"vcpus"`
+	Memory      int64             `json:"memory"`
+	CommandLine string            `json:"command_line"`
+	Environment map[string]string `json:"environment"`
+	// Timeout is the attempt duration in seconds, nil if there is none
+	Timeout       *int64            `json:"timeout"`
+	RetryStrategy *RetryStrategy    `json:"retry_strategy"`
+	Parameters    map[string]string `json:"parameters"`
+	SyncedAt      time.Time         `json:"synced_at"`
+}
+
+// RetryStrategy tells how many times AWS Batch tries a job and on which
+// failures it gives up or retries.
+type RetryStrategy struct {
+	Attempts       int64            `json:"attempts"`
+	EvaluateOnExit []EvaluateOnExit `json:"evaluate_on_exit,omitempty"`
+}
+
+// EvaluateOnExit is a rule of a retry strategy.
+type EvaluateOnExit struct {
+	Action         string `json:"action"`
+	OnExitCode     string `json:"on_exit_code,omitempty"`
+	OnReason       string `json:"on_reason,omitempty"`
+	OnStatusReason string `json:"on_status_reason,omitempty"`
+}
+
+// JobDefinitionChange is a difference between two job definition revisions.
+// Old or New is nil if the field was added or removed.
+type JobDefinitionChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// ParseJobDefinitionARN finds the name and revision in a job definition ARN
+// such as arn:aws:batch:us-west-2:123456789012:job-definition/name:3. It
+// also accepts plain name:revision.
+func ParseJobDefinitionARN(arn string) (string, int64, bool) {
+	name_and_revision := arn
+	if slash := strings.LastIndex(arn, "job-definition/"); slash >= 0 {
+		name_and_revision = arn[slash+len("job-definition/"):]
+	}
+	colon := strings.LastIndex(name_and_revision, ":")
+	if colon <= 0 {
+		return "", 0, false
+	}
+	revision, err := strconv.ParseInt(name_and_revision[colon+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return name_and_revision[:colon], revision, true
+}
+
+// DiffJobDefinitions lists what changed from one revision to another.
+// Environment variables and parameters are compared one by one.
+func DiffJobDefinitions(from *JobDefinition, to *JobDefinition) []*JobDefinitionChange {
+	changes := make([]*JobDefinitionChange, 0)
+	compare := func(field string, old interface{}, new interface{}) {
+		if !reflect.DeepEqual(old, new) {
+			changes = append(changes, &JobDefinitionChange{Field: field, Old: old, New: new})
+		}
+	}
+	compareMaps := func(prefix string, old map[string]string, new map[string]string) {
+		keys := make([]string, 0, len(old)+len(new))
+		for key := range old {
+			keys = append(keys, key)
+		}
+		for key := range new {
+			if _, ok := old[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			old_value, old_ok := old[key]
+			new_value, new_ok := new[key]
+			if old_ok && new_ok && old_value == new_value {
+				continue
+			}
+			change := &JobDefinitionChange{Field: prefix + "." + key}
+			if old_ok {
+				change.Old = old_value
+			}
+			if new_ok {
+				change.New = new_value
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	compare("type", from.Type, to.Type)
+	compare("status", from.Status, to.Status)
+	compare("image", from.Image, to.Image)
+	compare("vcpus", from.VCpus, to.VCpus)
+	compare("memory", from.Memory, to.Memory)
+	compare("command_line", from.CommandLine, to.CommandLine)
+	compare("timeout", from.Timeout, to.Timeout)
+	compare("retry_strategy", from.RetryStrategy, to.RetryStrategy)
+	compareMaps("environment", from.Environment, to.Environment)
+	compareMaps("parameters", from.Parameters, to.Parameters)
+	return changes
+}
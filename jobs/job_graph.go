@@ -0,0 +1,104 @@
+package jobs
+
+import "sort"
+
+// JobGraphNode is a job in a dependency graph. Jobs that are depended on but
+// that we have never seen (or that have been cleaned) have Known set to
+// false and no other information.
+type JobGraphNode struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	JobQueue string `json:"job_queue"`
+	Known    bool   `json:"known"`
+}
+
+// JobGraphEdge says that job To depends on job From.
+type JobGraphEdge struct {
+	From string  `json:"from"`
+	To   string  `json:"to"`
+	Type *string `json:"type"`
+}
+
+// JobGraph is everything upstream and downstream of a job.
+type JobGraph struct {
+	JobId string          `json:"job_id"`
+	Nodes []*JobGraphNode `json:"nodes"`
+	Edges []*JobGraphEdge `json:"edges"`
+	// BlockingJobs are the failed upstream jobs that are the root cause of
+	// the job not running: they have failed but nothing upstream of them
+	// has.
+	BlockingJobs []string `json:"blocking_jobs"`
+}
+
+func isFailedStatus(status string) bool {
+	return status == StatusFailed || status == StatusGone
+}
+
+// newJobGraph puts together a graph from its nodes and edges and works out
+// which jobs block JobId.
+func newJobGraph(job_id string, nodes map[string]*JobGraphNode, edges []*JobGraphEdge) *JobGraph {
+	graph := &JobGraph{
+		JobId:        job_id,
+		Nodes:        make([]*JobGraphNode, 0, len(nodes)),
+		Edges:        edges,
+		BlockingJobs: make([]string, 0),
+	}
+
+	upstream_of := make(map[string][]string)
+	for _, edge := range edges {
+		upstream_of[edge.To] = append(upstream_of[edge.To], edge.From)
+		for _, id := range []string{edge.From, edge.To} {
+			if _, ok := nodes[id]; !ok {
+				nodes[id] = &JobGraphNode{Id: id}
+			}
+		}
+	}
+	for _, node := range nodes {
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return graph.Nodes[i].Id < graph.Nodes[j].Id
+	})
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].To != graph.Edges[j].To {
+			return graph.Edges[i].To < graph.Edges[j].To
+		}
+		return graph.Edges[i].From < graph.Edges[j].From
+	})
+
+	// Walk upstream from the job. A failed job is blocking unless
+	// something upstream of it has failed too.
+	var hasFailedUpstream func(id string, visited map[string]bool) bool
+	hasFailedUpstream = func(id string, visited map[string]bool) bool {
+		for _, upstream_id := range upstream_of[id] {
+			if visited[upstream_id] {
+				continue
+			}
+			visited[upstream_id] = true
+			if isFailedStatus(nodes[upstream_id].Status) || hasFailedUpstream(upstream_id, visited) {
+				return true
+			}
+		}
+		return false
+	}
+	visited := map[string]bool{job_id: true}
+	queue := []string{job_id}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, upstream_id := range upstream_of[id] {
+			if visited[upstream_id] {
+				continue
+			}
+			visited[upstream_id] = true
+			queue = append(queue, upstream_id)
+			if isFailedStatus(nodes[upstream_id].Status) && !hasFailedUpstream(upstream_id, map[string]bool{upstream_id: true}) {
+				graph.BlockingJobs = append(graph.BlockingJobs, upstream_id)
+			}
+		}
+	}
+	sort.Strings(graph.BlockingJobs)
+
+	return graph
+}
@@ -0,0 +1,108 @@
+package jobs
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jobStatusSubscriptions keeps track of who wants to hear about job status
+// changes. It is shared by all store implementations; the store itself decides
+// when a job has changed and calls notify().
+type jobStatusSubscriptions struct {
+	subscribers map[string]([]chan<- Job)
+	lock        sync.Mutex
+}
+
+func newJobStatusSubscriptions() *jobStatusSubscriptions {
+	return &jobStatusSubscriptions{
+		subscribers: make(map[string][]chan<- Job),
+	}
+}
+
+// subscribe returns a channel where new job events will be sent and a
+// function that undoes the subscription. It's important to use the
+// unsubscriber function or memory will leak.
+func (s *jobStatusSubscriptions) subscribe(jobID string) (<-chan Job, func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existing_subscribers, ok := s.subscribers[jobID]
+	if !ok {
+		existing_subscribers = make([]chan<- Job, 0)
+	}
+
+	// Channels won't be sent more than ~5 things over its
+	// lifetime. We set capacity at 20 here.
+	status_channel := make(chan Job, 20)
+	existing_subscribers = append(existing_subscribers, status_channel)
+
+	// This function here undoes the subscription.
+	unsubscribe := func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		existing_subscribers, ok := s.subscribers[jobID]
+		if !ok {
+			return
+		}
+		// Make new subscribers list, but without the channel that is
+		// being unsubscribed.  A bit slow (we are creating an entirely
+		// new list) but usually there is only 1 subscriber anyway.
+		new_subscribers := make([]chan<- Job, 0)
+		for _, channel := range existing_subscribers {
+			if channel != status_channel {
+				new_subscribers = append(new_subscribers, channel)
+			}
+		}
+
+		// If the new subscribers would be empty, delete the key. Let's
+		// not have our map grow in terms of number of keys infinitely.
+		if len(new_subscribers) == 0 {
+			delete(s.subscribers, jobID)
+		} else {
+			s.subscribers[jobID] = new_subscribers
+		}
+
+		log.Info("Subscription deregistered for job id: ", jobID, ", total number of job IDs monitored: ", len(s.subscribers))
+	}
+
+	s.subscribers[jobID] = existing_subscribers
+	log.Info("Subscription registered for job id: ", jobID, ", total number of job IDs monitored: ", len(s.subscribers))
+
+	return status_channel, unsubscribe
+}
+
+// notify sends job statuses to every subscriber of those jobs.
+func (s *jobStatusSubscriptions) notify(job_statuses []Job) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, job_status := range job_statuses {
+		channels, ok := s.subscribers[job_status.Id]
+		if !ok {
+			continue
+		}
+		for _, channel := range channels {
+			channel <- job_status
+		}
+	}
+}
+
+// hasSubscribers tells if anyone is currently subscribed to a job.
+func (s *jobStatusSubscriptions) hasSubscribers(jobID string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.subscribers[jobID]
+	return ok
+}
+
+// subscribedJobIDs returns the IDs of all jobs that have at least one
+// subscriber.
+func (s *jobStatusSubscriptions) subscribedJobIDs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job_ids := make([]string, 0, len(s.subscribers))
+	for job_id := range s.subscribers {
+		job_ids = append(job_ids, job_id)
+	}
+	return job_ids
+}
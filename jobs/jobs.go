@@ -4,9 +4,12 @@ Package jobs implements the basic Job structure and related functionality
 package jobs
 
 import (
+	"context"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,6 +24,11 @@ const (
 	StatusSucceeded = "SUCCEEDED"
 )
 
+// StatusGone is a Batchiepatchie-specific status for jobs AWS Batch has
+// forgotten about. It is not part of StatusList since AWS Batch never
+// reports it.
+const StatusGone = "GONE"
+
 // StatusList is a list of all possible job statuses
 var StatusList = [...]string{
 	StatusFailed,
@@ -61,6 +69,80 @@ type Job struct {
 	PublicIP             *string          `json:"public_ip"`
 	PrivateIP            *string          `json:"private_ip"`
 	ArrayProperties      *ArrayProperties `json:"array_properties,omitempty"`
+	NodeProperties       *NodeProperties  `json:"node_properties,omitempty"`
+	// ParentJobId is set on children of array jobs, together with
+	// ArrayIndex, and on nodes of multi-node parallel jobs, together with
+	// NodeIndex
+	ParentJobId *string `json:"parent_job_id,omitempty"`
+	ArrayIndex  *int64  `json:"array_index,omitempty"`
+	NodeIndex   *int64  `json:"node_index,omitempty"`
+	// Nodes is only filled in by FindOne, for multi-node parallel jobs
+	Nodes []*Job `json:"nodes,omitempty"`
+	// JobDefinition is the revision the job ran with. It is only filled in
+	// by FindOne and only if the revision has been synchronized.
+	JobDefinition *JobDefinition `json:"job_definition,omitempty"`
+	// Attempts and DependsOn are only filled in by FindOne
+	Attempts  []*JobAttempt   `json:"attempts,omitempty"`
+	DependsOn []JobDependency `json:"depends_on,omitempty"`
+}
+
+// JobDependency is a job that has to finish before another job can start.
+// Type is set for dependencies between array jobs (N_TO_N or SEQUENTIAL).
+type JobDependency struct {
+	JobId string  `json:"job_id"`
+	Type  *string `json:"type"`
+}
+
+// JobAttempt is one try at running a job. AWS Batch makes a new attempt
+// every time a job with retries fails. Attempt counts from 0.
+type JobAttempt struct {
+	JobId                string     `json:"job_id"`
+	Attempt              int        `json:"attempt"`
+	StartedAt            *time.Time `json:"started_at"`
+	StoppedAt            *time.Time `json:"stopped_at"`
+	ExitCode             *int64     `json:"exitcode"`
+	Reason               *string    `json:"reason"`
+	TaskARN              *string    `json:"task_arn"`
+	ContainerInstanceARN *string    `json:"container_instance_arn"`
+	LogStreamName        *string    `json:"log_stream_name"`
+	InstanceID           *string    `json:"instance_id"`
+	PublicIP             *string    `json:"public_ip"`
+	PrivateIP            *string    `json:"private_ip"`
+}
+
+// StatusChangeSource tells where a job status change came from.
+type StatusChangeSource string
+
+const (
+	// StatusChangeFromSync is a change found by polling AWS Batch
+	StatusChangeFromSync StatusChangeSource = "sync"
+	// StatusChangeFromNotification is a change posted to /jobs/notify
+	StatusChangeFromNotification StatusChangeSource = "notify"
+	// StatusChangeFromStale is a job marked GONE by StaleOldJobs
+	StatusChangeFromStale StatusChangeSource = "stale"
+	// StatusChangeFromRestore is a job put back from an archive
+	StatusChangeFromRestore StatusChangeSource = "restore"
+)
+
+// JobStatusChange is one status transition in the history of a job.
+// OldStatus is nil for the first status the job was seen in.
+type JobStatusChange struct {
+	JobId     string             `json:"job_id"`
+	OldStatus *string            `json:"old_status"`
+	NewStatus string             `json:"new_status"`
+	ChangedAt time.Time          `json:"changed_at"`
+	Source    StatusChangeSource `json:"source"`
+	// Seconds the job spent in NewStatus; nil when the job is still in it.
+	Duration *float64 `json:"duration_seconds"`
+}
+
+// fillStatusChangeDurations computes Duration for a job's status history
+// that is sorted oldest first.
+func fillStatusChangeDurations(history []*JobStatusChange) {
+	for i := 0; i < len(history)-1; i++ {
+		duration := history[i+1].ChangedAt.Sub(history[i].ChangedAt).Seconds()
+		history[i].Duration = &duration
+	}
 }
 
 // ArrayProperties are properties of a parent array job.
@@ -86,6 +168,88 @@ func (a *ArrayProperties) Scan(value interface{}) error {
 	return json.Unmarshal(b, &a)
 }
 
+// NodeProperties are properties of a multi-node parallel job.
+type NodeProperties struct {
+	MainNode   int64       `json:"main_node"`
+	NumNodes   int64       `json:"num_nodes"`
+	NodeRanges []NodeRange `json:"node_ranges"`
+}
+
+// NodeRange is a range of nodes of a multi-node parallel job that run the
+// same container. TargetNodes uses the AWS Batch syntax: "2", "0:3" or "4:".
+type NodeRange struct {
+	TargetNodes string `json:"target_nodes"`
+	Image       string `json:"image"`
+	VCpus       int64  `json:"vcpus"`
+	Memory      int64  `json:"memory"`
+	CommandLine string `json:"command_line"`
+}
+
+// Value implements the driver.Valuer interface. This method
+// is needed for JSONB serialization to the database.
+func (n NodeProperties) Value() (driver.Value, error) {
+	return json.Marshal(n)
+}
+
+// Scan implements the sql.Scanner interface. This method
+// is needed for JSONB deserialization from the database.
+func (n *NodeProperties) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+
+	return json.Unmarshal(b, &n)
+}
+
+// NodeRangeFor returns the node range a node belongs to, or nil if there is
+// none.
+func (n *NodeProperties) NodeRangeFor(node int64) *NodeRange {
+	for i := range n.NodeRanges {
+		node_range := &n.NodeRanges[i]
+		start_str, end_str, is_range := strings.Cut(node_range.TargetNodes, ":")
+		start, err := strconv.ParseInt(start_str, 10, 64)
+		if err != nil {
+			start = 0
+		}
+		end := start
+		if is_range {
+			end, err = strconv.ParseInt(end_str, 10, 64)
+			if err != nil {
+				end = n.NumNodes - 1
+			}
+		}
+		if start <= node && node <= end {
+			return node_range
+		}
+	}
+	return nil
+}
+
+// ParseNodeJobID splits the ID of a node of a multi-node parallel job, which
+// AWS Batch makes up as <parent job ID>#<node index>.
+func ParseNodeJobID(job_id string) (string, int64, bool) {
+	return parseChildJobID(job_id, "#")
+}
+
+// ParseArrayChildID splits the ID of a child of an array job, which AWS Batch
+// makes up as <parent job ID>:<index>.
+func ParseArrayChildID(job_id string) (string, int64, bool) {
+	return parseChildJobID(job_id, ":")
+}
+
+func parseChildJobID(job_id string, separator string) (string, int64, bool) {
+	separator_index := strings.LastIndex(job_id, separator)
+	if separator_index <= 0 {
+		return "", 0, false
+	}
+	index, err := strconv.ParseInt(job_id[separator_index+len(separator):], 10, 64)
+	if err != nil || index < 0 {
+		return "", 0, false
+	}
+	return job_id[:separator_index], index, true
+}
+
 // StatusSummary is counts of statuses of child array jobs
 type StatusSummary struct {
 	Starting  int64 `json:"starting"`
@@ -99,7 +263,8 @@ type StatusSummary struct {
 
 // Options is the query options for the Find method to use
 type Options struct {
-	Search    string
+	// Search is nil when not searching for anything
+	Search    *SearchQuery
 	DateRange string
 	Limit     int
 	Offset    int
@@ -107,8 +272,56 @@ type Options struct {
 	SortBy    string
 	SortAsc   bool
 	Status    []string
+	// If Cursor is set, results continue after it and Offset is ignored.
+	// SortBy and SortAsc must match the cursor.
+	Cursor *Cursor
+}
+
+// ArrayChildrenOptions is the query options for FindArrayChildren
+type ArrayChildrenOptions struct {
+	ParentJobId string
+	Status      []string
+	// AfterIndex pages through children: only children with a larger array
+	// index are returned. Nil starts from the first child.
+	AfterIndex *int64
+	Limit      int
+}
+
+// ArrayChildren is a page of children of an array job, ordered by their
+// array index.
+type ArrayChildren struct {
+	Children []*Job `json:"children"`
+	// FailedIndexes has every failed child, not just those on this page
+	FailedIndexes []int64 `json:"failed_indexes"`
 }
 
+// parseDateRange parses the DateRange option into a duration
+// Accepts: 10m, 1h, 1d, 2d, 3d, 7d and 30d (default: 30d)
+func parseDateRange(input string) time.Duration {
+	switch input {
+	case "10m":
+		return 10 * time.Minute
+	case "1h":
+		return time.Hour
+	case "1d":
+		return 24 * time.Hour
+	case "2d":
+		return 2 * 24 * time.Hour
+	case "3d":
+		return 3 * 24 * time.Hour
+	case "7d":
+		return 7 * 24 * time.Hour
+	default:
+		return 30 * 24 * time.Hour
+	}
+}
+
+// JobStatsRollupInterval is the size, in seconds, of the buckets job usage
+// is pre-aggregated in. JobStatsOptions.Interval should be a multiple of it.
+const JobStatsRollupInterval = 300
+
+// JobStatsOptions selects finished jobs by the time they started running;
+// Start and End are Unix timestamps.
 type JobStatsOptions struct {
 	Queues   []string
 	Status   []string
@@ -128,6 +341,13 @@ type JobStats struct {
 	Interval        int64   `json:"interval"`
 }
 
+// JobSyncState is the part of a stored job that the synchronizer compares
+// with the job summaries of AWS Batch.
+type JobSyncState struct {
+	Status       string
+	StatusReason *string
+}
+
 // KillTaskID is a struct to handle JSON request to kill a task
 type KillTaskID struct {
 	ID string `json:"id" form:"id" query:"id"`
@@ -139,84 +359,183 @@ type FinderStorer interface {
 	Storer
 
 	// Methods to get information about Job Queues
-	ListActiveJobQueues() ([]string, error)
-	ListForcedScalingJobQueues() ([]string, error)
+	ListActiveJobQueues(ctx context.Context) ([]string, error)
+	ListForcedScalingJobQueues(ctx context.Context) ([]string, error)
 
-	ActivateJobQueue(string) error
-	DeactivateJobQueue(string) error
+	ActivateJobQueue(ctx context.Context, job_queue_name string) error
+	DeactivateJobQueue(ctx context.Context, job_queue_name string) error
 }
 
 // Finder is an interface to find jobs in a database/store
 type Finder interface {
 	// Find finds a jobs matching the query
-	Find(opts *Options) ([]*Job, error)
+	Find(ctx context.Context, opts *Options) ([]*Job, error)
 
 	// FindOne finds a job matching the query
-	FindOne(query string) (*Job, error)
+	FindOne(ctx context.Context, query string) (*Job, error)
 
 	// FindTimedoutJobs finds all job IDs that should have timed out by now
-	FindTimedoutJobs() ([]string, error)
+	FindTimedoutJobs(ctx context.Context) ([]string, error)
 
 	// Simple endpoint that returns a string for job status.
-	GetStatus(jobid string) (*JobStatus, error)
+	GetStatus(ctx context.Context, jobid string) (*JobStatus, error)
+
+	// GetStatusHistory returns all status changes of a job, oldest first
+	GetStatusHistory(ctx context.Context, jobid string) ([]*JobStatusChange, error)
+
+	// GetAttempts returns all attempts of a job, first attempt first
+	GetAttempts(ctx context.Context, jobid string) ([]*JobAttempt, error)
+
+	// GetJobGraph returns all jobs a job depends on, directly or not, and
+	// all jobs that depend on it
+	GetJobGraph(ctx context.Context, jobid string) (*JobGraph, error)
 
-	JobStats(opts *JobStatsOptions) ([]*JobStats, error)
+	// FindArrayChildren returns children of an array job; nil if there is
+	// no such job
+	FindArrayChildren(ctx context.Context, opts *ArrayChildrenOptions) (*ArrayChildren, error)
+
+	// ListJobDefinitions returns the latest revision of every job
+	// definition or, if name is given, every revision of that job
+	// definition, newest first
+	ListJobDefinitions(ctx context.Context, name string) ([]*JobDefinition, error)
+
+	// GetJobDefinition returns a revision of a job definition; nil if we
+	// do not have it
+	GetJobDefinition(ctx context.Context, name string, revision int64) (*JobDefinition, error)
+
+	JobStats(ctx context.Context, opts *JobStatsOptions) ([]*JobStats, error)
 }
 
 // Storer is an interface to save jobs in a database/store
 type Storer interface {
-	// Store saves a job
-	Store(job []*Job) error
+	// Store saves jobs; source tells where the job information came from
+	Store(ctx context.Context, job []*Job, source StatusChangeSource) error
+
+	// StoreJobDefinitions saves job definition revisions
+	StoreJobDefinitions(ctx context.Context, job_definitions []*JobDefinition) error
+
+	// Finds what is stored of the given jobs, for the synchronizer to
+	// compare with the job listings of AWS Batch. Jobs that are not stored
+	// are left out.
+	FindSyncStates(ctx context.Context, job_ids []string) (map[string]*JobSyncState, error)
 
 	// Gives the store a chance to stale jobs we no longer know about
 	// The argument is a set (value is ignored) of all known job_ids currently by AWS Batch
-	StaleOldJobs(map[string]bool) error
+	StaleOldJobs(ctx context.Context, job_ids map[string]bool) error
 
 	// Finds estimated load per job queue
-	EstimateRunningLoadByJobQueue([]string) (map[string]RunningLoad, error)
+	EstimateRunningLoadByJobQueue(ctx context.Context, queues []string) (map[string]RunningLoad, error)
 
 	// Update compute environment logs
-	UpdateComputeEnvironmentsLog([]ComputeEnvironment) error
+	UpdateComputeEnvironmentsLog(ctx context.Context, compute_environments []ComputeEnvironment) error
 
 	// Update job summaries
-	UpdateJobSummaryLog([]JobSummary) error
+	UpdateJobSummaryLog(ctx context.Context, job_summaries []JobSummary) error
 
 	// Mark on job that we requested it to be terminated
-	UpdateJobLogTerminationRequested(string) error
+	UpdateJobLogTerminationRequested(ctx context.Context, jobID string) error
 
 	// Updates information on task arns and ec2 metadata
-	UpdateTaskArnsInstanceIDs(map[string]Ec2Info, map[string]string) error
+	UpdateTaskArnsInstanceIDs(ctx context.Context, ec2info map[string]Ec2Info, task_ec2_mapping map[string]string) error
 
 	// Updates information on EC2 instances running on ECS
-	UpdateECSInstances(map[string]Ec2Info, map[string][]string) error
+	UpdateECSInstances(ctx context.Context, ec2info map[string]Ec2Info, tasks_per_ec2instance map[string][]string) error
 
 	// Gets alive EC2 instances (according to database)
-	GetAliveEC2Instances() ([]string, error)
+	GetAliveEC2Instances(ctx context.Context) ([]string, error)
 
 	// Gets all instance IDs that have jobs stuck in "STARTING" status
-	GetStartingStateStuckEC2Instances() ([]string, error)
+	GetStartingStateStuckEC2Instances(ctx context.Context) ([]string, error)
 
 	// Subscribes to updates about a job status. (see more info on this
 	// function in postgres_store.go)
 	SubscribeToJobStatus(jobID string) (<-chan Job, func())
+
+	// Ping checks that the store can be reached
+	Ping(ctx context.Context) error
+
+	// Close releases the connections of the store. Nothing may be called
+	// after it.
+	Close() error
+}
+
+// RetentionPolicy tells the cleaner how many days to keep things for. Zero
+// days means keep forever.
+type RetentionPolicy struct {
+	// JobDays applies to jobs in queues that are not in JobQueueDays
+	JobDays      int
+	JobQueueDays map[string]int
+
+	InstanceEventLogDays           int
+	JobSummaryEventLogDays         int
+	ComputeEnvironmentEventLogDays int
+
+	// InstanceDays is counted from when the instance disappeared; live
+	// instances are never cleaned.
+	InstanceDays int
+
+	// RestoredJobDays is counted from when a job was put back from an
+	// archive; until then the job is kept whatever JobDays and JobQueueDays
+	// say.
+	RestoredJobDays int
+
+	// BatchSize is the maximum number of rows deleted in one transaction
+	BatchSize int
+
+	// Archiver, if not nil, gets every job before it is cleaned
+	Archiver Archiver
 }
 
 // Cleaner allows you to clean the database
 type Cleaner interface {
 	// CleanOldJobs cleans old jobs from the database
-	CleanOldJobs() error
+	CleanOldJobs(ctx context.Context, policy *RetentionPolicy) error
 
 	// CleanOldInstanceEventLogs cleans old instance event logs from the database
-	CleanOldInstanceEventLogs() error
+	CleanOldInstanceEventLogs(ctx context.Context, policy *RetentionPolicy) error
+
+	// CleanOldJobSummaryEventLogs cleans old job summary event logs from the database
+	CleanOldJobSummaryEventLogs(ctx context.Context, policy *RetentionPolicy) error
+
+	// CleanOldComputeEnvironmentEventLogs cleans old compute environment event logs from the database
+	CleanOldComputeEnvironmentEventLogs(ctx context.Context, policy *RetentionPolicy) error
+
+	// CleanOldInstances cleans instances that disappeared long ago from the database
+	CleanOldInstances(ctx context.Context, policy *RetentionPolicy) error
+
+	// CreatePartitions creates the partitions of the coming months for the
+	// tables that are partitioned by month
+	CreatePartitions(ctx context.Context) error
+}
+
+// LeaderElection decides which batchiepatchie process runs the periodic
+// synchronizer, scaler and cleaner when several processes share a store.
+type LeaderElection interface {
+	// IsLeader tells if this process is currently the leader
+	IsLeader() bool
+
+	// CurrentLeader returns the current leader, or nil if nobody has
+	// been elected yet
+	CurrentLeader() (*Leader, error)
+
+	// Resign gives up leadership for good, so that another process can
+	// take over without waiting for this one to exit
+	Resign()
+}
+
+type Leader struct {
+	Identity      string    `json:"identity"`
+	Since         time.Time `json:"since"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
 }
 
 // Killer is an interface to kill jobs in the queue
 type Killer interface {
 	// KillOne kills a job matching the query
-	KillOne(jobID string, reason string, store Storer) error
+	KillOne(ctx context.Context, jobID string, reason string, store Storer) error
 
 	// Kills jobs and instances that are stuck in STARTING status
-	KillInstances(instances []string) error
+	KillInstances(ctx context.Context, instances []string) error
 }
 
 // This structure describes how many vcpus and memory the currently queued jobs require
@@ -17,3 +17,56 @@ func TestJobStruct(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestParseJobDefinitionARN(t *testing.T) {
+	for input, expected_ok := range map[string]bool{
+		"arn:aws:batch:us-west-2:123456789012:job-definition/nightly:3": true,
+		"nightly:3":    true,
+		"nightly":      false,
+		"nightly:last": false,
+	} {
+		name, revision, ok := jobs.ParseJobDefinitionARN(input)
+		if ok != expected_ok {
+			t.Errorf("Expected %q to parse: %v", input, expected_ok)
+		}
+		if ok && (name != "nightly" || revision != 3) {
+			t.Errorf("Unexpected name and revision for %q: %s, %d", input, name, revision)
+		}
+	}
+}
+
+func TestDiffJobDefinitions(t *testing.T) {
+	from := &jobs.JobDefinition{
+		Image:       "repo/image:1",
+		VCpus:       4,
+		Environment: map[string]string{"A": "1", "B": "2"},
+		Parameters:  map[string]string{},
+	}
+	timeout := int64(3600)
+	to := &jobs.JobDefinition{
+		Image:         "repo/image:2",
+		VCpus:         4,
+		Timeout:       &timeout,
+		RetryStrategy: &jobs.RetryStrategy{Attempts: 3},
+		Environment:   map[string]string{"A": "1", "C": "3"},
+		Parameters:    map[string]string{},
+	}
+
+	changes := jobs.DiffJobDefinitions(from, to)
+	fields := make([]string, 0, len(changes))
+	for _, change := range changes {
+		fields = append(fields, change.Field)
+	}
+	expected := []string{"image", "timeout", "retry_strategy", "environment.B", "environment.C"}
+	if len(fields) != len(expected) {
+		t.Fatalf("Expected changes to %v, got %v", expected, fields)
+	}
+	for i := range expected {
+		if fields[i] != expected[i] {
+			t.Errorf("Expected changes to %v, got %v", expected, fields)
+		}
+	}
+	if changes[3].Old != "2" || changes[3].New != nil {
+		t.Errorf("Expected environment.B to be removed, got %+v", changes[3])
+	}
+}
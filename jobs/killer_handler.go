@@ -1,7 +1,10 @@
 package jobs
 
 import (
+	"context"
+
 	"github.com/AdRoll/batchiepatchie/awsclients"
+	"github.com/AdRoll/batchiepatchie/metrics"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/batch"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -12,8 +15,8 @@ import (
 type KillerHandler struct {
 }
 
-func (th *KillerHandler) KillOne(jobID string, reason string, store Storer) error {
-	span := opentracing.StartSpan("KillOne")
+func (th *KillerHandler) KillOne(ctx context.Context, jobID string, reason string, store Storer) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "KillOne")
 	defer span.Finish()
 
 	input := &batch.TerminateJobInput{
@@ -22,17 +25,18 @@ func (th *KillerHandler) KillOne(jobID string, reason string, store Storer) erro
 	}
 
 	log.Info("Killing Job ", jobID, "...")
-	_, err := awsclients.Batch.TerminateJob(input)
+	_, err := awsclients.Batch.TerminateJobWithContext(ctx, input)
 	if err != nil {
 		log.Warning("Killing job failed: ", err)
 		return err
 	}
+	metrics.JobKills.WithLabelValues(reason).Inc()
 
-	return store.UpdateJobLogTerminationRequested(jobID)
+	return store.UpdateJobLogTerminationRequested(ctx, jobID)
 }
 
-func (th *KillerHandler) KillInstances(instances []string) error {
-	span := opentracing.StartSpan("KillInstances")
+func (th *KillerHandler) KillInstances(ctx context.Context, instances []string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "KillInstances")
 	defer span.Finish()
 
 	// Exit early if there are no instances to kill
@@ -55,12 +59,14 @@ func (th *KillerHandler) KillInstances(instances []string) error {
 		terminate_instances := &ec2.TerminateInstancesInput{
 			InstanceIds: instances_ptr,
 		}
-		_, err := awsclients.EC2.TerminateInstances(terminate_instances)
+		_, err := awsclients.EC2.TerminateInstancesWithContext(ctx, terminate_instances)
 		if err != nil {
 			log.Warning("Cannot terminate instance ", instance_id, ": ", err)
 			// Don't return early but record the error
 			final_ret = err
+			continue
 		}
+		metrics.InstanceKills.Inc()
 		log.Info("Terminated instance ", instance_id, " because it has a job at STARTING state stuck.")
 	}
 
@@ -0,0 +1,196 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// leaderLockID is the PostgreSQL advisory lock key that batchiepatchie
+// processes compete for. Any number works as long as it doesn't collide with
+// other users of advisory locks in the same database.
+const leaderLockID = 7162838372
+
+const leaderElectionPeriod = 5 * time.Second
+
+/*
+postgreSQLLeaderElection holds a session level advisory lock on a dedicated
+database connection. The lock is released by PostgreSQL when the connection
+goes away, so if the leader dies another process takes over within
+leaderElectionPeriod of PostgreSQL noticing.
+*/
+type postgreSQLLeaderElection struct {
+	db       *sql.DB
+	identity string
+
+	lock     sync.Mutex
+	conn     *sql.Conn
+	leader   bool
+	resigned bool
+}
+
+func (pq *postgreSQLStore) NewLeaderElection(identity string) *postgreSQLLeaderElection {
+	election := &postgreSQLLeaderElection{
+		db:       pq.connection,
+		identity: identity,
+	}
+	election.campaign()
+	go func() {
+		for !election.hasResigned() {
+			time.Sleep(leaderElectionPeriod)
+			election.campaign()
+		}
+	}()
+	return election
+}
+
+func (le *postgreSQLLeaderElection) hasResigned() bool {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	return le.resigned
+}
+
+// Resign releases the leader lock and stops campaigning.
+func (le *postgreSQLLeaderElection) Resign() {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	le.resigned = true
+	if le.leader {
+		log.Info("This process (", le.identity, ") is no longer the leader.")
+	}
+	le.resign()
+}
+
+func (le *postgreSQLLeaderElection) IsLeader() bool {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	return le.leader
+}
+
+func (le *postgreSQLLeaderElection) CurrentLeader() (*Leader, error) {
+	ctx_timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var leader Leader
+	err := le.db.QueryRowContext(ctx_timeout, `SELECT identity, since, last_heartbeat FROM leader_election WHERE lock_id = $1`, leaderLockID).Scan(
+		&leader.Identity,
+		&leader.Since,
+		&leader.LastHeartbeat)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Warning("Cannot get current leader: ", err)
+		return nil, err
+	}
+	return &leader, nil
+}
+
+// campaign tries to become the leader if we are not one, and sends a
+// heartbeat if we are.
+func (le *postgreSQLLeaderElection) campaign() {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	if le.resigned {
+		return
+	}
+
+	ctx_timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if le.leader {
+		_, err := le.conn.ExecContext(ctx_timeout, `UPDATE leader_election SET last_heartbeat = now() WHERE lock_id = $1`, leaderLockID)
+		if err != nil {
+			log.Warning("Lost leadership, cannot send leader heartbeat: ", err)
+			le.resign()
+		}
+		return
+	}
+
+	conn, err := le.db.Conn(ctx_timeout)
+	if err != nil {
+		log.Warning("Cannot get a connection for leader election: ", err)
+		return
+	}
+
+	var acquired bool
+	err = conn.QueryRowContext(ctx_timeout, `SELECT pg_try_advisory_lock($1)`, leaderLockID).Scan(&acquired)
+	if err != nil || !acquired {
+		if err != nil {
+			log.Warning("Cannot try to acquire leader lock: ", err)
+		}
+		conn.Close()
+		return
+	}
+
+	_, err = conn.ExecContext(ctx_timeout, `
+		INSERT INTO leader_election (lock_id, identity, since, last_heartbeat)
+		VALUES ($1, $2, now(), now())
+		ON CONFLICT (lock_id) DO UPDATE SET
+			identity = EXCLUDED.identity,
+			since = EXCLUDED.since,
+			last_heartbeat = EXCLUDED.last_heartbeat`, leaderLockID, le.identity)
+	if err != nil {
+		log.Warning("Cannot record leadership: ", err)
+		le.conn = conn
+		le.resign()
+		return
+	}
+
+	le.conn = conn
+	le.leader = true
+	log.Info("This process (", le.identity, ") is now the leader.")
+}
+
+// resign gives up leadership. The connection holding the advisory lock is
+// thrown away rather than returned to the pool; otherwise the lock would
+// stay held by whichever query next uses that connection. Must be called with
+// le.lock held.
+func (le *postgreSQLLeaderElection) resign() {
+	le.leader = false
+	if le.conn == nil {
+		return
+	}
+	err := le.conn.Raw(func(driverConn interface{}) error {
+		return driver.ErrBadConn
+	})
+	if err != nil && err != driver.ErrBadConn {
+		log.Warning("Cannot discard leader connection: ", err)
+	}
+	le.conn.Close()
+	le.conn = nil
+}
+
+// memoryLeaderElection is used with the memory store. Nothing is shared
+// between processes, so every process is its own leader.
+type memoryLeaderElection struct {
+	leader Leader
+}
+
+func (ms *memoryStore) NewLeaderElection(identity string) *memoryLeaderElection {
+	now := time.Now()
+	return &memoryLeaderElection{
+		leader: Leader{
+			Identity:      identity,
+			Since:         now,
+			LastHeartbeat: now,
+		},
+	}
+}
+
+func (le *memoryLeaderElection) IsLeader() bool {
+	return true
+}
+
+func (le *memoryLeaderElection) Resign() {
+}
+
+func (le *memoryLeaderElection) CurrentLeader() (*Leader, error) {
+	leader := le.leader
+	leader.LastHeartbeat = time.Now()
+	return &leader, nil
+}
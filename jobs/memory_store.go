@@ -0,0 +1,1383 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ memoryStore keeps everything in process memory. It is meant for unit tests
+ and for running Batchiepatchie locally without a PostgreSQL database; nothing
+ survives a restart.
+
+ The behaviour of every method mirrors the corresponding SQL in
+ postgres_store.go as closely as possible, including which updates count as
+ changes and thus notify job status subscribers.
+*/
+
+type memoryInstance struct {
+	info          Ec2Info
+	appearedAt    time.Time
+	disappearedAt *time.Time
+}
+
+type memoryInstanceEvent struct {
+	timestamp  time.Time
+	instanceID string
+	activeJobs []string
+	restoredAt *time.Time
+}
+
+type memoryTaskArnInfo struct {
+	instanceID string
+	publicIP   *string
+	privateIP  *string
+}
+
+type memoryComputeEnvironmentEvent struct {
+	timestamp time.Time
+	ce        ComputeEnvironment
+}
+
+type memoryJobSummaryEvent struct {
+	timestamp time.Time
+	summary   JobSummary
+}
+
+type memoryJobStatsKey struct {
+	bucket   int64
+	jobQueue string
+	status   string
+}
+
+type memoryStore struct {
+	lock sync.Mutex
+
+	jobs                       map[string]*Job
+	activatedJobQueues         map[string]bool // value is forced_scaling
+	taskArns                   map[string]memoryTaskArnInfo
+	instances                  map[string]*memoryInstance
+	instanceEventLog           []memoryInstanceEvent
+	computeEnvironmentEventLog []memoryComputeEnvironmentEvent
+	jobSummaryEventLog         []memoryJobSummaryEvent
+	statusHistory              map[string][]JobStatusChange
+	attempts                   map[string][]JobAttempt
+	dependencies               map[string][]JobDependency
+	jobDefinitions             map[string]*JobDefinition // by ARN
+	jobStatsRollup             map[memoryJobStatsKey]*JobStats
+	restoredAt                 map[string]time.Time
+
+	subscriptions *jobStatusSubscriptions
+}
+
+// These statuses are considered final; jobs in them are never marked GONE.
+func isFinalStatus(status string) bool {
+	return status == StatusSucceeded || status == StatusFailed || status == StatusGone
+}
+
+// pointerValueChanged mirrors the "a <> b or (a is null and b is not null)"
+// checks used in the upsert statements of the PostgreSQL store.
+func pointerValueChanged[T comparable](old *T, new *T) bool {
+	if old == nil {
+		return new != nil
+	}
+	return new != nil && *old != *new
+}
+
+func (ms *memoryStore) jobWithInstanceInfo(job *Job) *Job {
+	result := *job
+	result.InstanceID = nil
+	result.PublicIP = nil
+	result.PrivateIP = nil
+	if job.TaskARN != nil {
+		if info, ok := ms.taskArns[*job.TaskARN]; ok {
+			instance_id := info.instanceID
+			result.InstanceID = &instance_id
+			result.PublicIP = info.publicIP
+			result.PrivateIP = info.privateIP
+		}
+	}
+	return &result
+}
+
+// notifySubscribers looks up the given jobs and sends them to subscribers.
+// Must be called without holding ms.lock.
+func (ms *memoryStore) notifySubscribers(job_ids []string) {
+	if len(job_ids) == 0 {
+		return
+	}
+
+	job_statuses := make([]Job, 0, len(job_ids))
+	ms.lock.Lock()
+	for _, job_id := range job_ids {
+		if job, ok := ms.jobs[job_id]; ok {
+			job_statuses = append(job_statuses, *ms.jobWithInstanceInfo(job))
+		}
+	}
+	ms.lock.Unlock()
+
+	ms.subscriptions.notify(job_statuses)
+}
+
+// recordStatusChange does what the job status triggers do in PostgreSQL.
+// Must be called while holding ms.lock.
+func (ms *memoryStore) recordStatusChange(job_id string, old_status *string, new_status string, source StatusChangeSource) {
+	ms.statusHistory[job_id] = append(ms.statusHistory[job_id], JobStatusChange{
+		JobId:     job_id,
+		OldStatus: old_status,
+		NewStatus: new_status,
+		ChangedAt: time.Now(),
+		Source:    source,
+	})
+}
+
+func compareJobsByColumn(a *Job, b *Job, column string) int {
+	compareTimes := func(x *time.Time, y *time.Time) int {
+		// PostgreSQL sorts NULLs as if they were larger than any value.
+		switch {
+		case x == nil && y == nil:
+			return 0
+		case x == nil:
+			return 1
+		case y == nil:
+			return -1
+		case x.Before(*y):
+			return -1
+		case x.After(*y):
+			return 1
+		}
+		return 0
+	}
+
+	switch column {
+	case sortByID:
+		return strings.Compare(a.Id, b.Id)
+	case sortByName:
+		return strings.Compare(a.Name, b.Name)
+	case sortByStatus:
+		return strings.Compare(a.Status, b.Status)
+	case sortByStoppedAt:
+		return compareTimes(a.StoppedAt, b.StoppedAt)
+	default:
+		return compareTimes(&a.LastUpdated, &b.LastUpdated)
+	}
+}
+
+func containsString(lst []string, item string) bool {
+	for _, value := range lst {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}
+
+func (ms *memoryStore) Find(ctx context.Context, opts *Options) ([]*Job, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.Find")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	cutoff := time.Now().Add(-parseDateRange(opts.DateRange))
+
+	found := make([]*Job, 0)
+	for _, job := range ms.jobs {
+		if !job.LastUpdated.After(cutoff) {
+			continue
+		}
+		if len(opts.Status) > 0 && !containsString(opts.Status, job.Status) {
+			continue
+		}
+		if len(opts.Queues) > 0 && !containsString(opts.Queues, job.JobQueue) {
+			continue
+		}
+		if opts.Search != nil && !opts.Search.matches(job) {
+			continue
+		}
+		found = append(found, ms.jobWithInstanceInfo(job))
+	}
+
+	column := parseSortColumn(opts.SortBy)
+	compare := func(a *Job, b *Job) int {
+		cmp := compareJobsByColumn(a, b, column)
+		if cmp == 0 {
+			cmp = strings.Compare(a.Id, b.Id)
+		}
+		if !opts.SortAsc {
+			cmp = -cmp
+		}
+		return cmp
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return compare(found[i], found[j]) < 0
+	})
+
+	offset := opts.Offset
+	if opts.Cursor != nil {
+		cursor_job, err := opts.Cursor.job()
+		if err != nil {
+			return nil, err
+		}
+		offset = sort.Search(len(found), func(i int) bool {
+			return compare(found[i], cursor_job) > 0
+		})
+	}
+
+	if offset >= len(found) {
+		return make([]*Job, 0), nil
+	}
+	found = found[offset:]
+	if opts.Limit >= 0 && opts.Limit < len(found) {
+		found = found[:opts.Limit]
+	}
+
+	// Instance information is not part of Find results in PostgreSQL store either.
+	for _, job := range found {
+		job.InstanceID = nil
+		job.PublicIP = nil
+		job.PrivateIP = nil
+	}
+
+	return found, nil
+}
+
+func (ms *memoryStore) FindOne(ctx context.Context, query string) (*Job, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.FindOne")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	job, ok := ms.jobs[query]
+	if !ok {
+		return nil, fmt.Errorf("Cannot find job %s", query)
+	}
+	result := ms.jobWithInstanceInfo(job)
+	result.Attempts = ms.copyAttempts(query)
+	result.DependsOn = ms.copyDependencies(query)
+	if result.NodeProperties != nil {
+		result.Nodes = make([]*Job, 0)
+		for _, node := range ms.jobs {
+			if node.ParentJobId != nil && *node.ParentJobId == query && node.NodeIndex != nil {
+				result.Nodes = append(result.Nodes, ms.jobWithInstanceInfo(node))
+			}
+		}
+		sort.Slice(result.Nodes, func(i, j int) bool {
+			return *result.Nodes[i].NodeIndex < *result.Nodes[j].NodeIndex
+		})
+	}
+	if name, revision, ok := ParseJobDefinitionARN(result.Description); ok {
+		result.JobDefinition = ms.findJobDefinition(name, revision)
+	}
+	return result, nil
+}
+
+func (ms *memoryStore) GetAttempts(ctx context.Context, jobid string) ([]*JobAttempt, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.GetAttempts")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return ms.copyAttempts(jobid), nil
+}
+
+// copyAttempts must be called while holding ms.lock.
+func (ms *memoryStore) copyAttempts(jobid string) []*JobAttempt {
+	attempts := make([]*JobAttempt, 0, len(ms.attempts[jobid]))
+	for _, attempt := range ms.attempts[jobid] {
+		attempt := attempt
+		if attempt.TaskARN != nil {
+			if info, ok := ms.taskArns[*attempt.TaskARN]; ok {
+				instance_id := info.instanceID
+				attempt.InstanceID = &instance_id
+				attempt.PublicIP = info.publicIP
+				attempt.PrivateIP = info.privateIP
+			}
+		}
+		attempts = append(attempts, &attempt)
+	}
+	return attempts
+}
+
+// storeAttempts does what mergeJobAttempts does in PostgreSQL. Must be
+// called while holding ms.lock.
+func (ms *memoryStore) storeAttempts(job *Job) {
+	for _, attempt := range job.Attempts {
+		stored := *attempt
+		stored.JobId = job.Id
+		stored.InstanceID = nil
+		stored.PublicIP = nil
+		stored.PrivateIP = nil
+		attempts := ms.attempts[job.Id]
+		for len(attempts) <= stored.Attempt {
+			attempts = append(attempts, JobAttempt{JobId: job.Id, Attempt: len(attempts)})
+		}
+		attempts[stored.Attempt] = stored
+		ms.attempts[job.Id] = attempts
+	}
+}
+
+// copyDependencies must be called while holding ms.lock.
+func (ms *memoryStore) copyDependencies(jobid string) []JobDependency {
+	if len(ms.dependencies[jobid]) == 0 {
+		return nil
+	}
+	return append([]JobDependency(nil), ms.dependencies[jobid]...)
+}
+
+// storeDependencies does what mergeJobDependencies does in PostgreSQL.
+// Must be called while holding ms.lock.
+func (ms *memoryStore) storeDependencies(job *Job) {
+	for _, dependency := range job.DependsOn {
+		found := false
+		for _, stored := range ms.dependencies[job.Id] {
+			if stored.JobId == dependency.JobId {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ms.dependencies[job.Id] = append(ms.dependencies[job.Id], dependency)
+		}
+	}
+}
+
+func (ms *memoryStore) GetJobGraph(ctx context.Context, jobid string) (*JobGraph, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.GetJobGraph")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if _, ok := ms.jobs[jobid]; !ok {
+		return nil, nil
+	}
+
+	downstream_of := make(map[string][]string)
+	for job_id, dependencies := range ms.dependencies {
+		for _, dependency := range dependencies {
+			downstream_of[dependency.JobId] = append(downstream_of[dependency.JobId], job_id)
+		}
+	}
+
+	// An edge is keyed by the job that depends on another and the job it
+	// depends on, so walking up and down the graph never adds it twice.
+	type edgeKey struct{ to, from string }
+	seen_edges := make(map[edgeKey]bool)
+	edges := make([]*JobGraphEdge, 0)
+	addEdge := func(to string, dependency JobDependency) bool {
+		key := edgeKey{to, dependency.JobId}
+		if seen_edges[key] {
+			return false
+		}
+		seen_edges[key] = true
+		edges = append(edges, &JobGraphEdge{From: dependency.JobId, To: to, Type: dependency.Type})
+		return true
+	}
+
+	queue := []string{jobid}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, dependency := range ms.dependencies[id] {
+			if addEdge(id, dependency) {
+				queue = append(queue, dependency.JobId)
+			}
+		}
+	}
+	queue = []string{jobid}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, downstream_id := range downstream_of[id] {
+			for _, dependency := range ms.dependencies[downstream_id] {
+				if dependency.JobId == id && addEdge(downstream_id, dependency) {
+					queue = append(queue, downstream_id)
+				}
+			}
+		}
+	}
+
+	nodes := make(map[string]*JobGraphNode)
+	job_ids := []string{jobid}
+	for _, edge := range edges {
+		job_ids = append(job_ids, edge.From, edge.To)
+	}
+	for _, id := range job_ids {
+		if job, ok := ms.jobs[id]; ok {
+			nodes[id] = &JobGraphNode{Id: id, Name: job.Name, Status: job.Status, JobQueue: job.JobQueue, Known: true}
+		}
+	}
+	return newJobGraph(jobid, nodes, edges), nil
+}
+
+func (ms *memoryStore) FindArrayChildren(ctx context.Context, opts *ArrayChildrenOptions) (*ArrayChildren, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.FindArrayChildren")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if _, ok := ms.jobs[opts.ParentJobId]; !ok {
+		return nil, nil
+	}
+
+	all_children := make([]*Job, 0)
+	for _, job := range ms.jobs {
+		if job.ParentJobId != nil && *job.ParentJobId == opts.ParentJobId && job.ArrayIndex != nil {
+			all_children = append(all_children, job)
+		}
+	}
+	sort.Slice(all_children, func(i, j int) bool {
+		return *all_children[i].ArrayIndex < *all_children[j].ArrayIndex
+	})
+
+	children := &ArrayChildren{
+		Children:      make([]*Job, 0),
+		FailedIndexes: make([]int64, 0),
+	}
+	for _, job := range all_children {
+		if job.Status == StatusFailed {
+			children.FailedIndexes = append(children.FailedIndexes, *job.ArrayIndex)
+		}
+		if len(opts.Status) > 0 && !containsString(opts.Status, job.Status) {
+			continue
+		}
+		if opts.AfterIndex != nil && *job.ArrayIndex <= *opts.AfterIndex {
+			continue
+		}
+		if len(children.Children) < opts.Limit {
+			children.Children = append(children.Children, ms.jobWithInstanceInfo(job))
+		}
+	}
+	return children, nil
+}
+
+func (ms *memoryStore) StoreJobDefinitions(ctx context.Context, job_definitions []*JobDefinition) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.StoreJobDefinitions")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, job_definition := range job_definitions {
+		if existing, ok := ms.jobDefinitions[job_definition.ARN]; ok {
+			if existing.Status != job_definition.Status {
+				existing.Status = job_definition.Status
+				existing.SyncedAt = job_definition.SyncedAt
+			}
+			continue
+		}
+		stored := *job_definition
+		ms.jobDefinitions[job_definition.ARN] = &stored
+	}
+	return nil
+}
+
+func (ms *memoryStore) ListJobDefinitions(ctx context.Context, name string) ([]*JobDefinition, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.ListJobDefinitions")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	latest := make(map[string]*JobDefinition)
+	job_definitions := make([]*JobDefinition, 0)
+	for _, job_definition := range ms.jobDefinitions {
+		if name == "" {
+			if existing, ok := latest[job_definition.Name]; !ok || existing.Revision < job_definition.Revision {
+				latest[job_definition.Name] = job_definition
+			}
+		} else if job_definition.Name == name {
+			copied := *job_definition
+			job_definitions = append(job_definitions, &copied)
+		}
+	}
+	for _, job_definition := range latest {
+		copied := *job_definition
+		job_definitions = append(job_definitions, &copied)
+	}
+	sort.Slice(job_definitions, func(i, j int) bool {
+		if job_definitions[i].Name != job_definitions[j].Name {
+			return job_definitions[i].Name < job_definitions[j].Name
+		}
+		return job_definitions[i].Revision > job_definitions[j].Revision
+	})
+	return job_definitions, nil
+}
+
+func (ms *memoryStore) GetJobDefinition(ctx context.Context, name string, revision int64) (*JobDefinition, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.GetJobDefinition")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return ms.findJobDefinition(name, revision), nil
+}
+
+// findJobDefinition must be called while holding ms.lock.
+func (ms *memoryStore) findJobDefinition(name string, revision int64) *JobDefinition {
+	for _, job_definition := range ms.jobDefinitions {
+		if job_definition.Name == name && job_definition.Revision == revision {
+			copied := *job_definition
+			return &copied
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStore) FindTimedoutJobs(ctx context.Context) ([]string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.FindTimedoutJobs")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	now := time.Now()
+	job_ids := make([]string, 0)
+	for _, job := range ms.jobs {
+		if job.Timeout == -1 || isFinalStatus(job.Status) || job.TerminationRequested {
+			continue
+		}
+		if job.CreatedAt.Add(time.Duration(job.Timeout) * time.Second).Before(now) {
+			job_ids = append(job_ids, job.Id)
+		}
+	}
+	return job_ids, nil
+}
+
+func (ms *memoryStore) GetStatus(ctx context.Context, jobid string) (*JobStatus, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.GetStatus")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	job, ok := ms.jobs[jobid]
+	if !ok {
+		return nil, nil
+	}
+	return &JobStatus{Id: job.Id, Status: job.Status}, nil
+}
+
+func (ms *memoryStore) GetStatusHistory(ctx context.Context, jobid string) ([]*JobStatusChange, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.GetStatusHistory")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return ms.copyStatusHistory(jobid), nil
+}
+
+// copyStatusHistory must be called while holding ms.lock.
+func (ms *memoryStore) copyStatusHistory(jobid string) []*JobStatusChange {
+	history := make([]*JobStatusChange, 0, len(ms.statusHistory[jobid]))
+	for _, change := range ms.statusHistory[jobid] {
+		change := change
+		history = append(history, &change)
+	}
+	fillStatusChangeDurations(history)
+	return history
+}
+
+// archivedJob must be called while holding ms.lock.
+func (ms *memoryStore) archivedJob(job *Job) *ArchivedJob {
+	archived_job := &ArchivedJob{
+		Job:           ms.jobWithInstanceInfo(job),
+		StatusHistory: ms.copyStatusHistory(job.Id),
+	}
+	archived_job.Job.Attempts = ms.copyAttempts(job.Id)
+	archived_job.Job.DependsOn = ms.copyDependencies(job.Id)
+	if archived_job.Job.InstanceID == nil {
+		return archived_job
+	}
+	if job.RunStartTime != nil {
+		run_ended_at := job.LastUpdated
+		if job.StoppedAt != nil {
+			run_ended_at = *job.StoppedAt
+		}
+		for _, event := range ms.instanceEventLog {
+			if event.instanceID == *archived_job.Job.InstanceID && !event.timestamp.Before(*job.RunStartTime) && !event.timestamp.After(run_ended_at) {
+				archived_job.InstanceEvents = append(archived_job.InstanceEvents, &ArchivedInstanceEvent{
+					Timestamp:  event.timestamp,
+					InstanceID: event.instanceID,
+					ActiveJobs: append([]string(nil), event.activeJobs...),
+				})
+			}
+		}
+	}
+	instance, ok := ms.instances[*archived_job.Job.InstanceID]
+	if !ok {
+		return archived_job
+	}
+	archived_job.Instance = &ArchivedInstance{
+		InstanceID:            *archived_job.Job.InstanceID,
+		AppearedAt:            instance.appearedAt,
+		DisappearedAt:         instance.disappearedAt,
+		LaunchedAt:            instance.info.LaunchedAt,
+		AMI:                   instance.info.AMI,
+		InstanceType:          instance.info.InstanceType,
+		ComputeEnvironmentARN: instance.info.ComputeEnvironmentARN,
+		ECSClusterARN:         instance.info.ECSClusterARN,
+		AvailabilityZone:      instance.info.AvailabilityZone,
+		SpotInstanceRequestID: instance.info.SpotInstanceRequestID,
+		PrivateIP:             instance.info.PrivateIP,
+		PublicIP:              instance.info.PublicIP,
+	}
+	return archived_job
+}
+
+// rollupJobStats adds (sign 1) or removes (sign -1) the usage of a finished
+// job to jobStatsRollup, like the job_stats_rollup triggers. Callers hold the
+// lock.
+func (ms *memoryStore) rollupJobStats(job *Job, sign int) {
+	if job.StoppedAt == nil || job.RunStartTime == nil {
+		return
+	}
+	key := memoryJobStatsKey{
+		bucket:   job.RunStartTime.Unix() / JobStatsRollupInterval * JobStatsRollupInterval,
+		jobQueue: job.JobQueue,
+		status:   job.Status,
+	}
+	stats, ok := ms.jobStatsRollup[key]
+	if !ok {
+		stats = &JobStats{JobQueue: key.jobQueue, Status: key.status}
+		ms.jobStatsRollup[key] = stats
+	}
+	duration := job.StoppedAt.Sub(*job.RunStartTime).Seconds()
+	stats.VCPUSeconds += float64(sign) * float64(job.VCpus) * duration
+	stats.MemorySeconds += float64(sign) * float64(job.Memory) * duration
+	stats.InstanceSeconds += float64(sign) * duration
+	stats.JobCount += sign
+}
+
+func (ms *memoryStore) JobStats(ctx context.Context, opts *JobStatsOptions) ([]*JobStats, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.JobStats")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	type bucketKey struct {
+		jobQueue  string
+		status    string
+		timestamp float64
+	}
+
+	buckets := make(map[bucketKey]*JobStats)
+
+	for key, rollup := range ms.jobStatsRollup {
+		if key.bucket < opts.Start || key.bucket >= opts.End {
+			continue
+		}
+		if len(opts.Status) > 0 && !containsString(opts.Status, key.status) {
+			continue
+		}
+		if len(opts.Queues) > 0 && !containsString(opts.Queues, key.jobQueue) {
+			continue
+		}
+
+		bucket_key := bucketKey{
+			jobQueue:  key.jobQueue,
+			status:    key.status,
+			timestamp: math.Floor(float64(key.bucket)/float64(opts.Interval)) * float64(opts.Interval),
+		}
+		stats, ok := buckets[bucket_key]
+		if !ok {
+			stats = &JobStats{
+				JobQueue:  bucket_key.jobQueue,
+				Status:    bucket_key.status,
+				Timestamp: bucket_key.timestamp,
+				Interval:  opts.Interval,
+			}
+			buckets[bucket_key] = stats
+		}
+
+		stats.VCPUSeconds += rollup.VCPUSeconds
+		stats.MemorySeconds += rollup.MemorySeconds
+		stats.InstanceSeconds += rollup.InstanceSeconds
+		stats.JobCount += rollup.JobCount
+	}
+
+	allJobStats := make([]*JobStats, 0, len(buckets))
+	for _, stats := range buckets {
+		if stats.JobCount <= 0 {
+			continue
+		}
+		stats.VCPUSeconds = math.Max(stats.VCPUSeconds, 0)
+		stats.MemorySeconds = math.Max(stats.MemorySeconds, 0)
+		stats.InstanceSeconds = math.Max(stats.InstanceSeconds, 0)
+		allJobStats = append(allJobStats, stats)
+	}
+
+	// Same ordering as the SQL query: ORDER BY 1 ASC, 2 ASC, 3 DESC, 4 DESC, 5 DESC
+	sort.Slice(allJobStats, func(i, j int) bool {
+		a, b := allJobStats[i], allJobStats[j]
+		if a.JobQueue != b.JobQueue {
+			return a.JobQueue < b.JobQueue
+		}
+		if a.Status != b.Status {
+			return a.Status < b.Status
+		}
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp > b.Timestamp
+		}
+		if a.VCPUSeconds != b.VCPUSeconds {
+			return a.VCPUSeconds > b.VCPUSeconds
+		}
+		return a.MemorySeconds > b.MemorySeconds
+	})
+
+	return allJobStats, nil
+}
+
+func (ms *memoryStore) Store(ctx context.Context, jobs []*Job, source StatusChangeSource) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.Store")
+	defer span.Finish()
+
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	changed_job_ids := make([]string, 0)
+	inserts_and_updates := 0
+
+	ms.lock.Lock()
+	for _, job := range jobs {
+		existing, ok := ms.jobs[job.Id]
+		if !ok {
+			inserted := *job
+			inserted.TerminationRequested = false
+			inserted.InstanceID = nil
+			inserted.PublicIP = nil
+			inserted.PrivateIP = nil
+			inserted.Attempts = nil
+			inserted.DependsOn = nil
+			inserted.Nodes = nil
+			ms.jobs[job.Id] = &inserted
+			ms.rollupJobStats(&inserted, 1)
+			ms.storeAttempts(job)
+			ms.storeDependencies(job)
+			ms.recordStatusChange(job.Id, nil, job.Status, source)
+			changed_job_ids = append(changed_job_ids, job.Id)
+			inserts_and_updates++
+			continue
+		}
+
+		ms.storeAttempts(job)
+		ms.storeDependencies(job)
+
+		should_update := existing.Status != job.Status ||
+			pointerValueChanged(existing.StatusReason, job.StatusReason) ||
+			pointerValueChanged(existing.ExitCode, job.ExitCode) ||
+			pointerValueChanged(existing.LogStreamName, job.LogStreamName) ||
+			pointerValueChanged(existing.TaskARN, job.TaskARN) ||
+			(job.ArrayProperties != nil && existing.ArrayProperties == nil)
+		if !should_update {
+			continue
+		}
+
+		if existing.Status != job.Status {
+			old_status := existing.Status
+			ms.recordStatusChange(job.Id, &old_status, job.Status, source)
+			changed_job_ids = append(changed_job_ids, job.Id)
+		}
+		ms.rollupJobStats(existing, -1)
+		existing.Status = job.Status
+		existing.LastUpdated = job.LastUpdated
+		if job.StoppedAt != nil {
+			existing.StoppedAt = job.StoppedAt
+		}
+		existing.StatusReason = job.StatusReason
+		existing.RunStartTime = job.RunStartTime
+		ms.rollupJobStats(existing, 1)
+		existing.ExitCode = job.ExitCode
+		existing.LogStreamName = job.LogStreamName
+		existing.TaskARN = job.TaskARN
+		existing.ArrayProperties = job.ArrayProperties
+		if job.NodeProperties != nil {
+			existing.NodeProperties = job.NodeProperties
+		}
+		inserts_and_updates++
+	}
+	ms.lock.Unlock()
+
+	log.Info(fmt.Sprintf("Inserted/updated %d jobs in memory", inserts_and_updates))
+	ms.notifySubscribers(changed_job_ids)
+	return nil
+}
+
+func (ms *memoryStore) FindSyncStates(ctx context.Context, job_ids []string) (map[string]*JobSyncState, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.FindSyncStates")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	states := make(map[string]*JobSyncState)
+	for _, job_id := range job_ids {
+		if job, ok := ms.jobs[job_id]; ok {
+			states[job_id] = &JobSyncState{Status: job.Status, StatusReason: job.StatusReason}
+		}
+	}
+	return states, nil
+}
+
+func (ms *memoryStore) StaleOldJobs(ctx context.Context, job_ids map[string]bool) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.StaleOldJobs")
+	defer span.Finish()
+
+	changed_job_ids := make([]string, 0)
+	cutoff := time.Now().Add(-300 * time.Second)
+
+	ms.lock.Lock()
+	for job_id, job := range ms.jobs {
+		if isFinalStatus(job.Status) || job_ids[job_id] || !job.LastUpdated.Before(cutoff) {
+			continue
+		}
+		old_status := job.Status
+		ms.recordStatusChange(job_id, &old_status, StatusGone, StatusChangeFromStale)
+		ms.rollupJobStats(job, -1)
+		job.Status = StatusGone
+		ms.rollupJobStats(job, 1)
+		changed_job_ids = append(changed_job_ids, job_id)
+	}
+	ms.lock.Unlock()
+
+	ms.notifySubscribers(changed_job_ids)
+	return nil
+}
+
+func (ms *memoryStore) EstimateRunningLoadByJobQueue(ctx context.Context, queues []string) (map[string]RunningLoad, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.EstimateRunningLoadByJobQueue")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	mapping := make(map[string]RunningLoad)
+	for _, queue := range queues {
+		mapping[queue] = RunningLoad{WantedVCpus: 0, WantedMemory: 0}
+	}
+
+	for _, job := range ms.jobs {
+		switch job.Status {
+		case StatusSubmitted, StatusPending, StatusRunnable, StatusStarting, StatusRunning:
+			load := mapping[job.JobQueue]
+			load.WantedVCpus += job.VCpus
+			load.WantedMemory += job.Memory
+			mapping[job.JobQueue] = load
+		}
+	}
+
+	return mapping, nil
+}
+
+func (ms *memoryStore) UpdateComputeEnvironmentsLog(ctx context.Context, ce_lst []ComputeEnvironment) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.UpdateComputeEnvironmentsLog")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, ce := range ce_lst {
+		ok_to_insert := true
+		for i := len(ms.computeEnvironmentEventLog) - 1; i >= 0; i-- {
+			if ms.computeEnvironmentEventLog[i].ce.Name == ce.Name {
+				ok_to_insert = ms.computeEnvironmentEventLog[i].ce != ce
+				break
+			}
+		}
+		if ok_to_insert {
+			log.Info("Updating compute environment ", ce.Name)
+			ms.computeEnvironmentEventLog = append(ms.computeEnvironmentEventLog, memoryComputeEnvironmentEvent{
+				timestamp: time.Now(),
+				ce:        ce,
+			})
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStore) UpdateJobSummaryLog(ctx context.Context, job_summaries []JobSummary) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.UpdateJobSummaryLog")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, job_summary := range job_summaries {
+		ok_to_insert := true
+		for i := len(ms.jobSummaryEventLog) - 1; i >= 0; i-- {
+			if ms.jobSummaryEventLog[i].summary.JobQueue == job_summary.JobQueue {
+				ok_to_insert = ms.jobSummaryEventLog[i].summary != job_summary
+				break
+			}
+		}
+		if ok_to_insert {
+			ms.jobSummaryEventLog = append(ms.jobSummaryEventLog, memoryJobSummaryEvent{
+				timestamp: time.Now(),
+				summary:   job_summary,
+			})
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStore) UpdateJobLogTerminationRequested(ctx context.Context, jobID string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.UpdateJobLogTerminationRequested")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if job, ok := ms.jobs[jobID]; ok {
+		job.TerminationRequested = true
+	}
+	return nil
+}
+
+func (ms *memoryStore) UpdateTaskArnsInstanceIDs(ctx context.Context, ec2info map[string]Ec2Info, task_ec2_mapping map[string]string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.UpdateTaskArnsInstanceIDs")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for task_arn, ec2instance := range task_ec2_mapping {
+		ec2_info, ok := ec2info[ec2instance]
+		if !ok {
+			continue
+		}
+		if _, exists := ms.taskArns[task_arn]; exists {
+			continue
+		}
+		ms.taskArns[task_arn] = memoryTaskArnInfo{
+			instanceID: ec2instance,
+			publicIP:   ec2_info.PublicIP,
+			privateIP:  ec2_info.PrivateIP,
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStore) UpdateECSInstances(ctx context.Context, ec2info map[string]Ec2Info, tasks_per_ec2instance map[string][]string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.UpdateECSInstances")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	now := time.Now()
+
+	for instance_id, instance_info := range ec2info {
+		instance, ok := ms.instances[instance_id]
+		if !ok {
+			ms.instances[instance_id] = &memoryInstance{
+				info:       instance_info,
+				appearedAt: now,
+			}
+			continue
+		}
+		instance.info = instance_info
+		instance.disappearedAt = nil
+	}
+
+	for instance_id, tasks := range tasks_per_ec2instance {
+		ms.instanceEventLog = append(ms.instanceEventLog, memoryInstanceEvent{
+			timestamp:  now,
+			instanceID: instance_id,
+			activeJobs: tasks,
+		})
+	}
+
+	for instance_id, instance := range ms.instances {
+		if _, ok := ec2info[instance_id]; !ok && instance.disappearedAt == nil {
+			disappeared_at := now
+			instance.disappearedAt = &disappeared_at
+		}
+	}
+
+	return nil
+}
+
+func (ms *memoryStore) GetAliveEC2Instances(ctx context.Context) ([]string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.GetAliveEC2Instances")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	instances := make([]string, 0)
+	for instance_id, instance := range ms.instances {
+		if instance.disappearedAt == nil {
+			instances = append(instances, instance_id)
+		}
+	}
+	return instances, nil
+}
+
+func (ms *memoryStore) GetStartingStateStuckEC2Instances(ctx context.Context) ([]string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.GetStartingStateStuckEC2Instances")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	cutoff := time.Now().Add(-600 * time.Second)
+	instances_set := make(map[string]bool)
+	for _, job := range ms.jobs {
+		if job.Status != StatusStarting || job.TaskARN == nil || !job.LastUpdated.Before(cutoff) {
+			continue
+		}
+		if info, ok := ms.taskArns[*job.TaskARN]; ok {
+			instances_set[info.instanceID] = true
+		}
+	}
+
+	instances := make([]string, 0, len(instances_set))
+	for instance_id := range instances_set {
+		instances = append(instances, instance_id)
+	}
+	return instances, nil
+}
+
+func (ms *memoryStore) SubscribeToJobStatus(jobID string) (<-chan Job, func()) {
+	span := opentracing.StartSpan("Memory.SubscribeToJobStatus")
+	defer span.Finish()
+
+	return ms.subscriptions.subscribe(jobID)
+}
+
+func (ms *memoryStore) Close() error {
+	return nil
+}
+
+func (ms *memoryStore) Ping(ctx context.Context) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.Ping")
+	defer span.Finish()
+
+	return nil
+}
+
+func (ms *memoryStore) ListActiveJobQueues(ctx context.Context) ([]string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.ListActiveJobQueues")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	job_queue_names := make([]string, 0, len(ms.activatedJobQueues))
+	for job_queue := range ms.activatedJobQueues {
+		job_queue_names = append(job_queue_names, job_queue)
+	}
+	sort.Strings(job_queue_names)
+	return job_queue_names, nil
+}
+
+func (ms *memoryStore) ListForcedScalingJobQueues(ctx context.Context) ([]string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.ListForcedScalingJobQueues")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	job_queue_names := make([]string, 0)
+	for job_queue, forced_scaling := range ms.activatedJobQueues {
+		if forced_scaling {
+			job_queue_names = append(job_queue_names, job_queue)
+		}
+	}
+	sort.Strings(job_queue_names)
+	return job_queue_names, nil
+}
+
+func (ms *memoryStore) ActivateJobQueue(ctx context.Context, job_queue_name string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.ActivateJobQueue")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if _, ok := ms.activatedJobQueues[job_queue_name]; !ok {
+		ms.activatedJobQueues[job_queue_name] = false
+	}
+	return nil
+}
+
+func (ms *memoryStore) DeactivateJobQueue(ctx context.Context, job_queue_name string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.DeactivateJobQueue")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.activatedJobQueues, job_queue_name)
+	return nil
+}
+
+// retentionCutoff returns the time before which things should be cleaned, or
+// nil if they should be kept forever.
+func retentionCutoff(days int) *time.Time {
+	if days <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	return &cutoff
+}
+
+func (ms *memoryStore) CleanOldJobs(ctx context.Context, policy *RetentionPolicy) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.CleanOldJobs")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	restored_cutoff := retentionCutoff(policy.RestoredJobDays)
+	old_jobs := make([]*Job, 0)
+	for _, job := range ms.jobs {
+		if restored_at, ok := ms.restoredAt[job.Id]; ok && (restored_cutoff == nil || !restored_at.Before(*restored_cutoff)) {
+			continue
+		}
+		days, ok := policy.JobQueueDays[job.JobQueue]
+		if !ok {
+			days = policy.JobDays
+		}
+		cutoff := retentionCutoff(days)
+		if cutoff != nil && job.LastUpdated.Before(*cutoff) {
+			old_jobs = append(old_jobs, job)
+		}
+	}
+	if len(old_jobs) == 0 {
+		return nil
+	}
+
+	if policy.Archiver != nil {
+		archived_jobs := make([]*ArchivedJob, 0, len(old_jobs))
+		for _, job := range old_jobs {
+			archived_jobs = append(archived_jobs, ms.archivedJob(job))
+		}
+		if err := policy.Archiver.Archive(archived_jobs); err != nil {
+			return err
+		}
+	}
+
+	for _, job := range old_jobs {
+		if job.TaskARN != nil {
+			delete(ms.taskArns, *job.TaskARN)
+		}
+		delete(ms.statusHistory, job.Id)
+		delete(ms.attempts, job.Id)
+		delete(ms.dependencies, job.Id)
+		delete(ms.restoredAt, job.Id)
+		delete(ms.jobs, job.Id)
+	}
+	return nil
+}
+
+func (ms *memoryStore) Restore(ctx context.Context, archived_jobs []*ArchivedJob) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.Restore")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, archived_job := range archived_jobs {
+		job := *archived_job.Job
+		if _, ok := ms.jobs[job.Id]; ok {
+			continue
+		}
+		if job.TaskARN != nil && job.InstanceID != nil {
+			ms.taskArns[*job.TaskARN] = memoryTaskArnInfo{
+				instanceID: *job.InstanceID,
+				publicIP:   job.PublicIP,
+				privateIP:  job.PrivateIP,
+			}
+		}
+		ms.storeAttempts(&job)
+		ms.storeDependencies(&job)
+		job.InstanceID = nil
+		job.PublicIP = nil
+		job.PrivateIP = nil
+		job.Attempts = nil
+		job.DependsOn = nil
+		job.Nodes = nil
+		ms.jobs[job.Id] = &job
+		restored_at := time.Now()
+		ms.restoredAt[job.Id] = restored_at
+		ms.restoreInstanceEvents(archived_job.InstanceEvents, restored_at)
+
+		history := make([]JobStatusChange, 0, len(archived_job.StatusHistory))
+		for _, change := range archived_job.StatusHistory {
+			change := *change
+			change.Duration = nil
+			history = append(history, change)
+		}
+		ms.statusHistory[job.Id] = history
+
+		instance := archived_job.Instance
+		if instance == nil {
+			continue
+		}
+		if _, ok := ms.instances[instance.InstanceID]; !ok {
+			ms.instances[instance.InstanceID] = &memoryInstance{
+				info: Ec2Info{
+					PrivateIP:             instance.PrivateIP,
+					PublicIP:              instance.PublicIP,
+					AMI:                   instance.AMI,
+					ComputeEnvironmentARN: instance.ComputeEnvironmentARN,
+					ECSClusterARN:         instance.ECSClusterARN,
+					AvailabilityZone:      instance.AvailabilityZone,
+					SpotInstanceRequestID: instance.SpotInstanceRequestID,
+					InstanceType:          instance.InstanceType,
+					LaunchedAt:            instance.LaunchedAt,
+				},
+				appearedAt:    instance.AppearedAt,
+				disappearedAt: instance.DisappearedAt,
+			}
+		}
+	}
+	return nil
+}
+
+// restoreInstanceEvents puts back the archived instance events that are
+// missing. Must be called while holding ms.lock.
+func (ms *memoryStore) restoreInstanceEvents(events []*ArchivedInstanceEvent, restored_at time.Time) {
+	for _, archived_event := range events {
+		found := false
+		for _, event := range ms.instanceEventLog {
+			if event.instanceID == archived_event.InstanceID && event.timestamp.Equal(archived_event.Timestamp) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		ms.instanceEventLog = append(ms.instanceEventLog, memoryInstanceEvent{
+			timestamp:  archived_event.Timestamp,
+			instanceID: archived_event.InstanceID,
+			activeJobs: append([]string(nil), archived_event.ActiveJobs...),
+			restoredAt: &restored_at,
+		})
+	}
+}
+
+func (ms *memoryStore) CleanOldInstanceEventLogs(ctx context.Context, policy *RetentionPolicy) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.CleanOldInstanceEventLogs")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	cutoff := retentionCutoff(policy.InstanceEventLogDays)
+	if cutoff == nil {
+		return nil
+	}
+	kept := make([]memoryInstanceEvent, 0, len(ms.instanceEventLog))
+	for _, event := range ms.instanceEventLog {
+		aged_from := event.timestamp
+		if event.restoredAt != nil {
+			aged_from = *event.restoredAt
+		}
+		if !aged_from.Before(*cutoff) {
+			kept = append(kept, event)
+		}
+	}
+	ms.instanceEventLog = kept
+	return nil
+}
+
+func (ms *memoryStore) CleanOldJobSummaryEventLogs(ctx context.Context, policy *RetentionPolicy) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.CleanOldJobSummaryEventLogs")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	cutoff := retentionCutoff(policy.JobSummaryEventLogDays)
+	if cutoff == nil {
+		return nil
+	}
+	kept := make([]memoryJobSummaryEvent, 0, len(ms.jobSummaryEventLog))
+	for _, event := range ms.jobSummaryEventLog {
+		if !event.timestamp.Before(*cutoff) {
+			kept = append(kept, event)
+		}
+	}
+	ms.jobSummaryEventLog = kept
+	return nil
+}
+
+func (ms *memoryStore) CleanOldComputeEnvironmentEventLogs(ctx context.Context, policy *RetentionPolicy) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.CleanOldComputeEnvironmentEventLogs")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	cutoff := retentionCutoff(policy.ComputeEnvironmentEventLogDays)
+	if cutoff == nil {
+		return nil
+	}
+	kept := make([]memoryComputeEnvironmentEvent, 0, len(ms.computeEnvironmentEventLog))
+	for _, event := range ms.computeEnvironmentEventLog {
+		if !event.timestamp.Before(*cutoff) {
+			kept = append(kept, event)
+		}
+	}
+	ms.computeEnvironmentEventLog = kept
+	return nil
+}
+
+func (ms *memoryStore) CleanOldInstances(ctx context.Context, policy *RetentionPolicy) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Memory.CleanOldInstances")
+	defer span.Finish()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	cutoff := retentionCutoff(policy.InstanceDays)
+	if cutoff == nil {
+		return nil
+	}
+	for instance_id, instance := range ms.instances {
+		if instance.disappearedAt != nil && instance.disappearedAt.Before(*cutoff) {
+			delete(ms.instances, instance_id)
+		}
+	}
+	return nil
+}
+
+// CreatePartitions does nothing; the memory store is not partitioned.
+func (ms *memoryStore) CreatePartitions(ctx context.Context) error {
+	return nil
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{
+		jobs:               make(map[string]*Job),
+		activatedJobQueues: make(map[string]bool),
+		taskArns:           make(map[string]memoryTaskArnInfo),
+		instances:          make(map[string]*memoryInstance),
+		statusHistory:      make(map[string][]JobStatusChange),
+		attempts:           make(map[string][]JobAttempt),
+		dependencies:       make(map[string][]JobDependency),
+		jobDefinitions:     make(map[string]*JobDefinition),
+		jobStatsRollup:     make(map[memoryJobStatsKey]*JobStats),
+		restoredAt:         make(map[string]time.Time),
+		subscriptions:      newJobStatusSubscriptions(),
+	}
+}
@@ -0,0 +1,552 @@
+package jobs_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/batchiepatchie/jobs"
+)
+
+func newTestJob(id string, status string) *jobs.Job {
+	now := time.Now()
+	reason := ""
+	return &jobs.Job{
+		Id:           id,
+		Name:         "job-" + id,
+		Status:       status,
+		Description:  "arn:aws:batch:us-west-2:123456789012:job-definition/test:1",
+		LastUpdated:  now,
+		JobQueue:     "test-queue",
+		Image:        "repo/image:latest",
+		CreatedAt:    now,
+		Timeout:      -1,
+		CommandLine:  "[]",
+		StatusReason: &reason,
+	}
+}
+
+func TestMemoryStoreStoreAndFind(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	if err := store.Store(context.Background(), []*jobs.Job{newTestJob("a", jobs.StatusRunning), newTestJob("b", jobs.StatusFailed)}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := store.FindOne(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != jobs.StatusRunning {
+		t.Errorf("Expected RUNNING status, got %s", job.Status)
+	}
+
+	if _, err := store.FindOne(context.Background(), "missing"); err == nil {
+		t.Errorf("Expected an error when finding a job that does not exist")
+	}
+
+	found, err := store.Find(context.Background(), &jobs.Options{Limit: 100, Status: []string{jobs.StatusFailed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Id != "b" {
+		t.Errorf("Expected to find only job b, got %v", found)
+	}
+
+	search, err := jobs.ParseSearch("JOB-A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err = store.Find(context.Background(), &jobs.Options{Limit: 100, Search: search, SortBy: "id", SortAsc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Id != "a" {
+		t.Errorf("Expected case-insensitive search to find job a, got %v", found)
+	}
+
+	found, err = store.Find(context.Background(), &jobs.Options{Limit: 1, Offset: 1, SortBy: "id", SortAsc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Id != "b" {
+		t.Errorf("Expected second page to contain job b, got %v", found)
+	}
+}
+
+func TestMemoryStoreSubscriptions(t *testing.T) {
+	store := jobs.NewMemoryStore()
+	if err := store.Store(context.Background(), []*jobs.Job{newTestJob("a", jobs.StatusRunnable)}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	events, unsubscribe := store.SubscribeToJobStatus("a")
+	defer unsubscribe()
+
+	// Storing the same status again is not a status change.
+	if err := store.Store(context.Background(), []*jobs.Job{newTestJob("a", jobs.StatusRunnable)}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case job := <-events:
+		t.Errorf("Did not expect a notification, got %v", job)
+	default:
+	}
+
+	if err := store.Store(context.Background(), []*jobs.Job{newTestJob("a", jobs.StatusRunning)}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case job := <-events:
+		if job.Status != jobs.StatusRunning {
+			t.Errorf("Expected RUNNING notification, got %s", job.Status)
+		}
+	default:
+		t.Errorf("Expected a notification on status change")
+	}
+}
+
+func TestMemoryStoreStaleOldJobs(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	old := newTestJob("old", jobs.StatusRunning)
+	old.LastUpdated = time.Now().Add(-time.Hour)
+	known := newTestJob("known", jobs.StatusRunning)
+	known.LastUpdated = time.Now().Add(-time.Hour)
+	finished := newTestJob("finished", jobs.StatusSucceeded)
+	finished.LastUpdated = time.Now().Add(-time.Hour)
+	if err := store.Store(context.Background(), []*jobs.Job{old, known, finished}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.StaleOldJobs(context.Background(), map[string]bool{"known": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"old": jobs.StatusGone, "known": jobs.StatusRunning, "finished": jobs.StatusSucceeded}
+	for job_id, status := range expected {
+		job_status, err := store.GetStatus(context.Background(), job_id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job_status.Status != status {
+			t.Errorf("Expected %s to be %s, got %s", job_id, status, job_status.Status)
+		}
+	}
+}
+
+func TestMemoryStoreFindTimedoutJobs(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	timed_out := newTestJob("timed_out", jobs.StatusRunning)
+	timed_out.CreatedAt = time.Now().Add(-time.Hour)
+	timed_out.Timeout = 60
+	not_yet := newTestJob("not_yet", jobs.StatusRunning)
+	not_yet.Timeout = 3600
+	if err := store.Store(context.Background(), []*jobs.Job{timed_out, not_yet, newTestJob("no_timeout", jobs.StatusRunning)}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	job_ids, err := store.FindTimedoutJobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(job_ids) != 1 || job_ids[0] != "timed_out" {
+		t.Errorf("Expected only timed_out to have timed out, got %v", job_ids)
+	}
+
+	if err := store.UpdateJobLogTerminationRequested(context.Background(), "timed_out"); err != nil {
+		t.Fatal(err)
+	}
+	job_ids, err = store.FindTimedoutJobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(job_ids) != 0 {
+		t.Errorf("Expected no timed out jobs after termination was requested, got %v", job_ids)
+	}
+}
+
+func TestMemoryStoreJobStats(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	bucket := time.Unix(1700000000-1700000000%3600, 0)
+	for _, id := range []string{"a", "b"} {
+		job := newTestJob(id, jobs.StatusSucceeded)
+		job.VCpus = 2
+		job.Memory = 1000
+		started := bucket.Add(time.Minute)
+		stopped := started.Add(10 * time.Second)
+		job.RunStartTime = &started
+		job.StoppedAt = &stopped
+		job.LastUpdated = time.Now().Add(-10 * 24 * time.Hour)
+		if err := store.Store(context.Background(), []*jobs.Job{job}, jobs.StatusChangeFromSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Stats are kept after the jobs themselves are cleaned up
+	if err := store.CleanOldJobs(context.Background(), &jobs.RetentionPolicy{JobDays: 7, BatchSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.JobStats(context.Background(), &jobs.JobStatsOptions{
+		Interval: 3600,
+		Start:    bucket.Unix(),
+		End:      bucket.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("Expected a single bucket, got %d", len(stats))
+	}
+	if stats[0].Timestamp != float64(bucket.Unix()) || stats[0].JobCount != 2 || stats[0].VCPUSeconds != 40 || stats[0].InstanceSeconds != 20 {
+		t.Errorf("Unexpected job stats: %+v", stats[0])
+	}
+}
+
+func TestMemoryStoreCleanOldJobs(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	old := newTestJob("old", jobs.StatusSucceeded)
+	old.LastUpdated = time.Now().Add(-10 * 24 * time.Hour)
+	kept := newTestJob("kept", jobs.StatusSucceeded)
+	kept.LastUpdated = time.Now().Add(-10 * 24 * time.Hour)
+	kept.JobQueue = "important-queue"
+	if err := store.Store(context.Background(), []*jobs.Job{old, kept}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &jobs.RetentionPolicy{
+		JobDays:      7,
+		JobQueueDays: map[string]int{"important-queue": 0},
+		BatchSize:    1,
+	}
+	if err := store.CleanOldJobs(context.Background(), policy); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.FindOne(context.Background(), "old"); err == nil {
+		t.Errorf("Expected old job to be cleaned")
+	}
+	if _, err := store.FindOne(context.Background(), "kept"); err != nil {
+		t.Errorf("Expected job in a queue with no retention limit to be kept, got %v", err)
+	}
+}
+
+func TestMemoryStoreArchiveAndRestore(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	old := newTestJob("old", jobs.StatusSucceeded)
+	old.LastUpdated = time.Now().Add(-10 * 24 * time.Hour)
+	if err := store.Store(context.Background(), []*jobs.Job{old}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	policy := &jobs.RetentionPolicy{JobDays: 7, BatchSize: 100, Archiver: jobs.NewArchiver(dir)}
+	if err := store.CleanOldJobs(context.Background(), policy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FindOne(context.Background(), "old"); err == nil {
+		t.Fatalf("Expected old job to be cleaned")
+	}
+
+	archives, err := filepath.Glob(filepath.Join(dir, "dt=*", "queue=test-queue", "*.ndjson.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 1 {
+		t.Fatalf("Expected one archive file, got %v", archives)
+	}
+	data, err := os.ReadFile(archives[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived_jobs, err := jobs.DecodeArchive(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived_jobs) != 1 || archived_jobs[0].Job.Id != "old" || len(archived_jobs[0].StatusHistory) != 1 {
+		t.Fatalf("Unexpected archive contents: %+v", archived_jobs)
+	}
+
+	if err := store.Restore(context.Background(), archived_jobs); err != nil {
+		t.Fatal(err)
+	}
+	job, err := store.FindOne(context.Background(), "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != jobs.StatusSucceeded {
+		t.Errorf("Expected restored job to be SUCCEEDED, got %s", job.Status)
+	}
+	history, err := store.GetStatusHistory(context.Background(), "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("Expected restored status history, got %v", history)
+	}
+
+	policy.RestoredJobDays = 30
+	if err := store.CleanOldJobs(context.Background(), policy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FindOne(context.Background(), "old"); err != nil {
+		t.Errorf("Expected restored job to be kept, got %v", err)
+	}
+}
+
+// keptArchives is an archiver that keeps the archived jobs in memory.
+type keptArchives struct {
+	jobs []*jobs.ArchivedJob
+}
+
+func (k *keptArchives) Archive(archived_jobs []*jobs.ArchivedJob) error {
+	k.jobs = append(k.jobs, archived_jobs...)
+	return nil
+}
+
+func TestMemoryStoreArchiveInstanceEvents(t *testing.T) {
+	store := jobs.NewMemoryStore()
+	ctx := context.Background()
+
+	ec2info := map[string]jobs.Ec2Info{"i-123": {InstanceType: "m5.large"}}
+	if err := store.UpdateTaskArnsInstanceIDs(ctx, ec2info, map[string]string{"task-1": "i-123"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateECSInstances(ctx, ec2info, map[string][]string{"i-123": {"task-1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The run of the job covers the event logged above, while its last
+	// update makes it old enough to clean.
+	old := newTestJob("old", jobs.StatusSucceeded)
+	task_arn := "task-1"
+	run_started_at := time.Now().Add(-time.Hour)
+	stopped_at := time.Now().Add(time.Hour)
+	old.TaskARN = &task_arn
+	old.RunStartTime = &run_started_at
+	old.StoppedAt = &stopped_at
+	old.LastUpdated = time.Now().Add(-10 * 24 * time.Hour)
+	if err := store.Store(ctx, []*jobs.Job{old}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	archiver := &keptArchives{}
+	if err := store.CleanOldJobs(ctx, &jobs.RetentionPolicy{JobDays: 7, BatchSize: 100, Archiver: archiver}); err != nil {
+		t.Fatal(err)
+	}
+	if len(archiver.jobs) != 1 {
+		t.Fatalf("Expected one archived job, got %d", len(archiver.jobs))
+	}
+	events := archiver.jobs[0].InstanceEvents
+	if len(events) != 1 || events[0].InstanceID != "i-123" || len(events[0].ActiveJobs) != 1 || events[0].ActiveJobs[0] != "task-1" {
+		t.Fatalf("Unexpected archived instance events: %+v", events)
+	}
+
+	if err := store.Restore(ctx, archiver.jobs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStoreFindWithCursor(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	stopped_at := time.Now().Add(-time.Minute)
+	all_jobs := make([]*jobs.Job, 0)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		job := newTestJob(id, jobs.StatusSucceeded)
+		// Some jobs share a stopped_at and some have none at all, so
+		// the job ID has to break ties.
+		if id != "c" && id != "e" {
+			job.StoppedAt = &stopped_at
+		}
+		all_jobs = append(all_jobs, job)
+	}
+	if err := store.Store(context.Background(), all_jobs, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sort_asc := range []bool{true, false} {
+		seen := make([]string, 0)
+		var cursor *jobs.Cursor
+		for {
+			found, err := store.Find(context.Background(), &jobs.Options{Limit: 2, SortBy: "stopped_at", SortAsc: sort_asc, Cursor: cursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, job := range found {
+				seen = append(seen, job.Id)
+			}
+			if len(found) < 2 {
+				break
+			}
+			cursor, err = jobs.DecodeCursor(jobs.NewCursor(found[len(found)-1], "stopped_at", sort_asc).Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected := []string{"a", "b", "d", "c", "e"}
+		if !sort_asc {
+			expected = []string{"e", "c", "d", "b", "a"}
+		}
+		if strings.Join(seen, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected pages to contain %v in order, got %v", expected, seen)
+		}
+	}
+}
+
+func TestMemoryStoreAttempts(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	exit_code := int64(1)
+	first_stream := "first"
+	job := newTestJob("a", jobs.StatusRunnable)
+	job.Attempts = []*jobs.JobAttempt{{Attempt: 0, ExitCode: &exit_code, LogStreamName: &first_stream}}
+	if err := store.Store(context.Background(), []*jobs.Job{job}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	second_stream := "second"
+	job = newTestJob("a", jobs.StatusRunning)
+	job.Attempts = []*jobs.JobAttempt{
+		{Attempt: 0, ExitCode: &exit_code, LogStreamName: &first_stream},
+		{Attempt: 1, LogStreamName: &second_stream},
+	}
+	if err := store.Store(context.Background(), []*jobs.Job{job}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := store.FindOne(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found.Attempts) != 2 || *found.Attempts[0].ExitCode != 1 || *found.Attempts[1].LogStreamName != "second" || found.Attempts[1].JobId != "a" {
+		t.Errorf("Unexpected attempts: %+v", found.Attempts)
+	}
+}
+
+func TestMemoryStoreJobGraph(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	// a and b both failed but b only failed because a did. c is waiting on
+	// b and on x, which we have never seen. d is waiting on c.
+	a := newTestJob("a", jobs.StatusFailed)
+	b := newTestJob("b", jobs.StatusFailed)
+	b.DependsOn = []jobs.JobDependency{{JobId: "a"}}
+	c := newTestJob("c", jobs.StatusPending)
+	c.DependsOn = []jobs.JobDependency{{JobId: "b"}, {JobId: "x"}}
+	d := newTestJob("d", jobs.StatusPending)
+	d.DependsOn = []jobs.JobDependency{{JobId: "c"}}
+	if err := store.Store(context.Background(), []*jobs.Job{a, b, c, d}, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	graph, err := store.GetJobGraph(context.Background(), "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Nodes) != 5 || len(graph.Edges) != 4 {
+		t.Fatalf("Unexpected graph: %+v", graph)
+	}
+	if len(graph.BlockingJobs) != 1 || graph.BlockingJobs[0] != "a" {
+		t.Errorf("Expected a to be blocking, got %v", graph.BlockingJobs)
+	}
+	for _, node := range graph.Nodes {
+		if node.Known != (node.Id != "x") {
+			t.Errorf("Unexpected node: %+v", node)
+		}
+	}
+
+	graph, err = store.GetJobGraph(context.Background(), "missing")
+	if err != nil || graph != nil {
+		t.Errorf("Expected no graph for a missing job, got %v, %v", graph, err)
+	}
+}
+
+func TestMemoryStoreFindArrayChildren(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	stored := []*jobs.Job{newTestJob("p", jobs.StatusRunning)}
+	for i, status := range []string{jobs.StatusSucceeded, jobs.StatusFailed, jobs.StatusRunning, jobs.StatusFailed, jobs.StatusSucceeded} {
+		child := newTestJob("p:"+strconv.Itoa(i), status)
+		parent_job_id, index, ok := jobs.ParseArrayChildID(child.Id)
+		if !ok {
+			t.Fatalf("Cannot parse %s", child.Id)
+		}
+		child.ParentJobId = &parent_job_id
+		child.ArrayIndex = &index
+		stored = append(stored, child)
+	}
+	if err := store.Store(context.Background(), stored, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	after := int64(0)
+	children, err := store.FindArrayChildren(context.Background(), &jobs.ArrayChildrenOptions{
+		ParentJobId: "p",
+		Status:      []string{jobs.StatusSucceeded, jobs.StatusRunning},
+		AfterIndex:  &after,
+		Limit:       1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children.Children) != 1 || children.Children[0].Id != "p:2" {
+		t.Errorf("Unexpected children: %+v", children.Children)
+	}
+	if len(children.FailedIndexes) != 2 || children.FailedIndexes[0] != 1 || children.FailedIndexes[1] != 3 {
+		t.Errorf("Unexpected failed indexes: %v", children.FailedIndexes)
+	}
+
+	if _, _, ok := jobs.ParseArrayChildID("p#1"); ok {
+		t.Errorf("Expected p#1 not to be an array child")
+	}
+}
+
+func TestMemoryStoreMultiNodeJob(t *testing.T) {
+	store := jobs.NewMemoryStore()
+
+	parent := newTestJob("m", jobs.StatusRunning)
+	parent.NodeProperties = &jobs.NodeProperties{
+		MainNode: 0,
+		NumNodes: 4,
+		NodeRanges: []jobs.NodeRange{
+			{TargetNodes: "0", Image: "main"},
+			{TargetNodes: "1:", Image: "worker"},
+		},
+	}
+	stored := []*jobs.Job{parent}
+	for _, id := range []string{"m#1", "m#0"} {
+		node := newTestJob(id, jobs.StatusRunning)
+		parent_job_id, index, ok := jobs.ParseNodeJobID(id)
+		if !ok {
+			t.Fatalf("Cannot parse %s", id)
+		}
+		node.ParentJobId = &parent_job_id
+		node.NodeIndex = &index
+		stored = append(stored, node)
+	}
+	if err := store.Store(context.Background(), stored, jobs.StatusChangeFromSync); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := store.FindOne(context.Background(), "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found.Nodes) != 2 || found.Nodes[0].Id != "m#0" || found.Nodes[1].Id != "m#1" {
+		t.Errorf("Unexpected nodes: %+v", found.Nodes)
+	}
+	if node_range := found.NodeProperties.NodeRangeFor(3); node_range == nil || node_range.Image != "worker" {
+		t.Errorf("Expected node 3 to run worker, got %+v", node_range)
+	}
+}
@@ -1,6 +1,8 @@
 package jobs
 
 import (
+	"context"
+
 	"github.com/AdRoll/batchiepatchie/awsclients"
 	"github.com/aws/aws-sdk-go/service/batch"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -14,8 +16,8 @@ type arnInfo struct {
 	computeEnvironmentARN string
 }
 
-func MonitorECSClusters(fs Storer, queues []string) error {
-	span := opentracing.StartSpan("MonitorECSClusters")
+func MonitorECSClusters(ctx context.Context, fs Storer, queues []string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MonitorECSClusters")
 	defer span.Finish()
 
 	/* TODO: handle pagination in all these API calls. */
@@ -32,7 +34,7 @@ func MonitorECSClusters(fs Storer, queues []string) error {
 		JobQueues: job_queue_names,
 	}
 
-	job_queue_descs, err := awsclients.Batch.DescribeJobQueues(job_queues)
+	job_queue_descs, err := awsclients.Batch.DescribeJobQueuesWithContext(ctx, job_queues)
 	if err != nil {
 		log.Warning("Failed to describe job queues: ", err)
 		return err
@@ -59,7 +61,7 @@ func MonitorECSClusters(fs Storer, queues []string) error {
 		ComputeEnvironments: compute_environments_lst,
 	}
 
-	compute_environment_descs, err := awsclients.Batch.DescribeComputeEnvironments(compute_environments_input)
+	compute_environment_descs, err := awsclients.Batch.DescribeComputeEnvironmentsWithContext(ctx, compute_environments_input)
 	if err != nil {
 		log.Warning("Failed to describe compute environments: ", err)
 		return err
@@ -98,7 +100,7 @@ func MonitorECSClusters(fs Storer, queues []string) error {
 					NextToken: next_token,
 				}
 			}
-			task_listing, err := awsclients.ECS.ListTasks(tasks_input)
+			task_listing, err := awsclients.ECS.ListTasksWithContext(ctx, tasks_input)
 			if err != nil {
 				log.Warning("Failed to list tasks: ", err)
 				return err
@@ -116,7 +118,7 @@ func MonitorECSClusters(fs Storer, queues []string) error {
 					Tasks:   task_arns,
 				}
 
-				task_descs, err := awsclients.ECS.DescribeTasks(describe_tasks)
+				task_descs, err := awsclients.ECS.DescribeTasksWithContext(ctx, describe_tasks)
 				if err != nil {
 					log.Warning("Failed to describe tasks: ", err)
 					return err
@@ -153,7 +155,7 @@ func MonitorECSClusters(fs Storer, queues []string) error {
 				}
 			}
 
-			container_arns, err := awsclients.ECS.ListContainerInstances(describe_container_instances)
+			container_arns, err := awsclients.ECS.ListContainerInstancesWithContext(ctx, describe_container_instances)
 			if err != nil {
 				log.Warning("Failed to list container instances: ", err)
 				return err
@@ -204,7 +206,7 @@ func MonitorECSClusters(fs Storer, queues []string) error {
 				ContainerInstances: lst,
 			}
 			cursor += 50
-			container_descs, err := awsclients.ECS.DescribeContainerInstances(container_input)
+			container_descs, err := awsclients.ECS.DescribeContainerInstancesWithContext(ctx, container_input)
 			if err != nil {
 				log.Warning("Cannot describe container instances: ", err)
 				return err
@@ -269,7 +271,7 @@ func MonitorECSClusters(fs Storer, queues []string) error {
 		instances_input := &ec2.DescribeInstancesInput{
 			InstanceIds: lst,
 		}
-		instances_descs, err := awsclients.EC2.DescribeInstances(instances_input)
+		instances_descs, err := awsclients.EC2.DescribeInstancesWithContext(ctx, instances_input)
 		if err != nil {
 			log.Warning("Cannot describe instances: ", err)
 			return err
@@ -320,8 +322,8 @@ func MonitorECSClusters(fs Storer, queues []string) error {
 		}
 	}
 
-	err1 := fs.UpdateTaskArnsInstanceIDs(ec2instances_info, task_ec2_mapping)
-	err2 := fs.UpdateECSInstances(ec2instances_info, tasks_per_ec2instance)
+	err1 := fs.UpdateTaskArnsInstanceIDs(ctx, ec2instances_info, task_ec2_mapping)
+	err2 := fs.UpdateECSInstances(ctx, ec2instances_info, tasks_per_ec2instance)
 
 	if err1 != nil {
 		return err1
@@ -0,0 +1,502 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+
+	libpq "github.com/lib/pq"
+)
+
+/*
+jobs is partitioned by the month jobs were created and the event logs by the
+month of the event. Partitions are named <table>_pYYYYMM and cover that month
+in UTC; rows that fall outside every partition go to <table>_default.
+
+The cleaner drops a partition once its whole month is past the retention, so
+data is kept up to a month longer than the retention asks for. The default
+partition is still cleaned row by row.
+
+Retention of jobs is decided by when they were last updated and by their job
+queue, not by the month they were created in. A partition of jobs is only
+dropped once the retention policy keeps none of its jobs; until then the jobs
+it does not keep are cleaned row by row. Jobs are never moved between
+partitions.
+*/
+
+// partitionMonthsAhead is the number of months after the current one that
+// CreatePartitions creates partitions for.
+const partitionMonthsAhead = 2
+
+var partitionedTables = []string{"jobs", "instance_event_log", "job_summary_event_log", "compute_environment_event_log"}
+
+type monthlyPartition struct {
+	name  string
+	start time.Time
+	end   time.Time
+	// attached is false for partitions the cleaner detached but did not
+	// get to drop
+	attached bool
+}
+
+// CreatePartitions creates the partitions of the current and the coming
+// months, if they do not exist yet.
+func (pq *postgreSQLStore) CreatePartitions(ctx context.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.CreatePartitions")
+	defer span.Finish()
+
+	now := time.Now().UTC()
+	var final_err error
+	for i := 0; i <= partitionMonthsAhead; i++ {
+		month := time.Date(now.Year(), now.Month()+time.Month(i), 1, 0, 0, 0, 0, time.UTC)
+		for _, table := range partitionedTables {
+			_, err := pq.connection.ExecContext(ctx, `SELECT create_monthly_partition($1, $2)`, table, month.Format("2006-01-02"))
+			if err != nil {
+				log.Warning("Cannot create partition of ", table, " for ", month.Format("2006-01"), ": ", err)
+				final_err = err
+			}
+		}
+	}
+	return final_err
+}
+
+// monthlyPartitions lists the monthly partitions of table, oldest first,
+// including the ones that have been detached but not dropped.
+func (pq *postgreSQLStore) monthlyPartitions(ctx context.Context, table string) ([]monthlyPartition, error) {
+	rows, err := pq.connection.QueryContext(ctx, `
+		SELECT c.relname, EXISTS (SELECT 1 FROM pg_inherits i WHERE i.inhrelid = c.oid)
+		FROM pg_class c
+		WHERE c.relkind = 'r'
+		AND c.relname LIKE $1
+		AND pg_table_is_visible(c.oid)
+		ORDER BY c.relname`, table+`\_p%`)
+	if err != nil {
+		log.Warning("Cannot list partitions of ", table, ": ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := make([]monthlyPartition, 0)
+	for rows.Next() {
+		var partition monthlyPartition
+		if err := rows.Scan(&partition.name, &partition.attached); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		start, err := time.Parse("200601", strings.TrimPrefix(partition.name, table+"_p"))
+		if err != nil {
+			continue
+		}
+		partition.start = start
+		partition.end = start.AddDate(0, 1, 0)
+		partitions = append(partitions, partition)
+	}
+	return partitions, rows.Err()
+}
+
+// expiredPartitions returns the partitions of table that only have rows older
+// than days days, and those that have already been detached.
+func (pq *postgreSQLStore) expiredPartitions(ctx context.Context, table string, days int) ([]monthlyPartition, error) {
+	partitions, err := pq.monthlyPartitions(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	expired := make([]monthlyPartition, 0)
+	for _, partition := range partitions {
+		if partition.attached && partition.end.After(cutoff) {
+			continue
+		}
+		expired = append(expired, partition)
+	}
+	return expired, nil
+}
+
+// beginPartitionTransaction starts a transaction for detaching partitions.
+// Detaching locks the whole table, so give up rather than queue every other
+// query behind a long one.
+func (pq *postgreSQLStore) beginPartitionTransaction(ctx context.Context) (*sql.Tx, error) {
+	transaction, err := pq.connection.BeginTx(ctx, nil)
+	if err != nil {
+		log.Warning(err)
+		return nil, err
+	}
+	_, err = transaction.ExecContext(ctx, `SET LOCAL lock_timeout = '5s'`)
+	if err != nil {
+		log.Warning(err)
+		_ = transaction.Rollback()
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// dropPartition detaches (if it is still attached) and drops a partition.
+func (pq *postgreSQLStore) dropPartition(ctx context.Context, table string, partition monthlyPartition) error {
+	ctx_timeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	transaction, err := pq.beginPartitionTransaction(ctx_timeout)
+	if err != nil {
+		return err
+	}
+	queries := []string{`DROP TABLE ` + libpq.QuoteIdentifier(partition.name)}
+	if partition.attached {
+		queries = append([]string{`ALTER TABLE ` + libpq.QuoteIdentifier(table) + ` DETACH PARTITION ` + libpq.QuoteIdentifier(partition.name)}, queries...)
+	}
+	for _, query := range queries {
+		if _, err := transaction.ExecContext(ctx_timeout, query); err != nil {
+			log.Warning("Cannot drop partition ", partition.name, ": ", err)
+			_ = transaction.Rollback()
+			return err
+		}
+	}
+	err = transaction.Commit()
+	if err != nil {
+		log.Warning("Cannot commit transaction: ", err)
+		return err
+	}
+	log.Info("Dropped partition ", partition.name)
+	return nil
+}
+
+// cleanOldPartitions drops the partitions of an event log table that only
+// have rows older than days days, then deletes old rows from its default
+// partition. column is the time rows are aged from, usually the partition
+// key.
+func (pq *postgreSQLStore) cleanOldPartitions(ctx context.Context, table string, column string, days int, batch_size int) error {
+	if days <= 0 {
+		return nil
+	}
+
+	// A partition that cannot be dropped must not stop the default
+	// partition from being cleaned.
+	partitions, partitions_err := pq.expiredPartitions(ctx, table, days)
+	for _, partition := range partitions {
+		if err := pq.dropPartition(ctx, table, partition); err != nil {
+			partitions_err = err
+		}
+	}
+
+	default_partition := libpq.QuoteIdentifier(table + "_default")
+	err := pq.cleanInBatches(ctx, `
+		DELETE FROM `+default_partition+` WHERE ctid IN (
+			SELECT ctid FROM `+default_partition+`
+			WHERE `+column+` < NOW() - $1::integer * INTERVAL '1 day'
+			LIMIT $2
+		)`, days, batch_size)
+	if err != nil {
+		return err
+	}
+	return partitions_err
+}
+
+// keptJobCondition is true for the jobs, aliased j, that the retention policy
+// keeps at the time now, an SQL expression. $1 is the number of days jobs are
+// kept, $2 the job queues that have their own retention, $3 their number of
+// days and $4 the number of days restored jobs are kept.
+func keptJobCondition(now string) string {
+	return `(
+	(NOT (j.job_queue = ANY($2)) AND j.last_updated >= ` + now + ` - $1::integer * INTERVAL '1 day')
+	OR EXISTS (
+		SELECT 1 FROM unnest($2::text[], $3::integer[]) AS o(job_queue, days)
+		WHERE o.job_queue = j.job_queue
+		AND (o.days <= 0 OR j.last_updated >= ` + now + ` - o.days * INTERVAL '1 day'))
+	OR (j.restored_at IS NOT NULL AND ($4 <= 0 OR j.restored_at >= ` + now + ` - $4::integer * INTERVAL '1 day')))`
+}
+
+// unarchivedJobCondition is true for the jobs, aliased j, that have not been
+// archived with the rest of their partition, because the retention policy
+// still kept them when the partition was last archived. Jobs updated or
+// restored since then count as kept at that time. It takes the same arguments
+// as keptJobCondition.
+var unarchivedJobCondition = `NOT EXISTS (
+		SELECT 1 FROM job_partition_archives pa
+		WHERE pa.partition_name = j.tableoid::regclass::text
+		AND NOT ` + keptJobCondition("pa.archived_at") + `)`
+
+func keptJobArgs(policy *RetentionPolicy) []interface{} {
+	queues := make([]string, 0, len(policy.JobQueueDays))
+	days := make([]int64, 0, len(policy.JobQueueDays))
+	for job_queue, queue_days := range policy.JobQueueDays {
+		queues = append(queues, job_queue)
+		days = append(days, int64(queue_days))
+	}
+	return []interface{}{policy.JobDays, libpq.Array(queues), libpq.Array(days), policy.RestoredJobDays}
+}
+
+// rowQuerier is what hasKeptJobs needs of *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// hasKeptJobs tells if the retention policy keeps any job of a partition. It
+// asks once for restored jobs, once for the default retention and once per
+// job queue override, so that every query can use the restored_at,
+// last_updated or (job_queue, last_updated) index; it runs while the
+// partition is being detached.
+func hasKeptJobs(ctx context.Context, db rowQuerier, partition_name string, policy *RetentionPolicy) (bool, error) {
+	partition := libpq.QuoteIdentifier(partition_name)
+	overridden_queues := make([]string, 0, len(policy.JobQueueDays))
+	for job_queue := range policy.JobQueueDays {
+		overridden_queues = append(overridden_queues, job_queue)
+	}
+
+	var kept bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM `+partition+`
+			WHERE restored_at IS NOT NULL
+			AND ($1 <= 0 OR restored_at >= NOW() - $1::integer * INTERVAL '1 day'))`, policy.RestoredJobDays).Scan(&kept)
+	if err == nil && !kept {
+		err = db.QueryRowContext(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM `+partition+`
+				WHERE last_updated >= NOW() - $1::integer * INTERVAL '1 day'
+				AND NOT (job_queue = ANY($2)))`, policy.JobDays, libpq.Array(overridden_queues)).Scan(&kept)
+	}
+	for job_queue, days := range policy.JobQueueDays {
+		if err != nil || kept {
+			break
+		}
+		if days <= 0 {
+			err = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+partition+` WHERE job_queue = $1)`, job_queue).Scan(&kept)
+		} else {
+			err = db.QueryRowContext(ctx, `
+				SELECT EXISTS (
+					SELECT 1 FROM `+partition+`
+					WHERE job_queue = $1
+					AND last_updated >= NOW() - $2::integer * INTERVAL '1 day')`, job_queue, days).Scan(&kept)
+		}
+	}
+	if err != nil {
+		log.Warning("Cannot check for kept jobs in ", partition_name, ": ", err)
+		return false, err
+	}
+	return kept, nil
+}
+
+// setPartitionArchived records that the jobs of a partition that the
+// retention policy did not keep at archived_at have been archived.
+func (pq *postgreSQLStore) setPartitionArchived(ctx context.Context, partition_name string, archived_at time.Time) error {
+	_, err := pq.connection.ExecContext(ctx, `
+		INSERT INTO job_partition_archives (partition_name, archived_at) VALUES ($1, $2)
+		ON CONFLICT (partition_name) DO UPDATE SET archived_at = EXCLUDED.archived_at`, partition_name, archived_at)
+	if err != nil {
+		log.Warning("Cannot record archiving of ", partition_name, ": ", err)
+	}
+	return err
+}
+
+// forgetPartitionArchived forgets about the archiving of a dropped partition.
+func (pq *postgreSQLStore) forgetPartitionArchived(ctx context.Context, partition_name string) error {
+	_, err := pq.connection.ExecContext(ctx, `DELETE FROM job_partition_archives WHERE partition_name = $1`, partition_name)
+	if err != nil {
+		log.Warning("Cannot forget archiving of ", partition_name, ": ", err)
+	}
+	return err
+}
+
+// archiveJobPartition archives the jobs of a partition that the retention
+// policy does not keep, except those archived by an earlier round.
+func (pq *postgreSQLStore) archiveJobPartition(ctx context.Context, partition monthlyPartition, policy *RetentionPolicy) error {
+	// Jobs updated while this runs are newer than archived_at, so a later
+	// round archives them again.
+	var archived_at time.Time
+	err := pq.connection.QueryRowContext(ctx, `SELECT NOW()`).Scan(&archived_at)
+	if err != nil {
+		log.Warning(err)
+		return err
+	}
+
+	last_job_id := ""
+	for {
+		ctx_timeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+		rows, err := pq.connection.QueryContext(ctx_timeout, archiveJobPartitionQuery(partition.name), archiveJobPartitionArgs(policy, archived_at, last_job_id)...)
+		if err != nil {
+			cancel()
+			log.Warning("Cannot select jobs to archive from ", partition.name, ": ", err)
+			return err
+		}
+		job_ids, err := getRowsAsList(rows)
+		rows.Close()
+		if err != nil {
+			cancel()
+			return err
+		}
+		if len(job_ids) == 0 {
+			cancel()
+			break
+		}
+		archived_jobs, err := pq.findArchivedJobs(ctx_timeout, job_ids)
+		cancel()
+		if err != nil {
+			return err
+		}
+		err = policy.Archiver.Archive(archived_jobs)
+		if err != nil {
+			return err
+		}
+		if len(job_ids) < policy.BatchSize {
+			break
+		}
+		last_job_id = job_ids[len(job_ids)-1]
+	}
+	return pq.setPartitionArchived(ctx, partition.name, archived_at)
+}
+
+// archiveJobPartitionQuery selects a batch of the jobs that
+// archiveJobPartition archives.
+func archiveJobPartitionQuery(partition_name string) string {
+	return `
+		SELECT j.job_id FROM ` + libpq.QuoteIdentifier(partition_name) + ` j
+		WHERE j.job_id > $6 AND NOT ` + keptJobCondition("$5::timestamptz") + `
+		AND ` + unarchivedJobCondition + `
+		ORDER BY j.job_id
+		LIMIT $7`
+}
+
+func archiveJobPartitionArgs(policy *RetentionPolicy, archived_at time.Time, last_job_id string) []interface{} {
+	return append(keptJobArgs(policy), archived_at, last_job_id, policy.BatchSize)
+}
+
+// detachJobPartition detaches a partition of jobs that has no jobs the
+// retention policy keeps. Whether it has any is checked again after
+// detaching, while nothing can update its jobs; if a job was updated since
+// the partition was archived, the partition is left attached and false is
+// returned. The jobs that were archived stay recorded as such.
+func (pq *postgreSQLStore) detachJobPartition(ctx context.Context, partition monthlyPartition, policy *RetentionPolicy) (bool, error) {
+	ctx_timeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	transaction, err := pq.beginPartitionTransaction(ctx_timeout)
+	if err != nil {
+		return false, err
+	}
+	should_commit := false
+	defer func() {
+		if should_commit {
+			return
+		}
+		err := transaction.Rollback()
+		if err != nil {
+			log.Warning("Cannot roll back transaction: ", err)
+		}
+	}()
+
+	_, err = transaction.ExecContext(ctx_timeout, `ALTER TABLE jobs DETACH PARTITION `+libpq.QuoteIdentifier(partition.name))
+	if err != nil {
+		log.Warning("Cannot detach partition ", partition.name, ": ", err)
+		return false, err
+	}
+	kept, err := hasKeptJobs(ctx_timeout, transaction, partition.name, policy)
+	if err != nil {
+		return false, err
+	}
+	if kept {
+		log.Info("Not detaching partition ", partition.name, ", some of its jobs were updated")
+		return false, nil
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		log.Warning("Cannot commit transaction: ", err)
+		return false, err
+	}
+	should_commit = true
+	log.Info("Detached partition ", partition.name)
+	return true, nil
+}
+
+// dropJobPartition deletes everything that refers to the jobs of a detached
+// partition and then drops it.
+func (pq *postgreSQLStore) dropJobPartition(ctx context.Context, partition monthlyPartition, batch_size int) error {
+	jobs_table := libpq.QuoteIdentifier(partition.name)
+	queries := []string{
+		`DELETE FROM task_arns_to_instance_info WHERE ctid IN (
+			SELECT ta.ctid FROM task_arns_to_instance_info ta
+			JOIN ` + jobs_table + ` j ON j.task_arn = ta.task_arn
+			LIMIT $1)`,
+		`DELETE FROM job_status_history WHERE ctid IN (
+			SELECT h.ctid FROM job_status_history h
+			JOIN ` + jobs_table + ` j ON j.job_id = h.job_id
+			LIMIT $1)`,
+		`DELETE FROM job_attempts WHERE ctid IN (
+			SELECT a.ctid FROM job_attempts a
+			JOIN ` + jobs_table + ` j ON j.job_id = a.job_id
+			LIMIT $1)`,
+		`DELETE FROM job_dependencies WHERE ctid IN (
+			SELECT d.ctid FROM job_dependencies d
+			JOIN ` + jobs_table + ` j ON j.job_id = d.job_id
+			LIMIT $1)`,
+	}
+	for _, query := range queries {
+		if err := pq.deleteInBatches(ctx, query, batch_size, batch_size); err != nil {
+			return err
+		}
+	}
+	if err := pq.dropPartition(ctx, "jobs", partition); err != nil {
+		return err
+	}
+	return pq.forgetPartitionArchived(ctx, partition.name)
+}
+
+// cleanOldJobPartition archives, detaches and drops a partition of jobs
+// whose whole month is past policy.JobDays. Returns true if it was not
+// dropped because the policy still keeps some of its jobs.
+func (pq *postgreSQLStore) cleanOldJobPartition(ctx context.Context, partition monthlyPartition, policy *RetentionPolicy) (bool, error) {
+	if partition.attached {
+		ctx_timeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+		kept, err := hasKeptJobs(ctx_timeout, pq.connection, partition.name, policy)
+		cancel()
+		if err != nil || kept {
+			return kept, err
+		}
+		if policy.Archiver != nil {
+			if err := pq.archiveJobPartition(ctx, partition, policy); err != nil {
+				return false, err
+			}
+		}
+		detached, err := pq.detachJobPartition(ctx, partition, policy)
+		if err != nil {
+			return false, err
+		}
+		if !detached {
+			return true, nil
+		}
+	}
+	return false, pq.dropJobPartition(ctx, partition, policy.BatchSize)
+}
+
+// cleanOldJobPartitions drops the partitions of jobs whose whole month is past
+// policy.JobDays and that have no jobs the policy keeps, because they were
+// updated recently or are in a job queue with a longer retention. Returns the
+// partitions that are past policy.JobDays but still have kept jobs; their
+// other jobs are cleaned row by row until the partition can be dropped. A
+// partition that cannot be cleaned does not stop the others from being
+// cleaned.
+func (pq *postgreSQLStore) cleanOldJobPartitions(ctx context.Context, policy *RetentionPolicy) ([]string, error) {
+	if policy.JobDays <= 0 {
+		return nil, nil
+	}
+
+	partitions, err := pq.expiredPartitions(ctx, "jobs", policy.JobDays)
+	if err != nil {
+		return nil, err
+	}
+	kept_partitions := make([]string, 0)
+	var final_err error
+	for _, partition := range partitions {
+		kept, err := pq.cleanOldJobPartition(ctx, partition, policy)
+		if err != nil {
+			final_err = err
+		}
+		if kept {
+			kept_partitions = append(kept_partitions, partition.name)
+		}
+	}
+	return kept_partitions, final_err
+}
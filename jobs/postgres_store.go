@@ -15,13 +15,17 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	// postgres sql driver
-	_ "github.com/lib/pq"
+	libpq "github.com/lib/pq"
 )
 
 type postgreSQLStore struct {
-	connection               *sql.DB
-	jobStatusSubscribers     map[string]([]chan<- Job)
-	jobStatusSubscribersLock sync.Mutex
+	connection    *sql.DB
+	replica       *readReplica
+	listener      *libpq.Listener
+	subscriptions *jobStatusSubscriptions
+	// closed is closed by Close to stop the background goroutines
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // Sort options
@@ -50,6 +54,16 @@ func parseSortColumn(input string) string {
 	}
 }
 
+// sortExpression is what we actually ORDER BY for a sort column. NULL
+// stopped_at is turned into 'infinity' so it can be compared against a
+// cursor; it sorts the same way either way.
+func sortExpression(column string) string {
+	if column == sortByStoppedAt {
+		return "COALESCE(stopped_at, 'infinity'::timestamptz)"
+	}
+	return column
+}
+
 func searchEscape(search string) string {
 	/* Escape characters so they won't be interpreted as search special
 	 * characters */
@@ -59,10 +73,9 @@ func searchEscape(search string) string {
 	return strings.Replace(strings.Replace(strings.Replace(search, "\\", "\\\\", -1), "%", "\\%", -1), "_", "\\_", -1)
 }
 
-func (pq *postgreSQLStore) Find(opts *Options) ([]*Job, error) {
-	span := opentracing.StartSpan("PG.Find")
-	defer span.Finish()
-
+// findJobsQuery builds the query and arguments of Find. $1 and $2 are always
+// the limit and the offset.
+func findJobsQuery(opts *Options) (string, []interface{}) {
 	var sortDirection string
 	if opts.SortAsc {
 		sortDirection = "ASC"
@@ -90,7 +103,11 @@ func (pq *postgreSQLStore) Find(opts *Options) ([]*Job, error) {
 				log_stream_name,
 				termination_requested,
 				task_arn,
-				array_properties
+				array_properties,
+				parent_job_id,
+				array_index,
+				node_properties,
+				node_index
 			FROM jobs
 		`
 
@@ -101,38 +118,11 @@ func (pq *postgreSQLStore) Find(opts *Options) ([]*Job, error) {
 	args = append(args, opts.Limit)
 	args = append(args, opts.Offset)
 
-	var interval string
-	switch opts.DateRange {
-	case "10m":
-		interval = "10 minutes"
-	case "1h":
-		interval = "1 hour"
-	case "1d":
-		interval = "1 day"
-	case "2d":
-		interval = "2 days"
-	case "3d":
-		interval = "3 days"
-	case "7d":
-		interval = "7 days"
-	case "30d":
-		interval = "30 days"
-	default:
-		interval = "30 days"
-	}
-	whereClausesScan = append(whereClausesScan, fmt.Sprintf("last_updated > (now() - interval '%s')", interval))
-
-	// Split search into tokens (separated by whitespace). We will search for each token separately.
-	// If search is empty or only whitespace, tokens will be an empty array.
-	tokens := strings.Fields(opts.Search)
-	for _, token := range tokens {
-		glob_search := "%" + searchEscape(token) + "%"
-		args = append(args, glob_search)
-		index := strconv.Itoa(len(args))
+	interval := parseDateRange(opts.DateRange)
+	whereClausesScan = append(whereClausesScan, fmt.Sprintf("last_updated > (now() - interval '%d seconds')", int64(interval.Seconds())))
 
-		whereClausesScan = append(whereClausesScan, fmt.Sprintf(`
-			(job_id || job_name || job_queue || image) ILIKE $%s
-		`, index))
+	if opts.Search != nil {
+		whereClausesScan = append(whereClausesScan, compileSearchSQL(opts.Search, &args)...)
 	}
 
 	var statusBuffer bytes.Buffer
@@ -164,6 +154,23 @@ func (pq *postgreSQLStore) Find(opts *Options) ([]*Job, error) {
 		whereClausesPr = append(whereClausesPr, queuesBuffer.String())
 	}
 
+	if opts.Cursor != nil {
+		// Keyset pagination: continue from right after the cursor.
+		// Offset must not skip anything on top of that.
+		args[1] = 0
+		column := parseSortColumn(opts.SortBy)
+		value_type := "text"
+		if column == sortByLastUpdated || column == sortByStoppedAt {
+			value_type = "timestamptz"
+		}
+		comparison := "<"
+		if opts.SortAsc {
+			comparison = ">"
+		}
+		args = append(args, opts.Cursor.Value, opts.Cursor.JobId)
+		whereClausesPr = append(whereClausesPr, fmt.Sprintf("(%s, job_id) %s ($%d::%s, $%d)", sortExpression(column), comparison, len(args)-1, value_type, len(args)))
+	}
+
 	unconditional_filters := strings.Join(whereClausesPr, " AND ")
 	scanner := strings.Join(whereClausesScan, " AND ")
 
@@ -185,9 +192,17 @@ func (pq *postgreSQLStore) Find(opts *Options) ([]*Job, error) {
 		}
 	}
 
-	query += fmt.Sprintf(" ORDER BY %s %s LIMIT $1 OFFSET $2", parseSortColumn(opts.SortBy), sortDirection)
+	query += fmt.Sprintf(" ORDER BY %s %s, job_id %s LIMIT $1 OFFSET $2", sortExpression(parseSortColumn(opts.SortBy)), sortDirection, sortDirection)
+	return query, args
+}
+
+func (pq *postgreSQLStore) Find(ctx context.Context, opts *Options) ([]*Job, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.Find")
+	defer span.Finish()
+
+	query, args := findJobsQuery(opts)
 
-	rows, err := pq.connection.Query(
+	rows, err := pq.reader().QueryContext(ctx,
 		query,
 		args...)
 	if err != nil {
@@ -199,7 +214,7 @@ func (pq *postgreSQLStore) Find(opts *Options) ([]*Job, error) {
 	allJobs := make([]*Job, 0)
 	for rows.Next() {
 		var job Job
-		if err := rows.Scan(&job.Id, &job.Name, &job.Status, &job.Description, &job.LastUpdated, &job.JobQueue, &job.Image, &job.CreatedAt, &job.StoppedAt, &job.VCpus, &job.Memory, &job.Timeout, &job.CommandLine, &job.StatusReason, &job.RunStartTime, &job.ExitCode, &job.LogStreamName, &job.TerminationRequested, &job.TaskARN, &job.ArrayProperties); err != nil {
+		if err := rows.Scan(&job.Id, &job.Name, &job.Status, &job.Description, &job.LastUpdated, &job.JobQueue, &job.Image, &job.CreatedAt, &job.StoppedAt, &job.VCpus, &job.Memory, &job.Timeout, &job.CommandLine, &job.StatusReason, &job.RunStartTime, &job.ExitCode, &job.LogStreamName, &job.TerminationRequested, &job.TaskARN, &job.ArrayProperties, &job.ParentJobId, &job.ArrayIndex, &job.NodeProperties, &job.NodeIndex); err != nil {
 			log.Warning(err)
 			return nil, err
 		}
@@ -209,8 +224,10 @@ func (pq *postgreSQLStore) Find(opts *Options) ([]*Job, error) {
 	return allJobs, nil
 }
 
-func (pq *postgreSQLStore) FindTimedoutJobs() ([]string, error) {
-	span := opentracing.StartSpan("PG.FindTimedoutJobs")
+// FindTimedoutJobs reads from the primary even if there is a read replica;
+// jobs get killed based on what it returns.
+func (pq *postgreSQLStore) FindTimedoutJobs(ctx context.Context) ([]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.FindTimedoutJobs")
 	defer span.Finish()
 
 	query := `
@@ -219,7 +236,7 @@ func (pq *postgreSQLStore) FindTimedoutJobs() ([]string, error) {
 	WHERE created_at + interval '1 second' * timeout < now()
 	  AND timeout != -1 AND status != 'SUCCEEDED' AND status != 'GONE' AND status != 'FAILED' AND termination_requested = 'f'`
 
-	rows, err := pq.connection.Query(query)
+	rows, err := pq.connection.QueryContext(ctx, query)
 	if err != nil {
 		log.Warning("Cannot find timed out jobs from database: ", err)
 		return nil, err
@@ -241,10 +258,16 @@ func (pq *postgreSQLStore) FindTimedoutJobs() ([]string, error) {
 	return job_ids, nil
 }
 
-func (pq *postgreSQLStore) FindOne(index string) (*Job, error) {
-	span := opentracing.StartSpan("PG.FindOne")
+func (pq *postgreSQLStore) FindOne(ctx context.Context, index string) (*Job, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.FindOne")
 	defer span.Finish()
 
+	return pq.findOne(ctx, pq.reader(), index)
+}
+
+// findOne is FindOne against the given database, so that callers that just
+// wrote to the primary can read their own writes.
+func (pq *postgreSQLStore) findOne(ctx context.Context, db *sql.DB, index string) (*Job, error) {
 	query := `
 			SELECT job_id,
 				job_name,
@@ -268,14 +291,18 @@ func (pq *postgreSQLStore) FindOne(index string) (*Job, error) {
 				ta.instance_id,
 				ta.public_ip,
 				ta.private_ip,
-				jobs.array_properties
+				jobs.array_properties,
+				jobs.parent_job_id,
+				jobs.array_index,
+				jobs.node_properties,
+				jobs.node_index
 			FROM jobs
 			LEFT OUTER JOIN task_arns_to_instance_info ta ON
 			ta.task_arn = jobs.task_arn
 			WHERE jobs.job_id = $1
 		`
 
-	rows, err := pq.connection.Query(query, index)
+	rows, err := db.QueryContext(ctx, query, index)
 	if err != nil {
 		return nil, err
 	}
@@ -289,16 +316,242 @@ func (pq *postgreSQLStore) FindOne(index string) (*Job, error) {
 		job.StatusReason = &sr
 	}
 
-	if err := rows.Scan(&job.Id, &job.Name, &job.Status, &job.Description, &job.LastUpdated, &job.JobQueue, &job.Image, &job.CreatedAt, &job.StoppedAt, &job.VCpus, &job.Memory, &job.Timeout, &job.CommandLine, &job.StatusReason, &job.RunStartTime, &job.ExitCode, &job.LogStreamName, &job.TerminationRequested, &job.TaskARN, &job.InstanceID, &job.PublicIP, &job.PrivateIP, &job.ArrayProperties); err != nil {
+	if err := rows.Scan(&job.Id, &job.Name, &job.Status, &job.Description, &job.LastUpdated, &job.JobQueue, &job.Image, &job.CreatedAt, &job.StoppedAt, &job.VCpus, &job.Memory, &job.Timeout, &job.CommandLine, &job.StatusReason, &job.RunStartTime, &job.ExitCode, &job.LogStreamName, &job.TerminationRequested, &job.TaskARN, &job.InstanceID, &job.PublicIP, &job.PrivateIP, &job.ArrayProperties, &job.ParentJobId, &job.ArrayIndex, &job.NodeProperties, &job.NodeIndex); err != nil {
 		log.Warning(err)
 		return nil, err
 	}
 
+	attempts, err := findJobAttempts(ctx, db, []string{job.Id})
+	if err != nil {
+		return nil, err
+	}
+	job.Attempts = attempts[job.Id]
+	if job.Attempts == nil {
+		job.Attempts = make([]*JobAttempt, 0)
+	}
+
+	dependencies, err := findJobDependencies(ctx, db, []string{job.Id})
+	if err != nil {
+		return nil, err
+	}
+	job.DependsOn = dependencies[job.Id]
+
+	if job.NodeProperties != nil {
+		job.Nodes, err = findNodeJobs(ctx, db, job.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if name, revision, ok := ParseJobDefinitionARN(job.Description); ok {
+		job.JobDefinition, err = getJobDefinition(ctx, db, name, revision)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &job, nil
 }
 
-func (pq *postgreSQLStore) StaleOldJobs(job_ids map[string]bool) error {
-	span := opentracing.StartSpan("PG.StaleOldJobs")
+// findNodeJobsQuery selects the nodes of multi-node parallel job $1, in node
+// order, each with its own log stream and instance. Children of array jobs
+// have a parent too, but no node index.
+const findNodeJobsQuery = `
+			SELECT job_id,
+				job_name,
+				status,
+				job_definition,
+				last_updated,
+				job_queue,
+				image,
+				created_at,
+				stopped_at,
+				vcpus,
+				memory,
+				timeout,
+				command_line,
+				status_reason,
+				run_started_at,
+				exitcode,
+				log_stream_name,
+				termination_requested,
+				jobs.task_arn,
+				ta.instance_id,
+				ta.public_ip,
+				ta.private_ip,
+				jobs.array_properties,
+				jobs.parent_job_id,
+				jobs.array_index,
+				jobs.node_properties,
+				jobs.node_index
+			FROM jobs
+			LEFT OUTER JOIN task_arns_to_instance_info ta ON
+			ta.task_arn = jobs.task_arn
+			WHERE jobs.parent_job_id = $1 AND jobs.node_index IS NOT NULL
+			ORDER BY jobs.node_index ASC
+		`
+
+// findNodeJobs returns the nodes of a multi-node parallel job.
+func findNodeJobs(ctx context.Context, db *sql.DB, job_id string) ([]*Job, error) {
+	rows, err := db.QueryContext(ctx, findNodeJobsQuery, job_id)
+	if err != nil {
+		log.Warning("Cannot select nodes of job ", job_id, ": ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := make([]*Job, 0)
+	for rows.Next() {
+		var job Job
+		if err := rows.Scan(&job.Id, &job.Name, &job.Status, &job.Description, &job.LastUpdated, &job.JobQueue, &job.Image, &job.CreatedAt, &job.StoppedAt, &job.VCpus, &job.Memory, &job.Timeout, &job.CommandLine, &job.StatusReason, &job.RunStartTime, &job.ExitCode, &job.LogStreamName, &job.TerminationRequested, &job.TaskARN, &job.InstanceID, &job.PublicIP, &job.PrivateIP, &job.ArrayProperties, &job.ParentJobId, &job.ArrayIndex, &job.NodeProperties, &job.NodeIndex); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		nodes = append(nodes, &job)
+	}
+	return nodes, nil
+}
+
+// arrayChildrenQuery builds the query and arguments of FindArrayChildren. $1
+// is always the parent job ID and $2 the limit.
+func arrayChildrenQuery(opts *ArrayChildrenOptions) (string, []interface{}) {
+	args := []interface{}{opts.ParentJobId, opts.Limit}
+	where_clauses := []string{"parent_job_id = $1", "array_index IS NOT NULL"}
+	if len(opts.Status) > 0 {
+		args = append(args, libpq.Array(opts.Status))
+		where_clauses = append(where_clauses, fmt.Sprintf("status = ANY($%d)", len(args)))
+	}
+	if opts.AfterIndex != nil {
+		args = append(args, *opts.AfterIndex)
+		where_clauses = append(where_clauses, fmt.Sprintf("array_index > $%d", len(args)))
+	}
+
+	query := `
+			SELECT job_id,
+				job_name,
+				status,
+				job_definition,
+				last_updated,
+				job_queue,
+				image,
+				created_at,
+				stopped_at,
+				vcpus,
+				memory,
+				timeout,
+				command_line,
+				status_reason,
+				run_started_at,
+				exitcode,
+				log_stream_name,
+				termination_requested,
+				task_arn,
+				array_properties,
+				parent_job_id,
+				array_index,
+				node_properties,
+				node_index
+			FROM jobs
+			WHERE ` + strings.Join(where_clauses, " AND ") + `
+			ORDER BY array_index ASC
+			LIMIT $2
+		`
+	return query, args
+}
+
+// arrayFailedIndexesQuery selects the indexes of the failed children of array
+// job $1. The nodes of a multi-node parallel job have a parent too, but no
+// array index.
+const arrayFailedIndexesQuery = `
+		SELECT array_index
+		FROM jobs
+		WHERE parent_job_id = $1 AND array_index IS NOT NULL AND status = 'FAILED'
+		ORDER BY array_index ASC`
+
+func (pq *postgreSQLStore) FindArrayChildren(ctx context.Context, opts *ArrayChildrenOptions) (*ArrayChildren, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.FindArrayChildren")
+	defer span.Finish()
+
+	var parent_exists bool
+	err := pq.reader().QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM jobs WHERE job_id = $1)`, opts.ParentJobId).Scan(&parent_exists)
+	if err != nil {
+		log.Warning("Cannot check for array job ", opts.ParentJobId, ": ", err)
+		return nil, err
+	}
+	if !parent_exists {
+		return nil, nil
+	}
+
+	query, args := arrayChildrenQuery(opts)
+	rows, err := pq.reader().QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Warning("Cannot select children of array job ", opts.ParentJobId, ": ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	children := &ArrayChildren{
+		Children:      make([]*Job, 0),
+		FailedIndexes: make([]int64, 0),
+	}
+	for rows.Next() {
+		var job Job
+		if err := rows.Scan(&job.Id, &job.Name, &job.Status, &job.Description, &job.LastUpdated, &job.JobQueue, &job.Image, &job.CreatedAt, &job.StoppedAt, &job.VCpus, &job.Memory, &job.Timeout, &job.CommandLine, &job.StatusReason, &job.RunStartTime, &job.ExitCode, &job.LogStreamName, &job.TerminationRequested, &job.TaskARN, &job.ArrayProperties, &job.ParentJobId, &job.ArrayIndex, &job.NodeProperties, &job.NodeIndex); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		children.Children = append(children.Children, &job)
+	}
+
+	failed_rows, err := pq.reader().QueryContext(ctx, arrayFailedIndexesQuery, opts.ParentJobId)
+	if err != nil {
+		log.Warning("Cannot select failed children of array job ", opts.ParentJobId, ": ", err)
+		return nil, err
+	}
+	defer failed_rows.Close()
+	for failed_rows.Next() {
+		var index int64
+		if err := failed_rows.Scan(&index); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		children.FailedIndexes = append(children.FailedIndexes, index)
+	}
+
+	return children, nil
+}
+
+// FindSyncStates reads from the primary; a lagging replica would only make
+// the synchronizer describe more jobs, but there is no point in that.
+func (pq *postgreSQLStore) FindSyncStates(ctx context.Context, job_ids []string) (map[string]*JobSyncState, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.FindSyncStates")
+	defer span.Finish()
+
+	rows, err := pq.connection.QueryContext(ctx, `
+		SELECT job_id, status, status_reason
+		FROM jobs
+		WHERE job_id = ANY($1)`, libpq.Array(job_ids))
+	if err != nil {
+		log.Warning("Cannot select job sync states: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]*JobSyncState)
+	for rows.Next() {
+		var job_id string
+		var state JobSyncState
+		if err := rows.Scan(&job_id, &state.Status, &state.StatusReason); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		states[job_id] = &state
+	}
+	return states, rows.Err()
+}
+
+func (pq *postgreSQLStore) StaleOldJobs(ctx context.Context, job_ids map[string]bool) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.StaleOldJobs")
 	defer span.Finish()
 
 	/*
@@ -311,7 +564,7 @@ func (pq *postgreSQLStore) StaleOldJobs(job_ids map[string]bool) error {
 	   available.
 	*/
 	err := func() error {
-		transaction, err := pq.connection.Begin()
+		transaction, err := pq.connection.BeginTx(ctx, nil)
 		if err != nil {
 			log.Warning(err)
 			return err
@@ -341,26 +594,25 @@ func (pq *postgreSQLStore) StaleOldJobs(job_ids map[string]bool) error {
 			}
 		}()
 
-		query := `create temporary table jobs_known_about ( job_id text primary key ) on commit drop`
-		_, err = transaction.Exec(query)
+		err = setStatusChangeSource(transaction, StatusChangeFromStale)
 		if err != nil {
-			log.Warning("Cannot create temporary table in StaleOldJobs: ", err)
 			return err
 		}
 
+		known_job_ids := make([][]interface{}, 0, len(job_ids))
 		for job_id := range job_ids {
-			query := `insert into jobs_known_about ( job_id ) values ( $1 )`
-			_, err = transaction.Exec(query, job_id)
-			if err != nil {
-				log.Warning("Cannot insert into jobs_known_about in StaleOldJobs: ", err)
-				return err
-			}
+			known_job_ids = append(known_job_ids, []interface{}{job_id})
+		}
+		err = copyIntoTemporaryTable(ctx, transaction, "jobs_known_about", "jobs", []string{"job_id"}, known_job_ids)
+		if err != nil {
+			log.Warning("Cannot fill jobs_known_about in StaleOldJobs: ", err)
+			return err
 		}
 
 		where_clause := `WHERE j.status NOT IN ('GONE', 'SUCCEEDED', 'FAILED') ` +
 			`AND j.job_id NOT IN (SELECT jka.job_id FROM jobs_known_about jka) ` +
 			`AND AGE(CURRENT_TIMESTAMP, j.last_updated) > INTERVAL '300 sec'`
-		query = `UPDATE jobs j SET status = 'GONE' ` + where_clause
+		query := `UPDATE jobs j SET status = 'GONE' ` + where_clause
 		_, err = transaction.Exec(query)
 		if err != nil {
 			log.Warning("Cannot update GONE status: ", err)
@@ -372,14 +624,293 @@ func (pq *postgreSQLStore) StaleOldJobs(job_ids map[string]bool) error {
 		return nil
 	}()
 
+	return err
+}
+
+// setStatusChangeSource tells the job status triggers where the changes made
+// in this transaction come from. It is recorded in job_status_history.
+func setStatusChangeSource(transaction *sql.Tx, source StatusChangeSource) error {
+	_, err := transaction.Exec(`SELECT set_config('batchiepatchie.status_source', $1, true)`, string(source))
+	if err != nil {
+		log.Warning("Cannot set status change source: ", err)
+	}
+	return err
+}
+
+// copyIntoTemporaryTable creates a temporary table with the given columns of
+// an existing table and fills it with COPY, which is much faster than
+// inserting rows one by one. The table is dropped when the transaction ends.
+func copyIntoTemporaryTable(ctx context.Context, transaction *sql.Tx, table string, like string, columns []string, rows [][]interface{}) error {
+	_, err := transaction.ExecContext(ctx, `CREATE TEMPORARY TABLE `+table+` ON COMMIT DROP AS SELECT `+strings.Join(columns, ", ")+` FROM `+like+` WITH NO DATA`)
+	if err != nil {
+		return err
+	}
+
+	statement, err := transaction.PrepareContext(ctx, libpq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		_, err = statement.ExecContext(ctx, row...)
+		if err != nil {
+			statement.Close()
+			return err
+		}
+	}
+	// Executing without arguments sends the buffered rows
+	_, err = statement.ExecContext(ctx)
+	if err != nil {
+		statement.Close()
+		return err
+	}
+	return statement.Close()
+}
+
+// latestJobVersions drops all but the last version of each job, since one
+// statement cannot update the same row twice.
+func latestJobVersions(jobs []*Job) []*Job {
+	latest := make(map[string]int, len(jobs))
+	for i, job := range jobs {
+		latest[job.Id] = i
+	}
+	if len(latest) == len(jobs) {
+		return jobs
+	}
+	deduplicated := make([]*Job, 0, len(latest))
+	for i, job := range jobs {
+		if latest[job.Id] == i {
+			deduplicated = append(deduplicated, job)
+		}
+	}
+	return deduplicated
+}
+
+var jobsStagingColumns = []string{
+	"job_id",
+	"job_name",
+	"job_definition",
+	"job_queue",
+	"image",
+	"status",
+	"created_at",
+	"stopped_at",
+	"vcpus",
+	"memory",
+	"timeout",
+	"command_line",
+	"last_updated",
+	"status_reason",
+	"run_started_at",
+	"exitcode",
+	"log_stream_name",
+	"task_arn",
+	"array_properties",
+	"parent_job_id",
+	"array_index",
+	"node_properties",
+	"node_index",
+}
+
+/*
+mergeJobs copies jobs into a staging table and merges them into jobs with one
+statement. Existing rows are only updated if something we track changed, so
+the job status triggers fire only on real changes. A missing stopped_at or
+node_properties does not overwrite one we already have. Returns the number of
+rows inserted or updated.
+*/
+func mergeJobs(ctx context.Context, transaction *sql.Tx, jobs []*Job) (int, error) {
+	rows := make([][]interface{}, 0, len(jobs))
+	for _, job := range jobs {
+		var stopped_at *string
+		if job.StoppedAt != nil {
+			formatted := job.StoppedAt.Format("2006-01-02 15:04:05")
+			stopped_at = &formatted
+		}
+		// JSONB columns are copied as strings; COPY would send []byte
+		// as bytea.
+		var array_properties, node_properties *string
+		if job.ArrayProperties != nil {
+			marshalled, err := json.Marshal(job.ArrayProperties)
+			if err != nil {
+				log.Warning(err, ": ", job)
+				return 0, err
+			}
+			array_properties = new(string)
+			*array_properties = string(marshalled)
+		}
+		if job.NodeProperties != nil {
+			marshalled, err := json.Marshal(job.NodeProperties)
+			if err != nil {
+				log.Warning(err, ": ", job)
+				return 0, err
+			}
+			node_properties = new(string)
+			*node_properties = string(marshalled)
+		}
+		rows = append(rows, []interface{}{
+			job.Id,
+			job.Name,
+			job.Description,
+			job.JobQueue,
+			job.Image,
+			job.Status,
+			job.CreatedAt.Format("2006-01-02 15:04:05"),
+			stopped_at,
+			job.VCpus,
+			job.Memory,
+			job.Timeout,
+			job.CommandLine,
+			job.LastUpdated.Format("2006-01-02 15:04:05"),
+			job.StatusReason,
+			job.RunStartTime,
+			job.ExitCode,
+			job.LogStreamName,
+			job.TaskARN,
+			array_properties,
+			job.ParentJobId,
+			job.ArrayIndex,
+			node_properties,
+			job.NodeIndex,
+		})
+	}
+	err := copyIntoTemporaryTable(ctx, transaction, "jobs_staging", "jobs", jobsStagingColumns, rows)
+	if err != nil {
+		log.Warning("Cannot copy jobs to staging table: ", err)
+		return 0, err
+	}
+
+	columns := strings.Join(jobsStagingColumns, ", ")
+	result, err := transaction.ExecContext(ctx, `
+		INSERT INTO jobs ( `+columns+` )
+		SELECT `+columns+` FROM jobs_staging
+		ON CONFLICT (job_id, created_at) DO UPDATE SET
+		  status = EXCLUDED.status,
+		  last_updated = EXCLUDED.last_updated,
+		  stopped_at = COALESCE(EXCLUDED.stopped_at, jobs.stopped_at),
+		  status_reason = EXCLUDED.status_reason,
+		  run_started_at = EXCLUDED.run_started_at,
+		  exitcode = EXCLUDED.exitcode,
+		  log_stream_name = EXCLUDED.log_stream_name,
+		  task_arn = EXCLUDED.task_arn,
+		  array_properties = EXCLUDED.array_properties,
+		  node_properties = COALESCE(EXCLUDED.node_properties, jobs.node_properties)
+		WHERE jobs.status <> EXCLUDED.status
+		   OR jobs.status_reason <> EXCLUDED.status_reason
+		   OR jobs.exitcode <> EXCLUDED.exitcode
+		   OR jobs.log_stream_name <> EXCLUDED.log_stream_name
+		   OR jobs.task_arn <> EXCLUDED.task_arn
+		   OR (jobs.task_arn IS NULL AND EXCLUDED.task_arn IS NOT NULL)
+		   OR (jobs.log_stream_name IS NULL AND EXCLUDED.log_stream_name IS NOT NULL)
+		   OR (jobs.status_reason IS NULL AND EXCLUDED.status_reason IS NOT NULL)
+		   OR (jobs.exitcode IS NULL AND EXCLUDED.exitcode IS NOT NULL)
+		   OR (EXCLUDED.array_properties IS NOT NULL AND (
+		         jobs.array_properties IS NULL
+		         OR jobs.array_properties->'status_summary' IS DISTINCT FROM EXCLUDED.array_properties->'status_summary'))`)
+	if err != nil {
+		log.Warning("Cannot merge jobs from staging table: ", err)
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		log.Warning(err)
+		return 0, err
+	}
+	return int(n), nil
+}
+
+var jobAttemptsStagingColumns = []string{"job_id", "attempt", "started_at", "stopped_at", "exitcode", "reason", "task_arn", "container_instance_arn", "log_stream_name"}
+
+// mergeJobAttempts saves the attempts of the given jobs. Rows are only
+// rewritten if something about the attempt changed.
+func mergeJobAttempts(ctx context.Context, transaction *sql.Tx, jobs []*Job) error {
+	rows := make([][]interface{}, 0)
+	for _, job := range jobs {
+		for _, attempt := range job.Attempts {
+			rows = append(rows, []interface{}{
+				job.Id,
+				attempt.Attempt,
+				attempt.StartedAt,
+				attempt.StoppedAt,
+				attempt.ExitCode,
+				attempt.Reason,
+				attempt.TaskARN,
+				attempt.ContainerInstanceARN,
+				attempt.LogStreamName,
+			})
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	err := copyIntoTemporaryTable(ctx, transaction, "job_attempts_staging", "job_attempts", jobAttemptsStagingColumns, rows)
+	if err != nil {
+		log.Warning("Cannot copy job attempts to staging table: ", err)
+		return err
+	}
+
+	_, err = transaction.ExecContext(ctx, mergeJobAttemptsQuery())
+	if err != nil {
+		log.Warning("Cannot merge job attempts from staging table: ", err)
+	}
+	return err
+}
+
+// mergeJobAttemptsQuery builds the statement that moves the attempts from
+// job_attempts_staging into job_attempts. Every column but the key is
+// updated, and only if one of them changed.
+func mergeJobAttemptsQuery() string {
+	updated_columns := jobAttemptsStagingColumns[2:]
+	set_clauses := make([]string, 0, len(updated_columns))
+	old_values := make([]string, 0, len(updated_columns))
+	new_values := make([]string, 0, len(updated_columns))
+	for _, column := range updated_columns {
+		set_clauses = append(set_clauses, column+" = EXCLUDED."+column)
+		old_values = append(old_values, "job_attempts."+column)
+		new_values = append(new_values, "EXCLUDED."+column)
+	}
+
+	columns := strings.Join(jobAttemptsStagingColumns, ", ")
+	return `
+		INSERT INTO job_attempts ( ` + columns + ` )
+		SELECT ` + columns + ` FROM job_attempts_staging
+		ON CONFLICT (job_id, attempt) DO UPDATE SET
+		  ` + strings.Join(set_clauses, ", ") + `
+		WHERE (` + strings.Join(old_values, ", ") + `)
+		      IS DISTINCT FROM
+		      (` + strings.Join(new_values, ", ") + `)`
+}
+
+// mergeJobDependencies saves what the given jobs depend on. Dependencies are
+// fixed when a job is submitted so existing rows are left alone.
+func mergeJobDependencies(ctx context.Context, transaction *sql.Tx, jobs []*Job) error {
+	rows := make([][]interface{}, 0)
+	for _, job := range jobs {
+		for _, dependency := range job.DependsOn {
+			rows = append(rows, []interface{}{job.Id, dependency.JobId, dependency.Type})
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	err := copyIntoTemporaryTable(ctx, transaction, "job_dependencies_staging", "job_dependencies", []string{"job_id", "depends_on_job_id", "type"}, rows)
 	if err != nil {
+		log.Warning("Cannot copy job dependencies to staging table: ", err)
 		return err
 	}
-	return pq.flushJobStatusSubscriptions()
+
+	_, err = transaction.ExecContext(ctx, `
+		INSERT INTO job_dependencies ( job_id, depends_on_job_id, type )
+		SELECT DISTINCT ON (job_id, depends_on_job_id) job_id, depends_on_job_id, type
+		FROM job_dependencies_staging
+		ON CONFLICT (job_id, depends_on_job_id) DO NOTHING`)
+	if err != nil {
+		log.Warning("Cannot merge job dependencies from staging table: ", err)
+	}
+	return err
 }
 
-func (pq *postgreSQLStore) Store(jobs []*Job) error {
-	span := opentracing.StartSpan("PG.Store")
+func (pq *postgreSQLStore) Store(ctx context.Context, jobs []*Job, source StatusChangeSource) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.Store")
 	defer span.Finish()
 
 	/* Don't bother going to database to insert 0 jobs */
@@ -388,7 +919,7 @@ func (pq *postgreSQLStore) Store(jobs []*Job) error {
 	}
 
 	err := func() error {
-		transaction, err := pq.connection.Begin()
+		transaction, err := pq.connection.BeginTx(ctx, nil)
 		if err != nil {
 			log.Warning(err)
 			return err
@@ -418,156 +949,202 @@ func (pq *postgreSQLStore) Store(jobs []*Job) error {
 				return
 			}
 		}()
-		inserts_and_updates := 0
-		for _, job := range jobs {
-			extra_where_check := ""
-			if job.ArrayProperties != nil {
-				// extra_where_check is included in the update statement to minimize the number of updates.
-				extra_where_check = fmt.Sprintf(`
-					or jobs.array_properties is null
-					or (jobs.array_properties->'status_summary'->>'STARTING')::numeric != %d
-					or (jobs.array_properties->'status_summary'->>'FAILED')::numeric != %d
-					or (jobs.array_properties->'status_summary'->>'RUNNING')::numeric != %d
-					or (jobs.array_properties->'status_summary'->>'SUCCEEDED')::numeric != %d
-					or (jobs.array_properties->'status_summary'->>'RUNNABLE')::numeric != %d
-					or (jobs.array_properties->'status_summary'->>'SUBMITTED')::numeric != %d
-					or (jobs.array_properties->'status_summary'->>'PENDING')::numeric != %d
-					`,
-					job.ArrayProperties.StatusSummary.Starting,
-					job.ArrayProperties.StatusSummary.Failed,
-					job.ArrayProperties.StatusSummary.Running,
-					job.ArrayProperties.StatusSummary.Succeeded,
-					job.ArrayProperties.StatusSummary.Runnable,
-					job.ArrayProperties.StatusSummary.Submitted,
-					job.ArrayProperties.StatusSummary.Pending,
-				)
-			}
-			if job.StoppedAt == nil {
-				query := `insert into jobs (
-			  job_id,
-			  job_name,
-			  job_definition,
-			  job_queue,
-			  image,
-			  status,
-			  created_at,
-			  vcpus,
-			  memory,
-			  timeout,
-			  command_line,
-			  last_updated,
-		          status_reason,
-		          run_started_at,
-		          exitcode,
-		          log_stream_name,
-		          task_arn,
-				  array_properties)
-			  values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
-		      on conflict (job_id) do update set status = $6, last_updated = $12, status_reason = $13, run_started_at = $14, exitcode = $15, log_stream_name = $16, task_arn = $17, array_properties = $18
-		      where jobs.status <> $6 or jobs.status_reason <> $13 or jobs.exitcode <> $15 or jobs.log_stream_name <> $16 or jobs.task_arn <> $17 or (jobs.task_arn is null and $17 is not null) or (jobs.log_stream_name is null and $16 is not null) or (jobs.status_reason is null and $13 is not null) or (jobs.exitcode is null and $15 is not null)
-			  ` + extra_where_check
-				result, err := transaction.Exec(
-					query,
-					job.Id,
-					job.Name,
-					job.Description,
-					job.JobQueue,
-					job.Image,
-					job.Status,
-					job.CreatedAt.Format("2006-01-02 15:04:05"),
-					job.VCpus,
-					job.Memory,
-					job.Timeout,
-					job.CommandLine,
-					job.LastUpdated.Format("2006-01-02 15:04:05"),
-					job.StatusReason,
-					job.RunStartTime,
-					job.ExitCode,
-					job.LogStreamName,
-					job.TaskARN,
-					job.ArrayProperties)
-				if err != nil {
-					log.Warning(err, ": ", job)
-					return err
-				}
-				n, err := result.RowsAffected()
-				if err != nil {
-					log.Warning(err, ": ", job)
-					return err
-				}
-				inserts_and_updates += int(n)
-			} else {
-				query := `insert into jobs (
-			  job_id,
-			  job_name,
-			  job_definition,
-			  job_queue,
-			  image,
-			  status,
-			  created_at,
-			  stopped_at,
-			  vcpus,
-			  memory,
-			  timeout,
-			  command_line,
-			  last_updated,
-		          status_reason,
-		          run_started_at,
-		          exitcode,
-		          log_stream_name,
-		          task_arn,
-				  array_properties)
-			  values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
-		      on conflict (job_id) do update set status = $6, last_updated = $13, stopped_at = $8, status_reason = $14, run_started_at = $15, exitcode = $16, log_stream_name = $17, task_arn = $18, array_properties = $19
-		      where jobs.status <> $6 or jobs.status_reason <> $14 or jobs.exitcode <> $16 or jobs.log_stream_name <> $17 or jobs.task_arn <> $18 or (jobs.task_arn is null and $18 is not null) or (jobs.log_stream_name is null and $17 is not null) or (jobs.status_reason is null and $14 is not null) or (jobs.exitcode is null and $16 is not null)
-			  ` + extra_where_check
-				result, err := transaction.Exec(
-					query,
-					job.Id,
-					job.Name,
-					job.Description,
-					job.JobQueue,
-					job.Image,
-					job.Status,
-					job.CreatedAt.Format("2006-01-02 15:04:05"),
-					job.StoppedAt.Format("2006-01-02 15:04:05"),
-					job.VCpus,
-					job.Memory,
-					job.Timeout,
-					job.CommandLine,
-					job.LastUpdated.Format("2006-01-02 15:04:05"),
-					job.StatusReason,
-					job.RunStartTime,
-					job.ExitCode,
-					job.LogStreamName,
-					job.TaskARN,
-					job.ArrayProperties)
-				if err != nil {
-					log.Warning(err, ": ", job)
-					return err
-				}
-				n, err := result.RowsAffected()
-				if err != nil {
-					log.Warning(err, ": ", job)
-					return err
-				}
-				inserts_and_updates += int(n)
-			}
-		}
-		log.Info(fmt.Sprintf("Inserted/updated %d rows", inserts_and_updates))
-		should_commit = true
-		return nil
-	}()
-
-	if err != nil {
-		return err
-	}
 
-	return pq.flushJobStatusSubscriptions()
-}
+		err = setStatusChangeSource(transaction, source)
+		if err != nil {
+			return err
+		}
+		jobs = latestJobVersions(jobs)
+		inserts_and_updates, err := mergeJobs(ctx, transaction, jobs)
+		if err != nil {
+			return err
+		}
+		err = mergeJobAttempts(ctx, transaction, jobs)
+		if err != nil {
+			return err
+		}
+		err = mergeJobDependencies(ctx, transaction, jobs)
+		if err != nil {
+			return err
+		}
+		log.Info(fmt.Sprintf("Inserted/updated %d rows", inserts_and_updates))
+		should_commit = true
+		return nil
+	}()
+
+	return err
+}
+
+// findJobAttemptsQuery selects the attempts of the jobs in $1, each with the
+// instance its task ran on.
+const findJobAttemptsQuery = `
+		SELECT job_attempts.job_id,
+			job_attempts.attempt,
+			job_attempts.started_at,
+			job_attempts.stopped_at,
+			job_attempts.exitcode,
+			job_attempts.reason,
+			job_attempts.task_arn,
+			job_attempts.container_instance_arn,
+			job_attempts.log_stream_name,
+			ta.instance_id,
+			ta.public_ip,
+			ta.private_ip
+		FROM job_attempts
+		LEFT OUTER JOIN task_arns_to_instance_info ta ON
+		ta.task_arn = job_attempts.task_arn
+		WHERE job_attempts.job_id = ANY($1)
+		ORDER BY job_attempts.job_id, job_attempts.attempt ASC
+		`
+
+// findJobAttempts returns the attempts of the given jobs, keyed by job ID.
+func findJobAttempts(ctx context.Context, db *sql.DB, job_ids []string) (map[string][]*JobAttempt, error) {
+	rows, err := db.QueryContext(ctx, findJobAttemptsQuery, libpq.Array(job_ids))
+	if err != nil {
+		log.Warning("Cannot select job attempts: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := make(map[string][]*JobAttempt)
+	for rows.Next() {
+		var attempt JobAttempt
+		if err := rows.Scan(&attempt.JobId, &attempt.Attempt, &attempt.StartedAt, &attempt.StoppedAt, &attempt.ExitCode, &attempt.Reason, &attempt.TaskARN, &attempt.ContainerInstanceARN, &attempt.LogStreamName, &attempt.InstanceID, &attempt.PublicIP, &attempt.PrivateIP); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		attempts[attempt.JobId] = append(attempts[attempt.JobId], &attempt)
+	}
+	return attempts, nil
+}
+
+func (pq *postgreSQLStore) GetAttempts(ctx context.Context, jobid string) ([]*JobAttempt, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.GetAttempts")
+	defer span.Finish()
+
+	attempts, err := findJobAttempts(ctx, pq.reader(), []string{jobid})
+	if err != nil {
+		return nil, err
+	}
+	if attempts[jobid] == nil {
+		return make([]*JobAttempt, 0), nil
+	}
+	return attempts[jobid], nil
+}
+
+// findJobDependencies returns the dependencies of the given jobs, keyed by
+// job ID.
+func findJobDependencies(ctx context.Context, db *sql.DB, job_ids []string) (map[string][]JobDependency, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT job_id, depends_on_job_id, type
+		FROM job_dependencies
+		WHERE job_id = ANY($1)
+		ORDER BY job_id, depends_on_job_id`, libpq.Array(job_ids))
+	if err != nil {
+		log.Warning("Cannot select job dependencies: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	dependencies := make(map[string][]JobDependency)
+	for rows.Next() {
+		var job_id string
+		var dependency JobDependency
+		if err := rows.Scan(&job_id, &dependency.JobId, &dependency.Type); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		dependencies[job_id] = append(dependencies[job_id], dependency)
+	}
+	return dependencies, nil
+}
+
+// maxJobGraphEdges caps the size of a job graph so that a huge pipeline
+// cannot take the API down.
+const maxJobGraphEdges = 5000
+
+// jobGraphQuery selects the dependencies of everything upstream and
+// downstream of job $1, at most $2 of them. UNION (not UNION ALL) drops rows
+// we have already seen, which stops the recursion even if the dependencies
+// somehow form a cycle.
+const jobGraphQuery = `
+		WITH RECURSIVE upstream(job_id, depends_on_job_id, type) AS (
+			SELECT job_id, depends_on_job_id, type
+			FROM job_dependencies
+			WHERE job_id = $1
+			UNION
+			SELECT d.job_id, d.depends_on_job_id, d.type
+			FROM job_dependencies d
+			JOIN upstream u ON d.job_id = u.depends_on_job_id
+		), downstream(job_id, depends_on_job_id, type) AS (
+			SELECT job_id, depends_on_job_id, type
+			FROM job_dependencies
+			WHERE depends_on_job_id = $1
+			UNION
+			SELECT d.job_id, d.depends_on_job_id, d.type
+			FROM job_dependencies d
+			JOIN downstream u ON d.depends_on_job_id = u.job_id
+		)
+		SELECT job_id, depends_on_job_id, type FROM upstream
+		UNION
+		SELECT job_id, depends_on_job_id, type FROM downstream
+		LIMIT $2`
+
+func (pq *postgreSQLStore) GetJobGraph(ctx context.Context, jobid string) (*JobGraph, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.GetJobGraph")
+	defer span.Finish()
+
+	rows, err := pq.reader().QueryContext(ctx, jobGraphQuery, jobid, maxJobGraphEdges)
+	if err != nil {
+		log.Warning("Cannot select job graph: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	edges := make([]*JobGraphEdge, 0)
+	job_ids := []string{jobid}
+	for rows.Next() {
+		var edge JobGraphEdge
+		if err := rows.Scan(&edge.To, &edge.From, &edge.Type); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		edges = append(edges, &edge)
+		job_ids = append(job_ids, edge.From, edge.To)
+	}
+	if err := rows.Err(); err != nil {
+		log.Warning(err)
+		return nil, err
+	}
+
+	node_rows, err := pq.reader().QueryContext(ctx, `
+		SELECT job_id, job_name, status, job_queue
+		FROM jobs
+		WHERE job_id = ANY($1)`, libpq.Array(job_ids))
+	if err != nil {
+		log.Warning("Cannot select jobs of job graph: ", err)
+		return nil, err
+	}
+	defer node_rows.Close()
+
+	nodes := make(map[string]*JobGraphNode)
+	for node_rows.Next() {
+		node := JobGraphNode{Known: true}
+		if err := node_rows.Scan(&node.Id, &node.Name, &node.Status, &node.JobQueue); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		nodes[node.Id] = &node
+	}
+	if _, ok := nodes[jobid]; !ok {
+		return nil, nil
+	}
+
+	return newJobGraph(jobid, nodes, edges), nil
+}
 
-func (pq *postgreSQLStore) EstimateRunningLoadByJobQueue(queues []string) (map[string]RunningLoad, error) {
-	span := opentracing.StartSpan("PG.EstimateRunningLoadByJobQueue")
+func (pq *postgreSQLStore) EstimateRunningLoadByJobQueue(ctx context.Context, queues []string) (map[string]RunningLoad, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.EstimateRunningLoadByJobQueue")
 	defer span.Finish()
 
 	query := `
@@ -578,7 +1155,7 @@ func (pq *postgreSQLStore) EstimateRunningLoadByJobQueue(queues []string) (map[s
 	    status = 'STARTING' OR
 	    status = 'RUNNING'
 	    GROUP BY job_queue`
-	rows, err := pq.connection.Query(query)
+	rows, err := pq.connection.QueryContext(ctx, query)
 	if err != nil {
 		log.Error("EstimateRunningLoadByJobQueue failed to query database: ", err)
 		return nil, err
@@ -611,11 +1188,11 @@ func (pq *postgreSQLStore) EstimateRunningLoadByJobQueue(queues []string) (map[s
 	return mapping, nil
 }
 
-func (pq *postgreSQLStore) UpdateJobSummaryLog(job_summaries []JobSummary) error {
-	span := opentracing.StartSpan("PG.UpdateJobSummaryLog")
+func (pq *postgreSQLStore) UpdateJobSummaryLog(ctx context.Context, job_summaries []JobSummary) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.UpdateJobSummaryLog")
 	defer span.Finish()
 
-	ctx_timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx_timeout, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	transaction, err := pq.connection.BeginTx(ctx_timeout, &sql.TxOptions{Isolation: sql.LevelSerializable})
@@ -724,11 +1301,11 @@ func (pq *postgreSQLStore) UpdateJobSummaryLog(job_summaries []JobSummary) error
 	return nil
 }
 
-func (pq *postgreSQLStore) UpdateJobLogTerminationRequested(jobID string) error {
-	span := opentracing.StartSpan("PG.UpdateJobLogTerminationRequested")
+func (pq *postgreSQLStore) UpdateJobLogTerminationRequested(ctx context.Context, jobID string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.UpdateJobLogTerminationRequested")
 	defer span.Finish()
 
-	_, err := pq.connection.Exec(`UPDATE jobs SET termination_requested = 't' WHERE job_id = $1`, jobID)
+	_, err := pq.connection.ExecContext(ctx, `UPDATE jobs SET termination_requested = 't' WHERE job_id = $1`, jobID)
 	if err != nil {
 		log.Warning("Cannot update job termination requested status: ", err)
 	}
@@ -748,13 +1325,13 @@ func getRowsAsList(rows *sql.Rows) ([]string, error) {
 	return lst, nil
 }
 
-func (pq *postgreSQLStore) GetStartingStateStuckEC2Instances() ([]string, error) {
-	span := opentracing.StartSpan("PG.GetStartingStateStuckEC2Instances")
+func (pq *postgreSQLStore) GetStartingStateStuckEC2Instances(ctx context.Context) ([]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.GetStartingStateStuckEC2Instances")
 	defer span.Finish()
 
 	query := `SELECT DISTINCT ta.instance_id FROM jobs j JOIN task_arns_to_instance_info ta ON ta.task_arn = j.task_arn WHERE instance_id is not null AND (now() - last_updated) > '600 seconds' AND status = 'STARTING' AND j.task_arn is not null`
 
-	rows, err := pq.connection.Query(query)
+	rows, err := pq.connection.QueryContext(ctx, query)
 	if err != nil {
 		log.Warning("Cannot select jobs that are stuck in STARTING state: ", err)
 		return nil, err
@@ -768,13 +1345,13 @@ func (pq *postgreSQLStore) GetStartingStateStuckEC2Instances() ([]string, error)
 	return instances, nil
 }
 
-func (pq *postgreSQLStore) GetAliveEC2Instances() ([]string, error) {
-	span := opentracing.StartSpan("PG.GetAliveEC2Instances")
+func (pq *postgreSQLStore) GetAliveEC2Instances(ctx context.Context) ([]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.GetAliveEC2Instances")
 	defer span.Finish()
 
 	query := `SELECT DISTINCT instance_id FROM instances WHERE disappeared_at is null`
 
-	rows, err := pq.connection.Query(query)
+	rows, err := pq.connection.QueryContext(ctx, query)
 	if err != nil {
 		log.Warning("Cannot select alive EC2 instances from database: ", err)
 		return nil, err
@@ -788,11 +1365,11 @@ func (pq *postgreSQLStore) GetAliveEC2Instances() ([]string, error) {
 	return instances, nil
 }
 
-func (pq *postgreSQLStore) UpdateECSInstances(ec2info map[string]Ec2Info, tasks_per_ec2instance map[string][]string) error {
-	span := opentracing.StartSpan("PG.UpdateECSInstances")
+func (pq *postgreSQLStore) UpdateECSInstances(ctx context.Context, ec2info map[string]Ec2Info, tasks_per_ec2instance map[string][]string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.UpdateECSInstances")
 	defer span.Finish()
 
-	alive_instances, err := pq.GetAliveEC2Instances()
+	alive_instances, err := pq.GetAliveEC2Instances(ctx)
 	if err != nil {
 		return err
 	}
@@ -801,7 +1378,7 @@ func (pq *postgreSQLStore) UpdateECSInstances(ec2info map[string]Ec2Info, tasks_
 		alive_instances_set[instance_id] = true
 	}
 
-	transaction, err := pq.connection.Begin()
+	transaction, err := pq.connection.BeginTx(ctx, nil)
 	if err != nil {
 		log.Warning(err)
 		return err
@@ -915,11 +1492,11 @@ func (pq *postgreSQLStore) UpdateECSInstances(ec2info map[string]Ec2Info, tasks_
 	return nil
 }
 
-func (pq *postgreSQLStore) UpdateTaskArnsInstanceIDs(ec2info map[string]Ec2Info, task_ec2_mapping map[string]string) error {
-	span := opentracing.StartSpan("PG.UpdateTaskArnsInstanceIDs")
+func (pq *postgreSQLStore) UpdateTaskArnsInstanceIDs(ctx context.Context, ec2info map[string]Ec2Info, task_ec2_mapping map[string]string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.UpdateTaskArnsInstanceIDs")
 	defer span.Finish()
 
-	transaction, err := pq.connection.Begin()
+	transaction, err := pq.connection.BeginTx(ctx, nil)
 	if err != nil {
 		log.Warning(err)
 		return err
@@ -973,11 +1550,11 @@ func (pq *postgreSQLStore) UpdateTaskArnsInstanceIDs(ec2info map[string]Ec2Info,
 	return nil
 }
 
-func (pq *postgreSQLStore) GetStatus(jobid string) (*JobStatus, error) {
-	span := opentracing.StartSpan("PG.GetStatus")
+func (pq *postgreSQLStore) GetStatus(ctx context.Context, jobid string) (*JobStatus, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.GetStatus")
 	defer span.Finish()
 
-	rows, err := pq.connection.Query("SELECT status,job_id FROM jobs WHERE job_id = $1", jobid)
+	rows, err := pq.reader().QueryContext(ctx, "SELECT status,job_id FROM jobs WHERE job_id = $1", jobid)
 	if err != nil {
 		return nil, err
 	}
@@ -1000,11 +1577,46 @@ func (pq *postgreSQLStore) GetStatus(jobid string) (*JobStatus, error) {
 	}
 }
 
-func (pq *postgreSQLStore) UpdateComputeEnvironmentsLog(ce_lst []ComputeEnvironment) error {
-	span := opentracing.StartSpan("PG.UpdateComputeEnvironmentsLog")
+func (pq *postgreSQLStore) GetStatusHistory(ctx context.Context, jobid string) ([]*JobStatusChange, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.GetStatusHistory")
+	defer span.Finish()
+
+	query := `
+		SELECT job_id,
+		       old_status,
+		       new_status,
+		       changed_at,
+		       source
+		FROM job_status_history
+		WHERE job_id = $1
+		ORDER BY changed_at ASC`
+
+	rows, err := pq.reader().QueryContext(ctx, query, jobid)
+	if err != nil {
+		log.Warning("Cannot get job status history from database: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]*JobStatusChange, 0)
+	for rows.Next() {
+		var change JobStatusChange
+		if err := rows.Scan(&change.JobId, &change.OldStatus, &change.NewStatus, &change.ChangedAt, &change.Source); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		history = append(history, &change)
+	}
+	fillStatusChangeDurations(history)
+
+	return history, nil
+}
+
+func (pq *postgreSQLStore) UpdateComputeEnvironmentsLog(ctx context.Context, ce_lst []ComputeEnvironment) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.UpdateComputeEnvironmentsLog")
 	defer span.Finish()
 
-	transaction, err := pq.connection.Begin()
+	transaction, err := pq.connection.BeginTx(ctx, nil)
 	if err != nil {
 		log.Warning(err)
 		return err
@@ -1107,14 +1719,11 @@ func (pq *postgreSQLStore) UpdateComputeEnvironmentsLog(ce_lst []ComputeEnvironm
 	return nil
 }
 
-func (pq *postgreSQLStore) ActivateJobQueue(job_queue_name string) error {
-	span := opentracing.StartSpan("PG.ActivateJobQueue")
+func (pq *postgreSQLStore) ActivateJobQueue(ctx context.Context, job_queue_name string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.ActivateJobQueue")
 	defer span.Finish()
 
-	ctx_timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	transaction, err := pq.connection.BeginTx(ctx_timeout, &sql.TxOptions{})
+	transaction, err := pq.connection.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
 		log.Warning(err)
 		return err
@@ -1122,7 +1731,7 @@ func (pq *postgreSQLStore) ActivateJobQueue(job_queue_name string) error {
 	query := `
 	INSERT INTO activated_job_queues ( job_queue ) VALUES ( $1 ) ON CONFLICT DO NOTHING
 	`
-	_, err = transaction.ExecContext(ctx_timeout, query, job_queue_name)
+	_, err = transaction.ExecContext(ctx, query, job_queue_name)
 	if err != nil {
 		_ = transaction.Rollback()
 		return err
@@ -1137,14 +1746,11 @@ func (pq *postgreSQLStore) ActivateJobQueue(job_queue_name string) error {
 	return nil
 }
 
-func (pq *postgreSQLStore) DeactivateJobQueue(job_queue_name string) error {
-	span := opentracing.StartSpan("PG.DeactivateJobQueue")
+func (pq *postgreSQLStore) DeactivateJobQueue(ctx context.Context, job_queue_name string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.DeactivateJobQueue")
 	defer span.Finish()
 
-	ctx_timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	transaction, err := pq.connection.BeginTx(ctx_timeout, &sql.TxOptions{})
+	transaction, err := pq.connection.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
 		log.Warning(err)
 		return err
@@ -1152,7 +1758,7 @@ func (pq *postgreSQLStore) DeactivateJobQueue(job_queue_name string) error {
 	query := `
 	DELETE FROM activated_job_queues WHERE job_queue = $1
 	`
-	_, err = transaction.ExecContext(ctx_timeout, query, job_queue_name)
+	_, err = transaction.ExecContext(ctx, query, job_queue_name)
 	if err != nil {
 		_ = transaction.Rollback()
 		return err
@@ -1167,12 +1773,12 @@ func (pq *postgreSQLStore) DeactivateJobQueue(job_queue_name string) error {
 	return nil
 }
 
-func (pq *postgreSQLStore) ListActiveJobQueues() ([]string, error) {
-	span := opentracing.StartSpan("PG.ListActiveJobQueues")
+func (pq *postgreSQLStore) ListActiveJobQueues(ctx context.Context) ([]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.ListActiveJobQueues")
 	defer span.Finish()
 
 	query := `SELECT job_queue FROM activated_job_queues`
-	rows, err := pq.connection.Query(query)
+	rows, err := pq.connection.QueryContext(ctx, query)
 	if err != nil {
 		log.Error(query, " : failed with error: ", err)
 		return nil, err
@@ -1195,12 +1801,12 @@ func (pq *postgreSQLStore) ListActiveJobQueues() ([]string, error) {
 	return job_queue_names, nil
 }
 
-func (pq *postgreSQLStore) ListForcedScalingJobQueues() ([]string, error) {
-	span := opentracing.StartSpan("PG.ListForcedScalingJobQueues")
+func (pq *postgreSQLStore) ListForcedScalingJobQueues(ctx context.Context) ([]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.ListForcedScalingJobQueues")
 	defer span.Finish()
 
 	query := `SELECT job_queue FROM activated_job_queues WHERE forced_scaling`
-	rows, err := pq.connection.Query(query)
+	rows, err := pq.connection.QueryContext(ctx, query)
 	if err != nil {
 		log.Error(query, " : failed with error: ", err)
 		return nil, err
@@ -1223,83 +1829,51 @@ func (pq *postgreSQLStore) ListForcedScalingJobQueues() ([]string, error) {
 	return job_queue_names, nil
 }
 
-func (pq *postgreSQLStore) flushJobStatusSubscriptions() error {
-	span := opentracing.StartSpan("PG.flushJobStatusSubscriptions")
-	defer span.Finish()
-
-	// Sends status update to every subscription that have subscribed to job
-	// statuses, that have a job that's had an update.
-
-	job_ids := make([]string, 0)
-
-	ctx_timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	err := func() error {
-		tx, err := pq.connection.BeginTx(ctx_timeout, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
-		if err != nil {
-			log.Warning("Cannot get job statuses for notification purposes from database: ", err)
-			return err
-		}
-		should_commit := false
-		final := func() error {
-			if should_commit {
-				err := tx.Commit()
-				if err != nil {
-					log.Warning("Cannot commit transaction: ", err)
-					return err
-				}
-			} else {
-				err := tx.Rollback()
-				if err != nil {
-					log.Warning("Cannot roll back transaction: ", err)
-					return err
-				}
-			}
-			return nil
-		}
-		defer func() {
-			err := final()
-			if err != nil {
-				log.Warning("Cannot finalize flushJobStatusSubscriptions: ", err)
+// listenJobStatusEvents receives job status change notifications from
+// PostgreSQL and passes them on to local subscribers. Every batchiepatchie
+// process listens, so it doesn't matter which one made the change.
+func (pq *postgreSQLStore) listenJobStatusEvents() {
+	for {
+		select {
+		case <-pq.closed:
+			return
+		case notification, ok := <-pq.listener.Notify:
+			if !ok {
 				return
 			}
-		}()
-
-		query := `SELECT job_id FROM job_status_events`
-		rows, err := tx.QueryContext(ctx_timeout, query)
-		if err != nil {
-			log.Warning("Cannot get updated job IDs for the purposes of notifying subscribers: ", err)
-			return err
-		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var jobID string
-			if err := rows.Scan(&jobID); err != nil {
-				log.Warning("Cannot scan jobIDs from job_status_events: ", err)
-				return err
+			if notification == nil {
+				// The listener reconnected and we may have missed
+				// notifications while it was down. Send the current
+				// status to everyone, just in case.
+				log.Info("Job status listener reconnected, refreshing all subscriptions")
+				pq.notifyJobStatusSubscribers(pq.subscriptions.subscribedJobIDs())
+				continue
 			}
-			job_ids = append(job_ids, jobID)
-		}
-
-		_, err = tx.ExecContext(ctx_timeout, `DELETE FROM job_status_events`)
-		if err != nil {
-			log.Warning("Cannot delete from job_status_events: ", err)
-			return err
+			if !pq.subscriptions.hasSubscribers(notification.Extra) {
+				continue
+			}
+			pq.notifyJobStatusSubscribers([]string{notification.Extra})
+		case <-time.After(90 * time.Second):
+			// Make sure the connection is still alive; the listener
+			// reconnects by itself if it isn't.
+			go func() {
+				if err := pq.listener.Ping(); err != nil {
+					log.Warning("Job status listener ping failed: ", err)
+				}
+			}()
 		}
-		should_commit = true
-		return nil
-	}()
-
-	if err != nil {
-		return err
 	}
+}
+
+func (pq *postgreSQLStore) notifyJobStatusSubscribers(job_ids []string) {
+	span, ctx := opentracing.StartSpanFromContext(context.Background(), "PG.notifyJobStatusSubscribers")
+	defer span.Finish()
 
 	job_statuses := make([]Job, 0)
 	for _, job_id := range job_ids {
-		var job *Job
-		job, err := pq.FindOne(job_id)
+		// The notification came from the primary and the replica may not
+		// have the change yet.
+		job, err := pq.findOne(ctx, pq.connection, job_id)
 		if err != nil {
 			log.Warning("Cannot find job ", job_id, ": ", err)
 			// It can be normal not to find the job so we just log it and move on
@@ -1308,43 +1882,27 @@ func (pq *postgreSQLStore) flushJobStatusSubscriptions() error {
 		job_statuses = append(job_statuses, *job)
 	}
 
-	// At this point, we've flushed the database but next we need to tell
-	// all the subscribers about the events.
-	{
-		pq.jobStatusSubscribersLock.Lock()
-		defer pq.jobStatusSubscribersLock.Unlock()
-		for _, job_status := range job_statuses {
-			channels, ok := pq.jobStatusSubscribers[job_status.Id]
-			if !ok {
-				continue
-			}
-			for _, channel := range channels {
-				channel <- job_status
-			}
-		}
-	}
-
-	return nil
+	pq.subscriptions.notify(job_statuses)
 }
 
-func (pq *postgreSQLStore) JobStats(opts *JobStatsOptions) ([]*JobStats, error) {
-	span := opentracing.StartSpan("PG.JobStats")
+// JobStats reads job_stats_rollup, which triggers on jobs keep up to date as
+// jobs finish. The rollup is not touched by job cleanup.
+func (pq *postgreSQLStore) JobStats(ctx context.Context, opts *JobStatsOptions) ([]*JobStats, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.JobStats")
 	defer span.Finish()
 
 	query := `
 		SELECT
 			job_queue,
 			status,
-			FLOOR((EXTRACT(EPOCH FROM run_started_at) / $1)) * $1 AS interval_alias,
-			GREATEST(SUM(vcpus * EXTRACT(EPOCH FROM (stopped_at - run_started_at))), 0) vcpu_seconds,
-			GREATEST(SUM(memory * EXTRACT(EPOCH FROM (stopped_at - run_started_at))), 0) memory_seconds,
-			GREATEST(SUM(EXTRACT(EPOCH FROM (stopped_at - run_started_at))), 0) instance_seconds,
-			COUNT(*) job_count
-		FROM jobs
-		WHERE last_updated > TO_TIMESTAMP($2) AT TIME ZONE 'UTC'
-		AND last_updated < TO_TIMESTAMP($3) AT TIME ZONE 'UTC'
-		AND stopped_at IS NOT NULL
-		AND run_started_at IS NOT NULL
+			FLOOR((EXTRACT(EPOCH FROM bucket) / $1)) * $1 AS interval_alias,
+			GREATEST(SUM(vcpu_seconds), 0) vcpu_seconds,
+			GREATEST(SUM(memory_seconds), 0) memory_seconds,
+			GREATEST(SUM(instance_seconds), 0) instance_seconds,
+			SUM(job_count) job_count
+		FROM job_stats_rollup
+		WHERE bucket >= TO_TIMESTAMP($2)
+		AND bucket < TO_TIMESTAMP($3)
 	`
 
 	args := make([]interface{}, 0)
@@ -1380,12 +1938,13 @@ func (pq *postgreSQLStore) JobStats(opts *JobStatsOptions) ([]*JobStats, error)
 
 	query += `
 		GROUP BY job_queue, status, interval_alias
+		HAVING SUM(job_count) > 0
 		ORDER BY 1 ASC, 2 ASC, 3 DESC, 4 DESC, 5 DESC
 	`
 
-	rows, err := pq.connection.Query(query, args...)
+	rows, err := pq.reader().QueryContext(ctx, query, args...)
 	if err != nil {
-		log.Warning("Cannot find timed out jobs from database: ", err)
+		log.Warning("Cannot select job stats from database: ", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -1411,173 +1970,840 @@ func (pq *postgreSQLStore) SubscribeToJobStatus(jobID string) (<-chan Job, func(
 	// Subscribe to a job status. Returns a channel where new job events will
 	// be sent and a function unsubscribes from the subscription.
 	// It's important to use the unsubscriber function or memory will leak.
+	return pq.subscriptions.subscribe(jobID)
+}
 
-	pq.jobStatusSubscribersLock.Lock()
-	defer pq.jobStatusSubscribersLock.Unlock()
+// Close stops listening to job status events and closes the connections to
+// the primary and the read replica. Calling it again does nothing.
+func (pq *postgreSQLStore) Close() error {
+	var err error
+	pq.closeOnce.Do(func() {
+		err = pq.close()
+	})
+	return err
+}
 
-	existing_subscribers, ok := pq.jobStatusSubscribers[jobID]
-	if !ok {
-		existing_subscribers = make([]chan<- Job, 0)
+func (pq *postgreSQLStore) close() error {
+	close(pq.closed)
+	var first_err error
+	err := pq.listener.Close()
+	if err != nil {
+		log.Warning("Cannot close job status listener: ", err)
+		first_err = err
 	}
-
-	// Channels won't be sent more than ~5 things over its
-	// lifetime. We set capacity at 20 here.
-	status_channel := make(chan Job, 20)
-	existing_subscribers = append(existing_subscribers, status_channel)
-
-	// This function here undoes the subscription.
-	unsubscribe := func() {
-		pq.jobStatusSubscribersLock.Lock()
-		defer pq.jobStatusSubscribersLock.Unlock()
-		existing_subscribers, ok := pq.jobStatusSubscribers[jobID]
-		if !ok {
-			return
-		}
-		// Make new subscribers list, but without the channel that is
-		// being unsubscribed.  A bit slow (we are creating an entirely
-		// new list) but usually there is only 1 subscriber anyway.
-		new_subscribers := make([]chan<- Job, 0)
-		for _, channel := range existing_subscribers {
-			if channel != status_channel {
-				new_subscribers = append(new_subscribers, channel)
+	if pq.replica != nil {
+		err = pq.replica.connection.Close()
+		if err != nil {
+			log.Warning("Cannot close read replica connections: ", err)
+			if first_err == nil {
+				first_err = err
 			}
 		}
-
-		// If the new subscribers would be empty, delete the key. Let's
-		// not have our map grow in terms of number of keys infinitely.
-		if len(new_subscribers) == 0 {
-			delete(pq.jobStatusSubscribers, jobID)
-		} else {
-			pq.jobStatusSubscribers[jobID] = new_subscribers
+	}
+	err = pq.connection.Close()
+	if err != nil {
+		log.Warning("Cannot close database connections: ", err)
+		if first_err == nil {
+			first_err = err
 		}
-
-		log.Info("Subscription deregistered for job id: ", jobID, ", total number of job IDs monitored: ", len(pq.jobStatusSubscribers))
 	}
-
-	pq.jobStatusSubscribers[jobID] = existing_subscribers
-	log.Info("Subscription registered for job id: ", jobID, ", total number of job IDs monitored: ", len(pq.jobStatusSubscribers))
-
-	return status_channel, unsubscribe
+	return first_err
 }
 
-func (pq *postgreSQLStore) CleanOldJobs() error {
-	span := opentracing.StartSpan("PG.CleanOldJobs")
+// Ping checks the primary; a replica that cannot be reached is already
+// replaced by the primary for reads.
+func (pq *postgreSQLStore) Ping(ctx context.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.Ping")
 	defer span.Finish()
 
-	ctx_timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	transaction, err := pq.connection.BeginTx(ctx_timeout, &sql.TxOptions{})
+	err := pq.connection.PingContext(ctx)
 	if err != nil {
-		log.Warn(err)
+		log.Warning("Cannot ping database: ", err)
 		return err
 	}
+	return nil
+}
 
-	deleteInstanceInfo := `
-		DELETE FROM task_arns_to_instance_info
-		WHERE task_arn IN (
-			SELECT task_arn
-			FROM jobs
-			WHERE last_updated < NOW() - INTERVAL '30 day'
-		)`
-
-	_, err = transaction.ExecContext(ctx_timeout, deleteInstanceInfo)
-
-	if err != nil {
-		log.Warn(err)
-		newErr := transaction.Rollback()
-		if newErr != nil {
-			log.Warn(newErr)
-			return newErr
-		}
-		return err
+// selectOldJobIDs picks at most limit job IDs of jobs that have not been
+// updated in days days, leaving alone jobs restored in the last restored_days
+// days, or ever if restored_days is 0. If job_queue is nil, only jobs in table are
+// considered and jobs in excluded_queues are left alone; table is the default
+// partition or a monthly partition that cannot be dropped yet, as the other
+// monthly partitions are dropped whole. Otherwise only jobs in *job_queue are
+// considered.
+func (pq *postgreSQLStore) selectOldJobIDs(ctx context.Context, job_queue *string, table string, excluded_queues []string, days int, restored_days int, limit int) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	if job_queue != nil {
+		rows, err = pq.connection.QueryContext(ctx, `
+			SELECT job_id FROM jobs
+			WHERE job_queue = $1 AND last_updated < NOW() - $2::integer * INTERVAL '1 day'
+			AND (restored_at IS NULL OR ($3 > 0 AND restored_at < NOW() - $3::integer * INTERVAL '1 day'))
+			LIMIT $4`, *job_queue, days, restored_days, limit)
+	} else {
+		rows, err = pq.connection.QueryContext(ctx, `
+			SELECT job_id FROM `+libpq.QuoteIdentifier(table)+`
+			WHERE NOT (job_queue = ANY($1)) AND last_updated < NOW() - $2::integer * INTERVAL '1 day'
+			AND (restored_at IS NULL OR ($3 > 0 AND restored_at < NOW() - $3::integer * INTERVAL '1 day'))
+			LIMIT $4`, libpq.Array(excluded_queues), days, restored_days, limit)
 	}
-
-	query := `DELETE FROM jobs WHERE last_updated < NOW() - INTERVAL '30 day'`
-
-	_, err = transaction.ExecContext(ctx_timeout, query)
 	if err != nil {
 		log.Warn(err)
-		newErr := transaction.Rollback()
-		if newErr != nil {
-			log.Warn(newErr)
-			return newErr
-		}
-		return err
+		return nil, err
 	}
+	defer rows.Close()
+	return getRowsAsList(rows)
+}
 
-	err = transaction.Commit()
+// selectUnarchivedJobIDs returns the job IDs that were not archived with the
+// rest of their partition.
+func (pq *postgreSQLStore) selectUnarchivedJobIDs(ctx context.Context, job_ids []string, policy *RetentionPolicy) ([]string, error) {
+	args := append(keptJobArgs(policy), libpq.Array(job_ids))
+	rows, err := pq.connection.QueryContext(ctx, `
+		SELECT j.job_id FROM jobs j
+		WHERE j.job_id = ANY($5) AND `+unarchivedJobCondition, args...)
 	if err != nil {
-		log.Warn("Cannot commit transaction: ", err)
-		return err
+		log.Warning("Cannot select jobs that are not archived: ", err)
+		return nil, err
 	}
-
-	return nil
+	defer rows.Close()
+	return getRowsAsList(rows)
 }
 
-func (pq *postgreSQLStore) CleanOldInstanceEventLogs() error {
-	span := opentracing.StartSpan("PG.CleanOldInstanceEventLogs")
-	defer span.Finish()
-
-	ctx_timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// cleanOldJobsBatch archives (if the policy has an archiver) and then deletes
+// one batch of old jobs and everything that refers to them. Returns the
+// number of jobs deleted.
+func (pq *postgreSQLStore) cleanOldJobsBatch(ctx context.Context, job_queue *string, table string, excluded_queues []string, days int, policy *RetentionPolicy) (int, error) {
+	ctx_timeout, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	transaction, err := pq.connection.BeginTx(ctx_timeout, &sql.TxOptions{})
-	if err != nil {
-		log.Warn(err)
-		return err
+	job_ids, err := pq.selectOldJobIDs(ctx_timeout, job_queue, table, excluded_queues, days, policy.RestoredJobDays, policy.BatchSize)
+	if err != nil || len(job_ids) == 0 {
+		return 0, err
 	}
 
-	query := `DELETE FROM instance_event_log WHERE timestamp < NOW() - INTERVAL '30 day'`
+	if policy.Archiver != nil {
+		unarchived_job_ids, err := pq.selectUnarchivedJobIDs(ctx_timeout, job_ids, policy)
+		if err != nil {
+			return 0, err
+		}
+		archived_jobs, err := pq.findArchivedJobs(ctx_timeout, unarchived_job_ids)
+		if err != nil {
+			return 0, err
+		}
+		// Uploading can take a while; don't count it against the
+		// database timeout.
+		err = policy.Archiver.Archive(archived_jobs)
+		if err != nil {
+			return 0, err
+		}
+		ctx_timeout, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
 
-	_, err = transaction.ExecContext(ctx_timeout, query)
+	transaction, err := pq.connection.BeginTx(ctx_timeout, &sql.TxOptions{})
 	if err != nil {
 		log.Warn(err)
-		newErr := transaction.Rollback()
-		if newErr != nil {
-			log.Warn(newErr)
-			return newErr
+		return 0, err
+	}
+
+	queries := []string{
+		`DELETE FROM task_arns_to_instance_info
+		 WHERE task_arn IN (SELECT task_arn FROM jobs WHERE job_id = ANY($1))`,
+		`DELETE FROM job_status_history WHERE job_id = ANY($1)`,
+		`DELETE FROM job_attempts WHERE job_id = ANY($1)`,
+		`DELETE FROM job_dependencies WHERE job_id = ANY($1)`,
+		`DELETE FROM jobs WHERE job_id = ANY($1)`,
+	}
+	for _, query := range queries {
+		_, err = transaction.ExecContext(ctx_timeout, query, libpq.Array(job_ids))
+		if err != nil {
+			log.Warn(err)
+			newErr := transaction.Rollback()
+			if newErr != nil {
+				log.Warn(newErr)
+				return 0, newErr
+			}
+			return 0, err
 		}
-		return err
 	}
 
 	err = transaction.Commit()
 	if err != nil {
 		log.Warn("Cannot commit transaction: ", err)
-		return err
+		return 0, err
 	}
 
-	return nil
+	return len(job_ids), nil
 }
 
-func NewPostgreSQLStore(databaseHost string, databasePort int, databaseUsername string, databaseName string, databasePassword string, databaseRootCertificate string) (*postgreSQLStore, error) {
-	var dbstr string
-	if databaseRootCertificate == "" {
-		dbstr = fmt.Sprintf("user=%s dbname=%s host=%s port=%d password=%s sslmode=disable", databaseUsername, databaseName, databaseHost, databasePort, databasePassword)
-	} else {
-		dbstr = fmt.Sprintf("user=%s dbname=%s host=%s port=%d password=%s sslmode=verify-full sslrootcert=%s", databaseUsername, databaseName, databaseHost, databasePort, databasePassword, databaseRootCertificate)
-	}
-
-	db, err := sql.Open("postgres", dbstr)
-	if err != nil {
-		return nil, err
-	}
-
-	db.SetMaxOpenConns(500)
-
-	// sql.Open does not seem to exit early if anything failed with connection.
-	// We run one query we expect to succeed
-	rows, err := db.Query("SELECT * FROM pg_tables LIMIT 0")
-	if err != nil {
-		return nil, err
-	}
+// findArchivedJobs collects jobs, their status history, the instances they
+// ran on and the events of those instances while they ran for archiving.
+func (pq *postgreSQLStore) findArchivedJobs(ctx context.Context, job_ids []string) ([]*ArchivedJob, error) {
+	query := `
+			SELECT job_id,
+				job_name,
+				status,
+				job_definition,
+				last_updated,
+				job_queue,
+				image,
+				created_at,
+				stopped_at,
+				vcpus,
+				memory,
+				timeout,
+				command_line,
+				status_reason,
+				run_started_at,
+				exitcode,
+				log_stream_name,
+				termination_requested,
+				jobs.task_arn,
+				ta.instance_id,
+				ta.public_ip,
+				ta.private_ip,
+				jobs.array_properties,
+				jobs.parent_job_id,
+				jobs.array_index,
+				jobs.node_properties,
+				jobs.node_index
+			FROM jobs
+			LEFT OUTER JOIN task_arns_to_instance_info ta ON
+			ta.task_arn = jobs.task_arn
+			WHERE jobs.job_id = ANY($1)
+		`
+
+	rows, err := pq.connection.QueryContext(ctx, query, libpq.Array(job_ids))
+	if err != nil {
+		log.Warning("Cannot select jobs to archive: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	archived_jobs := make([]*ArchivedJob, 0, len(job_ids))
+	archived_jobs_by_id := make(map[string]*ArchivedJob)
+	instance_ids := make([]string, 0)
+	for rows.Next() {
+		var job Job
+		if err := rows.Scan(&job.Id, &job.Name, &job.Status, &job.Description, &job.LastUpdated, &job.JobQueue, &job.Image, &job.CreatedAt, &job.StoppedAt, &job.VCpus, &job.Memory, &job.Timeout, &job.CommandLine, &job.StatusReason, &job.RunStartTime, &job.ExitCode, &job.LogStreamName, &job.TerminationRequested, &job.TaskARN, &job.InstanceID, &job.PublicIP, &job.PrivateIP, &job.ArrayProperties, &job.ParentJobId, &job.ArrayIndex, &job.NodeProperties, &job.NodeIndex); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		archived_job := &ArchivedJob{Job: &job, StatusHistory: make([]*JobStatusChange, 0)}
+		archived_jobs = append(archived_jobs, archived_job)
+		archived_jobs_by_id[job.Id] = archived_job
+		if job.InstanceID != nil {
+			instance_ids = append(instance_ids, *job.InstanceID)
+		}
+	}
+
+	history_rows, err := pq.connection.QueryContext(ctx, `
+		SELECT job_id, old_status, new_status, changed_at, source
+		FROM job_status_history
+		WHERE job_id = ANY($1)
+		ORDER BY job_id, changed_at ASC`, libpq.Array(job_ids))
+	if err != nil {
+		log.Warning("Cannot select job status history to archive: ", err)
+		return nil, err
+	}
+	defer history_rows.Close()
+	for history_rows.Next() {
+		var change JobStatusChange
+		if err := history_rows.Scan(&change.JobId, &change.OldStatus, &change.NewStatus, &change.ChangedAt, &change.Source); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		if archived_job, ok := archived_jobs_by_id[change.JobId]; ok {
+			archived_job.StatusHistory = append(archived_job.StatusHistory, &change)
+		}
+	}
+	for _, archived_job := range archived_jobs {
+		fillStatusChangeDurations(archived_job.StatusHistory)
+	}
+
+	attempts, err := findJobAttempts(ctx, pq.connection, job_ids)
+	if err != nil {
+		return nil, err
+	}
+	dependencies, err := findJobDependencies(ctx, pq.connection, job_ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, archived_job := range archived_jobs {
+		archived_job.Job.Attempts = attempts[archived_job.Job.Id]
+		archived_job.Job.DependsOn = dependencies[archived_job.Job.Id]
+	}
+
+	instance_rows, err := pq.connection.QueryContext(ctx, `
+		SELECT instance_id,
+			appeared_at,
+			disappeared_at,
+			launched_at,
+			ami,
+			instance_type,
+			compute_environment_arn,
+			ecs_cluster_arn,
+			availability_zone,
+			spot_instance_request_id,
+			private_ip_address,
+			public_ip_address
+		FROM instances
+		WHERE instance_id = ANY($1)`, libpq.Array(instance_ids))
+	if err != nil {
+		log.Warning("Cannot select instances to archive: ", err)
+		return nil, err
+	}
+	defer instance_rows.Close()
+	instances := make(map[string]*ArchivedInstance)
+	for instance_rows.Next() {
+		var instance ArchivedInstance
+		if err := instance_rows.Scan(&instance.InstanceID, &instance.AppearedAt, &instance.DisappearedAt, &instance.LaunchedAt, &instance.AMI, &instance.InstanceType, &instance.ComputeEnvironmentARN, &instance.ECSClusterARN, &instance.AvailabilityZone, &instance.SpotInstanceRequestID, &instance.PrivateIP, &instance.PublicIP); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		instances[instance.InstanceID] = &instance
+	}
+	for _, archived_job := range archived_jobs {
+		if archived_job.Job.InstanceID != nil {
+			archived_job.Instance = instances[*archived_job.Job.InstanceID]
+		}
+	}
+
+	event_rows, err := pq.connection.QueryContext(ctx, `
+		SELECT jobs.job_id, e.timestamp, e.instance_id, e.active_jobs
+		FROM jobs
+		JOIN task_arns_to_instance_info ta ON ta.task_arn = jobs.task_arn
+		JOIN instance_event_log e ON e.instance_id = ta.instance_id
+		AND e.timestamp >= jobs.run_started_at
+		AND e.timestamp <= COALESCE(jobs.stopped_at, jobs.last_updated)
+		WHERE jobs.job_id = ANY($1)
+		ORDER BY jobs.job_id, e.timestamp`, libpq.Array(job_ids))
+	if err != nil {
+		log.Warning("Cannot select instance events to archive: ", err)
+		return nil, err
+	}
+	defer event_rows.Close()
+	for event_rows.Next() {
+		var job_id string
+		var active_jobs []byte
+		var event ArchivedInstanceEvent
+		if err := event_rows.Scan(&job_id, &event.Timestamp, &event.InstanceID, &active_jobs); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		if err := json.Unmarshal(active_jobs, &event.ActiveJobs); err != nil {
+			log.Warning("Cannot parse active jobs of instance ", event.InstanceID, ": ", err)
+			return nil, err
+		}
+		if archived_job, ok := archived_jobs_by_id[job_id]; ok {
+			archived_job.InstanceEvents = append(archived_job.InstanceEvents, &event)
+		}
+	}
+
+	return archived_jobs, nil
+}
+
+func (pq *postgreSQLStore) CleanOldJobs(ctx context.Context, policy *RetentionPolicy) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.CleanOldJobs")
+	defer span.Finish()
+
+	// A partition that cannot be dropped must not stop the rest of the
+	// cleaning.
+	kept_partitions, partitions_err := pq.cleanOldJobPartitions(ctx, policy)
+	if partitions_err != nil {
+		log.Warning("Cannot clean some partitions of jobs, cleaning row by row: ", partitions_err)
+	}
+
+	clean := func(job_queue *string, table string, excluded_queues []string, days int) error {
+		if days <= 0 {
+			return nil
+		}
+		for {
+			deleted, err := pq.cleanOldJobsBatch(ctx, job_queue, table, excluded_queues, days, policy)
+			if err != nil {
+				return err
+			}
+			if deleted < policy.BatchSize {
+				return nil
+			}
+		}
+	}
+
+	overridden_queues := make([]string, 0, len(policy.JobQueueDays))
+	for job_queue, days := range policy.JobQueueDays {
+		overridden_queues = append(overridden_queues, job_queue)
+		job_queue := job_queue
+		if err := clean(&job_queue, "", nil, days); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range append([]string{"jobs_default"}, kept_partitions...) {
+		if err := clean(nil, table, overridden_queues, policy.JobDays); err != nil {
+			return err
+		}
+	}
+	return partitions_err
+}
+
+// cleanInBatches runs a DELETE statement over and over until it deletes fewer
+// than batch_size rows. The statement gets the number of days as $1 and the
+// batch size as $2.
+func (pq *postgreSQLStore) cleanInBatches(ctx context.Context, query string, days int, batch_size int) error {
+	if days <= 0 {
+		return nil
+	}
+	return pq.deleteInBatches(ctx, query, batch_size, days, batch_size)
+}
+
+// deleteInBatches runs a DELETE statement with args over and over until it
+// deletes fewer than batch_size rows. Every round runs in its own transaction
+// so no single round can hit the timeout on a big table.
+func (pq *postgreSQLStore) deleteInBatches(ctx context.Context, query string, batch_size int, args ...interface{}) error {
+	for {
+		ctx_timeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+		result, err := pq.connection.ExecContext(ctx_timeout, query, args...)
+		cancel()
+		if err != nil {
+			log.Warn(err)
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			log.Warn(err)
+			return err
+		}
+		if deleted < int64(batch_size) {
+			return nil
+		}
+	}
+}
+
+func (pq *postgreSQLStore) CleanOldInstanceEventLogs(ctx context.Context, policy *RetentionPolicy) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.CleanOldInstanceEventLogs")
+	defer span.Finish()
+
+	// Restored events are aged from when they were restored.
+	return pq.cleanOldPartitions(ctx, "instance_event_log", "COALESCE(restored_at, timestamp)", policy.InstanceEventLogDays, policy.BatchSize)
+}
+
+func (pq *postgreSQLStore) CleanOldJobSummaryEventLogs(ctx context.Context, policy *RetentionPolicy) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.CleanOldJobSummaryEventLogs")
+	defer span.Finish()
+
+	return pq.cleanOldPartitions(ctx, "job_summary_event_log", "timestamp", policy.JobSummaryEventLogDays, policy.BatchSize)
+}
+
+func (pq *postgreSQLStore) CleanOldComputeEnvironmentEventLogs(ctx context.Context, policy *RetentionPolicy) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.CleanOldComputeEnvironmentEventLogs")
+	defer span.Finish()
+
+	return pq.cleanOldPartitions(ctx, "compute_environment_event_log", "timestamp", policy.ComputeEnvironmentEventLogDays, policy.BatchSize)
+}
+
+func (pq *postgreSQLStore) CleanOldInstances(ctx context.Context, policy *RetentionPolicy) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.CleanOldInstances")
+	defer span.Finish()
+
+	return pq.cleanInBatches(ctx, `
+		DELETE FROM instances WHERE instance_id IN (
+			SELECT instance_id FROM instances
+			WHERE disappeared_at < NOW() - $1::integer * INTERVAL '1 day'
+			LIMIT $2
+		)`, policy.InstanceDays, policy.BatchSize)
+}
+
+// Restore puts archived jobs back into the database. Jobs that still exist
+// are left untouched; for the others, the archived status history replaces
+// the single history row the insert trigger writes, and restored_at is set so
+// that the cleaner keeps them for RetentionPolicy.RestoredJobDays. Archived
+// instance events that are missing are put back as well.
+func (pq *postgreSQLStore) Restore(ctx context.Context, archived_jobs []*ArchivedJob) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.Restore")
+	defer span.Finish()
+
+	transaction, err := pq.connection.BeginTx(ctx, nil)
+	if err != nil {
+		log.Warning(err)
+		return err
+	}
+	should_commit := false
+	defer func() {
+		if should_commit {
+			return
+		}
+		err := transaction.Rollback()
+		if err != nil {
+			log.Warning("Cannot roll back transaction: ", err)
+		}
+	}()
+
+	err = setStatusChangeSource(transaction, StatusChangeFromRestore)
+	if err != nil {
+		return err
+	}
+
+	restored_jobs := make([]*Job, 0, len(archived_jobs))
+	for _, archived_job := range archived_jobs {
+		job := archived_job.Job
+		var job_id string
+		err = transaction.QueryRow(`
+			INSERT INTO jobs (
+				job_id,
+				job_name,
+				job_definition,
+				job_queue,
+				image,
+				status,
+				created_at,
+				stopped_at,
+				vcpus,
+				memory,
+				timeout,
+				command_line,
+				last_updated,
+				status_reason,
+				run_started_at,
+				exitcode,
+				log_stream_name,
+				termination_requested,
+				task_arn,
+				array_properties,
+				parent_job_id,
+				array_index,
+				node_properties,
+				node_index,
+				restored_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, NOW())
+			ON CONFLICT (job_id, created_at) DO NOTHING
+			RETURNING job_id`,
+			job.Id,
+			job.Name,
+			job.Description,
+			job.JobQueue,
+			job.Image,
+			job.Status,
+			job.CreatedAt,
+			job.StoppedAt,
+			job.VCpus,
+			job.Memory,
+			job.Timeout,
+			job.CommandLine,
+			job.LastUpdated,
+			job.StatusReason,
+			job.RunStartTime,
+			job.ExitCode,
+			job.LogStreamName,
+			job.TerminationRequested,
+			job.TaskARN,
+			job.ArrayProperties,
+			job.ParentJobId,
+			job.ArrayIndex,
+			job.NodeProperties,
+			job.NodeIndex).Scan(&job_id)
+		if err == sql.ErrNoRows {
+			log.Info("Job ", job.Id, " is already in the database, not restoring it.")
+			continue
+		}
+		if err != nil {
+			log.Warning("Cannot restore job ", job.Id, ": ", err)
+			return err
+		}
+		restored_jobs = append(restored_jobs, job)
+
+		_, err = transaction.Exec(`DELETE FROM job_status_history WHERE job_id = $1`, job.Id)
+		if err != nil {
+			log.Warning("Cannot restore job status history: ", err)
+			return err
+		}
+		for _, change := range archived_job.StatusHistory {
+			_, err = transaction.Exec(`
+				INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+				VALUES ( $1, $2, $3, $4, $5 )`,
+				job.Id, change.OldStatus, change.NewStatus, change.ChangedAt, change.Source)
+			if err != nil {
+				log.Warning("Cannot restore job status history: ", err)
+				return err
+			}
+		}
+
+		if job.TaskARN != nil && job.InstanceID != nil && job.PublicIP != nil && job.PrivateIP != nil {
+			_, err = transaction.Exec(`
+				INSERT INTO task_arns_to_instance_info
+				  ( task_arn, instance_id, public_ip, private_ip )
+				VALUES ( $1, $2, $3, $4 )
+				ON CONFLICT DO NOTHING`,
+				job.TaskARN, job.InstanceID, job.PublicIP, job.PrivateIP)
+			if err != nil {
+				log.Warning("Cannot restore task ARN instance info: ", err)
+				return err
+			}
+		}
+
+		instance := archived_job.Instance
+		if instance != nil {
+			_, err = transaction.Exec(`
+				INSERT INTO instances
+				    ( appeared_at
+				    , disappeared_at
+				    , launched_at
+				    , ami
+				    , instance_id
+				    , instance_type
+				    , compute_environment_arn
+				    , ecs_cluster_arn
+				    , availability_zone
+				    , spot_instance_request_id
+				    , private_ip_address
+				    , public_ip_address )
+				VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12 )
+				ON CONFLICT (instance_id) DO NOTHING`,
+				instance.AppearedAt,
+				instance.DisappearedAt,
+				instance.LaunchedAt,
+				instance.AMI,
+				instance.InstanceID,
+				instance.InstanceType,
+				instance.ComputeEnvironmentARN,
+				instance.ECSClusterARN,
+				instance.AvailabilityZone,
+				instance.SpotInstanceRequestID,
+				instance.PrivateIP,
+				instance.PublicIP)
+			if err != nil {
+				log.Warning("Cannot restore instance ", instance.InstanceID, ": ", err)
+				return err
+			}
+		}
+
+		for _, event := range archived_job.InstanceEvents {
+			active_jobs, err := json.Marshal(event.ActiveJobs)
+			if err != nil {
+				log.Warning("Cannot marshal some JSON: ", event.ActiveJobs)
+				return err
+			}
+			_, err = transaction.Exec(`
+				INSERT INTO instance_event_log ( timestamp, instance_id, active_jobs, restored_at )
+				VALUES ( $1, $2, $3, NOW() )
+				ON CONFLICT DO NOTHING`,
+				event.Timestamp, event.InstanceID, active_jobs)
+			if err != nil {
+				log.Warning("Cannot restore instance event log: ", err)
+				return err
+			}
+		}
+	}
+
+	err = mergeJobAttempts(ctx, transaction, restored_jobs)
+	if err != nil {
+		return err
+	}
+	err = mergeJobDependencies(ctx, transaction, restored_jobs)
+	if err != nil {
+		return err
+	}
+
+	should_commit = true
+	err = transaction.Commit()
+	if err != nil {
+		log.Warning("Cannot commit transaction: ", err)
+		return err
+	}
+	log.Info("Restored ", len(restored_jobs), " of ", len(archived_jobs), " archived jobs.")
+	return nil
+}
+
+func (pq *postgreSQLStore) StoreJobDefinitions(ctx context.Context, job_definitions []*JobDefinition) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.StoreJobDefinitions")
+	defer span.Finish()
+
+	// Revisions do not change once registered, but they can be
+	// deregistered.
+	query := `
+		INSERT INTO job_definitions
+		  ( arn, name, revision, type, status, image, vcpus, memory, command_line, environment, timeout, retry_strategy, parameters, synced_at )
+		VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14 )
+		ON CONFLICT (arn) DO UPDATE SET status = EXCLUDED.status, synced_at = EXCLUDED.synced_at
+		WHERE job_definitions.status <> EXCLUDED.status
+		`
+	for _, job_definition := range job_definitions {
+		environment, err := json.Marshal(job_definition.Environment)
+		if err != nil {
+			log.Warning(err)
+			return err
+		}
+		retry_strategy, err := json.Marshal(job_definition.RetryStrategy)
+		if err != nil {
+			log.Warning(err)
+			return err
+		}
+		parameters, err := json.Marshal(job_definition.Parameters)
+		if err != nil {
+			log.Warning(err)
+			return err
+		}
+		_, err = pq.connection.ExecContext(ctx,
+			query,
+			job_definition.ARN,
+			job_definition.Name,
+			job_definition.Revision,
+			job_definition.Type,
+			job_definition.Status,
+			job_definition.Image,
+			job_definition.VCpus,
+			job_definition.Memory,
+			job_definition.CommandLine,
+			string(environment),
+			job_definition.Timeout,
+			string(retry_strategy),
+			string(parameters),
+			job_definition.SyncedAt)
+		if err != nil {
+			log.Warning("Cannot store job definition ", job_definition.ARN, ": ", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// scanJobDefinitions reads job definitions selected with all their columns.
+func scanJobDefinitions(rows *sql.Rows) ([]*JobDefinition, error) {
+	job_definitions := make([]*JobDefinition, 0)
+	for rows.Next() {
+		var job_definition JobDefinition
+		var environment, retry_strategy, parameters []byte
+		if err := rows.Scan(&job_definition.ARN, &job_definition.Name, &job_definition.Revision, &job_definition.Type, &job_definition.Status, &job_definition.Image, &job_definition.VCpus, &job_definition.Memory, &job_definition.CommandLine, &environment, &job_definition.Timeout, &retry_strategy, &parameters, &job_definition.SyncedAt); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		if err := json.Unmarshal(environment, &job_definition.Environment); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		if retry_strategy != nil {
+			if err := json.Unmarshal(retry_strategy, &job_definition.RetryStrategy); err != nil {
+				log.Warning(err)
+				return nil, err
+			}
+		}
+		if err := json.Unmarshal(parameters, &job_definition.Parameters); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		job_definitions = append(job_definitions, &job_definition)
+	}
+	return job_definitions, rows.Err()
+}
+
+const jobDefinitionColumns = `arn, name, revision, type, status, image, vcpus, memory, command_line, environment, timeout, retry_strategy, parameters, synced_at`
+
+func (pq *postgreSQLStore) ListJobDefinitions(ctx context.Context, name string) ([]*JobDefinition, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.ListJobDefinitions")
+	defer span.Finish()
+
+	var rows *sql.Rows
+	var err error
+	if name == "" {
+		rows, err = pq.reader().QueryContext(ctx, `
+			SELECT DISTINCT ON (name) `+jobDefinitionColumns+`
+			FROM job_definitions
+			ORDER BY name ASC, revision DESC`)
+	} else {
+		rows, err = pq.reader().QueryContext(ctx, `
+			SELECT `+jobDefinitionColumns+`
+			FROM job_definitions
+			WHERE name = $1
+			ORDER BY revision DESC`, name)
+	}
+	if err != nil {
+		log.Warning("Cannot select job definitions: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanJobDefinitions(rows)
+}
+
+func (pq *postgreSQLStore) GetJobDefinition(ctx context.Context, name string, revision int64) (*JobDefinition, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PG.GetJobDefinition")
+	defer span.Finish()
+
+	return getJobDefinition(ctx, pq.reader(), name, revision)
+}
+
+func getJobDefinition(ctx context.Context, db *sql.DB, name string, revision int64) (*JobDefinition, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+jobDefinitionColumns+`
+		FROM job_definitions
+		WHERE name = $1 AND revision = $2`, name, revision)
+	if err != nil {
+		log.Warning("Cannot select job definition: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	job_definitions, err := scanJobDefinitions(rows)
+	if err != nil || len(job_definitions) == 0 {
+		return nil, err
+	}
+	return job_definitions[0], nil
+}
+
+func postgreSQLConnectionString(databaseHost string, databasePort int, databaseUsername string, databaseName string, databasePassword string, databaseRootCertificate string) string {
+	if databaseRootCertificate == "" {
+		return fmt.Sprintf("user=%s dbname=%s host=%s port=%d password=%s sslmode=disable", databaseUsername, databaseName, databaseHost, databasePort, databasePassword)
+	}
+	return fmt.Sprintf("user=%s dbname=%s host=%s port=%d password=%s sslmode=verify-full sslrootcert=%s", databaseUsername, databaseName, databaseHost, databasePort, databasePassword, databaseRootCertificate)
+}
+
+// OpenPostgreSQL connects to the database without setting up a store. It is
+// meant for tools such as schema migrations.
+func OpenPostgreSQL(databaseHost string, databasePort int, databaseUsername string, databaseName string, databasePassword string, databaseRootCertificate string) (*sql.DB, error) {
+	dbstr := postgreSQLConnectionString(databaseHost, databasePort, databaseUsername, databaseName, databasePassword, databaseRootCertificate)
+	db, err := sql.Open("postgres", dbstr)
+	if err != nil {
+		return nil, err
+	}
+
+	// sql.Open does not seem to exit early if anything failed with connection.
+	// We run one query we expect to succeed
+	rows, err := db.Query("SELECT * FROM pg_tables LIMIT 0")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 	rows.Close()
+	return db, nil
+}
+
+func NewPostgreSQLStore(databaseHost string, databasePort int, databaseUsername string, databaseName string, databasePassword string, databaseRootCertificate string) (*postgreSQLStore, error) {
+	dbstr := postgreSQLConnectionString(databaseHost, databasePort, databaseUsername, databaseName, databasePassword, databaseRootCertificate)
+	db, err := OpenPostgreSQL(databaseHost, databasePort, databaseUsername, databaseName, databasePassword, databaseRootCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(500)
+
+	listener := libpq.NewListener(dbstr, 10*time.Second, time.Minute, func(event libpq.ListenerEventType, err error) {
+		if err != nil {
+			log.Warning("Job status listener: ", err)
+		}
+	})
+	err = listener.Listen("job_status_events")
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
 
 	ret := postgreSQLStore{
-		connection:               db,
-		jobStatusSubscribers:     make(map[string][]chan<- Job),
-		jobStatusSubscribersLock: sync.Mutex{},
+		connection:    db,
+		listener:      listener,
+		subscriptions: newJobStatusSubscriptions(),
+		closed:        make(chan struct{}),
 	}
+	go ret.listenJobStatusEvents()
 
 	return &ret, nil
 }
@@ -0,0 +1,213 @@
+package jobs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// squash collapses whitespace so queries can be compared regardless of
+// indentation.
+func squash(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+func TestFindJobsQuery(t *testing.T) {
+	search, err := ParseSearch("queue:etl-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args := findJobsQuery(&Options{
+		Search:    search,
+		DateRange: "1d",
+		Limit:     50,
+		Offset:    100,
+		Queues:    []string{"etl-prod", "etl-dev"},
+		SortBy:    "name",
+		SortAsc:   true,
+		Status:    []string{StatusFailed},
+	})
+
+	expected := "FROM jobs WHERE (status IN ($4) AND job_queue IN ($5,$6)) AND ((last_updated > (now() - interval '86400 seconds') AND job_queue ILIKE $3)) ORDER BY job_name ASC, job_id ASC LIMIT $1 OFFSET $2"
+	if !strings.HasSuffix(squash(query), expected) {
+		t.Errorf("Expected query to end with %q, got %q", expected, squash(query))
+	}
+	expected_args := []interface{}{50, 100, "etl-%", StatusFailed, "etl-prod", "etl-dev"}
+	if len(args) != len(expected_args) {
+		t.Fatalf("Expected arguments %v, got %v", expected_args, args)
+	}
+	for i, arg := range expected_args {
+		if args[i] != arg {
+			t.Errorf("Expected argument $%d to be %v, got %v", i+1, arg, args[i])
+		}
+	}
+}
+
+func TestFindJobsQueryDefaults(t *testing.T) {
+	query, args := findJobsQuery(&Options{Limit: 10})
+
+	expected := "FROM jobs WHERE (last_updated > (now() - interval '2592000 seconds')) ORDER BY last_updated DESC, job_id DESC LIMIT $1 OFFSET $2"
+	if !strings.HasSuffix(squash(query), expected) {
+		t.Errorf("Expected query to end with %q, got %q", expected, squash(query))
+	}
+	if len(args) != 2 || args[0] != 10 || args[1] != 0 {
+		t.Errorf("Unexpected arguments: %v", args)
+	}
+}
+
+func TestFindJobsQueryCursor(t *testing.T) {
+	last_updated := time.Date(2020, 1, 10, 12, 0, 0, 123456000, time.UTC)
+	stopped_at := time.Date(2020, 1, 10, 13, 0, 0, 0, time.UTC)
+	job := &Job{Id: "job-7", Name: "nightly", Status: StatusSucceeded, LastUpdated: last_updated, StoppedAt: &stopped_at}
+	running_job := &Job{Id: "job-8", Name: "hourly", Status: StatusRunning, LastUpdated: last_updated}
+
+	for _, test := range []struct {
+		job        *Job
+		sort_by    string
+		sort_asc   bool
+		expression string
+		value      string
+		value_type string
+	}{
+		{job, "id", true, "job_id", "job-7", "text"},
+		{job, "name", false, "job_name", "nightly", "text"},
+		{job, "status", true, "status", StatusSucceeded, "text"},
+		{job, "last_updated", false, "last_updated", "2020-01-10T12:00:00.123456Z", "timestamptz"},
+		{job, "", true, "last_updated", "2020-01-10T12:00:00.123456Z", "timestamptz"},
+		{job, "stopped_at", true, "COALESCE(stopped_at, 'infinity'::timestamptz)", "2020-01-10T13:00:00Z", "timestamptz"},
+		{running_job, "stopped_at", false, "COALESCE(stopped_at, 'infinity'::timestamptz)", "infinity", "timestamptz"},
+	} {
+		cursor, err := DecodeCursor(NewCursor(test.job, test.sort_by, test.sort_asc).Encode())
+		if err != nil {
+			t.Fatalf("Cannot decode cursor sorted by %q: %v", test.sort_by, err)
+		}
+		cursor_job, err := cursor.job()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compareJobsByColumn(cursor_job, test.job, parseSortColumn(test.sort_by)) != 0 {
+			t.Errorf("Cursor sorted by %q does not point at the job it was made from", test.sort_by)
+		}
+
+		query, args := findJobsQuery(&Options{Limit: 20, Offset: 40, SortBy: test.sort_by, SortAsc: test.sort_asc, Cursor: cursor})
+
+		direction, comparison := "DESC", "<"
+		if test.sort_asc {
+			direction, comparison = "ASC", ">"
+		}
+		expected_where := "(" + test.expression + ", job_id) " + comparison + " ($3::" + test.value_type + ", $4)"
+		if !strings.Contains(squash(query), expected_where) {
+			t.Errorf("Expected %q in query sorted by %q, got %q", expected_where, test.sort_by, squash(query))
+		}
+		expected_order := "ORDER BY " + test.expression + " " + direction + ", job_id " + direction
+		if !strings.Contains(squash(query), expected_order) {
+			t.Errorf("Expected %q in query sorted by %q, got %q", expected_order, test.sort_by, squash(query))
+		}
+		if len(args) != 4 || args[0] != 20 || args[1] != 0 || args[2] != test.value || args[3] != test.job.Id {
+			t.Errorf("Unexpected arguments for query sorted by %q: %v", test.sort_by, args)
+		}
+	}
+}
+
+func TestArrayChildrenQuery(t *testing.T) {
+	query, args := arrayChildrenQuery(&ArrayChildrenOptions{ParentJobId: "parent", Limit: 100})
+	if !strings.Contains(squash(query), "WHERE parent_job_id = $1 AND array_index IS NOT NULL ORDER BY array_index ASC LIMIT $2") {
+		t.Errorf("Unexpected query: %q", squash(query))
+	}
+	if len(args) != 2 || args[0] != "parent" || args[1] != 100 {
+		t.Errorf("Unexpected arguments: %v", args)
+	}
+
+	after_index := int64(41)
+	query, args = arrayChildrenQuery(&ArrayChildrenOptions{ParentJobId: "parent", Limit: 100, Status: []string{StatusFailed}, AfterIndex: &after_index})
+	if !strings.Contains(squash(query), "WHERE parent_job_id = $1 AND array_index IS NOT NULL AND status = ANY($3) AND array_index > $4 ORDER BY array_index ASC LIMIT $2") {
+		t.Errorf("Unexpected query: %q", squash(query))
+	}
+	if len(args) != 4 || args[3] != after_index {
+		t.Errorf("Unexpected arguments: %v", args)
+	}
+}
+
+func TestArrayFailedIndexesQuery(t *testing.T) {
+	expected := "SELECT array_index FROM jobs WHERE parent_job_id = $1 AND array_index IS NOT NULL AND status = 'FAILED' ORDER BY array_index ASC"
+	if squash(arrayFailedIndexesQuery) != expected {
+		t.Errorf("Expected query %q, got %q", expected, squash(arrayFailedIndexesQuery))
+	}
+}
+
+func TestArchiveJobPartitionQuery(t *testing.T) {
+	query := squash(archiveJobPartitionQuery("jobs_p202001"))
+	for _, expected := range []string{
+		`FROM "jobs_p202001" j WHERE j.job_id > $6 AND NOT ( (NOT (j.job_queue = ANY($2)) AND j.last_updated >= $5::timestamptz - $1::integer * INTERVAL '1 day')`,
+		`WHERE pa.partition_name = j.tableoid::regclass::text AND NOT ( (NOT (j.job_queue = ANY($2)) AND j.last_updated >= pa.archived_at - $1::integer * INTERVAL '1 day')`,
+		`OR (j.restored_at IS NOT NULL AND ($4 <= 0 OR j.restored_at >= pa.archived_at - $4::integer * INTERVAL '1 day'))))`,
+		`ORDER BY j.job_id LIMIT $7`,
+	} {
+		if !strings.Contains(query, expected) {
+			t.Errorf("Expected query to contain %q, got %q", expected, query)
+		}
+	}
+
+	archived_at := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	args := archiveJobPartitionArgs(&RetentionPolicy{JobDays: 30, RestoredJobDays: 7, BatchSize: 100}, archived_at, "job-7")
+	if len(args) != 7 || args[0] != 30 || args[3] != 7 || args[4] != archived_at || args[5] != "job-7" || args[6] != 100 {
+		t.Errorf("Unexpected arguments: %v", args)
+	}
+}
+
+func TestMergeJobAttemptsQuery(t *testing.T) {
+	query := squash(mergeJobAttemptsQuery())
+	expected := "INSERT INTO job_attempts ( job_id, attempt, started_at, stopped_at, exitcode, reason, task_arn, container_instance_arn, log_stream_name ) " +
+		"SELECT job_id, attempt, started_at, stopped_at, exitcode, reason, task_arn, container_instance_arn, log_stream_name FROM job_attempts_staging " +
+		"ON CONFLICT (job_id, attempt) DO UPDATE SET started_at = EXCLUDED.started_at, stopped_at = EXCLUDED.stopped_at, exitcode = EXCLUDED.exitcode, reason = EXCLUDED.reason, " +
+		"task_arn = EXCLUDED.task_arn, container_instance_arn = EXCLUDED.container_instance_arn, log_stream_name = EXCLUDED.log_stream_name " +
+		"WHERE (job_attempts.started_at, job_attempts.stopped_at, job_attempts.exitcode, job_attempts.reason, job_attempts.task_arn, job_attempts.container_instance_arn, job_attempts.log_stream_name) " +
+		"IS DISTINCT FROM (EXCLUDED.started_at, EXCLUDED.stopped_at, EXCLUDED.exitcode, EXCLUDED.reason, EXCLUDED.task_arn, EXCLUDED.container_instance_arn, EXCLUDED.log_stream_name)"
+	if query != expected {
+		t.Errorf("Expected query %q, got %q", expected, query)
+	}
+}
+
+func TestFindJobAttemptsQuery(t *testing.T) {
+	query := squash(findJobAttemptsQuery)
+	expected := "FROM job_attempts LEFT OUTER JOIN task_arns_to_instance_info ta ON ta.task_arn = job_attempts.task_arn WHERE job_attempts.job_id = ANY($1) ORDER BY job_attempts.job_id, job_attempts.attempt ASC"
+	if !strings.HasSuffix(query, expected) {
+		t.Errorf("Expected query to end with %q, got %q", expected, query)
+	}
+	if !strings.Contains(query, "job_attempts.log_stream_name, ta.instance_id, ta.public_ip, ta.private_ip FROM") {
+		t.Errorf("Expected the log stream and instance of every attempt, got %q", query)
+	}
+}
+
+func TestJobGraphQuery(t *testing.T) {
+	query := squash(jobGraphQuery)
+	for _, expected := range []string{
+		// Upstream starts at what the job depends on and follows
+		// depends_on_job_id; downstream starts at what depends on the job
+		// and follows job_id.
+		"WITH RECURSIVE upstream(job_id, depends_on_job_id, type) AS ( SELECT job_id, depends_on_job_id, type FROM job_dependencies WHERE job_id = $1 UNION SELECT d.job_id, d.depends_on_job_id, d.type FROM job_dependencies d JOIN upstream u ON d.job_id = u.depends_on_job_id )",
+		"downstream(job_id, depends_on_job_id, type) AS ( SELECT job_id, depends_on_job_id, type FROM job_dependencies WHERE depends_on_job_id = $1 UNION SELECT d.job_id, d.depends_on_job_id, d.type FROM job_dependencies d JOIN downstream u ON d.depends_on_job_id = u.job_id )",
+		"SELECT job_id, depends_on_job_id, type FROM upstream UNION SELECT job_id, depends_on_job_id, type FROM downstream LIMIT $2",
+	} {
+		if !strings.Contains(query, expected) {
+			t.Errorf("Expected query to contain %q, got %q", expected, query)
+		}
+	}
+	// UNION ALL would recurse forever on a cycle.
+	if strings.Contains(query, "UNION ALL") {
+		t.Errorf("Expected only UNION in %q", query)
+	}
+}
+
+func TestFindNodeJobsQuery(t *testing.T) {
+	query := squash(findNodeJobsQuery)
+	expected := "FROM jobs LEFT OUTER JOIN task_arns_to_instance_info ta ON ta.task_arn = jobs.task_arn WHERE jobs.parent_job_id = $1 AND jobs.node_index IS NOT NULL ORDER BY jobs.node_index ASC"
+	if !strings.HasSuffix(query, expected) {
+		t.Errorf("Expected query to end with %q, got %q", expected, query)
+	}
+	for _, column := range []string{"log_stream_name,", "ta.instance_id,", "jobs.node_properties,", "jobs.node_index FROM"} {
+		if !strings.Contains(query, column) {
+			t.Errorf("Expected query to select %q, got %q", column, query)
+		}
+	}
+}
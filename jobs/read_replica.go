@@ -0,0 +1,108 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+readReplica is a PostgreSQL streaming replica that read-only Finder methods
+use to keep heavy queries off the primary. Its replication lag is checked
+periodically; while it is over maxLag, or if it cannot be checked, reads go to
+the primary instead.
+
+A replica that has replayed all the WAL it has received has no lag.
+Otherwise lag is measured as the time since the replica last replayed a
+transaction.
+*/
+type readReplica struct {
+	connection *sql.DB
+	maxLag     time.Duration
+
+	lock    sync.Mutex
+	lagging bool
+}
+
+// UseReadReplica makes read-only queries go to a replica of the database.
+// The replica is expected to accept the same credentials as the primary.
+func (pq *postgreSQLStore) UseReadReplica(databaseHost string, databasePort int, databaseUsername string, databaseName string, databasePassword string, databaseRootCertificate string, maxLag time.Duration, lagCheckPeriod time.Duration) error {
+	db, err := OpenPostgreSQL(databaseHost, databasePort, databaseUsername, databaseName, databasePassword, databaseRootCertificate)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(500)
+
+	replica := &readReplica{
+		connection: db,
+		maxLag:     maxLag,
+	}
+	replica.checkLag()
+	go func() {
+		for {
+			select {
+			case <-pq.closed:
+				return
+			case <-time.After(lagCheckPeriod):
+			}
+			replica.checkLag()
+		}
+	}()
+	pq.replica = replica
+	return nil
+}
+
+func (r *readReplica) checkLag() {
+	ctx_timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The LSNs are NULL when the server is not a replica, and
+	// pg_last_xact_replay_timestamp() is NULL when it has not replayed
+	// anything yet.
+	var lag_seconds float64
+	err := r.connection.QueryRowContext(ctx_timeout, `
+		SELECT CASE
+			WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+		END
+	`).Scan(&lag_seconds)
+	if err != nil {
+		log.Warning("Cannot check read replica lag, reading from the primary: ", err)
+	}
+	r.setLag(time.Duration(lag_seconds*float64(time.Second)), err)
+}
+
+// setLag records the outcome of a lag check; err is the error of the check.
+func (r *readReplica) setLag(lag time.Duration, err error) {
+	lagging := false
+	if err != nil {
+		lagging = true
+	} else if lag > r.maxLag {
+		lagging = true
+		log.Warning("Read replica is ", lag, " behind, reading from the primary")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.lagging && !lagging {
+		log.Info("Read replica has caught up, reading from the replica")
+	}
+	r.lagging = lagging
+}
+
+func (r *readReplica) isLagging() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lagging
+}
+
+// reader returns the database read-only queries should go to.
+func (pq *postgreSQLStore) reader() *sql.DB {
+	if pq.replica == nil || pq.replica.isLagging() {
+		return pq.connection
+	}
+	return pq.replica.connection
+}
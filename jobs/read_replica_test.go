@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReaderFallsBackToPrimary(t *testing.T) {
+	// sql.Open does not connect, so these never reach a database
+	primary, err := sql.Open("postgres", "host=primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	replica_db, err := sql.Open("postgres", "host=replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica_db.Close()
+
+	pq := &postgreSQLStore{connection: primary}
+	if pq.reader() != primary {
+		t.Errorf("Expected reads to go to the primary without a replica")
+	}
+
+	replica := &readReplica{connection: replica_db, maxLag: 30 * time.Second}
+	pq.replica = replica
+	if pq.reader() != replica_db {
+		t.Errorf("Expected reads to go to the replica")
+	}
+
+	for _, test := range []struct {
+		lag      time.Duration
+		err      error
+		expected *sql.DB
+	}{
+		{time.Minute, nil, primary},
+		{0, nil, replica_db},
+		{0, errors.New("connection refused"), primary},
+		{30 * time.Second, nil, replica_db},
+		{31 * time.Second, nil, primary},
+	} {
+		replica.setLag(test.lag, test.err)
+		if pq.reader() != test.expected {
+			t.Errorf("Unexpected reader after a lag check with lag %v and error %v", test.lag, test.err)
+		}
+	}
+}
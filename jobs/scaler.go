@@ -1,14 +1,16 @@
 package jobs
 
 import (
+	"context"
+
 	"github.com/AdRoll/batchiepatchie/awsclients"
 	"github.com/aws/aws-sdk-go/service/batch"
 	"github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
 )
 
-func ScaleComputeEnvironments(storer Storer, queues []string) {
-	span := opentracing.StartSpan("ScaleComputeEnvironments")
+func ScaleComputeEnvironments(ctx context.Context, storer Storer, queues []string) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ScaleComputeEnvironments")
 	defer span.Finish()
 
 	// Don't bother going to database if we have no queues.
@@ -16,7 +18,7 @@ func ScaleComputeEnvironments(storer Storer, queues []string) {
 		return
 	}
 
-	running_loads, err := storer.EstimateRunningLoadByJobQueue(queues)
+	running_loads, err := storer.EstimateRunningLoadByJobQueue(ctx, queues)
 	if err != nil {
 		log.Warning("Aborting compute environment scaling due to errors with store.")
 		return
@@ -40,7 +42,7 @@ func ScaleComputeEnvironments(storer Storer, queues []string) {
 		JobQueues: job_queue_names,
 	}
 
-	job_queue_descs, err := awsclients.Batch.DescribeJobQueues(job_queues)
+	job_queue_descs, err := awsclients.Batch.DescribeJobQueuesWithContext(ctx, job_queues)
 	if err != nil {
 		log.Warning("Failed to describe job queues: ", err)
 		return
@@ -92,7 +94,7 @@ func ScaleComputeEnvironments(storer Storer, queues []string) {
 
 		ces := make([]*string, 1)
 		ces[0] = &ce
-		out, err := awsclients.Batch.DescribeComputeEnvironments(&batch.DescribeComputeEnvironmentsInput{
+		out, err := awsclients.Batch.DescribeComputeEnvironmentsWithContext(ctx, &batch.DescribeComputeEnvironmentsInput{
 			ComputeEnvironments: ces,
 		})
 		if err != nil {
@@ -136,7 +138,7 @@ func ScaleComputeEnvironments(storer Storer, queues []string) {
 
 		// Now for the meat...if the desired vcpus is lower than we would like, we scale up.
 		if wanted != batch_min_vcpus {
-			_, err := awsclients.Batch.UpdateComputeEnvironment(&batch.UpdateComputeEnvironmentInput{
+			_, err := awsclients.Batch.UpdateComputeEnvironmentWithContext(ctx, &batch.UpdateComputeEnvironmentInput{
 				ComputeEnvironment: &ce,
 				ComputeResources:   &update_resources,
 			})
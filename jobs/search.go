@@ -0,0 +1,492 @@
+package jobs
+
+/*
+ This file implements the search language of the job listing. A search is a
+ list of terms separated by whitespace and every term must match:
+
+   status:FAILED queue:etl-* exit:137 image:repo/foo name:"nightly run"
+   created>2d vcpus>=8 -name:test some-word
+
+ * field:value matches text fields. A * in the value is a wildcard. Without
+   wildcards, status, queue and id must match exactly while name, image,
+   reason and definition only need to contain the value. Matching ignores
+   case.
+ * field:value, field>value, field>=value, field<value and field<=value
+   compare numeric fields.
+ * field>value etc. compare time fields. The value is either a duration
+   relative to now (10m, 2h, 2d, 1w) meaning that long ago, so created>2d is
+   "created within the last two days", or a date (2006-01-02) or an RFC 3339
+   timestamp.
+ * A word without a field matches job ID, name, queue or image, like the
+   search always did.
+ * A - in front of a term negates it.
+ * Values and words with spaces can be quoted: name:"nightly run".
+
+ The parsed query is compiled to parameterized SQL by the PostgreSQL store and
+ evaluated directly by the memory store.
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SearchOperator is a comparison operator in a search term.
+type SearchOperator string
+
+const (
+	SearchEqual          SearchOperator = ":"
+	SearchGreater        SearchOperator = ">"
+	SearchGreaterOrEqual SearchOperator = ">="
+	SearchLess           SearchOperator = "<"
+	SearchLessOrEqual    SearchOperator = "<="
+)
+
+// SearchQuery is a parsed search string. A job matches if it matches every
+// term.
+type SearchQuery struct {
+	Terms []SearchTerm
+}
+
+// SearchTerm is one of FreeTextTerm, TextTerm, NumberTerm or TimeTerm.
+type SearchTerm interface {
+	isNegated() bool
+}
+
+// FreeTextTerm is a word without a field.
+type FreeTextTerm struct {
+	Negated bool
+	Text    string
+}
+
+// TextTerm matches a text field. Pattern may contain * wildcards.
+type TextTerm struct {
+	Negated bool
+	Field   string
+	Pattern string
+}
+
+// NumberTerm compares a numeric field.
+type NumberTerm struct {
+	Negated bool
+	Field   string
+	Op      SearchOperator
+	Value   int64
+}
+
+// TimeTerm compares a time field. Relative times have already been resolved.
+type TimeTerm struct {
+	Negated bool
+	Field   string
+	Op      SearchOperator
+	Value   time.Time
+}
+
+func (t *FreeTextTerm) isNegated() bool { return t.Negated }
+func (t *TextTerm) isNegated() bool     { return t.Negated }
+func (t *NumberTerm) isNegated() bool   { return t.Negated }
+func (t *TimeTerm) isNegated() bool     { return t.Negated }
+
+// SearchSyntaxError tells what is wrong with a search string and where.
+type SearchSyntaxError struct {
+	Position int
+	Message  string
+}
+
+func (e *SearchSyntaxError) Error() string {
+	return fmt.Sprintf("Search syntax error at position %d: %s", e.Position+1, e.Message)
+}
+
+type searchFieldKind int
+
+const (
+	searchText searchFieldKind = iota
+	searchNumber
+	searchTime
+)
+
+type searchField struct {
+	column string
+	kind   searchFieldKind
+	// For text fields: without wildcards, match a substring instead of
+	// the whole value.
+	substring bool
+}
+
+var searchFields = map[string]searchField{
+	"status":     {column: "status", kind: searchText},
+	"queue":      {column: "job_queue", kind: searchText},
+	"id":         {column: "job_id", kind: searchText},
+	"name":       {column: "job_name", kind: searchText, substring: true},
+	"image":      {column: "image", kind: searchText, substring: true},
+	"reason":     {column: "status_reason", kind: searchText, substring: true},
+	"definition": {column: "job_definition", kind: searchText, substring: true},
+	"exit":       {column: "exitcode", kind: searchNumber},
+	"vcpus":      {column: "vcpus", kind: searchNumber},
+	"memory":     {column: "memory", kind: searchNumber},
+	"created":    {column: "created_at", kind: searchTime},
+	"updated":    {column: "last_updated", kind: searchTime},
+	"started":    {column: "run_started_at", kind: searchTime},
+	"stopped":    {column: "stopped_at", kind: searchTime},
+}
+
+// ParseSearch parses a search string. Errors are *SearchSyntaxError.
+func ParseSearch(input string) (*SearchQuery, error) {
+	return parseSearch(input, time.Now())
+}
+
+type searchParser struct {
+	input []rune
+	pos   int
+	now   time.Time
+}
+
+func parseSearch(input string, now time.Time) (*SearchQuery, error) {
+	p := &searchParser{input: []rune(input), now: now}
+	query := &SearchQuery{Terms: make([]SearchTerm, 0)}
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.input) {
+			return query, nil
+		}
+		term, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		query.Terms = append(query.Terms, term)
+	}
+}
+
+func (p *searchParser) errorf(position int, format string, args ...interface{}) error {
+	return &SearchSyntaxError{Position: position, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *searchParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *searchParser) peek(offset int) rune {
+	if p.pos+offset >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos+offset]
+}
+
+func isSearchFieldRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_'
+}
+
+func (p *searchParser) parseTerm() (SearchTerm, error) {
+	negated := false
+	if p.peek(0) == '-' && p.peek(1) != 0 && !unicode.IsSpace(p.peek(1)) {
+		negated = true
+		p.pos++
+	}
+
+	// Is this field<op>value?
+	start := p.pos
+	end := start
+	for end < len(p.input) && isSearchFieldRune(p.input[end]) {
+		end++
+	}
+	if end > start && end < len(p.input) && strings.ContainsRune(":<>", p.input[end]) {
+		name := strings.ToLower(string(p.input[start:end]))
+		field, ok := searchFields[name]
+		if !ok {
+			return nil, p.errorf(start, "unknown field '%s'", name)
+		}
+		p.pos = end
+		op := p.parseOperator()
+		value_start := p.pos
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			return nil, p.errorf(value_start, "missing value for '%s'", name)
+		}
+		return p.fieldTerm(negated, name, field, op, value, value_start)
+	}
+
+	word_start := p.pos
+	word, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if word == "" {
+		return nil, p.errorf(word_start, "empty search term")
+	}
+	return &FreeTextTerm{Negated: negated, Text: word}, nil
+}
+
+func (p *searchParser) parseOperator() SearchOperator {
+	switch {
+	case p.peek(0) == '>' && p.peek(1) == '=':
+		p.pos += 2
+		return SearchGreaterOrEqual
+	case p.peek(0) == '<' && p.peek(1) == '=':
+		p.pos += 2
+		return SearchLessOrEqual
+	case p.peek(0) == '>':
+		p.pos++
+		return SearchGreater
+	case p.peek(0) == '<':
+		p.pos++
+		return SearchLess
+	default:
+		p.pos++
+		return SearchEqual
+	}
+}
+
+// parseValue reads a quoted string or everything up to the next whitespace.
+func (p *searchParser) parseValue() (string, error) {
+	if p.peek(0) != '"' {
+		start := p.pos
+		for p.pos < len(p.input) && !unicode.IsSpace(p.input[p.pos]) {
+			p.pos++
+		}
+		return string(p.input[start:p.pos]), nil
+	}
+
+	quote_start := p.pos
+	p.pos++
+	var value strings.Builder
+	for p.pos < len(p.input) {
+		r := p.input[p.pos]
+		switch {
+		case r == '\\' && p.pos+1 < len(p.input):
+			value.WriteRune(p.input[p.pos+1])
+			p.pos += 2
+		case r == '"':
+			p.pos++
+			if p.pos < len(p.input) && !unicode.IsSpace(p.input[p.pos]) {
+				return "", p.errorf(p.pos, "expected whitespace after closing quote")
+			}
+			return value.String(), nil
+		default:
+			value.WriteRune(r)
+			p.pos++
+		}
+	}
+	return "", p.errorf(quote_start, "unterminated quote")
+}
+
+func (p *searchParser) fieldTerm(negated bool, name string, field searchField, op SearchOperator, value string, value_start int) (SearchTerm, error) {
+	switch field.kind {
+	case searchText:
+		if op != SearchEqual {
+			return nil, p.errorf(value_start-len(op), "'%s' only supports '%s:'", name, name)
+		}
+		if name == "status" {
+			value = strings.ToUpper(value)
+		}
+		return &TextTerm{Negated: negated, Field: name, Pattern: value}, nil
+	case searchNumber:
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, p.errorf(value_start, "'%s' expects a whole number, got '%s'", name, value)
+		}
+		return &NumberTerm{Negated: negated, Field: name, Op: op, Value: number}, nil
+	default:
+		if op == SearchEqual {
+			return nil, p.errorf(value_start-1, "'%s' must be compared with >, >=, < or <=", name)
+		}
+		t, err := p.parseTime(value)
+		if err != nil {
+			return nil, p.errorf(value_start, "'%s' expects a duration like 2d or a date like 2006-01-02, got '%s'", name, value)
+		}
+		return &TimeTerm{Negated: negated, Field: name, Op: op, Value: t}, nil
+	}
+}
+
+// parseTime understands relative durations (10m, 2h, 2d, 1w) counted back
+// from now, dates and RFC 3339 timestamps.
+func (p *searchParser) parseTime(value string) (time.Time, error) {
+	if len(value) >= 2 {
+		units := map[byte]time.Duration{
+			'm': time.Minute,
+			'h': time.Hour,
+			'd': 24 * time.Hour,
+			'w': 7 * 24 * time.Hour,
+		}
+		if unit, ok := units[value[len(value)-1]]; ok {
+			amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+			if err == nil && amount >= 0 {
+				return p.now.Add(-time.Duration(amount) * unit), nil
+			}
+		}
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// searchLikePattern turns a search pattern into an ILIKE pattern.
+func searchLikePattern(pattern string, substring bool) string {
+	escaped := strings.Replace(searchEscape(pattern), "*", "%", -1)
+	if substring && !strings.Contains(pattern, "*") {
+		return "%" + escaped + "%"
+	}
+	return escaped
+}
+
+// compileSearchSQL turns a query into SQL conditions, appending parameters
+// to args.
+func compileSearchSQL(query *SearchQuery, args *[]interface{}) []string {
+	placeholder := func(value interface{}) string {
+		*args = append(*args, value)
+		return "$" + strconv.Itoa(len(*args))
+	}
+
+	clauses := make([]string, 0, len(query.Terms))
+	for _, term := range query.Terms {
+		var clause string
+		switch t := term.(type) {
+		case *FreeTextTerm:
+			clause = fmt.Sprintf("(job_id || job_name || job_queue || image) ILIKE %s", placeholder("%"+searchEscape(t.Text)+"%"))
+		case *TextTerm:
+			field := searchFields[t.Field]
+			clause = fmt.Sprintf("%s ILIKE %s", field.column, placeholder(searchLikePattern(t.Pattern, field.substring)))
+		case *NumberTerm:
+			op := string(t.Op)
+			if t.Op == SearchEqual {
+				op = "="
+			}
+			clause = fmt.Sprintf("%s %s %s", searchFields[t.Field].column, op, placeholder(t.Value))
+		case *TimeTerm:
+			clause = fmt.Sprintf("%s %s %s", searchFields[t.Field].column, string(t.Op), placeholder(t.Value))
+		}
+		// Columns can be NULL; a NULL never matches and a negated NULL
+		// always does.
+		if term.isNegated() {
+			clause = "NOT COALESCE(" + clause + ", false)"
+		}
+		clauses = append(clauses, clause)
+	}
+	return clauses
+}
+
+// likeMatch is ILIKE for patterns made by searchLikePattern.
+func likeMatch(value string, pattern string, substring bool) bool {
+	value = strings.ToLower(value)
+	pattern = strings.ToLower(pattern)
+	if substring && !strings.Contains(pattern, "*") {
+		return strings.Contains(value, pattern)
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if i == len(parts)-2 {
+			return strings.HasSuffix(value, part)
+		}
+		index := strings.Index(value, part)
+		if index < 0 {
+			return false
+		}
+		value = value[index+len(part):]
+	}
+	return value == ""
+}
+
+func compareSearchValues(cmp int, op SearchOperator) bool {
+	switch op {
+	case SearchGreater:
+		return cmp > 0
+	case SearchGreaterOrEqual:
+		return cmp >= 0
+	case SearchLess:
+		return cmp < 0
+	case SearchLessOrEqual:
+		return cmp <= 0
+	default:
+		return cmp == 0
+	}
+}
+
+func (query *SearchQuery) matches(job *Job) bool {
+	for _, term := range query.Terms {
+		if termMatches(term, job) == term.isNegated() {
+			return false
+		}
+	}
+	return true
+}
+
+func termMatches(term SearchTerm, job *Job) bool {
+	switch t := term.(type) {
+	case *FreeTextTerm:
+		return strings.Contains(strings.ToLower(job.Id+job.Name+job.JobQueue+job.Image), strings.ToLower(t.Text))
+	case *TextTerm:
+		var value *string
+		switch t.Field {
+		case "status":
+			value = &job.Status
+		case "queue":
+			value = &job.JobQueue
+		case "id":
+			value = &job.Id
+		case "name":
+			value = &job.Name
+		case "image":
+			value = &job.Image
+		case "reason":
+			value = job.StatusReason
+		case "definition":
+			value = &job.Description
+		}
+		return value != nil && likeMatch(*value, t.Pattern, searchFields[t.Field].substring)
+	case *NumberTerm:
+		var value *int64
+		switch t.Field {
+		case "exit":
+			value = job.ExitCode
+		case "vcpus":
+			value = &job.VCpus
+		case "memory":
+			value = &job.Memory
+		}
+		if value == nil {
+			return false
+		}
+		cmp := 0
+		if *value < t.Value {
+			cmp = -1
+		} else if *value > t.Value {
+			cmp = 1
+		}
+		return compareSearchValues(cmp, t.Op)
+	case *TimeTerm:
+		var value *time.Time
+		switch t.Field {
+		case "created":
+			value = &job.CreatedAt
+		case "updated":
+			value = &job.LastUpdated
+		case "started":
+			value = job.RunStartTime
+		case "stopped":
+			value = job.StoppedAt
+		}
+		if value == nil {
+			return false
+		}
+		cmp := 0
+		if value.Before(t.Value) {
+			cmp = -1
+		} else if value.After(t.Value) {
+			cmp = 1
+		}
+		return compareSearchValues(cmp, t.Op)
+	}
+	return false
+}
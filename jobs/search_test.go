@@ -0,0 +1,117 @@
+package jobs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearch(t *testing.T) {
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+	query, err := parseSearch(`status:failed queue:etl-* exit:137 name:"nightly \"big\" run" created>2d vcpus>=8 -name:test word`, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []SearchTerm{
+		&TextTerm{Field: "status", Pattern: "FAILED"},
+		&TextTerm{Field: "queue", Pattern: "etl-*"},
+		&NumberTerm{Field: "exit", Op: SearchEqual, Value: 137},
+		&TextTerm{Field: "name", Pattern: `nightly "big" run`},
+		&TimeTerm{Field: "created", Op: SearchGreater, Value: now.Add(-48 * time.Hour)},
+		&NumberTerm{Field: "vcpus", Op: SearchGreaterOrEqual, Value: 8},
+		&TextTerm{Negated: true, Field: "name", Pattern: "test"},
+		&FreeTextTerm{Text: "word"},
+	}
+	if len(query.Terms) != len(expected) {
+		t.Fatalf("Expected %d terms, got %d: %v", len(expected), len(query.Terms), query.Terms)
+	}
+	for i, term := range query.Terms {
+		switch e := expected[i].(type) {
+		case *TextTerm:
+			if got, ok := term.(*TextTerm); !ok || *got != *e {
+				t.Errorf("Term %d: expected %+v, got %+v", i, e, term)
+			}
+		case *NumberTerm:
+			if got, ok := term.(*NumberTerm); !ok || *got != *e {
+				t.Errorf("Term %d: expected %+v, got %+v", i, e, term)
+			}
+		case *TimeTerm:
+			if got, ok := term.(*TimeTerm); !ok || got.Field != e.Field || got.Op != e.Op || !got.Value.Equal(e.Value) {
+				t.Errorf("Term %d: expected %+v, got %+v", i, e, term)
+			}
+		case *FreeTextTerm:
+			if got, ok := term.(*FreeTextTerm); !ok || *got != *e {
+				t.Errorf("Term %d: expected %+v, got %+v", i, e, term)
+			}
+		}
+	}
+}
+
+func TestParseSearchErrors(t *testing.T) {
+	for _, input := range []string{
+		`colour:red`,
+		`name:"unterminated`,
+		`exit:abc`,
+		`created:2d`,
+		`created>yesterday`,
+		`status>FAILED`,
+		`queue:`,
+	} {
+		_, err := ParseSearch(input)
+		if _, ok := err.(*SearchSyntaxError); !ok {
+			t.Errorf("Expected a syntax error for %q, got %v", input, err)
+		}
+	}
+}
+
+func TestCompileSearchSQL(t *testing.T) {
+	query, err := ParseSearch(`queue:etl-* name:50% -exit:0 word`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []interface{}{100, 0}
+	clauses := compileSearchSQL(query, &args)
+
+	expected := []string{
+		"job_queue ILIKE $3",
+		"job_name ILIKE $4",
+		"NOT COALESCE(exitcode = $5, false)",
+		"(job_id || job_name || job_queue || image) ILIKE $6",
+	}
+	if strings.Join(clauses, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected %v, got %v", expected, clauses)
+	}
+	if args[2] != "etl-%" || args[3] != `%50\%%` || args[4] != int64(0) || args[5] != "%word%" {
+		t.Errorf("Unexpected arguments: %v", args)
+	}
+}
+
+func TestSearchMatches(t *testing.T) {
+	exit_code := int64(137)
+	job := &Job{Id: "abc", Name: "Nightly Run", Status: StatusFailed, JobQueue: "etl-prod", Image: "repo/foo:latest", VCpus: 8, ExitCode: &exit_code, CreatedAt: time.Now().Add(-time.Hour)}
+
+	for input, expected := range map[string]bool{
+		`status:failed queue:etl-* exit:137 image:repo/foo`: true,
+		`name:"nightly run" created>2d vcpus>=8`:            true,
+		`queue:etl`:                                         false,
+		`-name:nightly`:                                     false,
+		`created<2d`:                                        false,
+		`stopped>2d`:                                        false,
+		`-stopped>2d`:                                       true,
+		`NIGHTLY`:                                           true,
+		`queue:*prod`:                                       true,
+		`queue:e*l*d`:                                       true,
+		`queue:e*x*d`:                                       false,
+		`exit:0`:                                            false,
+		`-exit:0 vcpus<9`:                                   true,
+	} {
+		query, err := ParseSearch(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query.matches(job) != expected {
+			t.Errorf("Expected %q to match: %v", input, expected)
+		}
+	}
+}
@@ -1,15 +1,17 @@
 package jobs
 
 import (
+	"context"
+
 	"github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
 )
 
-func KillTimedOutJobs(finder FinderStorer) error {
-	span := opentracing.StartSpan("KillTimedOutJobs")
+func KillTimedOutJobs(ctx context.Context, finder FinderStorer) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "KillTimedOutJobs")
 	defer span.Finish()
 
-	timed_out_jobs, err := finder.FindTimedoutJobs()
+	timed_out_jobs, err := finder.FindTimedoutJobs(ctx)
 	if err != nil {
 		return err
 	}
@@ -21,7 +23,7 @@ func KillTimedOutJobs(finder FinderStorer) error {
 	log.Info("There are ", len(timed_out_jobs), " that need killing.")
 
 	for _, job_id := range timed_out_jobs {
-		err = killer.KillOne(job_id, "timeout", finder)
+		err = killer.KillOne(ctx, job_id, "timeout", finder)
 		if err != nil {
 			log.Info("Requested termination for ", job_id)
 		}
@@ -0,0 +1,22 @@
+/*
+Package metrics defines the Prometheus metrics of Batchiepatchie and serves
+them. The metrics are registered with the default registry of client_golang
+when the package is loaded. Metrics without labels are shown from the start;
+the others once they have a series.
+*/
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultBuckets are the histogram buckets for durations in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Handler serves every registered metric, along with the Go runtime and
+// process metrics of client_golang.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
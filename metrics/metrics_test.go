@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	Jobs.WithLabelValues("test-queue", "RUNNING").Set(3)
+	defer Jobs.DeleteLabelValues("test-queue", "RUNNING")
+	InstanceKills.Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`batchiepatchie_jobs{job_queue="test-queue",status="RUNNING"} 3`,
+		`batchiepatchie_instance_kills_total 1`,
+		`batchiepatchie_websocket_subscriptions 0`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected %q in metrics:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics Batchiepatchie serves at /metrics.
+var (
+	LoopDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "batchiepatchie_loop_duration_seconds",
+		Help:    "Duration of rounds of the background loops.",
+		Buckets: DefaultBuckets,
+	}, []string{"loop"})
+	LoopErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "batchiepatchie_loop_errors_total",
+		Help: "Rounds of the background loops that failed.",
+	}, []string{"loop"})
+	SyncQueueErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "batchiepatchie_sync_queue_errors_total",
+		Help: "Job queues that could not be synchronized in a round.",
+	}, []string{"job_queue"})
+
+	AWSCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "batchiepatchie_aws_calls_total",
+		Help: "AWS API calls, retries included.",
+	}, []string{"service", "operation"})
+	AWSThrottles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "batchiepatchie_aws_throttles_total",
+		Help: "AWS API calls that were throttled.",
+	}, []string{"service", "operation"})
+
+	Jobs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "batchiepatchie_jobs",
+		Help: "Jobs per job queue and status, as of the last synchronization round.",
+	}, []string{"job_queue", "status"})
+
+	ComputeEnvironmentDesiredVCpus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "batchiepatchie_compute_environment_desired_vcpus",
+		Help: "Desired vCPUs of compute environments.",
+	}, []string{"compute_environment"})
+	ComputeEnvironmentMinVCpus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "batchiepatchie_compute_environment_min_vcpus",
+		Help: "Minimum vCPUs of compute environments.",
+	}, []string{"compute_environment"})
+	ComputeEnvironmentMaxVCpus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "batchiepatchie_compute_environment_max_vcpus",
+		Help: "Maximum vCPUs of compute environments.",
+	}, []string{"compute_environment"})
+
+	JobKills = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "batchiepatchie_job_kills_total",
+		Help: "Jobs Batchiepatchie asked AWS Batch to terminate.",
+	}, []string{"reason"})
+	InstanceKills = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "batchiepatchie_instance_kills_total",
+		Help: "EC2 instances terminated because they had a job stuck in STARTING.",
+	})
+
+	WebSocketSubscriptions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "batchiepatchie_websocket_subscriptions",
+		Help: "Open WebSocket subscriptions to job status updates.",
+	})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "batchiepatchie_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests per route.",
+		Buckets: DefaultBuckets,
+	}, []string{"method", "route", "code"})
+)
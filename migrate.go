@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/AdRoll/batchiepatchie/config"
+	"github.com/AdRoll/batchiepatchie/jobs"
+	"github.com/AdRoll/batchiepatchie/migrations"
+	log "github.com/sirupsen/logrus"
+)
+
+// runMigrate applies, rolls back or lists the schema migrations embedded in
+// the binary. The configuration file is taken from BATCHIEPATCHIE_CONFIG
+// environment variable.
+func runMigrate(args []string) {
+	if len(args) != 1 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		log.Fatal("batchiepatchie migrate expects exactly one argument: up, down or status.")
+	}
+
+	configurationFile := os.Getenv("BATCHIEPATCHIE_CONFIG")
+	if configurationFile == "" {
+		log.Fatal("batchiepatchie migrate reads its configuration from BATCHIEPATCHIE_CONFIG environment variable, but it is not set.")
+	}
+	err := config.ReadConfiguration(configurationFile)
+	if err != nil {
+		log.Fatal("Reading configuration failed, ", err)
+	}
+	if config.Conf.Store != "postgresql" {
+		log.Fatal("Migrations need store = \"postgresql\".")
+	}
+
+	db, err := jobs.OpenPostgreSQL(config.Conf.DatabaseHost, config.Conf.DatabasePort, config.Conf.DatabaseUsername, config.Conf.DatabaseName, config.Conf.DatabasePassword, config.Conf.DatabaseRootCertificate)
+	if err != nil {
+		log.Fatal("Connecting to postgresql failed, ", err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		if err := migrations.Up(db); err != nil {
+			log.Fatal("Applying migrations failed, ", err)
+		}
+		version, err := migrations.CurrentVersion(db)
+		if err != nil {
+			log.Fatal("Cannot read schema version, ", err)
+		}
+		log.Info("Database schema is at version ", version)
+	case "down":
+		if err := migrations.Down(db); err != nil {
+			log.Fatal("Rolling back migration failed, ", err)
+		}
+	case "status":
+		statuses, err := migrations.Status(db)
+		if err != nil {
+			log.Fatal("Cannot read migration status, ", err)
+		}
+		for _, status := range statuses {
+			applied_at := "pending"
+			if status.AppliedAt != nil {
+				applied_at = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%-24s %s\n", applied_at, status.Migration.Name)
+		}
+	}
+}
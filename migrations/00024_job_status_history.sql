@@ -0,0 +1,70 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+CREATE TABLE job_status_history (
+    job_id       VARCHAR(44) NOT NULL,
+    old_status   VARCHAR(9),
+    new_status   VARCHAR(9) NOT NULL,
+    changed_at   timestamp with time zone NOT NULL,
+    source       TEXT NOT NULL
+);
+
+CREATE INDEX job_status_history_job_id ON job_status_history (job_id, changed_at);
+CREATE INDEX job_status_history_changed_at ON job_status_history (changed_at);
+
+-- The source of the change is set by batchiepatchie for the duration of the
+-- transaction with set_config('batchiepatchie.status_source', ..., true).
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_update() RETURNS trigger AS
+$body$
+BEGIN
+    IF NEW.status <> OLD.status THEN
+        INSERT INTO job_status_events ( job_id, updated ) VALUES ( NEW.job_id, now() ) ON CONFLICT ( job_id ) DO UPDATE SET updated = now();
+        INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+            VALUES ( NEW.job_id, OLD.status, NEW.status, now(), COALESCE(NULLIF(current_setting('batchiepatchie.status_source', true), ''), 'unknown') );
+    END IF;
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_insert() RETURNS trigger AS
+$body$
+BEGIN
+    INSERT INTO job_status_events ( job_id, updated ) VALUES ( NEW.job_id, now() ) ON CONFLICT ( job_id ) DO UPDATE SET updated = now();
+    INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+        VALUES ( NEW.job_id, NULL, NEW.status, now(), COALESCE(NULLIF(current_setting('batchiepatchie.status_source', true), ''), 'unknown') );
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_update() RETURNS trigger AS
+$body$
+BEGIN
+    IF NEW.status <> OLD.status THEN
+        INSERT INTO job_status_events ( job_id, updated ) VALUES ( NEW.job_id, now() ) ON CONFLICT ( job_id ) DO UPDATE SET updated = now();
+    END IF;
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_insert() RETURNS trigger AS
+$body$
+BEGIN
+    INSERT INTO job_status_events ( job_id, updated ) VALUES ( NEW.job_id, now() ) ON CONFLICT ( job_id ) DO UPDATE SET updated = now();
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP INDEX job_status_history_changed_at;
+DROP INDEX job_status_history_job_id;
+DROP TABLE job_status_history;
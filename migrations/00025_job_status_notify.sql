@@ -0,0 +1,67 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+
+-- Job status changes are published with NOTIFY so that every batchiepatchie
+-- process LISTENing on the channel can tell its own subscribers about them.
+-- The payload is the job ID.
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_update() RETURNS trigger AS
+$body$
+BEGIN
+    IF NEW.status <> OLD.status THEN
+        PERFORM pg_notify('job_status_events', NEW.job_id);
+        INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+            VALUES ( NEW.job_id, OLD.status, NEW.status, now(), COALESCE(NULLIF(current_setting('batchiepatchie.status_source', true), ''), 'unknown') );
+    END IF;
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_insert() RETURNS trigger AS
+$body$
+BEGIN
+    PERFORM pg_notify('job_status_events', NEW.job_id);
+    INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+        VALUES ( NEW.job_id, NULL, NEW.status, now(), COALESCE(NULLIF(current_setting('batchiepatchie.status_source', true), ''), 'unknown') );
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP TABLE job_status_events;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+CREATE TABLE job_status_events (
+    job_id     CHAR(36) NOT NULL PRIMARY KEY,
+    updated    timestamp with time zone NOT NULL
+);
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_update() RETURNS trigger AS
+$body$
+BEGIN
+    IF NEW.status <> OLD.status THEN
+        INSERT INTO job_status_events ( job_id, updated ) VALUES ( NEW.job_id, now() ) ON CONFLICT ( job_id ) DO UPDATE SET updated = now();
+        INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+            VALUES ( NEW.job_id, OLD.status, NEW.status, now(), COALESCE(NULLIF(current_setting('batchiepatchie.status_source', true), ''), 'unknown') );
+    END IF;
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_insert() RETURNS trigger AS
+$body$
+BEGIN
+    INSERT INTO job_status_events ( job_id, updated ) VALUES ( NEW.job_id, now() ) ON CONFLICT ( job_id ) DO UPDATE SET updated = now();
+    INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+        VALUES ( NEW.job_id, NULL, NEW.status, now(), COALESCE(NULLIF(current_setting('batchiepatchie.status_source', true), ''), 'unknown') );
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+
+-- The leader itself is decided by a PostgreSQL advisory lock; this table only
+-- records who holds it so that it can be shown in the API.
+CREATE TABLE leader_election (
+    lock_id         BIGINT NOT NULL PRIMARY KEY,
+    identity        TEXT NOT NULL,
+    since           timestamp with time zone NOT NULL,
+    last_heartbeat  timestamp with time zone NOT NULL
+);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP TABLE leader_election;
@@ -0,0 +1,21 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+CREATE TABLE job_attempts (
+    job_id                  VARCHAR(44) NOT NULL,
+    attempt                 INTEGER NOT NULL,
+    started_at              timestamp with time zone,
+    stopped_at              timestamp with time zone,
+    exitcode                INTEGER,
+    reason                  TEXT,
+    task_arn                TEXT,
+    container_instance_arn  TEXT,
+    log_stream_name         TEXT,
+    PRIMARY KEY(job_id, attempt)
+);
+
+CREATE INDEX job_attempts_task_arn ON job_attempts (task_arn);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX job_attempts_task_arn;
+DROP TABLE job_attempts;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+CREATE TABLE job_dependencies (
+    job_id             VARCHAR(44) NOT NULL,
+    depends_on_job_id  VARCHAR(44) NOT NULL,
+    type               TEXT,
+    PRIMARY KEY(job_id, depends_on_job_id)
+);
+
+CREATE INDEX job_dependencies_depends_on_job_id ON job_dependencies (depends_on_job_id);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX job_dependencies_depends_on_job_id;
+DROP TABLE job_dependencies;
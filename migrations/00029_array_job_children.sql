@@ -0,0 +1,18 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+ALTER TABLE jobs ADD COLUMN parent_job_id VARCHAR(44);
+ALTER TABLE jobs ADD COLUMN array_index INTEGER;
+
+-- Children of array jobs have IDs like <parent job ID>:<index>.
+UPDATE jobs
+SET parent_job_id = split_part(job_id, ':', 1),
+    array_index = split_part(job_id, ':', 2)::integer
+WHERE job_id ~ '^[^:]+:[0-9]+$';
+
+CREATE INDEX jobs_parent_job_id_array_index ON jobs (parent_job_id, array_index) WHERE parent_job_id IS NOT NULL;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX jobs_parent_job_id_array_index;
+ALTER TABLE jobs DROP COLUMN array_index;
+ALTER TABLE jobs DROP COLUMN parent_job_id;
@@ -0,0 +1,19 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+ALTER TABLE jobs ADD COLUMN node_properties JSONB;
+ALTER TABLE jobs ADD COLUMN node_index INTEGER;
+
+-- Nodes of multi-node parallel jobs have IDs like <parent job ID>#<index>.
+UPDATE jobs
+SET parent_job_id = split_part(job_id, '#', 1),
+    node_index = split_part(job_id, '#', 2)::integer
+WHERE job_id ~ '^[^#]+#[0-9]+$';
+
+CREATE INDEX jobs_parent_job_id_node_index ON jobs (parent_job_id, node_index) WHERE node_index IS NOT NULL;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX jobs_parent_job_id_node_index;
+UPDATE jobs SET parent_job_id = NULL WHERE node_index IS NOT NULL;
+ALTER TABLE jobs DROP COLUMN node_index;
+ALTER TABLE jobs DROP COLUMN node_properties;
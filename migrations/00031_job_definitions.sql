@@ -0,0 +1,25 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+CREATE TABLE job_definitions (
+    arn             TEXT NOT NULL PRIMARY KEY,
+    name            TEXT NOT NULL,
+    revision        INTEGER NOT NULL,
+    type            TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    image           TEXT NOT NULL,
+    vcpus           INTEGER NOT NULL,
+    memory          INTEGER NOT NULL,
+    command_line    TEXT NOT NULL,
+    environment     JSONB NOT NULL,
+    timeout         INTEGER,
+    retry_strategy  JSONB,
+    parameters      JSONB NOT NULL,
+    synced_at       timestamp with time zone NOT NULL
+);
+
+CREATE UNIQUE INDEX job_definitions_name_revision ON job_definitions (name, revision);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX job_definitions_name_revision;
+DROP TABLE job_definitions;
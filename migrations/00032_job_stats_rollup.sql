@@ -0,0 +1,116 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+
+-- Usage of finished jobs, summed per queue, status and 5 minute bucket of the
+-- time the job started running. Kept up to date by triggers on jobs; there is
+-- no DELETE trigger so the history survives job cleanup.
+CREATE TABLE job_stats_rollup (
+    bucket           timestamp with time zone NOT NULL,
+    job_queue        TEXT NOT NULL,
+    status           VARCHAR(9) NOT NULL,
+    vcpu_seconds     double precision NOT NULL,
+    memory_seconds   double precision NOT NULL,
+    instance_seconds double precision NOT NULL,
+    job_count        INTEGER NOT NULL,
+    PRIMARY KEY (bucket, job_queue, status)
+);
+
+-- adds (sign = 1) or removes (sign = -1) the usage of one job.
+-- +goose StatementBegin
+CREATE FUNCTION job_stats_rollup_add(p_job_queue TEXT, p_status VARCHAR, p_run_started_at timestamp with time zone, p_stopped_at timestamp with time zone, p_vcpus INTEGER, p_memory INTEGER, p_sign INTEGER) RETURNS void AS
+$body$
+DECLARE
+    duration double precision;
+BEGIN
+    IF p_run_started_at IS NULL OR p_stopped_at IS NULL THEN
+        RETURN;
+    END IF;
+    duration := EXTRACT(EPOCH FROM (p_stopped_at - p_run_started_at));
+    INSERT INTO job_stats_rollup ( bucket, job_queue, status, vcpu_seconds, memory_seconds, instance_seconds, job_count )
+    VALUES (
+        TO_TIMESTAMP(FLOOR(EXTRACT(EPOCH FROM p_run_started_at) / 300) * 300),
+        p_job_queue,
+        p_status,
+        p_sign * p_vcpus * duration,
+        p_sign * p_memory * duration,
+        p_sign * duration,
+        p_sign
+    )
+    ON CONFLICT ( bucket, job_queue, status ) DO UPDATE SET
+        vcpu_seconds = job_stats_rollup.vcpu_seconds + EXCLUDED.vcpu_seconds,
+        memory_seconds = job_stats_rollup.memory_seconds + EXCLUDED.memory_seconds,
+        instance_seconds = job_stats_rollup.instance_seconds + EXCLUDED.instance_seconds,
+        job_count = job_stats_rollup.job_count + EXCLUDED.job_count;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION job_stats_rollup_insert() RETURNS trigger AS
+$body$
+BEGIN
+    -- restored jobs were counted before they were archived.
+    IF current_setting('batchiepatchie.status_source', true) = 'restore' THEN
+        RETURN NEW;
+    END IF;
+    PERFORM job_stats_rollup_add(NEW.job_queue, NEW.status, NEW.run_started_at, NEW.stopped_at, NEW.vcpus, NEW.memory, 1);
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION job_stats_rollup_update() RETURNS trigger AS
+$body$
+BEGIN
+    IF (OLD.job_queue, OLD.status, OLD.run_started_at, OLD.stopped_at, OLD.vcpus, OLD.memory) IS DISTINCT FROM
+       (NEW.job_queue, NEW.status, NEW.run_started_at, NEW.stopped_at, NEW.vcpus, NEW.memory) THEN
+        PERFORM job_stats_rollup_add(OLD.job_queue, OLD.status, OLD.run_started_at, OLD.stopped_at, OLD.vcpus, OLD.memory, -1);
+        PERFORM job_stats_rollup_add(NEW.job_queue, NEW.status, NEW.run_started_at, NEW.stopped_at, NEW.vcpus, NEW.memory, 1);
+    END IF;
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER job_stats_rollup_trigger_insert
+  AFTER
+  INSERT
+  ON jobs
+  FOR EACH ROW
+  EXECUTE PROCEDURE job_stats_rollup_insert();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER job_stats_rollup_trigger_update
+  AFTER
+  UPDATE
+  ON jobs
+  FOR EACH ROW
+  EXECUTE PROCEDURE job_stats_rollup_update();
+-- +goose StatementEnd
+
+-- backfill from the jobs that have not been cleaned up yet.
+INSERT INTO job_stats_rollup ( bucket, job_queue, status, vcpu_seconds, memory_seconds, instance_seconds, job_count )
+SELECT
+    TO_TIMESTAMP(FLOOR(EXTRACT(EPOCH FROM run_started_at) / 300) * 300),
+    job_queue,
+    status,
+    SUM(vcpus * EXTRACT(EPOCH FROM (stopped_at - run_started_at))),
+    SUM(memory * EXTRACT(EPOCH FROM (stopped_at - run_started_at))),
+    SUM(EXTRACT(EPOCH FROM (stopped_at - run_started_at))),
+    COUNT(*)
+FROM jobs
+WHERE stopped_at IS NOT NULL
+AND run_started_at IS NOT NULL
+GROUP BY 1, 2, 3;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP TRIGGER job_stats_rollup_trigger_insert ON jobs;
+DROP TRIGGER job_stats_rollup_trigger_update ON jobs;
+DROP FUNCTION job_stats_rollup_insert();
+DROP FUNCTION job_stats_rollup_update();
+DROP FUNCTION job_stats_rollup_add(TEXT, VARCHAR, timestamp with time zone, timestamp with time zone, INTEGER, INTEGER, INTEGER);
+DROP TABLE job_stats_rollup;
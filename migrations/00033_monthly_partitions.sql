@@ -0,0 +1,325 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+
+-- jobs is partitioned by the month the job was created and the event logs by
+-- the month of the event, so that the cleaner can drop whole partitions
+-- instead of deleting rows. Rows that fall outside every monthly partition go
+-- to a DEFAULT partition. Requires PostgreSQL 11 or newer.
+--
+-- A unique index on a partitioned table must include the partition key, so
+-- the primary key of jobs becomes (job_id, created_at). This changes
+-- behavior: job_id alone is no longer unique, so the database no longer
+-- rejects a second row for a job ID with a different created_at. AWS Batch
+-- never changes the creation time of a job, so the synchronizer does not
+-- store one, but anything else that writes to jobs must keep job IDs unique
+-- itself.
+
+-- create_monthly_partition creates the partition of parent for the month (in
+-- UTC) that contains month, unless it exists, and returns its name.
+-- +goose StatementBegin
+CREATE FUNCTION create_monthly_partition(parent TEXT, month timestamp) RETURNS TEXT AS
+$body$
+DECLARE
+    month_start timestamp;
+    partition_name TEXT;
+BEGIN
+    month_start := date_trunc('month', month);
+    partition_name := parent || '_p' || to_char(month_start, 'YYYYMM');
+    EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+        partition_name, parent, month_start AT TIME ZONE 'UTC', (month_start + INTERVAL '1 month') AT TIME ZONE 'UTC');
+    RETURN partition_name;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- Jobs moved between partitions by the cleaner have already been counted in
+-- job_status_history and job_stats_rollup.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_insert() RETURNS trigger AS
+$body$
+BEGIN
+    IF current_setting('batchiepatchie.moving_partition', true) = 'on' THEN
+        RETURN NEW;
+    END IF;
+    PERFORM pg_notify('job_status_events', NEW.job_id);
+    INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+        VALUES ( NEW.job_id, NULL, NEW.status, now(), COALESCE(NULLIF(current_setting('batchiepatchie.status_source', true), ''), 'unknown') );
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_stats_rollup_insert() RETURNS trigger AS
+$body$
+BEGIN
+    -- restored jobs were counted before they were archived.
+    IF current_setting('batchiepatchie.status_source', true) = 'restore'
+       OR current_setting('batchiepatchie.moving_partition', true) = 'on' THEN
+        RETURN NEW;
+    END IF;
+    PERFORM job_stats_rollup_add(NEW.job_queue, NEW.status, NEW.run_started_at, NEW.stopped_at, NEW.vcpus, NEW.memory, 1);
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- jobs
+ALTER TABLE jobs RENAME TO jobs_unpartitioned;
+CREATE TABLE jobs (LIKE jobs_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (created_at);
+CREATE TABLE jobs_default PARTITION OF jobs DEFAULT;
+
+-- +goose StatementBegin
+DO $body$
+DECLARE
+    month timestamp;
+BEGIN
+    FOR month IN
+        SELECT generate_series(date_trunc('month', COALESCE(oldest, now()) AT TIME ZONE 'UTC'), now() AT TIME ZONE 'UTC' + INTERVAL '2 months', INTERVAL '1 month')
+        FROM (SELECT MIN(created_at) AS oldest FROM jobs_unpartitioned) AS t
+    LOOP
+        PERFORM create_monthly_partition('jobs', month);
+    END LOOP;
+END;
+$body$;
+-- +goose StatementEnd
+
+INSERT INTO jobs SELECT * FROM jobs_unpartitioned;
+DROP TABLE jobs_unpartitioned;
+ALTER TABLE jobs ADD PRIMARY KEY (job_id, created_at);
+
+CREATE INDEX jobs_created_at_timestamp ON jobs (created_at);
+CREATE INDEX jobs_stopped_at_timestamp ON jobs (stopped_at);
+CREATE INDEX jobs_last_updated_timestamp ON jobs (last_updated);
+CREATE INDEX jobs_status ON jobs (status);
+CREATE INDEX job_queue_timestamp_jobs ON jobs (job_queue, last_updated);
+CREATE INDEX trgm_idx_jobs ON jobs USING gin (
+    (job_id || job_name || job_queue || image) gin_trgm_ops
+);
+CREATE INDEX jobs_parent_job_id_array_index ON jobs (parent_job_id, array_index) WHERE parent_job_id IS NOT NULL;
+CREATE INDEX jobs_parent_job_id_node_index ON jobs (parent_job_id, node_index) WHERE node_index IS NOT NULL;
+
+-- +goose StatementBegin
+CREATE TRIGGER job_status_update_trigger_insert
+  AFTER
+  INSERT
+  ON jobs
+  FOR EACH ROW
+  EXECUTE PROCEDURE job_status_update_insert();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER job_status_update_trigger_update
+  AFTER
+  UPDATE
+  ON jobs
+  FOR EACH ROW
+  EXECUTE PROCEDURE job_status_update_update();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER job_stats_rollup_trigger_insert
+  AFTER
+  INSERT
+  ON jobs
+  FOR EACH ROW
+  EXECUTE PROCEDURE job_stats_rollup_insert();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER job_stats_rollup_trigger_update
+  AFTER
+  UPDATE
+  ON jobs
+  FOR EACH ROW
+  EXECUTE PROCEDURE job_stats_rollup_update();
+-- +goose StatementEnd
+
+-- instance_event_log
+ALTER TABLE instance_event_log RENAME TO instance_event_log_unpartitioned;
+CREATE TABLE instance_event_log (LIKE instance_event_log_unpartitioned) PARTITION BY RANGE (timestamp);
+CREATE TABLE instance_event_log_default PARTITION OF instance_event_log DEFAULT;
+
+-- +goose StatementBegin
+DO $body$
+DECLARE
+    month timestamp;
+BEGIN
+    FOR month IN
+        SELECT generate_series(date_trunc('month', COALESCE(oldest, now()) AT TIME ZONE 'UTC'), now() AT TIME ZONE 'UTC' + INTERVAL '2 months', INTERVAL '1 month')
+        FROM (SELECT MIN(timestamp) AS oldest FROM instance_event_log_unpartitioned) AS t
+    LOOP
+        PERFORM create_monthly_partition('instance_event_log', month);
+    END LOOP;
+END;
+$body$;
+-- +goose StatementEnd
+
+INSERT INTO instance_event_log SELECT * FROM instance_event_log_unpartitioned;
+DROP TABLE instance_event_log_unpartitioned;
+ALTER TABLE instance_event_log ADD PRIMARY KEY (timestamp, instance_id);
+
+CREATE INDEX instance_event_log_instance_id ON instance_event_log (instance_id);
+
+-- job_summary_event_log
+ALTER TABLE job_summary_event_log RENAME TO job_summary_event_log_unpartitioned;
+CREATE TABLE job_summary_event_log (LIKE job_summary_event_log_unpartitioned) PARTITION BY RANGE (timestamp);
+CREATE TABLE job_summary_event_log_default PARTITION OF job_summary_event_log DEFAULT;
+
+-- +goose StatementBegin
+DO $body$
+DECLARE
+    month timestamp;
+BEGIN
+    FOR month IN
+        SELECT generate_series(date_trunc('month', COALESCE(oldest, now()) AT TIME ZONE 'UTC'), now() AT TIME ZONE 'UTC' + INTERVAL '2 months', INTERVAL '1 month')
+        FROM (SELECT MIN(timestamp) AS oldest FROM job_summary_event_log_unpartitioned) AS t
+    LOOP
+        PERFORM create_monthly_partition('job_summary_event_log', month);
+    END LOOP;
+END;
+$body$;
+-- +goose StatementEnd
+
+INSERT INTO job_summary_event_log SELECT * FROM job_summary_event_log_unpartitioned;
+DROP TABLE job_summary_event_log_unpartitioned;
+
+CREATE INDEX job_summary_event_log_timestamp ON job_summary_event_log (timestamp);
+CREATE INDEX job_summary_event_log_job_queue ON job_summary_event_log (job_queue, timestamp);
+
+-- compute_environment_event_log
+ALTER TABLE compute_environment_event_log RENAME TO compute_environment_event_log_unpartitioned;
+CREATE TABLE compute_environment_event_log (LIKE compute_environment_event_log_unpartitioned) PARTITION BY RANGE (timestamp);
+CREATE TABLE compute_environment_event_log_default PARTITION OF compute_environment_event_log DEFAULT;
+
+-- +goose StatementBegin
+DO $body$
+DECLARE
+    month timestamp;
+BEGIN
+    FOR month IN
+        SELECT generate_series(date_trunc('month', COALESCE(oldest, now()) AT TIME ZONE 'UTC'), now() AT TIME ZONE 'UTC' + INTERVAL '2 months', INTERVAL '1 month')
+        FROM (SELECT MIN(timestamp) AS oldest FROM compute_environment_event_log_unpartitioned) AS t
+    LOOP
+        PERFORM create_monthly_partition('compute_environment_event_log', month);
+    END LOOP;
+END;
+$body$;
+-- +goose StatementEnd
+
+INSERT INTO compute_environment_event_log SELECT * FROM compute_environment_event_log_unpartitioned;
+DROP TABLE compute_environment_event_log_unpartitioned;
+
+CREATE INDEX compute_environment_event_log_timestamp ON compute_environment_event_log (timestamp);
+CREATE INDEX compute_environment_event_log_compute_environment ON compute_environment_event_log (compute_environment, timestamp);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+-- Partitions that the cleaner has detached but not dropped yet are left
+-- alone.
+
+-- compute_environment_event_log
+ALTER TABLE compute_environment_event_log RENAME TO compute_environment_event_log_partitioned;
+CREATE TABLE compute_environment_event_log (LIKE compute_environment_event_log_partitioned);
+INSERT INTO compute_environment_event_log SELECT * FROM compute_environment_event_log_partitioned;
+DROP TABLE compute_environment_event_log_partitioned;
+CREATE INDEX compute_environment_event_log_timestamp ON compute_environment_event_log (timestamp);
+CREATE INDEX compute_environment_event_log_compute_environment ON compute_environment_event_log (compute_environment, timestamp);
+
+-- job_summary_event_log
+ALTER TABLE job_summary_event_log RENAME TO job_summary_event_log_partitioned;
+CREATE TABLE job_summary_event_log (LIKE job_summary_event_log_partitioned);
+INSERT INTO job_summary_event_log SELECT * FROM job_summary_event_log_partitioned;
+DROP TABLE job_summary_event_log_partitioned;
+CREATE INDEX job_summary_event_log_timestamp ON job_summary_event_log (timestamp);
+CREATE INDEX job_summary_event_log_job_queue ON job_summary_event_log (job_queue, timestamp);
+
+-- instance_event_log
+ALTER TABLE instance_event_log RENAME TO instance_event_log_partitioned;
+CREATE TABLE instance_event_log (LIKE instance_event_log_partitioned);
+INSERT INTO instance_event_log SELECT * FROM instance_event_log_partitioned;
+DROP TABLE instance_event_log_partitioned;
+ALTER TABLE instance_event_log ADD PRIMARY KEY (timestamp, instance_id);
+CREATE INDEX instance_event_log_instance_id ON instance_event_log (instance_id);
+
+-- jobs
+ALTER TABLE jobs RENAME TO jobs_partitioned;
+CREATE TABLE jobs (LIKE jobs_partitioned INCLUDING DEFAULTS);
+INSERT INTO jobs SELECT DISTINCT ON (job_id) * FROM jobs_partitioned ORDER BY job_id, last_updated DESC;
+DROP TABLE jobs_partitioned;
+ALTER TABLE jobs ADD PRIMARY KEY (job_id);
+
+CREATE INDEX jobs_created_at_timestamp ON jobs (created_at);
+CREATE INDEX jobs_stopped_at_timestamp ON jobs (stopped_at);
+CREATE INDEX jobs_last_updated_timestamp ON jobs (last_updated);
+CREATE INDEX jobs_status ON jobs (status);
+CREATE INDEX job_queue_timestamp_jobs ON jobs (job_queue, last_updated);
+CREATE INDEX trgm_idx_jobs ON jobs USING gin (
+    (job_id || job_name || job_queue || image) gin_trgm_ops
+);
+CREATE INDEX jobs_parent_job_id_array_index ON jobs (parent_job_id, array_index) WHERE parent_job_id IS NOT NULL;
+CREATE INDEX jobs_parent_job_id_node_index ON jobs (parent_job_id, node_index) WHERE node_index IS NOT NULL;
+
+-- +goose StatementBegin
+CREATE TRIGGER job_status_update_trigger_insert
+  AFTER
+  INSERT
+  ON jobs
+  FOR EACH ROW
+  EXECUTE PROCEDURE job_status_update_insert();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER job_status_update_trigger_update
+  AFTER
+  UPDATE
+  ON jobs
+  FOR EACH ROW
+  EXECUTE PROCEDURE job_status_update_update();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER job_stats_rollup_trigger_insert
+  AFTER
+  INSERT
+  ON jobs
+  FOR EACH ROW
+  EXECUTE PROCEDURE job_stats_rollup_insert();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER job_stats_rollup_trigger_update
+  AFTER
+  UPDATE
+  ON jobs
+  FOR EACH ROW
+  EXECUTE PROCEDURE job_stats_rollup_update();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_stats_rollup_insert() RETURNS trigger AS
+$body$
+BEGIN
+    -- restored jobs were counted before they were archived.
+    IF current_setting('batchiepatchie.status_source', true) = 'restore' THEN
+        RETURN NEW;
+    END IF;
+    PERFORM job_stats_rollup_add(NEW.job_queue, NEW.status, NEW.run_started_at, NEW.stopped_at, NEW.vcpus, NEW.memory, 1);
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_insert() RETURNS trigger AS
+$body$
+BEGIN
+    PERFORM pg_notify('job_status_events', NEW.job_id);
+    INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+        VALUES ( NEW.job_id, NULL, NEW.status, now(), COALESCE(NULLIF(current_setting('batchiepatchie.status_source', true), ''), 'unknown') );
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP FUNCTION create_monthly_partition(TEXT, timestamp);
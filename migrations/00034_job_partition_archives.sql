@@ -0,0 +1,73 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+
+-- Monthly partitions of jobs whose jobs have been archived. The cleaner
+-- archives a partition before it detaches it; if detaching fails, the next
+-- round does not archive the same jobs again.
+CREATE TABLE job_partition_archives (
+    partition_name TEXT PRIMARY KEY,
+    archived_at    timestamp with time zone NOT NULL DEFAULT now()
+);
+
+-- The cleaner no longer moves jobs between partitions, so the triggers do not
+-- need to skip moved jobs.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_insert() RETURNS trigger AS
+$body$
+BEGIN
+    PERFORM pg_notify('job_status_events', NEW.job_id);
+    INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+        VALUES ( NEW.job_id, NULL, NEW.status, now(), COALESCE(NULLIF(current_setting('batchiepatchie.status_source', true), ''), 'unknown') );
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_stats_rollup_insert() RETURNS trigger AS
+$body$
+BEGIN
+    -- restored jobs were counted before they were archived.
+    IF current_setting('batchiepatchie.status_source', true) = 'restore' THEN
+        RETURN NEW;
+    END IF;
+    PERFORM job_stats_rollup_add(NEW.job_queue, NEW.status, NEW.run_started_at, NEW.stopped_at, NEW.vcpus, NEW.memory, 1);
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_stats_rollup_insert() RETURNS trigger AS
+$body$
+BEGIN
+    -- restored jobs were counted before they were archived.
+    IF current_setting('batchiepatchie.status_source', true) = 'restore'
+       OR current_setting('batchiepatchie.moving_partition', true) = 'on' THEN
+        RETURN NEW;
+    END IF;
+    PERFORM job_stats_rollup_add(NEW.job_queue, NEW.status, NEW.run_started_at, NEW.stopped_at, NEW.vcpus, NEW.memory, 1);
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION job_status_update_insert() RETURNS trigger AS
+$body$
+BEGIN
+    IF current_setting('batchiepatchie.moving_partition', true) = 'on' THEN
+        RETURN NEW;
+    END IF;
+    PERFORM pg_notify('job_status_events', NEW.job_id);
+    INSERT INTO job_status_history ( job_id, old_status, new_status, changed_at, source )
+        VALUES ( NEW.job_id, NULL, NEW.status, now(), COALESCE(NULLIF(current_setting('batchiepatchie.status_source', true), ''), 'unknown') );
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP TABLE job_partition_archives;
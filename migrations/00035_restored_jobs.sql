@@ -0,0 +1,14 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+
+-- When a job was put back from an archive. Restored jobs keep their original
+-- last_updated, so the cleaner keeps them for the restore retention counted
+-- from this instead of cleaning them again right away.
+ALTER TABLE jobs ADD COLUMN restored_at timestamp with time zone;
+CREATE INDEX jobs_restored_at ON jobs (restored_at) WHERE restored_at IS NOT NULL;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+
+DROP INDEX jobs_restored_at;
+ALTER TABLE jobs DROP COLUMN restored_at;
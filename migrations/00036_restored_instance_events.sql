@@ -0,0 +1,12 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+
+-- When an instance event was put back from an archive along with a job that
+-- ran on the instance. The cleaner counts the age of restored events from
+-- this rather than from their timestamp.
+ALTER TABLE instance_event_log ADD COLUMN restored_at timestamp with time zone;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+
+ALTER TABLE instance_event_log DROP COLUMN restored_at;
@@ -0,0 +1,63 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+
+-- A partition cannot be created for a month that already has rows in the
+-- DEFAULT partition, which happens when rows arrive before the partition of
+-- their month exists, for example while the syncer was not running to create
+-- it ahead of time. create_monthly_partition now detaches the DEFAULT
+-- partition, fills the new partition with the rows of its month while it is
+-- still a plain table, so that no trigger fires for them, and attaches both
+-- again. Detaching locks the whole table, so like the cleaner it gives up
+-- rather than wait more than 5 seconds for the lock; the syncer tries again
+-- later.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION create_monthly_partition(parent TEXT, month timestamp) RETURNS TEXT AS
+$body$
+DECLARE
+    month_start timestamp;
+    month_end timestamp;
+    partition_name TEXT;
+    default_name TEXT;
+    partition_key TEXT;
+BEGIN
+    month_start := date_trunc('month', month);
+    month_end := month_start + INTERVAL '1 month';
+    partition_name := parent || '_p' || to_char(month_start, 'YYYYMM');
+    default_name := parent || '_default';
+    IF to_regclass(quote_ident(partition_name)) IS NOT NULL THEN
+        RETURN partition_name;
+    END IF;
+
+    -- pg_get_partkeydef gives for example RANGE (created_at)
+    partition_key := substring(pg_get_partkeydef(parent::regclass) FROM '^RANGE \((.*)\)$');
+    PERFORM set_config('lock_timeout', '5s', true);
+    EXECUTE format('ALTER TABLE %I DETACH PARTITION %I', parent, default_name);
+    EXECUTE format('CREATE TABLE %I (LIKE %I INCLUDING DEFAULTS)', partition_name, parent);
+    EXECUTE format('WITH moved AS (DELETE FROM %I WHERE %s >= %L AND %s < %L RETURNING *) INSERT INTO %I SELECT * FROM moved',
+        default_name, partition_key, month_start AT TIME ZONE 'UTC', partition_key, month_end AT TIME ZONE 'UTC', partition_name);
+    EXECUTE format('ALTER TABLE %I ATTACH PARTITION %I FOR VALUES FROM (%L) TO (%L)',
+        parent, partition_name, month_start AT TIME ZONE 'UTC', month_end AT TIME ZONE 'UTC');
+    EXECUTE format('ALTER TABLE %I ATTACH PARTITION %I DEFAULT', parent, default_name);
+    RETURN partition_name;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION create_monthly_partition(parent TEXT, month timestamp) RETURNS TEXT AS
+$body$
+DECLARE
+    month_start timestamp;
+    partition_name TEXT;
+BEGIN
+    month_start := date_trunc('month', month);
+    partition_name := parent || '_p' || to_char(month_start, 'YYYYMM');
+    EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+        partition_name, parent, month_start AT TIME ZONE 'UTC', (month_start + INTERVAL '1 month') AT TIME ZONE 'UTC');
+    RETURN partition_name;
+END;
+$body$ LANGUAGE plpgsql;
+-- +goose StatementEnd
@@ -0,0 +1,418 @@
+/*
+Package migrations embeds the goose SQL migrations of the database schema and
+applies them.
+
+Applied migrations are recorded in goose's own goose_db_version table so a
+database can be migrated both with batchiepatchie and with the goose command
+line tool.
+*/
+package migrations
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// migrationLockID is the PostgreSQL advisory lock key held while migrations
+// are applied or rolled back, so that two processes running migrate at the
+// same time do not both apply the same migration. It must differ from the
+// leader election lock key.
+const migrationLockID = 7162838373
+
+// Migration is one of the embedded migration files.
+type Migration struct {
+	Version int64
+	Name    string
+	// Up and Down are the statements that apply and roll back the
+	// migration
+	Up   []string
+	Down []string
+	// NoTransaction is set for migrations that cannot run in a
+	// transaction, such as CREATE INDEX CONCURRENTLY
+	NoTransaction bool
+}
+
+// MigrationStatus tells if a migration has been applied.
+type MigrationStatus struct {
+	Migration *Migration
+	// AppliedAt is nil if the migration has not been applied
+	AppliedAt *time.Time
+}
+
+// parseMigration splits a goose SQL migration into statements. Statements end
+// with a line that ends in a semicolon, unless they are between
+// StatementBegin and StatementEnd annotations.
+func parseMigration(name string, content string) (*Migration, error) {
+	version_str, _, ok := strings.Cut(name, "_")
+	if !ok {
+		return nil, fmt.Errorf("migration %s: name must be <version>_<description>.sql", name)
+	}
+	version, err := strconv.ParseInt(version_str, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("migration %s: name must start with a version number", name)
+	}
+	migration := &Migration{Version: version, Name: name}
+
+	var statements *[]string
+	var statement strings.Builder
+	in_statement_block := false
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "-- +goose ") {
+			switch strings.TrimSpace(strings.TrimPrefix(trimmed, "-- +goose ")) {
+			case "Up":
+				statements = &migration.Up
+			case "Down":
+				statements = &migration.Down
+			case "NO TRANSACTION":
+				migration.NoTransaction = true
+			case "StatementBegin":
+				in_statement_block = true
+			case "StatementEnd":
+				if statements == nil {
+					return nil, fmt.Errorf("migration %s: StatementEnd before +goose Up", name)
+				}
+				in_statement_block = false
+				*statements = append(*statements, statement.String())
+				statement.Reset()
+			}
+			continue
+		}
+		if statements == nil || trimmed == "" || (strings.HasPrefix(trimmed, "--") && statement.Len() == 0) {
+			continue
+		}
+		statement.WriteString(line)
+		statement.WriteString("\n")
+		if !in_statement_block && strings.HasSuffix(trimmed, ";") {
+			*statements = append(*statements, statement.String())
+			statement.Reset()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("migration %s: %w", name, err)
+	}
+	if statement.Len() > 0 {
+		return nil, fmt.Errorf("migration %s: last statement does not end with a semicolon", name)
+	}
+	if statements == nil {
+		return nil, fmt.Errorf("migration %s: no +goose Up annotation", name)
+	}
+	return migration, nil
+}
+
+// Migrations returns the embedded migrations, oldest first.
+func Migrations() ([]*Migration, error) {
+	entries, err := files.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]*Migration, 0, len(entries))
+	for _, entry := range entries {
+		content, err := files.ReadFile(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migration, err := parseMigration(path.Base(entry.Name()), string(content))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// LatestVersion is the schema version the code expects.
+func LatestVersion() (int64, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// ensureVersionTable creates goose_db_version the way goose does, if it does
+// not exist yet.
+func ensureVersionTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS goose_db_version (
+			id serial NOT NULL,
+			version_id bigint NOT NULL,
+			is_applied boolean NOT NULL,
+			tstamp timestamp NULL default now(),
+			PRIMARY KEY(id)
+		)`)
+	if err != nil {
+		log.Warning("Cannot create goose_db_version: ", err)
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO goose_db_version (version_id, is_applied)
+		SELECT 0, true
+		WHERE NOT EXISTS (SELECT 1 FROM goose_db_version)`)
+	if err != nil {
+		log.Warning("Cannot initialize goose_db_version: ", err)
+	}
+	return err
+}
+
+// versionTableExists tells if goose_db_version has been created. It does not
+// change the database.
+func versionTableExists(db *sql.DB) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT to_regclass('goose_db_version') IS NOT NULL`).Scan(&exists)
+	if err != nil {
+		log.Warning("Cannot check for goose_db_version: ", err)
+	}
+	return exists, err
+}
+
+// withMigrationLock runs f while holding the migration lock. The lock is
+// session level, so it is taken on a connection of its own that f does not
+// use.
+func withMigrationLock(db *sql.DB, f func() error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		log.Warning("Cannot get a connection for the migration lock: ", err)
+		return err
+	}
+	defer conn.Close()
+
+	log.Info("Waiting for the migration lock...")
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		log.Warning("Cannot acquire the migration lock: ", err)
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID); err != nil {
+			log.Warning("Cannot release the migration lock: ", err)
+		}
+	}()
+	return f()
+}
+
+// appliedVersions reads goose_db_version. Like goose, the latest row of each
+// version tells whether it is applied; older versions of goose recorded
+// rollbacks as rows with is_applied false instead of deleting rows.
+func appliedVersions(db *sql.DB) (map[int64]time.Time, error) {
+	rows, err := db.Query(`SELECT version_id, is_applied, tstamp FROM goose_db_version ORDER BY id DESC`)
+	if err != nil {
+		log.Warning("Cannot select from goose_db_version: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[int64]bool)
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var is_applied bool
+		var tstamp *time.Time
+		if err := rows.Scan(&version, &is_applied, &tstamp); err != nil {
+			log.Warning(err)
+			return nil, err
+		}
+		if seen[version] {
+			continue
+		}
+		seen[version] = true
+		if is_applied && version > 0 {
+			applied[version] = time.Time{}
+			if tstamp != nil {
+				applied[version] = *tstamp
+			}
+		}
+	}
+	return applied, rows.Err()
+}
+
+// appliedVersionsIfAny is appliedVersions for read-only callers: a database
+// without goose_db_version has no migrations applied.
+func appliedVersionsIfAny(db *sql.DB) (map[int64]time.Time, error) {
+	exists, err := versionTableExists(db)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return make(map[int64]time.Time), nil
+	}
+	return appliedVersions(db)
+}
+
+// CurrentVersion returns the version of the latest migration applied to the
+// database; 0 if none. It does not change the database.
+func CurrentVersion(db *sql.DB) (int64, error) {
+	applied, err := appliedVersionsIfAny(db)
+	if err != nil {
+		return 0, err
+	}
+	current := int64(0)
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+// run applies or rolls back a migration and records it in goose_db_version.
+func run(db *sql.DB, migration *Migration, up bool) error {
+	statements := migration.Down
+	record := `DELETE FROM goose_db_version WHERE version_id = $1`
+	if up {
+		statements = migration.Up
+		record = `INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, true)`
+	}
+
+	if migration.NoTransaction {
+		for _, statement := range statements {
+			if _, err := db.Exec(statement); err != nil {
+				return fmt.Errorf("migration %s: %w", migration.Name, err)
+			}
+		}
+		if _, err := db.Exec(record, migration.Version); err != nil {
+			return fmt.Errorf("migration %s: %w", migration.Name, err)
+		}
+		return nil
+	}
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if _, err := transaction.Exec(statement); err != nil {
+			_ = transaction.Rollback()
+			return fmt.Errorf("migration %s: %w", migration.Name, err)
+		}
+	}
+	if _, err := transaction.Exec(record, migration.Version); err != nil {
+		_ = transaction.Rollback()
+		return fmt.Errorf("migration %s: %w", migration.Name, err)
+	}
+	return transaction.Commit()
+}
+
+// Up applies every migration that has not been applied yet.
+func Up(db *sql.DB) error {
+	return withMigrationLock(db, func() error {
+		return up(db)
+	})
+}
+
+func up(db *sql.DB) error {
+	if err := ensureVersionTable(db); err != nil {
+		return err
+	}
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		log.Info("Applying migration ", migration.Name)
+		if err := run(db, migration, true); err != nil {
+			log.Warning(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Down rolls back the latest applied migration.
+func Down(db *sql.DB) error {
+	return withMigrationLock(db, func() error {
+		return down(db)
+	})
+}
+
+func down(db *sql.DB) error {
+	current, err := CurrentVersion(db)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return fmt.Errorf("no migration to roll back")
+	}
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if migration.Version == current {
+			log.Info("Rolling back migration ", migration.Name)
+			if err := run(db, migration, false); err != nil {
+				log.Warning(err)
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("migration %d is applied but not known to this version of batchiepatchie", current)
+}
+
+// Status tells which of the embedded migrations have been applied.
+func Status(db *sql.DB) ([]*MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersionsIfAny(db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]*MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		status := &MigrationStatus{Migration: migration}
+		if applied_at, ok := applied[migration.Version]; ok {
+			applied_at := applied_at
+			status.AppliedAt = &applied_at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// CheckVersion returns an error if the database schema is older than the
+// code expects. It does not change the database.
+func CheckVersion(db *sql.DB) error {
+	current, err := CurrentVersion(db)
+	if err != nil {
+		return err
+	}
+	latest, err := LatestVersion()
+	if err != nil {
+		return err
+	}
+	if current < latest {
+		return fmt.Errorf("database schema is at version %d but batchiepatchie expects %d; run batchiepatchie migrate up", current, latest)
+	}
+	return nil
+}
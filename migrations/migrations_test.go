@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range migrations {
+		if migration.Version != int64(i+1) {
+			t.Errorf("Expected %s to be version %d", migration.Name, i+1)
+		}
+		if len(migration.Up) == 0 {
+			t.Errorf("Expected %s to have statements", migration.Name)
+		}
+	}
+}
+
+func TestParseMigration(t *testing.T) {
+	migration, err := parseMigration("00042_test.sql", `-- +goose NO TRANSACTION
+-- +goose Up
+-- A comment
+CREATE TABLE a (
+    id INTEGER
+);
+-- +goose StatementBegin
+CREATE FUNCTION f() RETURNS trigger AS $$
+begin
+  return new;
+end;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+DROP FUNCTION f();
+DROP TABLE a;
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migration.Version != 42 || !migration.NoTransaction {
+		t.Errorf("Unexpected migration: %+v", migration)
+	}
+	if len(migration.Up) != 2 || !strings.HasPrefix(migration.Up[1], "CREATE FUNCTION") || !strings.Contains(migration.Up[1], "end;") {
+		t.Errorf("Unexpected up statements: %q", migration.Up)
+	}
+	if len(migration.Down) != 2 {
+		t.Errorf("Unexpected down statements: %q", migration.Down)
+	}
+
+	if _, err := parseMigration("00043_test.sql", "-- +goose Up\nSELECT 1"); err == nil {
+		t.Errorf("Expected an error for a statement without a semicolon")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/AdRoll/batchiepatchie/config"
+	"github.com/AdRoll/batchiepatchie/fetcher"
+	"github.com/AdRoll/batchiepatchie/jobs"
+	log "github.com/sirupsen/logrus"
+)
+
+// runRestore loads job archives written by the cleaner back into the
+// database. Archives can be local files or s3:// locations. The configuration
+// file is taken from BATCHIEPATCHIE_CONFIG environment variable.
+func runRestore(archives []string) {
+	if len(archives) == 0 {
+		log.Fatal("batchiepatchie restore expects one or more archives to restore.")
+	}
+
+	configurationFile := os.Getenv("BATCHIEPATCHIE_CONFIG")
+	if configurationFile == "" {
+		log.Fatal("batchiepatchie restore reads its configuration from BATCHIEPATCHIE_CONFIG environment variable, but it is not set.")
+	}
+	err := config.ReadConfiguration(configurationFile)
+	if err != nil {
+		log.Fatal("Reading configuration failed, ", err)
+	}
+	if config.Conf.Store != "postgresql" {
+		log.Fatal("Restoring archives needs store = \"postgresql\".")
+	}
+
+	store, err := jobs.NewPostgreSQLStore(config.Conf.DatabaseHost, config.Conf.DatabasePort, config.Conf.DatabaseUsername, config.Conf.DatabaseName, config.Conf.DatabasePassword, config.Conf.DatabaseRootCertificate)
+	if err != nil {
+		log.Fatal("Creating postgresql store failed, ", err)
+	}
+	defer store.Close()
+	var restorer jobs.Restorer = store
+
+	for _, archive := range archives {
+		data, err := fetcher.ReadAll(archive)
+		if err != nil {
+			log.Fatal("Cannot read archive ", archive, ": ", err)
+		}
+		archived_jobs, err := jobs.DecodeArchive(data)
+		if err != nil {
+			log.Fatal("Cannot decode archive ", archive, ": ", err)
+		}
+		err = restorer.Restore(context.Background(), archived_jobs)
+		if err != nil {
+			log.Fatal("Cannot restore archive ", archive, ": ", err)
+		}
+		log.Info("Restored ", archive)
+	}
+}
@@ -1,381 +1,983 @@
 package syncer
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/AdRoll/batchiepatchie/awsclients"
 	"github.com/AdRoll/batchiepatchie/config"
 	"github.com/AdRoll/batchiepatchie/jobs"
+	"github.com/AdRoll/batchiepatchie/metrics"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/batch"
 	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
-func syncJobsStatus(storer jobs.Storer, status string, queues []string, job_summaries map[string]*jobs.JobSummary, parentSpan opentracing.Span) (map[string]bool, error) {
-	topspan := opentracing.StartSpan("syncJobsStatus", opentracing.ChildOf(parentSpan.Context()))
-	defer topspan.Finish()
-
-	known_job_ids := make(map[string]bool)
-	/* TODO: make the job queues we are interested in configurable */
-	for _, queue := range queues {
-
-		/* We got to be careful to make sure we look up Job ID between job
-		* listings and their description. Since this is at minimum two calls
-		* to AWS Batch, the state of jobs might change between their
-		* invocations. Basically we can't be sure there are equal number of
-		* results in job_results and job_description_results */
-		job_results := make(map[string]*batch.JobSummary)
-		job_description_results := make(map[string]*batch.JobDetail)
+// millisToTime converts AWS Batch timestamps (milliseconds since epoch).
+func millisToTime(millis *int64) *time.Time {
+	if millis == nil {
+		return nil
+	}
+	t := time.Unix(*millis/1000, (*millis%1000)*1000000).UTC()
+	return &t
+}
 
-		list_jobs := batch.ListJobsInput{
-			JobQueue:  &queue,
-			JobStatus: &status,
+// jobAttempts converts every attempt AWS Batch reports for a job.
+func jobAttempts(job_id string, attempt_details []*batch.AttemptDetail) []*jobs.JobAttempt {
+	attempts := make([]*jobs.JobAttempt, 0, len(attempt_details))
+	for i, attempt_detail := range attempt_details {
+		attempt := &jobs.JobAttempt{
+			JobId:     job_id,
+			Attempt:   i,
+			StartedAt: millisToTime(attempt_detail.StartedAt),
+			StoppedAt: millisToTime(attempt_detail.StoppedAt),
+			Reason:    attempt_detail.StatusReason,
 		}
+		if attempt_detail.Container != nil {
+			if attempt_detail.Container.Reason != nil && len(*attempt_detail.Container.Reason) > 0 {
+				attempt.Reason = attempt_detail.Container.Reason
+			}
+			attempt.ExitCode = attempt_detail.Container.ExitCode
+			attempt.TaskARN = attempt_detail.Container.TaskArn
+			attempt.ContainerInstanceARN = attempt_detail.Container.ContainerInstanceArn
+			attempt.LogStreamName = attempt_detail.Container.LogStreamName
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts
+}
 
-		var jobList *batch.ListJobsOutput
-		var err error
-
-		joblistspan := opentracing.StartSpan("listJobs", opentracing.ChildOf(topspan.Context()))
+// jobDependencies converts the jobs AWS Batch says a job depends on.
+func jobDependencies(dependencies []*batch.JobDependency) []jobs.JobDependency {
+	result := make([]jobs.JobDependency, 0, len(dependencies))
+	for _, dependency := range dependencies {
+		if dependency.JobId == nil {
+			continue
+		}
+		result = append(result, jobs.JobDependency{JobId: *dependency.JobId, Type: dependency.Type})
+	}
+	return result
+}
 
-		for {
-			jobList, err = awsclients.Batch.ListJobs(&list_jobs)
+// pybatchTimeout reads the timeout of a job from its environment; -1 if
+// there is none.
+func pybatchTimeout(environment []*batch.KeyValuePair) int {
+	for _, value := range environment {
+		if *value.Name == "PYBATCH_TIMEOUT" {
+			timeout, err := strconv.Atoi(*value.Value)
 			if err != nil {
-				joblistspan.Finish()
-				return nil, err
+				log.Warning("PYBATCH_TIMEOUT contains unparseable ", value.Value, " : ", err)
+				return -1
 			}
+			return timeout
+		}
+	}
+	return -1
+}
 
-			for _, job := range jobList.JobSummaryList {
-				job_results[*job.JobId] = job
+// nodeProperties converts the node properties of a multi-node parallel job.
+// It also returns the container properties of the main node since that is
+// what we show for the job as a whole.
+func nodeProperties(properties *batch.NodeProperties) (*jobs.NodeProperties, *batch.ContainerProperties) {
+	if properties == nil || properties.MainNode == nil || properties.NumNodes == nil {
+		return nil, nil
+	}
+	node_properties := &jobs.NodeProperties{
+		MainNode:   *properties.MainNode,
+		NumNodes:   *properties.NumNodes,
+		NodeRanges: make([]jobs.NodeRange, 0, len(properties.NodeRangeProperties)),
+	}
+	containers := make([]*batch.ContainerProperties, 0, len(properties.NodeRangeProperties))
+	for _, range_properties := range properties.NodeRangeProperties {
+		node_range := jobs.NodeRange{}
+		if range_properties.TargetNodes != nil {
+			node_range.TargetNodes = *range_properties.TargetNodes
+		}
+		if container := range_properties.Container; container != nil {
+			if container.Image != nil {
+				node_range.Image = *container.Image
+			}
+			if container.Vcpus != nil {
+				node_range.VCpus = *container.Vcpus
+			}
+			if container.Memory != nil {
+				node_range.Memory = *container.Memory
+			}
+			command_line_json, err := json.Marshal(container.Command)
+			if err == nil {
+				node_range.CommandLine = string(command_line_json)
 			}
+		}
+		node_properties.NodeRanges = append(node_properties.NodeRanges, node_range)
+		containers = append(containers, range_properties.Container)
+	}
 
-			if jobList.NextToken == nil {
-				break
+	var main_container *batch.ContainerProperties
+	if main_range := node_properties.NodeRangeFor(node_properties.MainNode); main_range != nil {
+		for i := range node_properties.NodeRanges {
+			if &node_properties.NodeRanges[i] == main_range {
+				main_container = containers[i]
 			}
+		}
+	}
+	return node_properties, main_container
+}
+
+// jobFromDescription converts what AWS Batch tells about a job.
+func jobFromDescription(desc *batch.JobDetail, queue string) (*jobs.Job, error) {
+	var err error
+	timeout := -1
+	if desc.Container != nil {
+		timeout = pybatchTimeout(desc.Container.Environment)
+	}
 
-			cp := string(*jobList.NextToken)
-			list_jobs.NextToken = &cp
+	var stopped_at *time.Time
+
+	if desc.StoppedAt != nil {
+		tmp := time.Unix(*desc.StoppedAt/1000, (*desc.StoppedAt%1000)*1000000).UTC()
+		stopped_at = &tmp
+	}
+
+	command_line_json := []byte{}
+	if desc.Container != nil {
+		command_line_json, err = json.Marshal(desc.Container.Command)
+		if err != nil {
+			log.Warning("Cannot marshal command line to JSON: ", err)
+			return nil, err
 		}
-		joblistspan.Finish()
+	}
 
-		describe_jobs := batch.DescribeJobsInput{}
-		doDescriptionSync := func() error {
-			job_descriptions, err := awsclients.Batch.DescribeJobs(&describe_jobs)
-			if err != nil {
-				return err
-			}
-			for _, desc := range job_descriptions.Jobs {
-				job_description_results[*desc.JobId] = desc
-			}
-			return nil
-		}
-
-		/* Also synchronize job descriptions, if we found any jobs. */
-		if len(jobList.JobSummaryList) > 0 {
-			describejobsspan := opentracing.StartSpan("describeJobs", opentracing.ChildOf(topspan.Context()))
-			for _, job := range jobList.JobSummaryList {
-				job_id_copy := string(*job.JobId)
-				describe_jobs.Jobs = append(describe_jobs.Jobs, &job_id_copy)
-				// Maximum number of jobs you can submit to AWS Batch description call is 100
-				if len(describe_jobs.Jobs) >= 100 {
-					err = doDescriptionSync()
-					if err != nil {
-						describejobsspan.Finish()
-						return nil, err
-					}
-					describe_jobs = batch.DescribeJobsInput{}
-				}
+	status_reason := ""
+	var exit_code *int64
+
+	if desc.StatusReason != nil {
+		status_reason = *desc.StatusReason
+	}
+
+	var run_started_time *time.Time
+	var log_stream_name *string
+	var task_arn *string
+
+	if len(desc.Attempts) > 0 {
+		last_attempt := desc.Attempts[len(desc.Attempts)-1]
+		if last_attempt.Container != nil &&
+			last_attempt.Container.Reason != nil &&
+			len(*last_attempt.Container.Reason) > 0 {
+			status_reason = *last_attempt.Container.Reason
+		}
+		if last_attempt.StartedAt != nil {
+			tt := time.Unix(*last_attempt.StartedAt/1000, (*last_attempt.StartedAt%1000)*1000000).UTC()
+			run_started_time = &tt
+		}
+		if last_attempt.Container != nil && last_attempt.Container.ExitCode != nil {
+			ec := *last_attempt.Container.ExitCode
+			exit_code = &ec
+		}
+		if last_attempt.Container != nil && last_attempt.Container.LogStreamName != nil {
+			var lsn = *last_attempt.Container.LogStreamName
+			log_stream_name = &lsn
+		}
+		if last_attempt.Container != nil && last_attempt.Container.TaskArn != nil {
+			task_arn_c := *last_attempt.Container.TaskArn
+			task_arn = &task_arn_c
+		}
+	}
+
+	if log_stream_name == nil && desc.Container != nil && desc.Container.LogStreamName != nil {
+		var lsn = *desc.Container.LogStreamName
+		log_stream_name = &lsn
+	}
+	if (task_arn == nil || *task_arn == "") && desc.Container != nil && desc.Container.TaskArn != nil {
+		task_arn_c := *desc.Container.TaskArn
+		task_arn = &task_arn_c
+	}
+	image := ""
+	vcpus := int64(0)
+	memory := int64(0)
+	if desc.Container != nil {
+		if desc.Container.Image != nil {
+			image = *desc.Container.Image
+		}
+		if desc.Container.Vcpus != nil {
+			vcpus = *desc.Container.Vcpus
+		}
+		if desc.Container.Memory != nil {
+			memory = *desc.Container.Memory
+		}
+	}
+
+	// Multi-node parallel jobs have no container of their own; each node
+	// range has one.
+	node_properties, main_container := nodeProperties(desc.NodeProperties)
+	if desc.Container == nil && main_container != nil {
+		timeout = pybatchTimeout(main_container.Environment)
+		command_line_json, err = json.Marshal(main_container.Command)
+		if err != nil {
+			log.Warning("Cannot marshal command line to JSON: ", err)
+			return nil, err
+		}
+		if main_container.Image != nil {
+			image = *main_container.Image
+		}
+		if main_container.Vcpus != nil {
+			vcpus = *main_container.Vcpus
+		}
+		if main_container.Memory != nil {
+			memory = *main_container.Memory
+		}
+	}
+
+	var array_properties *jobs.ArrayProperties
+	is_parent_array_job := desc.ArrayProperties != nil && desc.ArrayProperties.Size != nil
+	if is_parent_array_job {
+		array_properties = new(jobs.ArrayProperties)
+		array_properties.Size = *desc.ArrayProperties.Size
+		array_properties.StatusSummary.Starting = *desc.ArrayProperties.StatusSummary["STARTING"]
+		array_properties.StatusSummary.Failed = *desc.ArrayProperties.StatusSummary["FAILED"]
+		array_properties.StatusSummary.Running = *desc.ArrayProperties.StatusSummary["RUNNING"]
+		array_properties.StatusSummary.Succeeded = *desc.ArrayProperties.StatusSummary["SUCCEEDED"]
+		array_properties.StatusSummary.Runnable = *desc.ArrayProperties.StatusSummary["RUNNABLE"]
+		array_properties.StatusSummary.Submitted = *desc.ArrayProperties.StatusSummary["SUBMITTED"]
+		array_properties.StatusSummary.Pending = *desc.ArrayProperties.StatusSummary["PENDING"]
+	}
+
+	job := &jobs.Job{
+		Id:              *desc.JobId,
+		Name:            *desc.JobName,
+		Status:          *desc.Status,
+		Description:     *desc.JobDefinition,
+		LastUpdated:     time.Now().UTC(),
+		JobQueue:        queue,
+		Image:           image,
+		CreatedAt:       time.Unix(*desc.CreatedAt/1000, (*desc.CreatedAt%1000)*1000000).UTC(),
+		StoppedAt:       stopped_at,
+		VCpus:           vcpus,
+		Memory:          memory,
+		CommandLine:     string(command_line_json),
+		Timeout:         timeout,
+		StatusReason:    &status_reason,
+		RunStartTime:    run_started_time,
+		ExitCode:        exit_code,
+		LogStreamName:   log_stream_name,
+		TaskARN:         task_arn,
+		ArrayProperties: array_properties,
+		NodeProperties:  node_properties,
+		Attempts:        jobAttempts(*desc.JobId, desc.Attempts),
+		DependsOn:       jobDependencies(desc.DependsOn),
+	}
+	if desc.ArrayProperties != nil && desc.ArrayProperties.Index != nil {
+		if parent_job_id, index, ok := jobs.ParseArrayChildID(*desc.JobId); ok && index == *desc.ArrayProperties.Index {
+			job.ParentJobId = &parent_job_id
+			job.ArrayIndex = &index
+		}
+	}
+	if desc.NodeDetails != nil && desc.NodeDetails.NodeIndex != nil {
+		if parent_job_id, index, ok := jobs.ParseNodeJobID(*desc.JobId); ok && index == *desc.NodeDetails.NodeIndex {
+			job.ParentJobId = &parent_job_id
+			job.NodeIndex = &index
+			// Nodes repeat the node properties of their parent
+			job.NodeProperties = nil
+		}
+	}
+	return job, nil
+}
+
+// summaryChanged tells if a job listed by AWS Batch needs to be described,
+// given what is stored of it (nil if nothing).
+func summaryChanged(summary *batch.JobSummary, state *jobs.JobSyncState) bool {
+	if state == nil || summary.Status == nil || *summary.Status != state.Status {
+		return true
+	}
+	if state.Status == jobs.StatusSucceeded || state.Status == jobs.StatusFailed {
+		return false
+	}
+	// The listing does not tell how the children of array and multi-node
+	// parallel jobs are doing.
+	if summary.ArrayProperties != nil || summary.NodeProperties != nil {
+		return true
+	}
+	// The stored status reason can come from the container of the last
+	// attempt instead, so only compare when the listing has one.
+	return summary.StatusReason != nil && (state.StatusReason == nil || *summary.StatusReason != *state.StatusReason)
+}
+
+// describeCalls is the number of DescribeJobs calls it takes to describe
+// job_count jobs.
+func describeCalls(job_count int) int {
+	return (job_count + 99) / 100
+}
+
+// countJobSummary counts a job in the status it has in AWS Batch.
+func countJobSummary(summary *jobs.JobSummary, status *string) {
+	if status == nil {
+		return
+	}
+	switch *status {
+	case "SUBMITTED":
+		summary.Submitted++
+	case "PENDING":
+		summary.Pending++
+	case "RUNNABLE":
+		summary.Runnable++
+	case "STARTING":
+		summary.Starting++
+	case "RUNNING":
+		summary.Running++
+	}
+}
+
+// syncJobsStatus stores the jobs of one queue that are in the given status
+// and adds them to known_job_ids.
+func syncJobsStatus(ctx context.Context, storer jobs.Storer, queue string, status string, job_summary *jobs.JobSummary, stats *SyncStats, known_job_ids map[string]bool) error {
+	topspan, ctx := opentracing.StartSpanFromContext(ctx, "syncJobsStatus")
+	defer topspan.Finish()
+	topspan.SetTag("status", status)
+
+	/* We got to be careful to make sure we look up Job ID between job
+	* listings and their description. Since this is at minimum two calls
+	* to AWS Batch, the state of jobs might change between their
+	* invocations. Basically we can't be sure there are equal number of
+	* results in job_results and job_description_results */
+	job_results := make(map[string]*batch.JobSummary)
+	job_description_results := make(map[string]*batch.JobDetail)
+
+	list_jobs := batch.ListJobsInput{
+		JobQueue:  &queue,
+		JobStatus: &status,
+	}
+
+	var jobList *batch.ListJobsOutput
+	var err error
+
+	joblistspan := opentracing.StartSpan("listJobs", opentracing.ChildOf(topspan.Context()))
+
+	for {
+		err = callBatch(ctx, "ListJobs", func(opts ...request.Option) error {
+			jobList, err = awsclients.Batch.ListJobsWithContext(ctx, &list_jobs, opts...)
+			return err
+		})
+		if err != nil {
+			joblistspan.Finish()
+			return err
+		}
+
+		for _, job := range jobList.JobSummaryList {
+			job_results[*job.JobId] = job
+		}
+
+		if jobList.NextToken == nil {
+			break
+		}
+
+		cp := string(*jobList.NextToken)
+		list_jobs.NextToken = &cp
+	}
+	joblistspan.Finish()
+
+	/* In incremental mode, jobs whose listing matches what we have
+	* stored are not described again. They are still known. */
+	job_ids_to_describe := make([]string, 0, len(job_results))
+	if config.Conf.IncrementalSync && len(job_results) > 0 {
+		listed_job_ids := make([]string, 0, len(job_results))
+		for job_id := range job_results {
+			listed_job_ids = append(listed_job_ids, job_id)
+		}
+		states, err := storer.FindSyncStates(ctx, listed_job_ids)
+		if err != nil {
+			return err
+		}
+		for job_id, summary := range job_results {
+			if summaryChanged(summary, states[job_id]) {
+				job_ids_to_describe = append(job_ids_to_describe, job_id)
+				continue
 			}
-			if len(describe_jobs.Jobs) > 0 {
+			known_job_ids[job_id] = true
+			countJobSummary(job_summary, summary.Status)
+			stats.SkippedJobs++
+		}
+	} else {
+		for job_id := range job_results {
+			job_ids_to_describe = append(job_ids_to_describe, job_id)
+		}
+	}
+	stats.ListedJobs += len(job_results)
+	stats.DescribedJobs += len(job_ids_to_describe)
+
+	describe_jobs := batch.DescribeJobsInput{}
+	doDescriptionSync := func() error {
+		stats.DescribeCalls++
+		var job_descriptions *batch.DescribeJobsOutput
+		err := callBatch(ctx, "DescribeJobs", func(opts ...request.Option) error {
+			var err error
+			job_descriptions, err = awsclients.Batch.DescribeJobsWithContext(ctx, &describe_jobs, opts...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, desc := range job_descriptions.Jobs {
+			job_description_results[*desc.JobId] = desc
+		}
+		return nil
+	}
+
+	/* Also synchronize job descriptions, if we found any jobs. */
+	if len(job_ids_to_describe) > 0 {
+		describejobsspan := opentracing.StartSpan("describeJobs", opentracing.ChildOf(topspan.Context()))
+		for _, job_id := range job_ids_to_describe {
+			job_id_copy := job_id
+			describe_jobs.Jobs = append(describe_jobs.Jobs, &job_id_copy)
+			// Maximum number of jobs you can submit to AWS Batch description call is 100
+			if len(describe_jobs.Jobs) >= 100 {
 				err = doDescriptionSync()
 				if err != nil {
 					describejobsspan.Finish()
-					return nil, err
+					return err
 				}
+				describe_jobs = batch.DescribeJobsInput{}
 			}
-			describejobsspan.Finish()
-
-			log.Info("Fetched ", len(job_description_results), " job descriptions.")
-		}
-
-		jobs_to_insert := make([]*jobs.Job, 0)
-
-		for job_id, job := range job_results {
-			if desc, ok := job_description_results[job_id]; ok {
-
-				if desc.Status != nil {
-					if _, ok := job_summaries[queue]; ok {
-						switch *desc.Status {
-						case "SUBMITTED":
-							job_summaries[queue].Submitted++
-						case "PENDING":
-							job_summaries[queue].Pending++
-						case "RUNNABLE":
-							job_summaries[queue].Runnable++
-						case "STARTING":
-							job_summaries[queue].Starting++
-						case "RUNNING":
-							job_summaries[queue].Running++
-						}
-					}
-				}
+		}
+		if len(describe_jobs.Jobs) > 0 {
+			err = doDescriptionSync()
+			if err != nil {
+				describejobsspan.Finish()
+				return err
+			}
+		}
+		describejobsspan.Finish()
 
-				timeout := -1
-				if desc.Container != nil {
-					for _, value := range desc.Container.Environment {
-						if *value.Name == "PYBATCH_TIMEOUT" {
-							timeout, err = strconv.Atoi(*value.Value)
-							if err != nil {
-								timeout = -1
-								log.Warning("PYBATCH_TIMEOUT contains unparseable ", value.Value, " : ", err)
-							}
-							break
-						}
-					}
-				}
+		log.Info("Fetched ", len(job_description_results), " job descriptions of ", status, " jobs in ", queue, ".")
+	}
+	stats.SavedDescribeCalls += describeCalls(len(job_results)) - describeCalls(len(job_ids_to_describe))
 
-				var stopped_at *time.Time
+	jobs_to_insert := make([]*jobs.Job, 0)
 
-				if desc.StoppedAt != nil {
-					tmp := time.Unix(*desc.StoppedAt/1000, (*desc.StoppedAt%1000)*1000000).UTC()
-					stopped_at = &tmp
-				}
+	for _, job_id := range job_ids_to_describe {
+		if desc, ok := job_description_results[job_id]; ok {
+			countJobSummary(job_summary, desc.Status)
 
-				command_line_json := []byte{}
-				if desc.Container != nil {
-					command_line_json, err = json.Marshal(desc.Container.Command)
-					if err != nil {
-						log.Warning("Cannot marshal command line to JSON: ", err)
-						continue
-					}
-				}
+			known_job_ids[job_id] = true
+			job, err := jobFromDescription(desc, queue)
+			if err != nil {
+				continue
+			}
+			jobs_to_insert = append(jobs_to_insert, job)
+		}
+	}
 
-				status_reason := ""
-				var exit_code *int64
+	err = storer.Store(ctx, jobs_to_insert, jobs.StatusChangeFromSync)
+	if err != nil {
+		return err
+	}
 
-				if desc.StatusReason != nil {
-					status_reason = *desc.StatusReason
-				}
+	err = syncJobDefinitions(ctx, storer, jobs_to_insert)
+	if err != nil {
+		log.Warning("Cannot synchronize job definitions: ", err)
+	}
 
-				var run_started_time *time.Time
-				var log_stream_name *string
-				var task_arn *string
-
-				if len(desc.Attempts) > 0 {
-					last_attempt := desc.Attempts[len(desc.Attempts)-1]
-					if last_attempt.Container != nil &&
-						last_attempt.Container.Reason != nil &&
-						len(*last_attempt.Container.Reason) > 0 {
-						status_reason = *last_attempt.Container.Reason
-					}
-					if last_attempt.StartedAt != nil {
-						tt := time.Unix(*last_attempt.StartedAt/1000, (*last_attempt.StartedAt%1000)*1000000).UTC()
-						run_started_time = &tt
-					}
-					if last_attempt.Container != nil && last_attempt.Container.ExitCode != nil {
-						ec := *last_attempt.Container.ExitCode
-						exit_code = &ec
-					}
-					if last_attempt.Container != nil && last_attempt.Container.LogStreamName != nil {
-						var lsn = *last_attempt.Container.LogStreamName
-						log_stream_name = &lsn
-					}
-					if last_attempt.Container != nil && last_attempt.Container.TaskArn != nil {
-						task_arn_c := *last_attempt.Container.TaskArn
-						task_arn = &task_arn_c
-					}
-				}
+	for _, job := range jobs_to_insert {
+		if job.ArrayProperties != nil {
+			err = syncArrayJobChildren(ctx, storer, job, known_job_ids)
+			if err != nil {
+				log.Warning("Cannot synchronize children of array job ", job.Id, ": ", err)
+			}
+		}
+		if job.NodeProperties != nil {
+			err = syncMultiNodeJobNodes(ctx, storer, job, known_job_ids)
+			if err != nil {
+				log.Warning("Cannot synchronize nodes of multi-node parallel job ", job.Id, ": ", err)
+			}
+		}
+	}
 
-				if log_stream_name == nil && desc.Container != nil && desc.Container.LogStreamName != nil {
-					var lsn = *desc.Container.LogStreamName
-					log_stream_name = &lsn
-				}
-				if (task_arn == nil || *task_arn == "") && desc.Container != nil && desc.Container.TaskArn != nil {
-					task_arn_c := *desc.Container.TaskArn
-					task_arn = &task_arn_c
-				}
-				known_job_ids[job_id] = true
-
-				image := ""
-				vcpus := int64(0)
-				memory := int64(0)
-				if desc.Container != nil {
-					if desc.Container.Image != nil {
-						image = *desc.Container.Image
-					}
-					if desc.Container.Vcpus != nil {
-						vcpus = *desc.Container.Vcpus
-					}
-					if desc.Container.Memory != nil {
-						memory = *desc.Container.Memory
-					}
-				}
+	return nil
+}
 
-				var array_properties *jobs.ArrayProperties
-				is_parent_array_job := desc.ArrayProperties != nil && desc.ArrayProperties.Size != nil
-				if is_parent_array_job {
-					array_properties = new(jobs.ArrayProperties)
-					array_properties.Size = *desc.ArrayProperties.Size
-					array_properties.StatusSummary.Starting = *desc.ArrayProperties.StatusSummary["STARTING"]
-					array_properties.StatusSummary.Failed = *desc.ArrayProperties.StatusSummary["FAILED"]
-					array_properties.StatusSummary.Running = *desc.ArrayProperties.StatusSummary["RUNNING"]
-					array_properties.StatusSummary.Succeeded = *desc.ArrayProperties.StatusSummary["SUCCEEDED"]
-					array_properties.StatusSummary.Runnable = *desc.ArrayProperties.StatusSummary["RUNNABLE"]
-					array_properties.StatusSummary.Submitted = *desc.ArrayProperties.StatusSummary["SUBMITTED"]
-					array_properties.StatusSummary.Pending = *desc.ArrayProperties.StatusSummary["PENDING"]
-				}
+// queueSyncResult is what synchronizing one job queue found.
+type queueSyncResult struct {
+	queue         string
+	known_job_ids map[string]bool
+	summary       *jobs.JobSummary
+	stats         SyncStats
+	err           error
+}
+
+// syncQueue synchronizes the jobs of one queue in every status. It stops at
+// the first error; what was stored before it stays stored.
+func syncQueue(ctx context.Context, storer jobs.Storer, queue string) *queueSyncResult {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "syncQueue")
+	defer span.Finish()
+	span.SetTag("queue", queue)
+
+	result := &queueSyncResult{
+		queue:         queue,
+		known_job_ids: make(map[string]bool),
+		summary:       &jobs.JobSummary{JobQueue: queue},
+	}
+	for _, status := range jobs.StatusList {
+		result.err = syncJobsStatus(ctx, storer, queue, status, result.summary, &result.stats, result.known_job_ids)
+		if result.err != nil {
+			span.SetTag("error", result.err)
+			return result
+		}
+	}
+	return result
+}
+
+// arrayJobState is what the synchronizer last saw of an array job.
+type arrayJobState struct {
+	statusSummary jobs.StatusSummary
+	// children maps the job ID of each child to its status
+	children map[string]string
+}
+
+// arrayJobStates lets the synchronizer skip array jobs whose status summary
+// has not changed since their children were last listed. Array jobs can have
+// up to 10,000 children so listing and describing all of them on every sync
+// is not an option.
+var arrayJobStates = make(map[string]*arrayJobState)
+
+// childJobStatesLock guards arrayJobStates and multiNodeJobStates, which the
+// synchronizer workers share. A state itself is only touched by the worker
+// synchronizing the queue of its job.
+var childJobStatesLock sync.Mutex
+
+// syncArrayJobChildren stores the children of an array job. Only children
+// whose status changed since the last time are described and stored.
+func syncArrayJobChildren(ctx context.Context, storer jobs.Storer, parent *jobs.Job, known_job_ids map[string]bool) error {
+	childJobStatesLock.Lock()
+	state, ok := arrayJobStates[parent.Id]
+	if !ok {
+		state = &arrayJobState{children: make(map[string]string)}
+		arrayJobStates[parent.Id] = state
+	}
+	childJobStatesLock.Unlock()
+	for child_id := range state.children {
+		known_job_ids[child_id] = true
+	}
+	if ok && state.statusSummary == parent.ArrayProperties.StatusSummary {
+		return nil
+	}
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "syncArrayJobChildren")
+	defer span.Finish()
+
+	listed_children, err := listChildJobs(ctx, batch.ListJobsInput{ArrayJobId: &parent.Id})
+	if err != nil {
+		return err
+	}
+	for child_id := range listed_children {
+		known_job_ids[child_id] = true
+	}
+	err = storeChangedChildJobs(ctx, storer, parent.JobQueue, listed_children, state.children)
+	if err != nil {
+		return err
+	}
+
+	state.statusSummary = parent.ArrayProperties.StatusSummary
+	log.Info("Synchronized ", len(listed_children), " children of array job ", parent.Id)
+	return nil
+}
+
+// multiNodeJobState is what the synchronizer last saw of a multi-node
+// parallel job.
+type multiNodeJobState struct {
+	status string
+	// nodes maps the job ID of each node to its status
+	nodes map[string]string
+}
+
+// multiNodeJobStates lets the synchronizer skip finished multi-node parallel
+// jobs whose nodes have already been synchronized.
+var multiNodeJobStates = make(map[string]*multiNodeJobState)
+
+// syncMultiNodeJobNodes stores the nodes of a multi-node parallel job. Each
+// node is a job of its own with its own container and logs.
+func syncMultiNodeJobNodes(ctx context.Context, storer jobs.Storer, parent *jobs.Job, known_job_ids map[string]bool) error {
+	childJobStatesLock.Lock()
+	state, ok := multiNodeJobStates[parent.Id]
+	if !ok {
+		state = &multiNodeJobState{nodes: make(map[string]string)}
+		multiNodeJobStates[parent.Id] = state
+	}
+	childJobStatesLock.Unlock()
+	for node_id := range state.nodes {
+		known_job_ids[node_id] = true
+	}
+	is_finished := parent.Status == jobs.StatusSucceeded || parent.Status == jobs.StatusFailed
+	if ok && is_finished && state.status == parent.Status {
+		return nil
+	}
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "syncMultiNodeJobNodes")
+	defer span.Finish()
+
+	listed_nodes, err := listChildJobs(ctx, batch.ListJobsInput{MultiNodeJobId: &parent.Id})
+	if err != nil {
+		return err
+	}
+	for node_id := range listed_nodes {
+		known_job_ids[node_id] = true
+	}
+	err = storeChangedChildJobs(ctx, storer, parent.JobQueue, listed_nodes, state.nodes)
+	if err != nil {
+		return err
+	}
+
+	state.status = parent.Status
+	return nil
+}
 
-				jobs_to_insert = append(jobs_to_insert, &jobs.Job{
-					Id:              *job.JobId,
-					Name:            *job.JobName,
-					Status:          *desc.Status,
-					Description:     *desc.JobDefinition,
-					LastUpdated:     time.Now().UTC(),
-					JobQueue:        queue,
-					Image:           image,
-					CreatedAt:       time.Unix(*desc.CreatedAt/1000, (*desc.CreatedAt%1000)*1000000).UTC(),
-					StoppedAt:       stopped_at,
-					VCpus:           vcpus,
-					Memory:          memory,
-					CommandLine:     string(command_line_json),
-					Timeout:         timeout,
-					StatusReason:    &status_reason,
-					RunStartTime:    run_started_time,
-					ExitCode:        exit_code,
-					LogStreamName:   log_stream_name,
-					TaskARN:         task_arn,
-					ArrayProperties: array_properties,
-				})
+// forgetChildJobStates drops the states of jobs that are no longer listed.
+func forgetChildJobStates(known_job_ids map[string]bool) {
+	childJobStatesLock.Lock()
+	defer childJobStatesLock.Unlock()
+	for parent_job_id := range arrayJobStates {
+		if !known_job_ids[parent_job_id] {
+			delete(arrayJobStates, parent_job_id)
+		}
+	}
+	for parent_job_id := range multiNodeJobStates {
+		if !known_job_ids[parent_job_id] {
+			delete(multiNodeJobStates, parent_job_id)
+		}
+	}
+}
+
+// listChildJobs lists the children or nodes of a job in every status and
+// returns their statuses keyed by job ID.
+func listChildJobs(ctx context.Context, list_jobs batch.ListJobsInput) (map[string]string, error) {
+	listed_jobs := make(map[string]string)
+	// Without a status, ListJobs only returns RUNNING jobs.
+	for _, status := range jobs.StatusList {
+		status := status
+		list_jobs.JobStatus = &status
+		list_jobs.NextToken = nil
+		for {
+			var job_list *batch.ListJobsOutput
+			err := callBatch(ctx, "ListJobs", func(opts ...request.Option) error {
+				var err error
+				job_list, err = awsclients.Batch.ListJobsWithContext(ctx, &list_jobs, opts...)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, job := range job_list.JobSummaryList {
+				listed_jobs[*job.JobId] = *job.Status
+			}
+			if job_list.NextToken == nil {
+				break
 			}
+			list_jobs.NextToken = job_list.NextToken
 		}
+	}
+	return listed_jobs, nil
+}
+
+// storeChangedChildJobs describes and stores the listed jobs whose status is
+// not the one in known_statuses, and then updates known_statuses.
+func storeChangedChildJobs(ctx context.Context, storer jobs.Storer, queue string, listed_jobs map[string]string, known_statuses map[string]string) error {
+	changed_job_ids := make([]*string, 0)
+	for job_id, status := range listed_jobs {
+		if known_statuses[job_id] != status {
+			job_id := job_id
+			changed_job_ids = append(changed_job_ids, &job_id)
+		}
+	}
 
-		err = storer.Store(jobs_to_insert)
+	// Maximum number of jobs you can submit to AWS Batch description call is 100
+	for len(changed_job_ids) > 0 {
+		batch_size := len(changed_job_ids)
+		if batch_size > 100 {
+			batch_size = 100
+		}
+		describe_jobs := batch.DescribeJobsInput{Jobs: changed_job_ids[:batch_size]}
+		var job_descriptions *batch.DescribeJobsOutput
+		err := callBatch(ctx, "DescribeJobs", func(opts ...request.Option) error {
+			var err error
+			job_descriptions, err = awsclients.Batch.DescribeJobsWithContext(ctx, &describe_jobs, opts...)
+			return err
+		})
 		if err != nil {
-			return nil, err
+			return err
+		}
+		changed_job_ids = changed_job_ids[batch_size:]
+
+		jobs_to_insert := make([]*jobs.Job, 0, len(job_descriptions.Jobs))
+		for _, desc := range job_descriptions.Jobs {
+			job, err := jobFromDescription(desc, queue)
+			if err != nil {
+				continue
+			}
+			jobs_to_insert = append(jobs_to_insert, job)
+		}
+		err = storer.Store(ctx, jobs_to_insert, jobs.StatusChangeFromSync)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs_to_insert {
+			known_statuses[job.Id] = job.Status
 		}
 	}
+	return nil
+}
+
+// SyncStats counts what a synchronization round did with the jobs it listed.
+type SyncStats struct {
+	ListedJobs    int `json:"listed_jobs"`
+	DescribedJobs int `json:"described_jobs"`
+	// SkippedJobs were not described since the listing matched the store
+	SkippedJobs   int `json:"skipped_jobs"`
+	DescribeCalls int `json:"describe_calls"`
+	// SavedDescribeCalls is how many fewer DescribeJobs calls the round
+	// made than it would have without incremental_sync
+	SavedDescribeCalls int `json:"saved_describe_calls"`
+	// FailedQueues could not be synchronized in the round
+	FailedQueues int `json:"failed_queues"`
+}
 
-	return known_job_ids, nil
+func (stats *SyncStats) add(other SyncStats) {
+	stats.ListedJobs += other.ListedJobs
+	stats.DescribedJobs += other.DescribedJobs
+	stats.SkippedJobs += other.SkippedJobs
+	stats.DescribeCalls += other.DescribeCalls
+	stats.SavedDescribeCalls += other.SavedDescribeCalls
 }
 
-func syncJobs(storer jobs.Storer, queues []string) (map[string]bool, error) {
-	syncjobsspan := opentracing.StartSpan("syncJobs")
+var lastSyncStatsLock sync.Mutex
+var lastSyncStats SyncStats
+
+// LastSyncStats returns the stats of the last finished synchronization round.
+func LastSyncStats() SyncStats {
+	lastSyncStatsLock.Lock()
+	defer lastSyncStatsLock.Unlock()
+	return lastSyncStats
+}
+
+// jobQueuesInMetric are the job queues that have series in metrics.Jobs. Only
+// the synchronizer loop touches it.
+var jobQueuesInMetric = make(map[string]bool)
+
+// updateJobsMetric sets the job counts of the given queues. If complete, the
+// series of the other queues are deleted afterwards. The series are never
+// reset, so a scrape does not see the counts of a queue missing.
+func updateJobsMetric(job_summaries []jobs.JobSummary, complete bool) {
+	listed_queues := make(map[string]bool)
+	for _, summary := range job_summaries {
+		metrics.Jobs.WithLabelValues(summary.JobQueue, "SUBMITTED").Set(float64(summary.Submitted))
+		metrics.Jobs.WithLabelValues(summary.JobQueue, "PENDING").Set(float64(summary.Pending))
+		metrics.Jobs.WithLabelValues(summary.JobQueue, "RUNNABLE").Set(float64(summary.Runnable))
+		metrics.Jobs.WithLabelValues(summary.JobQueue, "STARTING").Set(float64(summary.Starting))
+		metrics.Jobs.WithLabelValues(summary.JobQueue, "RUNNING").Set(float64(summary.Running))
+		listed_queues[summary.JobQueue] = true
+		jobQueuesInMetric[summary.JobQueue] = true
+	}
+	if !complete {
+		return
+	}
+	for queue := range jobQueuesInMetric {
+		if !listed_queues[queue] {
+			metrics.Jobs.DeletePartialMatch(prometheus.Labels{"job_queue": queue})
+			delete(jobQueuesInMetric, queue)
+		}
+	}
+}
+
+// syncJobs synchronizes the given queues, sync_concurrency of them at a time.
+// A queue that fails does not stop the others; it is returned in
+// failed_queues and the jobs it knows about are missing from known_job_ids.
+func syncJobs(ctx context.Context, storer jobs.Storer, queues []string) (known_job_ids map[string]bool, failed_queues []string, err error) {
+	syncjobsspan, ctx := opentracing.StartSpanFromContext(ctx, "syncJobs")
 	defer syncjobsspan.Finish()
 
-	job_summaries := make(map[string]*jobs.JobSummary)
+	work := make(chan string)
+	results := make(chan *queueSyncResult, len(queues))
+	var workers sync.WaitGroup
+	for i := 0; i < config.Conf.SyncConcurrency && i < len(queues); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for queue := range work {
+				results <- syncQueue(ctx, storer, queue)
+			}
+		}()
+	}
 	for _, queue := range queues {
-		job_summaries[queue] = &jobs.JobSummary{JobQueue: queue}
+		work <- queue
 	}
+	close(work)
+	workers.Wait()
+	close(results)
 
-	known_job_ids := make(map[string]bool)
-	for _, status := range jobs.StatusList {
-		log.Info("Synchronizing jobs with status ", status, "...")
-		known_job_ids_status, err := syncJobsStatus(storer, status, queues, job_summaries, syncjobsspan)
-		if err != nil {
-			return nil, err
-		}
-
-		for key, value := range known_job_ids_status {
+	stats := SyncStats{}
+	known_job_ids = make(map[string]bool)
+	job_summaries := make([]jobs.JobSummary, 0, len(queues))
+	for result := range results {
+		stats.add(result.stats)
+		for key, value := range result.known_job_ids {
 			known_job_ids[key] = value
 		}
+		if result.err != nil {
+			log.Error("Cannot synchronize job queue ", result.queue, ": ", result.err)
+			metrics.SyncQueueErrors.WithLabelValues(result.queue).Inc()
+			failed_queues = append(failed_queues, result.queue)
+			continue
+		}
+		job_summaries = append(job_summaries, *result.summary)
 	}
+	sort.Strings(failed_queues)
+	stats.FailedQueues = len(failed_queues)
+
+	// The children of array and multi-node parallel jobs in a failed queue
+	// are not known, so their states are kept until a complete round.
+	// Likewise, the job counts of a failed queue are left as they were.
+	if len(failed_queues) == 0 {
+		forgetChildJobStates(known_job_ids)
+	}
+	updateJobsMetric(job_summaries, len(failed_queues) == 0)
+
+	syncjobsspan.SetTag("listed_jobs", stats.ListedJobs)
+	syncjobsspan.SetTag("described_jobs", stats.DescribedJobs)
+	syncjobsspan.SetTag("skipped_jobs", stats.SkippedJobs)
+	syncjobsspan.SetTag("describe_calls", stats.DescribeCalls)
+	syncjobsspan.SetTag("saved_describe_calls", stats.SavedDescribeCalls)
+	syncjobsspan.SetTag("failed_queues", stats.FailedQueues)
+	log.Info("Listed ", stats.ListedJobs, " jobs, described ", stats.DescribedJobs, " in ", stats.DescribeCalls, " DescribeJobs calls, skipped ", stats.SkippedJobs, " and saved ", stats.SavedDescribeCalls, " calls.")
+	lastSyncStatsLock.Lock()
+	lastSyncStats = stats
+	lastSyncStatsLock.Unlock()
 
 	log.Info("Logging changes in number of jobs...\n")
 	for _, summary := range job_summaries {
-		summary_lst := []jobs.JobSummary{*summary}
-		err := storer.UpdateJobSummaryLog(summary_lst)
+		summary_lst := []jobs.JobSummary{summary}
+		err := storer.UpdateJobSummaryLog(ctx, summary_lst)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	return known_job_ids, nil
+	return known_job_ids, failed_queues, nil
 }
 
-func RunPeriodicScaler(fs jobs.FinderStorer) {
-	go func() {
-		for {
-			queues, err := fs.ListForcedScalingJobQueues()
-			if err != nil {
-				log.Warning("Cannot run scaler because I can't list job queues: ", err)
-				continue
-			}
+// waitForLeadership tells if this process should run a round of a periodic
+// loop. Only the leader talks to AWS Batch; followers sleep for period, or
+// until the loops are stopped, and check again.
+func waitForLeadership(leadership jobs.LeaderElection, period int64) bool {
+	if leadership.IsLeader() {
+		return true
+	}
+	sleep(time.Second * time.Duration(period))
+	return false
+}
 
-			log.Info("Logging ECS cluster statuses.")
-			err = jobs.MonitorECSClusters(fs, queues)
-			if err != nil {
-				log.Error("Cannot monitor ECS clusters: ", err)
-			} else {
-				log.Info("Logging ECS cluster statuses complete.")
-			}
+// Names of the supervised loops, as shown by the health endpoint.
+const (
+	synchronizerLoop     = "synchronizer"
+	scalerLoop           = "scaler"
+	partitionCreatorLoop = "partition_creator"
+	cleanerLoop          = "cleaner"
+)
+
+func RunPeriodicScaler(fs jobs.FinderStorer, leadership jobs.LeaderElection) {
+	supervise(scalerLoop, config.Conf.ScalePeriod, leadership, func(ctx context.Context) error {
+		queues, err := fs.ListForcedScalingJobQueues(ctx)
+		if err != nil {
+			log.Warning("Cannot run scaler because I can't list job queues: ", err)
+			return err
+		}
 
-			log.Info("Starting scaling with AWS Batch.")
-			jobs.ScaleComputeEnvironments(fs, queues)
-			log.Info("Scaling round complete.")
+		// The steps are independent, so a failing one does not stop
+		// the others; the round fails with the first error.
+		var round_err error
 
-			log.Info("Logging compute environment changes.")
-			jobs.MonitorComputeEnvironments(fs, queues)
-			log.Info("Logging compute environments round complete.")
+		log.Info("Logging ECS cluster statuses.")
+		err = jobs.MonitorECSClusters(ctx, fs, queues)
+		if err != nil {
+			log.Error("Cannot monitor ECS clusters: ", err)
+			round_err = err
+		} else {
+			log.Info("Logging ECS cluster statuses complete.")
+		}
 
-			err = jobs.KillTimedOutJobs(fs)
-			if err != nil {
-				log.Error("Cannot kill timed out jobs: ", err)
+		log.Info("Starting scaling with AWS Batch.")
+		jobs.ScaleComputeEnvironments(ctx, fs, queues)
+		log.Info("Scaling round complete.")
+
+		log.Info("Logging compute environment changes.")
+		jobs.MonitorComputeEnvironments(ctx, fs, queues)
+		log.Info("Logging compute environments round complete.")
+
+		err = jobs.KillTimedOutJobs(ctx, fs)
+		if err != nil {
+			log.Error("Cannot kill timed out jobs: ", err)
+			if round_err == nil {
+				round_err = err
 			}
-			time.Sleep(time.Second * time.Duration(config.Conf.ScalePeriod))
 		}
-	}()
+		return round_err
+	})
 }
 
-func RunPeriodicSynchronizer(fs jobs.FinderStorer, killer jobs.Killer) {
+func RunPeriodicSynchronizer(fs jobs.FinderStorer, killer jobs.Killer, leadership jobs.LeaderElection) {
 	/* This function runs RunSynchronizer every sync_period seconds. */
-	go func() {
-		for {
-			if config.Conf.KillStuckJobs {
-				killer := func() {
-					killerspan := opentracing.StartSpan("killStuckJobs")
-					defer killerspan.Finish()
-
-					log.Info("Checking and killing stuck STARTING jobs.")
-					instance_ids, err := fs.GetStartingStateStuckEC2Instances()
-					if err != nil {
-						log.Error("Cannot get stuck starting jobs: ", err)
-					}
-					err = killer.KillInstances(instance_ids)
-					if err != nil {
-						log.Error("Cannot kill stuck starting jobs: ", err)
-					}
-					log.Info("Checked and killed stuck STARTING jobs.")
-				}
-				killer()
-			}
+	supervise(synchronizerLoop, config.Conf.SyncPeriod, leadership, func(ctx context.Context) error {
+		if config.Conf.KillStuckJobs {
+			killer := func() {
+				killerspan, ctx := opentracing.StartSpanFromContext(ctx, "killStuckJobs")
+				defer killerspan.Finish()
 
-			queues, err := fs.ListActiveJobQueues()
-			if err != nil {
-				log.Warning("Cannot run synchronizer because I can't list job queues: ", err)
-				continue
-			}
-			log.Info("Starting synchronization with AWS Batch.")
-			err = RunSynchronizer(fs, queues)
-			if err != nil {
-				log.Error("Synchronization failed: ", err)
+				log.Info("Checking and killing stuck STARTING jobs.")
+				instance_ids, err := fs.GetStartingStateStuckEC2Instances(ctx)
+				if err != nil {
+					log.Error("Cannot get stuck starting jobs: ", err)
+				}
+				err = killer.KillInstances(ctx, instance_ids)
+				if err != nil {
+					log.Error("Cannot kill stuck starting jobs: ", err)
+				}
+				log.Info("Checked and killed stuck STARTING jobs.")
 			}
-			log.Info("Synchronized with AWS Batch.")
+			killer()
+		}
 
-			time.Sleep(time.Second * time.Duration(config.Conf.SyncPeriod))
+		queues, err := fs.ListActiveJobQueues(ctx)
+		if err != nil {
+			log.Warning("Cannot run synchronizer because I can't list job queues: ", err)
+			return err
 		}
-	}()
+		log.Info("Starting synchronization with AWS Batch.")
+		err = RunSynchronizer(ctx, fs, queues)
+		if err != nil {
+			log.Error("Synchronization failed: ", err)
+			return err
+		}
+		log.Info("Synchronized with AWS Batch.")
+		return nil
+	})
 }
 
-// RunSynchronizer runs a round of synchronization with AWS batch APIs
-// Note: Does AWS have api throttling?
-func RunSynchronizer(fs jobs.FinderStorer, queues []string) error {
+// RunSynchronizer runs a round of synchronization with AWS batch APIs. Jobs
+// are only marked GONE when every queue was synchronized; otherwise the jobs
+// of the failed queues would look gone.
+func RunSynchronizer(ctx context.Context, fs jobs.FinderStorer, queues []string) error {
 	// Synchronize jobs
-	known_job_ids, err := syncJobs(fs, queues)
+	known_job_ids, failed_queues, err := syncJobs(ctx, fs, queues)
 	if err != nil {
 		return err
 	}
-	err = fs.StaleOldJobs(known_job_ids)
+	if len(failed_queues) > 0 {
+		return fmt.Errorf("cannot synchronize job queues %s; not marking missing jobs GONE", strings.Join(failed_queues, ", "))
+	}
+	err = fs.StaleOldJobs(ctx, known_job_ids)
 	if err != nil {
 		return err
 	}
@@ -383,18 +985,65 @@ func RunSynchronizer(fs jobs.FinderStorer, queues []string) error {
 	return nil
 }
 
-func RunPeriodicCleaner(cleaner jobs.Cleaner) {
-	go func() {
-		for {
-			err := cleaner.CleanOldJobs()
-			if err != nil {
-				log.Error("Cannot clean old jobs: ", err)
-			}
-			err = cleaner.CleanOldInstanceEventLogs()
+// retentionPolicy turns the [retention] configuration section into a
+// jobs.RetentionPolicy.
+func retentionPolicy() *jobs.RetentionPolicy {
+	retention := config.Conf.Retention
+	var archiver jobs.Archiver
+	if retention.Archive != "" {
+		archiver = jobs.NewArchiver(retention.Archive)
+	}
+	return &jobs.RetentionPolicy{
+		JobDays:                        retention.Days,
+		JobQueueDays:                   retention.JobQueues,
+		InstanceEventLogDays:           retention.InstanceEventLogDays,
+		JobSummaryEventLogDays:         retention.JobSummaryEventLogDays,
+		ComputeEnvironmentEventLogDays: retention.ComputeEnvironmentEventLogDays,
+		InstanceDays:                   retention.InstancesDays,
+		RestoredJobDays:                retention.RestoredDays,
+		BatchSize:                      retention.BatchSize,
+		Archiver:                       archiver,
+	}
+}
+
+// partitionCreationPeriod is the number of seconds between checks that the
+// partitions of the coming months exist.
+const partitionCreationPeriod = 3600
+
+// RunPeriodicPartitionCreator makes sure partitions exist for the coming
+// months. It runs whether or not the cleaner is enabled, as rows that have no
+// partition of their own end up in the default partition, which is slower to
+// clean.
+func RunPeriodicPartitionCreator(cleaner jobs.Cleaner, leadership jobs.LeaderElection) {
+	supervise(partitionCreatorLoop, partitionCreationPeriod, leadership, func(ctx context.Context) error {
+		err := cleaner.CreatePartitions(ctx)
+		if err != nil {
+			log.Error("Cannot create partitions: ", err)
+		}
+		return err
+	})
+}
+
+func RunPeriodicCleaner(cleaner jobs.Cleaner, leadership jobs.LeaderElection) {
+	policy := retentionPolicy()
+	supervise(cleanerLoop, config.Conf.CleanPeriod, leadership, func(ctx context.Context) error {
+		// Every kind of data is cleaned even if another one fails; the
+		// round fails with the first error.
+		var round_err error
+		clean := func(what string, clean func(ctx context.Context, policy *jobs.RetentionPolicy) error) {
+			err := clean(ctx, policy)
 			if err != nil {
-				log.Error("Cannot clean old instance event logs: ", err)
+				log.Error("Cannot clean old ", what, ": ", err)
+				if round_err == nil {
+					round_err = err
+				}
 			}
-			time.Sleep(time.Second * time.Duration(config.Conf.CleanPeriod))
 		}
-	}()
+		clean("jobs", cleaner.CleanOldJobs)
+		clean("instance event logs", cleaner.CleanOldInstanceEventLogs)
+		clean("job summary event logs", cleaner.CleanOldJobSummaryEventLogs)
+		clean("compute environment event logs", cleaner.CleanOldComputeEnvironmentEventLogs)
+		clean("instances", cleaner.CleanOldInstances)
+		return round_err
+	})
 }
@@ -0,0 +1,329 @@
+package syncer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/batchiepatchie/awsclients"
+	"github.com/AdRoll/batchiepatchie/config"
+	"github.com/AdRoll/batchiepatchie/jobs"
+	"github.com/AdRoll/batchiepatchie/metrics"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/batch/batchiface"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeBatch is an AWS Batch that knows a fixed set of jobs. The synchronizer
+// workers call it in parallel.
+type fakeBatch struct {
+	batchiface.BatchAPI
+
+	lock sync.Mutex
+	// jobs are keyed by job queue
+	jobs map[string][]*batch.JobDetail
+	// failing queues fail every ListJobs call
+	failing       map[string]bool
+	describeCalls int
+}
+
+func newFakeBatch() *fakeBatch {
+	return &fakeBatch{
+		jobs:    make(map[string][]*batch.JobDetail),
+		failing: make(map[string]bool),
+	}
+}
+
+func (fake *fakeBatch) addJob(queue string, id string, status string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.jobs[queue] = append(fake.jobs[queue], &batch.JobDetail{
+		JobId:         aws.String(id),
+		JobName:       aws.String("job-" + id),
+		JobQueue:      aws.String(queue),
+		Status:        aws.String(status),
+		JobDefinition: aws.String("arn:aws:batch:us-west-2:123456789012:job-definition/test:1"),
+		CreatedAt:     aws.Int64(time.Now().UnixNano() / int64(time.Millisecond)),
+		Container: &batch.ContainerDetail{
+			Image:   aws.String("repo/image:latest"),
+			Vcpus:   aws.Int64(1),
+			Memory:  aws.Int64(1024),
+			Command: []*string{aws.String("true")},
+		},
+	})
+}
+
+func (fake *fakeBatch) ListJobsWithContext(ctx aws.Context, input *batch.ListJobsInput, opts ...request.Option) (*batch.ListJobsOutput, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	output := &batch.ListJobsOutput{}
+	if input.JobQueue == nil {
+		return output, nil
+	}
+	if fake.failing[*input.JobQueue] {
+		return nil, awserr.New("ServerException", "queue "+*input.JobQueue+" is broken", nil)
+	}
+	for _, job := range fake.jobs[*input.JobQueue] {
+		if *job.Status == *input.JobStatus {
+			output.JobSummaryList = append(output.JobSummaryList, &batch.JobSummary{
+				JobId:   job.JobId,
+				JobName: job.JobName,
+				Status:  job.Status,
+			})
+		}
+	}
+	return output, nil
+}
+
+func (fake *fakeBatch) DescribeJobsWithContext(ctx aws.Context, input *batch.DescribeJobsInput, opts ...request.Option) (*batch.DescribeJobsOutput, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.describeCalls++
+	output := &batch.DescribeJobsOutput{}
+	for _, job_id := range input.Jobs {
+		for _, queue_jobs := range fake.jobs {
+			for _, job := range queue_jobs {
+				if *job.JobId == *job_id {
+					output.Jobs = append(output.Jobs, job)
+				}
+			}
+		}
+	}
+	return output, nil
+}
+
+func (fake *fakeBatch) DescribeJobDefinitionsWithContext(ctx aws.Context, input *batch.DescribeJobDefinitionsInput, opts ...request.Option) (*batch.DescribeJobDefinitionsOutput, error) {
+	return &batch.DescribeJobDefinitionsOutput{}, nil
+}
+
+// useFakeBatch points the synchronizer at fake until the test ends.
+func useFakeBatch(t *testing.T, fake *fakeBatch, incremental_sync bool) {
+	old_batch := awsclients.Batch
+	old_conf := config.Conf
+	awsclients.Batch = fake
+	config.Conf.SyncConcurrency = 2
+	config.Conf.IncrementalSync = incremental_sync
+	// The call limiter is made on first use and shared by every test.
+	config.Conf.BatchCallsPerSecond = 1000
+	t.Cleanup(func() {
+		awsclients.Batch = old_batch
+		config.Conf = old_conf
+	})
+}
+
+func newStoredJob(queue string, id string, status string) *jobs.Job {
+	now := time.Now()
+	reason := ""
+	return &jobs.Job{
+		Id:           id,
+		Name:         "job-" + id,
+		Status:       status,
+		Description:  "arn:aws:batch:us-west-2:123456789012:job-definition/test:1",
+		LastUpdated:  now,
+		JobQueue:     queue,
+		Image:        "repo/image:latest",
+		CreatedAt:    now,
+		Timeout:      -1,
+		CommandLine:  "[]",
+		StatusReason: &reason,
+	}
+}
+
+func TestSummaryChanged(t *testing.T) {
+	reason := "Essential container in task exited"
+	other_reason := "Host EC2 instance terminated"
+
+	for _, test := range []struct {
+		name     string
+		summary  *batch.JobSummary
+		state    *jobs.JobSyncState
+		expected bool
+	}{
+		{"new job", &batch.JobSummary{Status: aws.String(jobs.StatusRunning)}, nil, true},
+		{"no status", &batch.JobSummary{}, &jobs.JobSyncState{Status: jobs.StatusRunning}, true},
+		{"status change", &batch.JobSummary{Status: aws.String(jobs.StatusRunning)}, &jobs.JobSyncState{Status: jobs.StatusRunnable}, true},
+		{"to terminal", &batch.JobSummary{Status: aws.String(jobs.StatusFailed)}, &jobs.JobSyncState{Status: jobs.StatusRunning}, true},
+		{"succeeded stored as succeeded", &batch.JobSummary{Status: aws.String(jobs.StatusSucceeded)}, &jobs.JobSyncState{Status: jobs.StatusSucceeded}, false},
+		{"failed stored as failed", &batch.JobSummary{Status: aws.String(jobs.StatusFailed), StatusReason: &other_reason}, &jobs.JobSyncState{Status: jobs.StatusFailed, StatusReason: &reason}, false},
+		{"array parent", &batch.JobSummary{Status: aws.String(jobs.StatusRunning), ArrayProperties: &batch.ArrayPropertiesSummary{Size: aws.Int64(10)}}, &jobs.JobSyncState{Status: jobs.StatusRunning}, true},
+		{"finished array parent", &batch.JobSummary{Status: aws.String(jobs.StatusSucceeded), ArrayProperties: &batch.ArrayPropertiesSummary{Size: aws.Int64(10)}}, &jobs.JobSyncState{Status: jobs.StatusSucceeded}, false},
+		{"multi-node parallel parent", &batch.JobSummary{Status: aws.String(jobs.StatusRunning), NodeProperties: &batch.NodePropertiesSummary{NumNodes: aws.Int64(2)}}, &jobs.JobSyncState{Status: jobs.StatusRunning}, true},
+		{"unchanged", &batch.JobSummary{Status: aws.String(jobs.StatusRunning), StatusReason: &reason}, &jobs.JobSyncState{Status: jobs.StatusRunning, StatusReason: &reason}, false},
+		{"reason change", &batch.JobSummary{Status: aws.String(jobs.StatusRunning), StatusReason: &other_reason}, &jobs.JobSyncState{Status: jobs.StatusRunning, StatusReason: &reason}, true},
+		{"new reason", &batch.JobSummary{Status: aws.String(jobs.StatusRunning), StatusReason: &reason}, &jobs.JobSyncState{Status: jobs.StatusRunning}, true},
+		{"listing without reason", &batch.JobSummary{Status: aws.String(jobs.StatusRunning)}, &jobs.JobSyncState{Status: jobs.StatusRunning, StatusReason: &reason}, false},
+	} {
+		if changed := summaryChanged(test.summary, test.state); changed != test.expected {
+			t.Errorf("%s: expected summaryChanged to be %v, got %v", test.name, test.expected, changed)
+		}
+	}
+}
+
+func TestIncrementalSyncStats(t *testing.T) {
+	fake := newFakeBatch()
+	useFakeBatch(t, fake, true)
+	store := jobs.NewMemoryStore()
+	ctx := context.Background()
+
+	err := store.Store(ctx, []*jobs.Job{
+		newStoredJob("queue", "done", jobs.StatusSucceeded),
+		newStoredJob("queue", "running", jobs.StatusRunning),
+		newStoredJob("queue", "started", jobs.StatusRunnable),
+	}, jobs.StatusChangeFromSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.addJob("queue", "done", jobs.StatusSucceeded)
+	fake.addJob("queue", "running", jobs.StatusRunning)
+	fake.addJob("queue", "started", jobs.StatusRunning)
+	fake.addJob("queue", "new", jobs.StatusRunning)
+
+	known_job_ids, failed_queues, err := syncJobs(ctx, store, []string{"queue"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed_queues) != 0 {
+		t.Fatalf("Expected no failed queues, got %v", failed_queues)
+	}
+	for _, job_id := range []string{"done", "running", "started", "new"} {
+		if !known_job_ids[job_id] {
+			t.Errorf("Expected job %s to be known", job_id)
+		}
+	}
+
+	// The SUCCEEDED listing is skipped entirely, which saves its
+	// DescribeJobs call. Two of the three RUNNING jobs still take one call.
+	stats := LastSyncStats()
+	expected := SyncStats{ListedJobs: 4, DescribedJobs: 2, SkippedJobs: 2, DescribeCalls: 1, SavedDescribeCalls: 1}
+	if stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+	if fake.describeCalls != stats.DescribeCalls {
+		t.Errorf("Expected %d DescribeJobs calls, got %d", stats.DescribeCalls, fake.describeCalls)
+	}
+
+	for job_id, status := range map[string]string{"started": jobs.StatusRunning, "new": jobs.StatusRunning} {
+		job, err := store.FindOne(ctx, job_id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != status {
+			t.Errorf("Expected job %s to be stored as %s, got %s", job_id, status, job.Status)
+		}
+	}
+}
+
+func TestFullSyncDescribesEveryJob(t *testing.T) {
+	fake := newFakeBatch()
+	useFakeBatch(t, fake, false)
+	store := jobs.NewMemoryStore()
+	ctx := context.Background()
+
+	err := store.Store(ctx, []*jobs.Job{newStoredJob("queue", "done", jobs.StatusSucceeded)}, jobs.StatusChangeFromSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.addJob("queue", "done", jobs.StatusSucceeded)
+	fake.addJob("queue", "new", jobs.StatusRunning)
+
+	_, _, err = syncJobs(ctx, store, []string{"queue"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := LastSyncStats()
+	expected := SyncStats{ListedJobs: 2, DescribedJobs: 2, DescribeCalls: 2}
+	if stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestUpdateJobsMetric(t *testing.T) {
+	updateJobsMetric([]jobs.JobSummary{{JobQueue: "a", Running: 2}, {JobQueue: "b", Pending: 1}}, true)
+	if count := testutil.CollectAndCount(metrics.Jobs); count != 10 {
+		t.Errorf("Expected 10 series, got %d", count)
+	}
+
+	// Without queue b, its counts are kept unless the round is complete.
+	updateJobsMetric([]jobs.JobSummary{{JobQueue: "a", Running: 3}}, false)
+	if value := testutil.ToFloat64(metrics.Jobs.WithLabelValues("b", "PENDING")); value != 1 {
+		t.Errorf("Expected the counts of queue b to be kept, got %v pending jobs", value)
+	}
+	updateJobsMetric([]jobs.JobSummary{{JobQueue: "a", Running: 3}}, true)
+	if count := testutil.CollectAndCount(metrics.Jobs); count != 5 {
+		t.Errorf("Expected 5 series, got %d", count)
+	}
+	if value := testutil.ToFloat64(metrics.Jobs.WithLabelValues("a", "RUNNING")); value != 3 {
+		t.Errorf("Expected 3 running jobs in queue a, got %v", value)
+	}
+
+	updateJobsMetric(nil, true)
+	if count := testutil.CollectAndCount(metrics.Jobs); count != 0 {
+		t.Errorf("Expected no series, got %d", count)
+	}
+}
+
+func TestRunSynchronizerIsolatesFailedQueues(t *testing.T) {
+	fake := newFakeBatch()
+	useFakeBatch(t, fake, false)
+	store := jobs.NewMemoryStore()
+	ctx := context.Background()
+
+	// A job that AWS Batch forgot about a while ago. It is only marked GONE
+	// once every queue has been synchronized.
+	forgotten := newStoredJob("b", "forgotten", jobs.StatusRunning)
+	forgotten.LastUpdated = time.Now().Add(-time.Hour)
+	err := store.Store(ctx, []*jobs.Job{forgotten}, jobs.StatusChangeFromSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.addJob("a", "a-1", jobs.StatusRunning)
+	fake.addJob("b", "b-1", jobs.StatusRunnable)
+	fake.addJob("c", "c-1", jobs.StatusSucceeded)
+	fake.addJob("c", "c-2", jobs.StatusFailed)
+	fake.failing["b"] = true
+
+	err = RunSynchronizer(ctx, store, []string{"a", "b", "c"})
+	if err == nil {
+		t.Fatal("Expected an error when queue b fails")
+	}
+	for _, job_id := range []string{"a-1", "c-1", "c-2"} {
+		if _, err := store.FindOne(ctx, job_id); err != nil {
+			t.Errorf("Expected job %s to be stored although queue b failed: %v", job_id, err)
+		}
+	}
+	if _, err := store.FindOne(ctx, "b-1"); err == nil {
+		t.Errorf("Expected job b-1 of the failed queue not to be stored")
+	}
+	job, err := store.FindOne(ctx, "forgotten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != jobs.StatusRunning {
+		t.Errorf("Expected no job to be marked GONE after a failed queue, got %s", job.Status)
+	}
+	if stats := LastSyncStats(); stats.FailedQueues != 1 {
+		t.Errorf("Expected 1 failed queue, got %d", stats.FailedQueues)
+	}
+
+	fake.lock.Lock()
+	fake.failing["b"] = false
+	fake.lock.Unlock()
+	err = RunSynchronizer(ctx, store, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = store.FindOne(ctx, "forgotten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != jobs.StatusGone {
+		t.Errorf("Expected the forgotten job to be marked GONE after a complete round, got %s", job.Status)
+	}
+	if _, err := store.FindOne(ctx, "b-1"); err != nil {
+		t.Errorf("Expected job b-1 to be stored: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/batchiepatchie/awsclients"
+	"github.com/AdRoll/batchiepatchie/jobs"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// syncedJobDefinitions has the ARN of every job definition revision we have
+// stored. Revisions do not change once registered so each of them is only
+// described once.
+var syncedJobDefinitions = make(map[string]bool)
+
+// syncedJobDefinitionsLock guards syncedJobDefinitions, which the
+// synchronizer workers share.
+var syncedJobDefinitionsLock sync.Mutex
+
+// jobDefinitionFromDescription converts what AWS Batch tells about a job
+// definition revision.
+func jobDefinitionFromDescription(desc *batch.JobDefinition) *jobs.JobDefinition {
+	job_definition := &jobs.JobDefinition{
+		ARN:         aws.StringValue(desc.JobDefinitionArn),
+		Name:        aws.StringValue(desc.JobDefinitionName),
+		Revision:    aws.Int64Value(desc.Revision),
+		Type:        aws.StringValue(desc.Type),
+		Status:      aws.StringValue(desc.Status),
+		CommandLine: "[]",
+		Environment: make(map[string]string),
+		Parameters:  aws.StringValueMap(desc.Parameters),
+		SyncedAt:    time.Now().UTC(),
+	}
+
+	// Multi-node parallel job definitions have a container per node range;
+	// we keep the one of the main node.
+	container := desc.ContainerProperties
+	if container == nil {
+		_, container = nodeProperties(desc.NodeProperties)
+	}
+	if container != nil {
+		job_definition.Image = aws.StringValue(container.Image)
+		job_definition.VCpus = aws.Int64Value(container.Vcpus)
+		job_definition.Memory = aws.Int64Value(container.Memory)
+		command_line_json, err := json.Marshal(container.Command)
+		if err == nil {
+			job_definition.CommandLine = string(command_line_json)
+		}
+		for _, value := range container.Environment {
+			job_definition.Environment[aws.StringValue(value.Name)] = aws.StringValue(value.Value)
+		}
+	}
+
+	if desc.Timeout != nil && desc.Timeout.AttemptDurationSeconds != nil {
+		timeout := *desc.Timeout.AttemptDurationSeconds
+		job_definition.Timeout = &timeout
+	}
+
+	if desc.RetryStrategy != nil {
+		job_definition.RetryStrategy = &jobs.RetryStrategy{
+			Attempts: aws.Int64Value(desc.RetryStrategy.Attempts),
+		}
+		for _, evaluate_on_exit := range desc.RetryStrategy.EvaluateOnExit {
+			job_definition.RetryStrategy.EvaluateOnExit = append(job_definition.RetryStrategy.EvaluateOnExit, jobs.EvaluateOnExit{
+				Action:         aws.StringValue(evaluate_on_exit.Action),
+				OnExitCode:     aws.StringValue(evaluate_on_exit.OnExitCode),
+				OnReason:       aws.StringValue(evaluate_on_exit.OnReason),
+				OnStatusReason: aws.StringValue(evaluate_on_exit.OnStatusReason),
+			})
+		}
+	}
+	return job_definition
+}
+
+// syncJobDefinitions stores the job definition revisions of the given jobs
+// that we have not stored yet.
+func syncJobDefinitions(ctx context.Context, storer jobs.Storer, jobs_to_sync []*jobs.Job) error {
+	arns := make([]*string, 0)
+	seen := make(map[string]bool)
+	syncedJobDefinitionsLock.Lock()
+	for _, job := range jobs_to_sync {
+		if syncedJobDefinitions[job.Description] || seen[job.Description] {
+			continue
+		}
+		if _, _, ok := jobs.ParseJobDefinitionARN(job.Description); !ok {
+			continue
+		}
+		seen[job.Description] = true
+		arn := job.Description
+		arns = append(arns, &arn)
+	}
+	syncedJobDefinitionsLock.Unlock()
+	if len(arns) == 0 {
+		return nil
+	}
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "syncJobDefinitions")
+	defer span.Finish()
+
+	// Maximum number of job definitions you can submit to AWS Batch description call is 100
+	for len(arns) > 0 {
+		batch_size := len(arns)
+		if batch_size > 100 {
+			batch_size = 100
+		}
+		describe_job_definitions := batch.DescribeJobDefinitionsInput{JobDefinitions: arns[:batch_size]}
+		arns = arns[batch_size:]
+
+		job_definitions := make([]*jobs.JobDefinition, 0)
+		for {
+			var output *batch.DescribeJobDefinitionsOutput
+			err := callBatch(ctx, "DescribeJobDefinitions", func(opts ...request.Option) error {
+				var err error
+				output, err = awsclients.Batch.DescribeJobDefinitionsWithContext(ctx, &describe_job_definitions, opts...)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			for _, desc := range output.JobDefinitions {
+				job_definitions = append(job_definitions, jobDefinitionFromDescription(desc))
+			}
+			if output.NextToken == nil {
+				break
+			}
+			describe_job_definitions.NextToken = output.NextToken
+		}
+
+		err := storer.StoreJobDefinitions(ctx, job_definitions)
+		if err != nil {
+			return err
+		}
+		syncedJobDefinitionsLock.Lock()
+		for _, job_definition := range job_definitions {
+			syncedJobDefinitions[job_definition.ARN] = true
+		}
+		syncedJobDefinitionsLock.Unlock()
+		log.Info("Synchronized ", len(job_definitions), " job definitions.")
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/batchiepatchie/jobs"
+	"github.com/AdRoll/batchiepatchie/metrics"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	log "github.com/sirupsen/logrus"
+)
+
+// loopMaxBackoff caps how long a failing loop waits before its next round,
+// unless its period is longer.
+const loopMaxBackoff = 10 * time.Minute
+
+// LoopStatus is what the supervisor knows of one background loop.
+type LoopStatus struct {
+	Name string `json:"name"`
+	// Standby is true when this process is not the leader, so the loop
+	// does not run rounds
+	Standby bool `json:"standby"`
+	// ActiveSince is when the loop started running rounds, that is, when
+	// this process last became the leader
+	ActiveSince         *time.Time `json:"active_since"`
+	Running             bool       `json:"running"`
+	LastStarted         *time.Time `json:"last_started"`
+	LastSuccess         *time.Time `json:"last_success"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at"`
+	LastDuration        float64    `json:"last_duration_seconds"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+var loopStatusesLock sync.Mutex
+var loopStatuses = make(map[string]*LoopStatus)
+
+// loopsStopping is cancelled by StopLoops: loops finish the round they are
+// in, if any, and do not start another. loopsAborting is cancelled when
+// WaitForLoops runs out of time and is the context of every round.
+var loopsStopping, stopLoops = context.WithCancel(context.Background())
+var loopsAborting, abortLoops = context.WithCancel(context.Background())
+
+// loopsRunning counts the loops that have not stopped yet.
+var loopsRunning sync.WaitGroup
+
+// StopLoops tells every background loop to stop after its current round.
+func StopLoops() {
+	stopLoops()
+}
+
+// abortGracePeriod is how long WaitForLoops waits for cancelled rounds to
+// return.
+const abortGracePeriod = 5 * time.Second
+
+// WaitForLoops waits until every background loop has stopped. If ctx ends
+// first, the rounds still running are cancelled and ctx.Err() is returned
+// once they have returned, or after abortGracePeriod at most. Rounds should
+// not be using the store when the caller closes it.
+func WaitForLoops(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		loopsRunning.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		log.Warning("Background loops did not stop in time, cancelling their rounds.")
+		abortLoops()
+	}
+	timer := time.NewTimer(abortGracePeriod)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		log.Warning("Cancelled background rounds did not return in ", abortGracePeriod, ".")
+	}
+	return ctx.Err()
+}
+
+// sleep waits for duration, or until the loops are told to stop. Returns
+// false if they were.
+func sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-loopsStopping.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// LoopStatuses returns the status of every supervised loop, sorted by name.
+func LoopStatuses() []LoopStatus {
+	loopStatusesLock.Lock()
+	defer loopStatusesLock.Unlock()
+	statuses := make([]LoopStatus, 0, len(loopStatuses))
+	for _, status := range loopStatuses {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// updateLoopStatus changes the status of a loop under the lock.
+func updateLoopStatus(name string, update func(status *LoopStatus)) {
+	loopStatusesLock.Lock()
+	defer loopStatusesLock.Unlock()
+	status, ok := loopStatuses[name]
+	if !ok {
+		status = &LoopStatus{Name: name}
+		loopStatuses[name] = status
+	}
+	update(status)
+}
+
+// SyncStaleness tells how long the synchronizer has gone without a
+// successful round. It is zero when the synchronizer is on standby.
+func SyncStaleness(now time.Time) time.Duration {
+	loopStatusesLock.Lock()
+	defer loopStatusesLock.Unlock()
+	status, ok := loopStatuses[synchronizerLoop]
+	if !ok || status.Standby || status.ActiveSince == nil {
+		return 0
+	}
+	since := *status.ActiveSince
+	if status.LastSuccess != nil && status.LastSuccess.After(since) {
+		since = *status.LastSuccess
+	}
+	return now.Sub(since)
+}
+
+// loopBackoff is how long a loop waits after failing failures rounds in a
+// row: its period after the first failure and twice as long after every
+// further one.
+func loopBackoff(period time.Duration, failures int) time.Duration {
+	max_backoff := loopMaxBackoff
+	if period > max_backoff {
+		max_backoff = period
+	}
+	backoff := period
+	for i := 1; i < failures && backoff < max_backoff; i++ {
+		backoff *= 2
+	}
+	if backoff > max_backoff {
+		backoff = max_backoff
+	}
+	return backoff
+}
+
+// runRound runs one round of a loop and turns a panic into an error, so that
+// one bad round does not take the whole process down. Every round is a trace
+// of its own.
+func runRound(name string, round func(ctx context.Context) error) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(loopsAborting, "Loop."+name)
+	defer func() {
+		if err != nil {
+			ext.Error.Set(span, true)
+			span.LogKV("error", err.Error())
+		}
+		span.Finish()
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("Loop ", name, " panicked: ", r, "\n", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return round(ctx)
+}
+
+// supervise runs round every period seconds while this process is the
+// leader, until StopLoops. It records how every round went and backs off when
+// rounds fail.
+func supervise(name string, period int64, leadership jobs.LeaderElection, round func(ctx context.Context) error) {
+	updateLoopStatus(name, func(status *LoopStatus) {
+		status.Standby = true
+	})
+	loopsRunning.Add(1)
+	go func() {
+		defer loopsRunning.Done()
+		for loopsStopping.Err() == nil {
+			if !waitForLeadership(leadership, period) {
+				updateLoopStatus(name, func(status *LoopStatus) {
+					status.Standby = true
+					status.ActiveSince = nil
+				})
+				continue
+			}
+
+			started := time.Now().UTC()
+			updateLoopStatus(name, func(status *LoopStatus) {
+				if status.Standby {
+					status.Standby = false
+					status.ActiveSince = &started
+				}
+				status.Running = true
+				status.LastStarted = &started
+			})
+
+			err := runRound(name, round)
+
+			finished := time.Now().UTC()
+			metrics.LoopDuration.WithLabelValues(name).Observe(finished.Sub(started).Seconds())
+			if err != nil {
+				metrics.LoopErrors.WithLabelValues(name).Inc()
+			}
+			failures := 0
+			updateLoopStatus(name, func(status *LoopStatus) {
+				status.Running = false
+				status.LastDuration = finished.Sub(started).Seconds()
+				if err != nil {
+					status.LastError = err.Error()
+					status.LastErrorAt = &finished
+					status.ConsecutiveFailures++
+				} else {
+					status.LastSuccess = &finished
+					status.ConsecutiveFailures = 0
+				}
+				failures = status.ConsecutiveFailures
+			})
+
+			delay := time.Second * time.Duration(period)
+			if err != nil {
+				delay = loopBackoff(delay, failures)
+				log.Error("Loop ", name, " failed ", failures, " times in a row, next round in ", delay, ": ", err)
+			}
+			sleep(delay)
+		}
+		log.Info("Loop ", name, " stopped.")
+	}()
+}
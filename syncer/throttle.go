@@ -0,0 +1,84 @@
+package syncer
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/batchiepatchie/config"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// throttleBaseDelay and throttleMaxDelay bound the backoff after AWS
+	// Batch throttles a call.
+	throttleBaseDelay = 200 * time.Millisecond
+	throttleMaxDelay  = 10 * time.Second
+	// throttleMaxRetries is how many times a throttled call is retried
+	// before its queue gives up for the round.
+	throttleMaxRetries = 8
+)
+
+var batchLimiterOnce sync.Once
+var batchLimiter *rate.Limiter
+
+// batchCallLimiter is shared by every synchronizer worker so that together
+// they stay within batch_calls_per_second.
+func batchCallLimiter() *rate.Limiter {
+	batchLimiterOnce.Do(func() {
+		burst := int(config.Conf.BatchCallsPerSecond)
+		if burst < 1 {
+			burst = 1
+		}
+		batchLimiter = rate.NewLimiter(rate.Limit(config.Conf.BatchCallsPerSecond), burst)
+	})
+	return batchLimiter
+}
+
+// throttleDelay is the backoff before retry number attempt (starting at 0).
+// It uses full jitter so that workers throttled at the same time do not all
+// retry at the same time.
+func throttleDelay(attempt int) time.Duration {
+	ceiling := throttleBaseDelay << uint(attempt)
+	if ceiling > throttleMaxDelay || ceiling <= 0 {
+		ceiling = throttleMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
+
+// noSDKRetries turns off the retries of the AWS SDK for one request, so
+// that callBatch makes every retry itself.
+func noSDKRetries(r *request.Request) {
+	r.Retryer = client.DefaultRetryer{NumMaxRetries: 0}
+}
+
+// callBatch makes one AWS Batch call within the call budget. Throttled calls
+// are retried with backoff; any other error is returned as is. call must pass
+// opts to the AWS SDK; otherwise the SDK would retry on its own, outside of
+// the call budget and without jitter.
+func callBatch(ctx context.Context, operation string, call func(opts ...request.Option) error) error {
+	limiter := batchCallLimiter()
+	for attempt := 0; ; attempt++ {
+		err := limiter.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		err = call(noSDKRetries)
+		if err == nil || !request.IsErrorThrottle(err) || attempt >= throttleMaxRetries {
+			return err
+		}
+		delay := throttleDelay(attempt)
+		log.Warning("AWS Batch throttled ", operation, ", retrying in ", delay, ": ", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
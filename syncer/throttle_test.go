@@ -0,0 +1,74 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/batchiepatchie/config"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestCallBatchRetriesThrottledCalls(t *testing.T) {
+	old_conf := config.Conf
+	defer func() { config.Conf = old_conf }()
+	// The call limiter is made on first use and shared by every test.
+	config.Conf.BatchCallsPerSecond = 1000
+
+	calls := 0
+	err := callBatch(context.Background(), "ListJobs", func(opts ...request.Option) error {
+		calls++
+		r := &request.Request{}
+		r.ApplyOptions(opts...)
+		if r.Retryer == nil || r.MaxRetries() != 0 {
+			t.Errorf("Expected callBatch to turn off the retries of the AWS SDK")
+		}
+		if calls < 3 {
+			return awserr.New("TooManyRequestsException", "Too Many Requests", nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls)
+	}
+
+	calls = 0
+	failure := errors.New("access denied")
+	err = callBatch(context.Background(), "ListJobs", func(opts ...request.Option) error {
+		calls++
+		return failure
+	})
+	if err != failure || calls != 1 {
+		t.Errorf("Expected one call that fails with %v, got %d calls and %v", failure, calls, err)
+	}
+}
+
+func TestThrottleDelay(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		ceiling := throttleMaxDelay
+		if attempt < 6 {
+			ceiling = throttleBaseDelay << uint(attempt)
+		}
+		for i := 0; i < 100; i++ {
+			delay := throttleDelay(attempt)
+			if delay <= 0 || delay > ceiling {
+				t.Fatalf("Expected the delay of attempt %d to be in (0, %v], got %v", attempt, ceiling, delay)
+			}
+		}
+	}
+
+	// With full jitter, delays of the same attempt are spread out rather
+	// than all being the ceiling.
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		distinct[throttleDelay(3)] = true
+	}
+	if len(distinct) < 50 {
+		t.Errorf("Expected jittered delays, got only %d distinct delays out of 100", len(distinct))
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Package tracing records the opentracing spans of Batchiepatchie with the
+OpenTelemetry SDK, through the OpenTelemetry bridge for opentracing. Spans are
+exported with OTLP, or written to standard output for local development.
+Incoming trace context is read from the W3C traceparent header so that traces
+continue across services.
+*/
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+// serviceName is the service.name of the spans, unless OTEL_SERVICE_NAME
+// says otherwise.
+const serviceName = "batchiepatchie"
+
+// NewExporter makes the span exporter of the given tracer, "otlp" or
+// "stdout". The OTLP exporter sends spans over HTTP and is configured with the
+// standard OTEL_EXPORTER_OTLP_* environment variables. The stdout exporter
+// writes every span to out as a line of JSON.
+func NewExporter(ctx context.Context, tracer string, out io.Writer) (sdktrace.SpanExporter, error) {
+	switch tracer {
+	case "otlp":
+		return otlptracehttp.New(ctx)
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(out))
+	}
+	return nil, fmt.Errorf("no OpenTelemetry exporter for tracer %q", tracer)
+}
+
+// NewTracer makes an opentracing tracer whose spans are exported by exporter
+// and registers it with OpenTelemetry as well. shutdown exports the spans
+// that are still buffered and stops exporter.
+func NewTracer(ctx context.Context, exporter sdktrace.SpanExporter) (tracer opentracing.Tracer, shutdown func(context.Context) error, err error) {
+	// Detectors that come later win, so OTEL_SERVICE_NAME and
+	// OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceNameKey.String(serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		log.Warning("Cannot detect OpenTelemetry resource: ", err)
+		return nil, nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	bridge, wrapper := otbridge.NewTracerPair(provider.Tracer("github.com/AdRoll/batchiepatchie"))
+	bridge.SetTextMapPropagator(propagation.TraceContext{})
+	bridge.SetWarningHandler(func(msg string) {
+		log.Warning("OpenTelemetry bridge: ", msg)
+	})
+	otel.SetTracerProvider(wrapper)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return bridge, provider.Shutdown, nil
+}
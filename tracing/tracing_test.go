@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// keptSpans is an in-memory exporter whose spans are still there after
+// shutdown.
+type keptSpans struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keptSpans) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func TestTracerContinuesIncomingTrace(t *testing.T) {
+	exporter := keptSpans{tracetest.NewInMemoryExporter()}
+	tracer, shutdown, err := NewTracer(context.Background(), exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := http.Header{}
+	headers.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	incoming, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(headers))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := tracer.StartSpan("HTTP GET /api/v1/jobs", opentracing.ChildOf(incoming))
+	child := tracer.StartSpan("PG.Find", opentracing.ChildOf(root.Context()))
+	child.SetTag("rows", 3)
+	child.Finish()
+	root.Finish()
+
+	outgoing := http.Header{}
+	if err := tracer.Inject(root.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(outgoing)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	child_span, root_span := spans[0], spans[1]
+	if root_span.Name != "HTTP GET /api/v1/jobs" || child_span.Name != "PG.Find" {
+		t.Errorf("Unexpected span names: %s, %s", root_span.Name, child_span.Name)
+	}
+	if root_span.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || child_span.SpanContext.TraceID() != root_span.SpanContext.TraceID() {
+		t.Errorf("Spans are not in the incoming trace: %s, %s", root_span.SpanContext.TraceID(), child_span.SpanContext.TraceID())
+	}
+	if root_span.Parent.SpanID().String() != "00f067aa0ba902b7" || child_span.Parent.SpanID() != root_span.SpanContext.SpanID() {
+		t.Errorf("Unexpected parents: %s, %s", root_span.Parent.SpanID(), child_span.Parent.SpanID())
+	}
+	expected_traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + root_span.SpanContext.SpanID().String() + "-01"
+	if outgoing.Get("traceparent") != expected_traceparent {
+		t.Errorf("Expected traceparent %s, got %s", expected_traceparent, outgoing.Get("traceparent"))
+	}
+	service_name, _ := root_span.Resource.Set().Value("service.name")
+	if service_name.AsString() != "batchiepatchie" {
+		t.Errorf("Unexpected service name %q", service_name.AsString())
+	}
+}
+
+func TestTracerRejectsBadTraceparent(t *testing.T) {
+	tracer, shutdown, err := NewTracer(context.Background(), tracetest.NewInMemoryExporter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	for _, value := range []string{"", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-xyz-00f067aa0ba902b7-01"} {
+		headers := http.Header{}
+		if value != "" {
+			headers.Set("traceparent", value)
+		}
+		if _, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(headers)); err == nil {
+			t.Errorf("Extracted a span context from %q", value)
+		}
+	}
+}